@@ -1,5 +1,7 @@
 package config
 
+import "time"
+
 //Properties Configuration properties based on env variables.
 type Properties struct {
 	Port				string `env:"MY_APP_PORT" env-default:"8080"`
@@ -9,5 +11,53 @@ type Properties struct {
 	DBName				string `env:"DB_NAME" env-default:"tronics"`
 	ProductCollection	string `env:"PRODUCTS_COL_NAME" env-default:"products"`
 	UsersCollection		string `env:"USER_COL_NAME" env-default:"users"`
+	InventoryCollection	string `env:"INVENTORY_COL_NAME" env-default:"inventory"`
+	StockAdjCollection	string `env:"STOCK_ADJ_COL_NAME" env-default:"stock_adjustments"`
+	ReservationTTL		time.Duration `env:"RESERVATION_TTL" env-default:"15m"`
+	ReservationSweep	time.Duration `env:"RESERVATION_SWEEP_INTERVAL" env-default:"1m"`
+	RatesCollection		string `env:"RATES_COL_NAME" env-default:"exchange_rates"`
+	ExchangeRatesFile	string `env:"EXCHANGE_RATES_FILE"`
+	PromotionsCollection	string `env:"PROMOTIONS_COL_NAME" env-default:"promotions"`
+	CategoriesCollection	string `env:"CATEGORIES_COL_NAME" env-default:"categories"`
+	RevisionsCollection	string `env:"REVISIONS_COL_NAME" env-default:"revisions"`
+	VendorsCollection	string `env:"VENDORS_COL_NAME" env-default:"vendors"`
+	PriceHistoryCollection	string `env:"PRICE_HISTORY_COL_NAME" env-default:"price_history"`
+	ReviewsCollection	string `env:"REVIEWS_COL_NAME" env-default:"reviews"`
+	CartsCollection		string `env:"CARTS_COL_NAME" env-default:"carts"`
+	GuestCartTTL		time.Duration `env:"GUEST_CART_TTL" env-default:"720h"`
+	CartCurrency		string `env:"CART_CURRENCY" env-default:"USD"`
+	OrdersCollection	string `env:"ORDERS_COL_NAME" env-default:"orders"`
+	PaymentProvider		string `env:"PAYMENT_PROVIDER" env-default:"fake"`
+	PendingOrderTTL		time.Duration `env:"PENDING_ORDER_TTL" env-default:"30m"`
+	PendingOrderSweep	time.Duration `env:"PENDING_ORDER_SWEEP_INTERVAL" env-default:"1m"`
+	WishlistsCollection	string `env:"WISHLISTS_COL_NAME" env-default:"wishlists"`
+	AlertsCollection	string `env:"ALERTS_COL_NAME" env-default:"alerts"`
+	Notifier			string `env:"NOTIFIER" env-default:"log"`
+	NotificationsFile	string `env:"NOTIFICATIONS_FILE" env-default:"./data/notifications.log"`
+	WebhooksCollection	string `env:"WEBHOOKS_COL_NAME" env-default:"webhooks"`
+	DeliveriesCollection	string `env:"WEBHOOK_DELIVERIES_COL_NAME" env-default:"webhook_deliveries"`
+	WebhookMaxAttempts	int `env:"WEBHOOK_MAX_ATTEMPTS" env-default:"8"`
+	WebhookBackoff		time.Duration `env:"WEBHOOK_BACKOFF" env-default:"30s"`
+	WebhookTimeout		time.Duration `env:"WEBHOOK_TIMEOUT" env-default:"10s"`
+	WebhookInterval		time.Duration `env:"WEBHOOK_INTERVAL" env-default:"5s"`
+	Locales				[]string `env:"LOCALES" env-default:"en-US,en-IN,hi-IN"`
+	DefaultLocale		string `env:"DEFAULT_LOCALE" env-default:"en"`
+	SchedulerInterval	time.Duration `env:"SCHEDULER_INTERVAL" env-default:"1m"`
+	BlobStore			string `env:"BLOB_STORE" env-default:"local"`
+	BlobDir				string `env:"BLOB_DIR" env-default:"./data/blobs"`
+	S3Endpoint			string `env:"S3_ENDPOINT" env-default:"http://localhost:9000"`
+	S3Region			string `env:"S3_REGION" env-default:"us-east-1"`
+	S3Bucket			string `env:"S3_BUCKET" env-default:"tronics"`
+	S3AccessKey			string `env:"S3_ACCESS_KEY"`
+	S3SecretKey			string `env:"S3_SECRET_KEY"`
+	MediaMaxSize		int64 `env:"MEDIA_MAX_SIZE" env-default:"10485760"`
+	MediaMaxAge			int `env:"MEDIA_MAX_AGE" env-default:"31536000"`
+	ProductCacheControl	string `env:"PRODUCT_CACHE_CONTROL" env-default:"public, max-age=60"`
+	ProductsCacheControl	string `env:"PRODUCTS_CACHE_CONTROL" env-default:"public, max-age=30"`
+	APIv1Sunset			time.Time `env:"API_V1_SUNSET" env-default:"2027-06-30" env-layout:"2006-01-02"`
+	BatchMaxRequests	int `env:"BATCH_MAX_REQUESTS" env-default:"50"`
 	JwtTokenSecret		string `env:"JWT_TOKEN_SECRET" env-default:"abrakadabra"`
+	GRPCPort			string `env:"GRPC_PORT" env-default:"9090"`
+	GRPCReflection		bool `env:"GRPC_REFLECTION" env-default:"true"`
+	DocsUIScript		string `env:"DOCS_UI_SCRIPT" env-default:"https://cdn.jsdelivr.net/npm/redoc@2.0.0-rc.45/bundles/redoc.standalone.js"`
 }
\ No newline at end of file
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/inerts73/tronicscorp/dbiface"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//Expansion holds the products a product refers to, embedded on request
+type Expansion struct {
+	Accessories []Product `json:"accessories,omitempty"`
+	Compatible  []Product `json:"compatible,omitempty"`
+}
+
+//referenceFields are the product fields which refer to other products
+var referenceFields = []string{"accessory_ids", "compatible_ids"}
+
+//missingIDs returns the ids of want which are not in found
+func missingIDs(want, found []primitive.ObjectID) []primitive.ObjectID {
+	seen := map[primitive.ObjectID]bool{}
+	for _, ID := range found {
+		seen[ID] = true
+	}
+	var missing []primitive.ObjectID
+	for _, ID := range want {
+		if !seen[ID] {
+			missing = append(missing, ID)
+		}
+	}
+	return missing
+}
+
+//productsByID returns the products among IDs which match filter, in the
+//order of IDs
+func productsByID(ctx context.Context, IDs []primitive.ObjectID, filter bson.M, collection dbiface.CollectionAPI) ([]Product, error) {
+	if len(IDs) == 0 {
+		return nil, nil
+	}
+	filter["_id"] = bson.M{"$in": IDs}
+	found, err := findProducts(ctx, filter, collection)
+	if err != nil {
+		return nil, err
+	}
+	byID := map[primitive.ObjectID]Product{}
+	for _, p := range found {
+		byID[p.ID] = p
+	}
+	products := []Product{}
+	for _, ID := range IDs {
+		if p, ok := byID[ID]; ok {
+			products = append(products, p)
+		}
+	}
+	return products, nil
+}
+
+//checkProductRefs makes sure that the accessories and compatible items of a
+//product are other products which exist
+func checkProductRefs(ctx context.Context, product Product, collection dbiface.CollectionAPI) error {
+	IDs := append(append([]primitive.ObjectID{}, product.AccessoryIDs...), product.CompatibleIDs...)
+	for _, ID := range IDs {
+		if ID == product.ID {
+			return echo.NewHTTPError(http.StatusBadRequest, "A product cannot refer to itself")
+		}
+	}
+	found, err := productsByID(ctx, IDs, bson.M{}, collection)
+	if err != nil {
+		return err
+	}
+	foundIDs := make([]primitive.ObjectID, len(found))
+	for i, p := range found {
+		foundIDs[i] = p.ID
+	}
+	if missing := missingIDs(IDs, foundIDs); len(missing) > 0 {
+		hex := make([]string, len(missing))
+		for i, ID := range missing {
+			hex[i] = ID.Hex()
+		}
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Products %s do not exist", strings.Join(hex, ", ")))
+	}
+	return nil
+}
+
+//expandRefs embeds the products named by expand, e.g. "accessories,compatible".
+//Unless published is false, only published products are embedded.
+func expandRefs(ctx context.Context, product *Product, expand string, published bool, collection dbiface.CollectionAPI) error {
+	filter := func() bson.M {
+		if published {
+			return bson.M{"$or": publishedFilter}
+		}
+		return bson.M{}
+	}
+	expansion := &Expansion{}
+	for _, field := range strings.Split(expand, ",") {
+		var err error
+		switch strings.TrimSpace(field) {
+		case "accessories":
+			expansion.Accessories, err = productsByID(ctx, product.AccessoryIDs, filter(), collection)
+		case "compatible":
+			expansion.Compatible, err = productsByID(ctx, product.CompatibleIDs, filter(), collection)
+		default:
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unable to expand %q", field))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	product.Expanded = expansion
+	return nil
+}
+
+//removeDanglingRefs removes a deleted product from the products which refer to it
+func removeDanglingRefs(ctx context.Context, ID primitive.ObjectID, collection dbiface.CollectionAPI) (int64, error) {
+	filter := bson.A{}
+	pull := bson.M{}
+	for _, field := range referenceFields {
+		filter = append(filter, bson.M{field: ID})
+		pull[field] = ID
+	}
+	res, err := collection.UpdateMany(ctx, bson.M{"$or": filter}, touch(bson.M{"$pull": pull}))
+	if err != nil {
+		log.Errorf("Unable to remove the references to %s : %v", ID.Hex(), err)
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
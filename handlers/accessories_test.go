@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMissingIDs(t *testing.T) {
+	a, b, c := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	assert.Equal(t, []primitive.ObjectID{b}, missingIDs([]primitive.ObjectID{a, b, c}, []primitive.ObjectID{c, a}))
+	assert.Nil(t, missingIDs([]primitive.ObjectID{a}, []primitive.ObjectID{a}))
+}
+
+func TestAccessories(t *testing.T) {
+	ctx := context.Background()
+	h := ProductHandler{Col: col}
+
+	create := func(body string) (primitive.ObjectID, error) {
+		var IDs []primitive.ObjectID
+		c, res := newRequest(http.MethodPost, "/products", body, adminClaims)
+		if err := h.CreateProducts(c); err != nil {
+			return primitive.NilObjectID, err
+		}
+		if !assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &IDs)) || !assert.Len(t, IDs, 1) {
+			return primitive.NilObjectID, nil
+		}
+		return IDs[0], nil
+	}
+
+	charger, err := create(`[{"product_name":"charger","price":20,"currency":"USD","vendor":"google","status":"published"}]`)
+	assert.Nil(t, err)
+
+	t.Run("unknown accessory", func(t *testing.T) {
+		_, err := create(fmt.Sprintf(`[{"product_name":"pixel","price":500,"currency":"USD","vendor":"google","accessory_ids":[%q]}]`, primitive.NewObjectID().Hex()))
+		assertHTTPError(t, err, http.StatusBadRequest)
+	})
+
+	phone, err := create(fmt.Sprintf(`[{"product_name":"pixel","price":500,"currency":"USD","vendor":"google","accessory_ids":[%q]}]`, charger.Hex()))
+	assert.Nil(t, err)
+
+	t.Run("expand accessories", func(t *testing.T) {
+		var product Product
+		c, res := newRequest(http.MethodGet, "/products/"+phone.Hex()+"?expand=accessories", "", adminClaims, "id", phone.Hex())
+		assert.Nil(t, h.GetProduct(c))
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &product))
+		if assert.NotNil(t, product.Expanded) && assert.Len(t, product.Expanded.Accessories, 1) {
+			assert.Equal(t, "charger", product.Expanded.Accessories[0].Name)
+		}
+	})
+
+	t.Run("self reference", func(t *testing.T) {
+		c, _ := newRequest(http.MethodPut, "/products/"+phone.Hex(), fmt.Sprintf(`{"compatible_ids":[%q]}`, phone.Hex()), adminClaims, "id", phone.Hex())
+		err := h.UpdateProduct(c)
+		assertHTTPError(t, err, http.StatusBadRequest)
+	})
+
+	t.Run("delete removes the references", func(t *testing.T) {
+		c, _ := newRequest(http.MethodDelete, "/products/"+charger.Hex(), "", adminClaims, "id", charger.Hex())
+		assert.Nil(t, h.DeleteProduct(c))
+		product, err := findProduct(ctx, phone.Hex(), col)
+		assert.Nil(t, err)
+		assert.Empty(t, product.AccessoryIDs)
+	})
+}
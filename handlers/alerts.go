@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/inerts73/tronicscorp/dbiface"
+	"github.com/inerts73/tronicscorp/notify"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/go-playground/validator.v9"
+)
+
+const (
+	//AlertPriceBelow alerts fire when the price goes below Price
+	AlertPriceBelow = "price_below"
+	//AlertPriceDrop alerts fire whenever the price goes down
+	AlertPriceDrop = "price_drop"
+	//AlertDiscount alerts fire when a change of the product makes the
+	//promotions take a bigger share off its price
+	AlertDiscount = "discount"
+	//AlertChange alerts fire on any change of the product
+	AlertChange = "change"
+)
+
+func init() {
+	v.RegisterStructValidation(func(sl validator.StructLevel) {
+		a := sl.Current().Interface().(Alert)
+		if a.Condition == AlertPriceBelow && (a.Price == nil || a.Price.Amount <= 0) {
+			sl.ReportError(a.Price, "Price", "price", "required", "")
+		}
+		if a.Condition != AlertPriceBelow && a.Price != nil {
+			sl.ReportError(a.Price, "Price", "price", "excluded", "")
+		}
+	}, Alert{})
+}
+
+//Alert is the subscription of a user to a condition on a product
+type Alert struct {
+	ID          primitive.ObjectID `json:"_id" bson:"_id"`
+	UserID      string             `json:"user_id" bson:"user_id"`
+	ProductID   primitive.ObjectID `json:"product_id" bson:"product_id" validate:"required"`
+	Condition   string             `json:"condition" bson:"condition" validate:"required,oneof=price_below price_drop discount change"`
+	Price       *Money             `json:"price,omitempty" bson:"price,omitempty"`
+	CreatedAt   time.Time          `json:"created_at" bson:"created_at"`
+	TriggeredAt *time.Time         `json:"triggered_at,omitempty" bson:"triggered_at,omitempty"`
+	Triggers    int                `json:"triggers" bson:"triggers"`
+}
+
+//AlertsHandler an alerts handler
+type AlertsHandler struct {
+	Col     dbiface.CollectionAPI
+	ProdCol dbiface.CollectionAPI
+}
+
+//AlertChecker notifies the users whose alerts a product change meets
+type AlertChecker struct {
+	Col      dbiface.CollectionAPI
+	Rates    *RateTable
+	Notifier notify.Notifier
+	//Promos and PromoCol price the products for the discount alerts
+	Promos   *PromotionEngine
+	PromoCol dbiface.CollectionAPI
+}
+
+//priceFalls reports whether the price of the product went below threshold
+//with this change, so crossing it notifies once
+func priceFalls(old, updated Product, threshold Money, rates *RateTable) bool {
+	before, err := old.PriceIn(threshold.Currency, rates)
+	if err != nil {
+		return false
+	}
+	after, err := updated.PriceIn(threshold.Currency, rates)
+	if err != nil {
+		return false
+	}
+	return after.Amount < threshold.Amount && before.Amount >= threshold.Amount
+}
+
+//discountShare is the share of the list price of a product the promotions
+//take off. Products the promotion engine did not price fall back to their
+//discount field.
+func discountShare(p Product) float64 {
+	if p.Pricing == nil {
+		return float64(p.Discount) / 100
+	}
+	list := p.Pricing.ListPrice.Amount
+	if list <= 0 {
+		return 0
+	}
+	return float64(list-p.Pricing.FinalPrice.Amount) / float64(list)
+}
+
+//message tells why the alert fires for the change from old to updated, or
+//returns false when it does not
+func (a Alert) message(old, updated Product, changes []FieldChange, rates *RateTable) (string, bool) {
+	price := updated.ListPrice()
+	switch a.Condition {
+	case AlertPriceBelow:
+		if priceFalls(old, updated, *a.Price, rates) {
+			return fmt.Sprintf("%s is now %s, below %s", updated.Name, price, *a.Price), true
+		}
+	case AlertPriceDrop:
+		before, err := rates.Convert(old.ListPrice(), price.Currency)
+		if err == nil && price.Amount < before.Amount {
+			return fmt.Sprintf("%s dropped from %s to %s", updated.Name, before, price), true
+		}
+	case AlertDiscount:
+		if after := discountShare(updated); after > discountShare(old) {
+			return fmt.Sprintf("%s is now %.0f%% off", updated.Name, after*100), true
+		}
+	case AlertChange:
+		if len(changes) > 0 {
+			return fmt.Sprintf("%s changed", updated.Name), true
+		}
+	}
+	return "", false
+}
+
+//check notifies the users whose alerts on the product fire. Only changes to
+//published products are notified.
+func (ac *AlertChecker) check(ctx context.Context, old, updated Product) {
+	if updated.status() != StatusPublished {
+		return
+	}
+	var alerts []Alert
+	cursor, err := ac.Col.Find(ctx, bson.M{"product_id": updated.ID})
+	if err != nil {
+		log.Errorf("Unable to find the alerts : %v", err)
+		return
+	}
+	if err := cursor.All(ctx, &alerts); err != nil {
+		log.Errorf("Unable to read the cursor : %v", err)
+		return
+	}
+	if len(alerts) == 0 {
+		return
+	}
+	changes, err := diffProducts(old, updated)
+	if err != nil {
+		log.Errorf("Unable to diff the product : %v", err)
+		return
+	}
+	if ac.Promos != nil && ac.PromoCol != nil {
+		//both sides get the promotions running now, so only the change counts
+		priced := []Product{old, updated}
+		if err := ac.Promos.setPricing(ctx, priced, ac.PromoCol); err != nil {
+			log.Errorf("Unable to price the product : %v", err)
+			return
+		}
+		old, updated = priced[0], priced[1]
+	}
+	now := time.Now().UTC()
+	var fired []firedAlert
+	for _, alert := range alerts {
+		msg, ok := alert.message(old, updated, changes, ac.Rates)
+		if !ok {
+			continue
+		}
+		n := notify.Notification{UserID: alert.UserID, Kind: alert.Condition, ProductID: updated.ID.Hex(), Message: msg, At: now}
+		fired = append(fired, firedAlert{alertID: alert.ID, notification: n})
+	}
+	if len(fired) == 0 {
+		return
+	}
+	//a notification cannot be taken back, so none is sent for a change that
+	//is rolled back with its atomic batch
+	afterCommit(ctx, func() {
+		ac.notify(context.Background(), fired, now)
+	})
+}
+
+//firedAlert is an alert whose condition is met, with its notification
+type firedAlert struct {
+	alertID      primitive.ObjectID
+	notification notify.Notification
+}
+
+//notify sends the notifications of the fired alerts and marks them triggered
+func (ac *AlertChecker) notify(ctx context.Context, fired []firedAlert, now time.Time) {
+	for _, f := range fired {
+		if err := ac.Notifier.Notify(ctx, f.notification); err != nil {
+			log.Errorf("Unable to notify %s : %v", f.notification.UserID, err)
+			continue
+		}
+		update := bson.M{"$set": bson.M{"triggered_at": now}, "$inc": bson.M{"triggers": 1}}
+		if _, err := ac.Col.UpdateOne(ctx, bson.M{"_id": f.alertID}, update); err != nil {
+			log.Errorf("Unable to update the alert : %v", err)
+		}
+	}
+}
+
+//GetAlerts lists the alerts of the user
+func (h *AlertsHandler) GetAlerts(c echo.Context) error {
+	ctx := storageContext(c)
+	alerts := []Alert{}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cursor, err := h.Col.Find(ctx, bson.M{"user_id": userIDFromContext(c)}, opts)
+	if err != nil {
+		log.Errorf("Unable to find the alerts : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the alerts")
+	}
+	if err := cursor.All(ctx, &alerts); err != nil {
+		log.Errorf("Unable to read the cursor : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the alerts")
+	}
+	return c.JSON(http.StatusOK, alerts)
+}
+
+//CreateAlert subscribes the user to a condition on a product
+func (h *AlertsHandler) CreateAlert(c echo.Context) error {
+	ctx := storageContext(c)
+	var alert Alert
+	if err := c.Bind(&alert); err != nil {
+		log.Errorf("Unable to bind to alert : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	if err := v.Struct(alert); err != nil {
+		log.Errorf("Unable to validate the alert %+v %v", alert, err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload.")
+	}
+	if _, err := publishedProduct(ctx, alert.ProductID.Hex(), h.ProdCol); err != nil {
+		return err
+	}
+	alert.ID = primitive.NewObjectID()
+	alert.UserID = userIDFromContext(c)
+	alert.CreatedAt = time.Now().UTC()
+	alert.TriggeredAt, alert.Triggers = nil, 0
+	if _, err := h.Col.InsertOne(ctx, alert); err != nil {
+		log.Errorf("Unable to insert the alert : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to create the alert")
+	}
+	return c.JSON(http.StatusCreated, alert)
+}
+
+//DeleteAlert unsubscribes the user from an alert
+func (h *AlertsHandler) DeleteAlert(c echo.Context) error {
+	alertID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid alert id")
+	}
+	res, err := h.Col.DeleteOne(storageContext(c), bson.M{"_id": alertID, "user_id": userIDFromContext(c)})
+	if err != nil {
+		log.Errorf("Unable to delete the alert : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to delete the alert")
+	}
+	if res.DeletedCount == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "Alert does not exist")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
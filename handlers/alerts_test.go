@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/inerts73/tronicscorp/notify"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type recordingNotifier struct {
+	sent []notify.Notification
+}
+
+func (r *recordingNotifier) Notify(ctx context.Context, n notify.Notification) error {
+	r.sent = append(r.sent, n)
+	return nil
+}
+
+func TestAlertMessage(t *testing.T) {
+	old := Product{Name: "pixel", Price: 500, Currency: "USD"}
+	cheaper, discounted, renamed := old, old, old
+	cheaper.Price = 450
+	discounted.Discount = 10
+	renamed.Name = "pixel 4"
+	//priced by the promotion engine, the discount field does not count
+	promoted, pricedDiscount := old, old
+	promoted.Pricing = &Pricing{ListPrice: Money{Amount: 50000, Currency: "USD"}, FinalPrice: Money{Amount: 40000, Currency: "USD"}}
+	pricedDiscount.Pricing = &Pricing{ListPrice: Money{Amount: 50000, Currency: "USD"}, FinalPrice: Money{Amount: 50000, Currency: "USD"}}
+	pricedDiscount.Discount = 10
+	changes := func(a, b Product) []FieldChange {
+		changes, err := diffProducts(a, b)
+		assert.Nil(t, err)
+		return changes
+	}
+
+	tests := []struct {
+		name    string
+		alert   Alert
+		updated Product
+		want    string
+	}{
+		{"below", Alert{Condition: AlertPriceBelow, Price: &Money{Amount: 48000, Currency: "USD"}}, cheaper, "pixel is now 450.00 USD, below 480.00 USD"},
+		{"not below", Alert{Condition: AlertPriceBelow, Price: &Money{Amount: 40000, Currency: "USD"}}, cheaper, ""},
+		{"drop", Alert{Condition: AlertPriceDrop}, cheaper, "pixel dropped from 500.00 USD to 450.00 USD"},
+		{"no drop", Alert{Condition: AlertPriceDrop}, renamed, ""},
+		{"discount", Alert{Condition: AlertDiscount}, discounted, "pixel is now 10% off"},
+		{"promotion", Alert{Condition: AlertDiscount}, promoted, "pixel is now 20% off"},
+		{"discount field of a priced product", Alert{Condition: AlertDiscount}, pricedDiscount, ""},
+		{"change", Alert{Condition: AlertChange}, renamed, "pixel 4 changed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, ok := tt.alert.message(old, tt.updated, changes(old, tt.updated), &RateTable{})
+			assert.Equal(t, tt.want != "", ok)
+			assert.Equal(t, tt.want, msg)
+		})
+	}
+
+	t.Run("crossing once", func(t *testing.T) {
+		alert := Alert{Condition: AlertPriceBelow, Price: &Money{Amount: 48000, Currency: "USD"}}
+		cheapest := cheaper
+		cheapest.Price = 400
+		_, ok := alert.message(cheaper, cheapest, changes(cheaper, cheapest), &RateTable{})
+		assert.False(t, ok)
+	})
+}
+
+func TestAlertValidation(t *testing.T) {
+	productID := primitive.NewObjectID()
+	assert.Nil(t, v.Struct(Alert{ProductID: productID, Condition: AlertPriceBelow, Price: &Money{Amount: 100, Currency: "USD"}}))
+	assert.NotNil(t, v.Struct(Alert{ProductID: productID, Condition: AlertPriceBelow}))
+	assert.NotNil(t, v.Struct(Alert{ProductID: productID, Condition: AlertDiscount, Price: &Money{Amount: 100, Currency: "USD"}}))
+	assert.NotNil(t, v.Struct(Alert{ProductID: productID, Condition: "restock"}))
+}
+
+func TestWishlistsAndAlerts(t *testing.T) {
+	notifier := &recordingNotifier{}
+	ph := ProductHandler{Col: col, Alerts: &AlertChecker{Col: db.Collection("alerts"), Notifier: notifier}}
+	wh := WishlistsHandler{Col: db.Collection("wishlists"), ProdCol: col}
+	ah := AlertsHandler{Col: db.Collection("alerts"), ProdCol: col}
+
+	var IDs []primitive.ObjectID
+	c, res := newRequest(http.MethodPost, "/products", `[{"product_name":"pixel","price":500,"currency":"USD","vendor":"google","status":"published"}]`, adminClaims)
+	assert.Nil(t, ph.CreateProducts(c))
+	if !assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &IDs)) || !assert.Len(t, IDs, 1) {
+		return
+	}
+	id := IDs[0].Hex()
+
+	t.Run("wishlist", func(t *testing.T) {
+		for _, status := range []int{http.StatusCreated, http.StatusOK} {
+			c, res := newRequest(http.MethodPost, "/users/me/wishlist", fmt.Sprintf(`{"product_id":%q}`, id), userClaims("shopper@tronics.com"))
+			assert.Nil(t, wh.AddToWishlist(c))
+			assert.Equal(t, status, res.Code)
+		}
+		var items []WishlistItem
+		c, res := newRequest(http.MethodGet, "/users/me/wishlist", "", userClaims("shopper@tronics.com"))
+		assert.Nil(t, wh.GetWishlist(c))
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &items))
+		assert.Len(t, items, 1)
+		assert.Equal(t, "pixel", items[0].Product.Name)
+	})
+
+	t.Run("price drop alert", func(t *testing.T) {
+		c, res := newRequest(http.MethodPost, "/users/me/alerts", fmt.Sprintf(`{"product_id":%q,"condition":"price_below","price":{"amount":45000,"currency":"USD"}}`, id), userClaims("shopper@tronics.com"))
+		assert.Nil(t, ah.CreateAlert(c))
+		assert.Equal(t, http.StatusCreated, res.Code)
+
+		c, _ = newRequest(http.MethodPut, "/products/"+id, `{"price":480}`, adminClaims, "id", id)
+		assert.Nil(t, ph.UpdateProduct(c))
+		assert.Len(t, notifier.sent, 0)
+		c, _ = newRequest(http.MethodPut, "/products/"+id, `{"price":420}`, adminClaims, "id", id)
+		assert.Nil(t, ph.UpdateProduct(c))
+		assert.Len(t, notifier.sent, 1)
+		assert.Equal(t, "shopper@tronics.com", notifier.sent[0].UserID)
+
+		var alerts []Alert
+		c, res = newRequest(http.MethodGet, "/users/me/alerts", "", userClaims("shopper@tronics.com"))
+		assert.Nil(t, ah.GetAlerts(c))
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &alerts))
+		assert.Equal(t, 1, alerts[0].Triggers)
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		c, _ := newRequest(http.MethodDelete, "/users/me/wishlist/"+id, "", userClaims("shopper@tronics.com"), "pid", id)
+		assert.Nil(t, wh.RemoveFromWishlist(c))
+		c, _ = newRequest(http.MethodDelete, "/users/me/wishlist/"+id, "", userClaims("shopper@tronics.com"), "pid", id)
+		err := wh.RemoveFromWishlist(c)
+		assertHTTPError(t, err, http.StatusNotFound)
+	})
+}
@@ -0,0 +1,239 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/inerts73/tronicscorp/dbiface"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/go-playground/validator.v9"
+)
+
+const (
+	//AttrNumber attributes are numbers in Unit, e.g. a screen size in inches
+	AttrNumber = "number"
+	//AttrEnum attributes take one of Values, e.g. a connectivity
+	AttrEnum = "enum"
+	//AttrBoolean attributes are true or false
+	AttrBoolean = "boolean"
+	//AttrString attributes are free text
+	AttrString = "string"
+)
+
+//attrFilterPrefix starts the query params filtering on attributes, e.g.
+//attr.connectivity=5g,wifi or attr.screen_size.min=6
+const attrFilterPrefix = "attr."
+
+var attributeKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+func init() {
+	v.RegisterValidation("attrkey", func(fl validator.FieldLevel) bool {
+		return attributeKeyPattern.MatchString(fl.Field().String())
+	})
+	v.RegisterStructValidation(func(sl validator.StructLevel) {
+		a := sl.Current().Interface().(AttributeDef)
+		if a.Type == AttrEnum && len(a.Values) == 0 {
+			sl.ReportError(a.Values, "Values", "values", "required", "")
+		}
+		if a.Type != AttrEnum && len(a.Values) > 0 {
+			sl.ReportError(a.Values, "Values", "values", "excluded", "")
+		}
+		if a.Type != AttrNumber && (a.Unit != "" || a.Min != nil || a.Max != nil) {
+			sl.ReportError(a.Unit, "Unit", "unit", "excluded", "")
+		}
+		if a.Min != nil && a.Max != nil && *a.Min > *a.Max {
+			sl.ReportError(a.Max, "Max", "max", "gtefield", "Min")
+		}
+	}, AttributeDef{})
+}
+
+//AttributeDef describes an attribute the products of a category have
+type AttributeDef struct {
+	Key      string   `json:"key" bson:"key" validate:"required,max=50,attrkey"`
+	Label    string   `json:"label,omitempty" bson:"label,omitempty" validate:"max=100"`
+	Type     string   `json:"type" bson:"type" validate:"required,oneof=number enum boolean string"`
+	Unit     string   `json:"unit,omitempty" bson:"unit,omitempty" validate:"max=20"`
+	Values   []string `json:"values,omitempty" bson:"values,omitempty" validate:"unique"`
+	Min      *float64 `json:"min,omitempty" bson:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty" bson:"max,omitempty"`
+	Required bool     `json:"required,omitempty" bson:"required,omitempty"`
+}
+
+//attributeSchema merges the attribute definitions of categories and of their
+//ancestors. A category can redefine an attribute of its ancestors.
+func attributeSchema(ctx context.Context, IDs []primitive.ObjectID, collection dbiface.CollectionAPI) (map[string]AttributeDef, error) {
+	schema := map[string]AttributeDef{}
+	if len(IDs) == 0 {
+		return schema, nil
+	}
+	var categories []Category
+	cursor, err := collection.Find(ctx, bson.M{"_id": bson.M{"$in": IDs}})
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &categories); err != nil {
+		return nil, err
+	}
+	var ancestorIDs []primitive.ObjectID
+	for _, category := range categories {
+		ancestorIDs = append(ancestorIDs, category.Ancestors...)
+	}
+	var ancestors []Category
+	if len(ancestorIDs) > 0 {
+		cursor, err := collection.Find(ctx, bson.M{"_id": bson.M{"$in": ancestorIDs}})
+		if err != nil {
+			return nil, err
+		}
+		if err := cursor.All(ctx, &ancestors); err != nil {
+			return nil, err
+		}
+	}
+	for _, category := range append(ancestors, categories...) {
+		for _, def := range category.Attributes {
+			schema[def.Key] = def
+		}
+	}
+	return schema, nil
+}
+
+//checkAttributes validates the attributes of a product against schema.
+//Attributes set to null are removed.
+func checkAttributes(attributes map[string]interface{}, schema map[string]AttributeDef) error {
+	for key, value := range attributes {
+		if value == nil {
+			delete(attributes, key)
+			continue
+		}
+		def, ok := schema[key]
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Attribute %s is not defined for the categories of the product", key))
+		}
+		if err := def.check(value); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Attribute %s %v", key, err))
+		}
+	}
+	for key, def := range schema {
+		if _, ok := attributes[key]; def.Required && !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Attribute %s is required", key))
+		}
+	}
+	return nil
+}
+
+func (a AttributeDef) check(value interface{}) error {
+	switch a.Type {
+	case AttrNumber:
+		n, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("must be a number")
+		}
+		if a.Min != nil && n < *a.Min {
+			return fmt.Errorf("must be at least %v", *a.Min)
+		}
+		if a.Max != nil && n > *a.Max {
+			return fmt.Errorf("must be at most %v", *a.Max)
+		}
+	case AttrEnum:
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("must be one of %s", strings.Join(a.Values, ", "))
+		}
+		for _, allowed := range a.Values {
+			if s == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %s", strings.Join(a.Values, ", "))
+	case AttrBoolean:
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("must be true or false")
+		}
+	case AttrString:
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("must be a string")
+		}
+	}
+	return nil
+}
+
+//attributeFilter turns the attr. query params into a filter. attr.<key>=a,b
+//matches any of the values and attr.<key>.min and attr.<key>.max match a range.
+func attributeFilter(q url.Values) (bson.M, error) {
+	filter := bson.M{}
+	for param, values := range q {
+		if !strings.HasPrefix(param, attrFilterPrefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(param, attrFilterPrefix), ".", 2)
+		if !attributeKeyPattern.MatchString(parts[0]) {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid attribute filter %s", param))
+		}
+		field := "attributes." + parts[0]
+		cond, _ := filter[field].(bson.M)
+		if cond == nil {
+			cond = bson.M{}
+			filter[field] = cond
+		}
+		if len(parts) == 1 {
+			var in bson.A
+			for _, value := range strings.Split(values[0], ",") {
+				if n, err := strconv.ParseFloat(value, 64); err == nil {
+					in = append(in, n)
+				}
+				if b, err := strconv.ParseBool(value); err == nil {
+					in = append(in, b)
+				}
+				in = append(in, value)
+			}
+			cond["$in"] = in
+			continue
+		}
+		op := map[string]string{"min": "$gte", "max": "$lte"}[parts[1]]
+		n, err := strconv.ParseFloat(values[0], 64)
+		if op == "" || err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid attribute filter %s", param))
+		}
+		cond[op] = n
+	}
+	return filter, nil
+}
+
+//attributesUpdate replaces the attribute definitions of a category
+type attributesUpdate struct {
+	Attributes []AttributeDef `json:"attributes" validate:"unique=Key,dive"`
+}
+
+//SetAttributes replaces the attribute schema of a category
+func (h *CategoriesHandler) SetAttributes(c echo.Context) error {
+	var req attributesUpdate
+	docID, err := categoryID(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	category, err := findCategory(storageContext(c), docID, h.Col)
+	if err != nil {
+		return err
+	}
+	if err := c.Bind(&req); err != nil {
+		log.Errorf("Unable to bind to attributes : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	if err := v.Struct(req); err != nil {
+		log.Errorf("Unable to validate the attributes %+v %v", req, err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload.")
+	}
+	category.Attributes = req.Attributes
+	if _, err := h.Col.UpdateOne(storageContext(c), bson.M{"_id": docID}, bson.M{"$set": bson.M{"attributes": req.Attributes}}); err != nil {
+		log.Errorf("Unable to update the attributes : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to update the attributes")
+	}
+	return c.JSON(http.StatusOK, category)
+}
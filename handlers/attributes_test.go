@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAttributeDefs(t *testing.T) {
+	assert.Nil(t, v.Struct(AttributeDef{Key: "screen_size", Type: AttrNumber, Unit: "in"}))
+	assert.Nil(t, v.Struct(AttributeDef{Key: "connectivity", Type: AttrEnum, Values: []string{"4g", "5g"}}))
+	assert.NotNil(t, v.Struct(AttributeDef{Key: "connectivity", Type: AttrEnum}))
+	assert.NotNil(t, v.Struct(AttributeDef{Key: "nfc", Type: AttrBoolean, Unit: "in"}))
+	assert.NotNil(t, v.Struct(AttributeDef{Key: "Screen Size", Type: AttrNumber}))
+}
+
+func TestCheckAttributes(t *testing.T) {
+	min := 0.0
+	schema := map[string]AttributeDef{
+		"battery_mah":  {Key: "battery_mah", Type: AttrNumber, Unit: "mAh", Min: &min, Required: true},
+		"connectivity": {Key: "connectivity", Type: AttrEnum, Values: []string{"4g", "5g"}},
+		"nfc":          {Key: "nfc", Type: AttrBoolean},
+	}
+	assert.Nil(t, checkAttributes(map[string]interface{}{"battery_mah": 4000.0, "connectivity": "5g", "nfc": true}, schema))
+
+	attributes := map[string]interface{}{"battery_mah": 4000.0, "nfc": nil}
+	assert.Nil(t, checkAttributes(attributes, schema))
+	assert.Equal(t, map[string]interface{}{"battery_mah": 4000.0}, attributes, "null removes an attribute")
+
+	for _, attributes := range []map[string]interface{}{
+		{},
+		{"battery_mah": -1.0},
+		{"battery_mah": "4000"},
+		{"battery_mah": 4000.0, "connectivity": "3g"},
+		{"battery_mah": 4000.0, "color": "black"},
+	} {
+		err := checkAttributes(attributes, schema)
+		assertHTTPError(t, err, http.StatusBadRequest, "%v", attributes)
+	}
+}
+
+func TestAttributeFilter(t *testing.T) {
+	q, _ := url.ParseQuery("attr.connectivity=5g,wifi&attr.screen_size.min=6&attr.screen_size.max=6.5&vendor=google")
+	filter, err := attributeFilter(q)
+	assert.Nil(t, err)
+	assert.Equal(t, bson.M{
+		"attributes.connectivity": bson.M{"$in": bson.A{"5g", "wifi"}},
+		"attributes.screen_size":  bson.M{"$gte": 6.0, "$lte": 6.5},
+	}, filter)
+
+	q, _ = url.ParseQuery("attr.screen_size.above=6")
+	_, err = attributeFilter(q)
+	assert.NotNil(t, err)
+}
+
+func TestProductAttributes(t *testing.T) {
+	ch := CategoriesHandler{Col: db.Collection("categories"), ProdCol: col}
+	ph := ProductHandler{Col: col, CatCol: ch.Col}
+
+	var category Category
+	c, res := newRequest(http.MethodPost, "/categories", `{"name":"Tablets","attributes":[{"key":"screen_size","type":"number","unit":"in"}]}`, adminClaims)
+	assert.Nil(t, ch.CreateCategory(c))
+	assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &category))
+
+	create := func(size string) error {
+		body := fmt.Sprintf(`[{"product_name":"tab","price":300,"currency":"USD","vendor":"google","categories":[%q],"attributes":{"screen_size":%s}}]`, category.ID.Hex(), size)
+		c, _ := newRequest(http.MethodPost, "/products", body, adminClaims)
+		return ph.CreateProducts(c)
+	}
+	assert.Nil(t, create("8"))
+	assert.Nil(t, create("11"))
+	err := create(`"big"`)
+	assertHTTPError(t, err, http.StatusBadRequest)
+
+	var products []Product
+	c, res = newRequest(http.MethodGet, "/products?attr.screen_size.min=10", "", adminClaims)
+	assert.Nil(t, ph.GetProducts(c))
+	assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &products))
+	if assert.Len(t, products, 1) {
+		assert.Equal(t, 11.0, products[0].Attributes["screen_size"])
+	}
+}
@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/inerts73/tronicscorp/dbiface"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+//inheritedHeaders are passed from a batch to its sub-requests, unless they set their own
+var inheritedHeaders = []string{"x-auth-token", HeaderCartToken, "X-Correlation-ID", "Accept-Language"}
+
+//BatchRequest is a sub-request of a batch
+type BatchRequest struct {
+	Method  string            `json:"method" validate:"required,oneof=GET POST PUT PATCH DELETE"`
+	Path    string            `json:"path" validate:"required,startswith=/"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+//BatchResponse is the response to a sub-request. JSON bodies are kept as they
+//are, other bodies are JSON strings.
+type BatchResponse struct {
+	Status  int             `json:"status"`
+	Headers http.Header     `json:"headers,omitempty"`
+	Body    json.RawMessage `json:"body,omitempty"`
+}
+
+//batch is the payload of POST /batch. Atomic batches stop at the first
+//failed sub-request and undo the storage operations of the ones before. What
+//the transaction cannot undo, e.g. notifications, waits for its commit.
+type batch struct {
+	Atomic   bool           `json:"atomic"`
+	Requests []BatchRequest `json:"requests" validate:"required,min=1,dive"`
+}
+
+//BatchResult lists the responses to the sub-requests of a batch, in order
+type BatchResult struct {
+	Responses  []BatchResponse `json:"responses"`
+	RolledBack bool            `json:"rolled_back,omitempty"`
+}
+
+//BatchHandler runs several requests in one round trip. Sub-requests go through
+//the router of Echo, its middlewares included, one after the other.
+type BatchHandler struct {
+	Echo *echo.Echo
+	//Client runs the transactions of atomic batches, which need a replica set
+	Client      dbiface.ClientAPI
+	MaxRequests int
+}
+
+//atomicBatchKey marks the context of the sub-requests of an atomic batch, its
+//value is the *sideEffects of the batch
+type atomicBatchKey struct{}
+
+//sideEffects are the actions of an atomic batch that its transaction cannot
+//undo. They run once the transaction is committed, and never if it is aborted.
+type sideEffects struct {
+	mu      sync.Mutex
+	pending []func()
+}
+
+//afterCommit runs f once the storage operations made with ctx are committed:
+//at the end of the atomic batch of ctx, or right away outside of one
+func afterCommit(ctx context.Context, f func()) {
+	effects, ok := ctx.Value(atomicBatchKey{}).(*sideEffects)
+	if !ok {
+		f()
+		return
+	}
+	effects.mu.Lock()
+	defer effects.mu.Unlock()
+	effects.pending = append(effects.pending, f)
+}
+
+func (s *sideEffects) run() {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	for _, f := range pending {
+		f()
+	}
+}
+
+//inAtomicBatch tells if ctx is the context of a sub-request of an atomic batch
+func inAtomicBatch(ctx context.Context) bool {
+	return ctx.Value(atomicBatchKey{}) != nil
+}
+
+//storageContext is the context of the storage operations of a request: the
+//transaction of its atomic batch, if any
+func storageContext(c echo.Context) context.Context {
+	if ctx := c.Request().Context(); inAtomicBatch(ctx) {
+		return ctx
+	}
+	return context.Background()
+}
+
+//Serve runs a batch
+func (h *BatchHandler) Serve(c echo.Context) error {
+	var b batch
+	if err := c.Bind(&b); err != nil {
+		log.Errorf("Unable to bind to batch : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	if err := v.Struct(b); err != nil {
+		log.Errorf("Unable to validate the batch %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload.")
+	}
+	if h.MaxRequests > 0 && len(b.Requests) > h.MaxRequests {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("A batch has at most %d requests", h.MaxRequests))
+	}
+	for _, r := range b.Requests {
+		if isBatchPath(r.Path) {
+			return echo.NewHTTPError(http.StatusBadRequest, "Batches cannot be nested")
+		}
+	}
+	if !b.Atomic {
+		return c.JSON(http.StatusOK, BatchResult{Responses: h.dispatch(context.Background(), c, b.Requests, false)})
+	}
+	if h.Client == nil {
+		return echo.NewHTTPError(http.StatusNotImplemented, "Atomic batches are not available")
+	}
+	var result BatchResult
+	effects := &sideEffects{}
+	err := h.Client.UseSession(context.Background(), func(sc mongo.SessionContext) error {
+		if err := sc.StartTransaction(); err != nil {
+			return err
+		}
+		result.Responses = h.dispatch(context.WithValue(sc, atomicBatchKey{}, effects), c, b.Requests, true)
+		if last := result.Responses[len(result.Responses)-1]; last.Status >= http.StatusBadRequest {
+			result.RolledBack = true
+			return sc.AbortTransaction(sc)
+		}
+		return sc.CommitTransaction(sc)
+	})
+	if err != nil {
+		log.Errorf("Unable to run the batch in a transaction : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to apply the batch")
+	}
+	if !result.RolledBack {
+		effects.run()
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+//isBatchPath tells if a path is the batch route, of any version
+func isBatchPath(p string) bool {
+	p = path.Clean(strings.SplitN(p, "?", 2)[0])
+	return p == "/batch" || p == "/v1/batch" || p == "/v2/batch"
+}
+
+//dispatch runs the sub-requests in order. With stopOnError it stops after the
+//first one that fails.
+func (h *BatchHandler) dispatch(ctx context.Context, c echo.Context, requests []BatchRequest, stopOnError bool) []BatchResponse {
+	responses := make([]BatchResponse, 0, len(requests))
+	for _, r := range requests {
+		res, err := h.serve(ctx, c, r)
+		if err != nil {
+			log.Errorf("Unable to run the sub-request %s %s : %v", r.Method, r.Path, err)
+			res = BatchResponse{Status: http.StatusBadRequest, Body: json.RawMessage(`{"message":"Invalid request"}`)}
+		}
+		responses = append(responses, res)
+		if stopOnError && res.Status >= http.StatusBadRequest {
+			break
+		}
+	}
+	return responses
+}
+
+func (h *BatchHandler) serve(ctx context.Context, c echo.Context, r BatchRequest) (BatchResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, r.Method, r.Path, bytes.NewReader(r.Body))
+	if err != nil {
+		return BatchResponse{}, err
+	}
+	outer := c.Request()
+	req.RequestURI, req.RemoteAddr, req.Host = r.Path, outer.RemoteAddr, outer.Host
+	for _, name := range inheritedHeaders {
+		if value := outer.Header.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	if len(r.Body) > 0 {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	for name, value := range r.Headers {
+		req.Header.Set(name, value)
+	}
+	rec := &batchRecorder{header: http.Header{}}
+	h.Echo.ServeHTTP(rec, req)
+	return rec.response()
+}
+
+//batchRecorder keeps the response to a sub-request
+type batchRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *batchRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *batchRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *batchRecorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(b)
+}
+
+func (r *batchRecorder) response() (BatchResponse, error) {
+	res := BatchResponse{Status: r.status, Headers: r.header}
+	if res.Status == 0 {
+		res.Status = http.StatusOK
+	}
+	body := r.body.Bytes()
+	switch {
+	case len(body) == 0:
+	case strings.HasPrefix(r.header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON) && json.Valid(body):
+		res.Body = json.RawMessage(bytes.TrimSpace(body))
+	case utf8.Valid(body):
+		data, err := json.Marshal(string(body))
+		if err != nil {
+			return res, err
+		}
+		res.Body = data
+	default:
+		data, err := json.Marshal(body)
+		if err != nil {
+			return res, err
+		}
+		res.Body = data
+	}
+	return res, nil
+}
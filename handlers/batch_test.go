@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/inerts73/tronicscorp/notify"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func batchServer() *echo.Echo {
+	e := echo.New()
+	requireToken := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if c.Request().Header.Get("x-auth-token") != "Bearer admin" {
+				return echo.NewHTTPError(http.StatusUnauthorized, "invalid or expired jwt")
+			}
+			return next(c)
+		}
+	}
+	h := &BatchHandler{Echo: e, MaxRequests: 3}
+	versions := &APIVersions{}
+	for _, api := range []*echo.Group{e.Group("", versions.Unversioned), e.Group("/v1", versions.V1), e.Group("/v2", versions.V2)} {
+		api.GET("/products/:id", func(c echo.Context) error {
+			return c.JSON(http.StatusOK, Product{Name: c.Param("id")})
+		})
+		api.POST("/products", func(c echo.Context) error {
+			var products []Product
+			if err := c.Bind(&products); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+			}
+			return c.JSON(http.StatusCreated, []string{products[0].Name})
+		}, requireToken)
+		api.GET("/health", func(c echo.Context) error {
+			return c.String(http.StatusOK, "ok")
+		})
+		api.POST("/batch", h.Serve)
+	}
+	return e
+}
+
+func postBatch(e *echo.Echo, body string, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if token != "" {
+		req.Header.Set("x-auth-token", token)
+	}
+	res := httptest.NewRecorder()
+	e.ServeHTTP(res, req)
+	return res
+}
+
+func TestBatch(t *testing.T) {
+	e := batchServer()
+	body := `{"requests": [
+		{"method": "GET", "path": "/v2/products/phone"},
+		{"method": "POST", "path": "/products", "body": [{"product_name": "case"}]},
+		{"method": "POST", "path": "/products", "headers": {"x-auth-token": "Bearer user"}, "body": [{"product_name": "case"}]},
+		{"method": "GET", "path": "/health"}
+	]}`
+	res := postBatch(e, body, "Bearer admin")
+	assert.Equal(t, http.StatusBadRequest, res.Code, "more requests than MaxRequests")
+
+	body = `{"requests": [
+		{"method": "GET", "path": "/v2/products/phone"},
+		{"method": "POST", "path": "/products", "body": [{"product_name": "case"}]},
+		{"method": "POST", "path": "/products", "headers": {"x-auth-token": "Bearer user"}, "body": [{"product_name": "case"}]}
+	]}`
+	res = postBatch(e, body, "Bearer admin")
+	assert.Equal(t, http.StatusOK, res.Code)
+	var result BatchResult
+	assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &result))
+	assert.False(t, result.RolledBack)
+	assert.Len(t, result.Responses, 3)
+	assert.Equal(t, http.StatusOK, result.Responses[0].Status)
+	assert.Contains(t, string(result.Responses[0].Body), `"product_name":"phone"`)
+	assert.Equal(t, http.StatusCreated, result.Responses[1].Status, "the token of the batch is passed on")
+	assert.JSONEq(t, `["case"]`, string(result.Responses[1].Body))
+	assert.Equal(t, http.StatusUnauthorized, result.Responses[2].Status, "a sub-request can set its own token")
+
+	res = postBatch(e, `{"requests": [{"method": "GET", "path": "/health"}, {"method": "GET", "path": "/missing"}]}`, "")
+	assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &result))
+	assert.Equal(t, json.RawMessage(`"ok"`), result.Responses[0].Body)
+	assert.Equal(t, http.StatusNotFound, result.Responses[1].Status)
+
+	testCases := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"no requests", `{"requests": []}`, http.StatusBadRequest},
+		{"unknown method", `{"requests": [{"method": "TRACE", "path": "/health"}]}`, http.StatusBadRequest},
+		{"relative path", `{"requests": [{"method": "GET", "path": "health"}]}`, http.StatusBadRequest},
+		{"nested batch", `{"requests": [{"method": "POST", "path": "/v1/batch/"}]}`, http.StatusBadRequest},
+		{"atomic without transactions", `{"atomic": true, "requests": [{"method": "GET", "path": "/health"}]}`, http.StatusNotImplemented},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.code, postBatch(e, tc.body, "").Code)
+		})
+	}
+}
+
+func TestStorageContext(t *testing.T) {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/products", nil)
+	assert.Equal(t, context.Background(), storageContext(e.NewContext(req, httptest.NewRecorder())))
+
+	ctx := context.WithValue(context.Background(), atomicBatchKey{}, true)
+	req = req.WithContext(ctx)
+	assert.Equal(t, ctx, storageContext(e.NewContext(req, httptest.NewRecorder())))
+}
+
+//transactions is a client whose transactions only count how they end
+type transactions struct {
+	committed, aborted int
+}
+
+func (tx *transactions) UseSession(ctx context.Context, fn func(mongo.SessionContext) error) error {
+	return fn(&fakeSession{Context: ctx, tx: tx})
+}
+
+type fakeSession struct {
+	context.Context
+	mongo.Session
+	tx *transactions
+}
+
+func (s *fakeSession) StartTransaction(...*options.TransactionOptions) error {
+	return nil
+}
+
+func (s *fakeSession) AbortTransaction(context.Context) error {
+	s.tx.aborted++
+	return nil
+}
+
+func (s *fakeSession) CommitTransaction(context.Context) error {
+	s.tx.committed++
+	return nil
+}
+
+func TestAtomicBatch(t *testing.T) {
+	e := echo.New()
+	notifier := &recordingNotifier{}
+	e.PUT("/products/:id", func(c echo.Context) error {
+		//the context of echo is reused once the sub-request is served
+		id := c.Param("id")
+		afterCommit(storageContext(c), func() {
+			notifier.Notify(context.Background(), notify.Notification{ProductID: id})
+		})
+		return c.NoContent(http.StatusOK)
+	})
+	e.GET("/conflict", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusConflict)
+	})
+	e.POST("/products/:id/media", (&MediaHandler{}).UploadMedia)
+	e.POST("/orders/:id/pay", (&OrdersHandler{}).PayOrder)
+	e.POST("/graphql", (&GraphQLHandler{}).Serve)
+	tx := &transactions{}
+	h := &BatchHandler{Echo: e, Client: tx}
+	e.POST("/batch", h.Serve)
+
+	res := postBatch(e, `{"atomic": true, "requests": [{"method": "PUT", "path": "/products/1"}, {"method": "GET", "path": "/conflict"}]}`, "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	var result BatchResult
+	assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &result))
+	assert.True(t, result.RolledBack)
+	assert.Equal(t, 1, tx.aborted)
+	assert.Empty(t, notifier.sent, "an aborted batch sends no notifications")
+
+	res = postBatch(e, `{"atomic": true, "requests": [{"method": "PUT", "path": "/products/1"}, {"method": "PUT", "path": "/products/2"}]}`, "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, 1, tx.committed)
+	if assert.Len(t, notifier.sent, 2) {
+		assert.Equal(t, "1", notifier.sent[0].ProductID)
+		assert.Equal(t, "2", notifier.sent[1].ProductID)
+	}
+
+	res = postBatch(e, `{"requests": [{"method": "PUT", "path": "/products/3"}]}`, "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Len(t, notifier.sent, 3, "outside of an atomic batch the notification is sent right away")
+
+	rejected := []struct {
+		path, body, message string
+	}{
+		{"/products/1/media", "", "Files cannot be uploaded in an atomic batch"},
+		{"/orders/1/pay", `, "body": {"source": "tok_visa"}`, "Orders cannot be paid in an atomic batch"},
+		{"/graphql", `, "body": {"query": "{ products { name } }"}`, "GraphQL requests cannot run in an atomic batch"},
+	}
+	for _, r := range rejected {
+		res = postBatch(e, `{"atomic": true, "requests": [{"method": "POST", "path": "`+r.path+`"`+r.body+`}]}`, "")
+		result = BatchResult{}
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &result))
+		assert.True(t, result.RolledBack)
+		assert.Equal(t, http.StatusBadRequest, result.Responses[0].Status, r.path)
+		assert.Contains(t, string(result.Responses[0].Body), r.message)
+	}
+
+	paid := Order{Status: OrderPaid, ChargeID: "ch_1"}
+	ctx := context.WithValue(context.Background(), atomicBatchKey{}, &sideEffects{})
+	_, err := (&OrdersHandler{}).transition(ctx, paid, OrderRefunded, OrderEvent{}, nil)
+	assertHTTPError(t, err, http.StatusBadRequest, "a refund cannot be rolled back")
+}
@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+	"net/http"
+
+	"github.com/inerts73/tronicscorp/dbiface"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	//ProductTypeBundle products are sold as a set of other products
+	ProductTypeBundle = "bundle"
+	//BundleFixedPrice bundles are sold at their own price
+	BundleFixedPrice = "fixed"
+	//BundleDerivedPrice bundles cost the price of their components minus a discount
+	BundleDerivedPrice = "derived"
+)
+
+//Bundle lists the components of a bundle and how it is priced.
+//Available is computed for the response from the stock of the components.
+type Bundle struct {
+	Components      []BundleComponent `json:"components" bson:"components" validate:"required,min=1,unique=ProductID,dive"`
+	Pricing         string            `json:"pricing" bson:"pricing" validate:"required,oneof=fixed derived"`
+	DiscountPercent int               `json:"discount_percent,omitempty" bson:"discount_percent,omitempty" validate:"min=0,max=100"`
+	Available       *int              `json:"available,omitempty" bson:"-"`
+}
+
+//BundleComponent is a product of a bundle. Product is embedded in responses.
+type BundleComponent struct {
+	ProductID primitive.ObjectID `json:"product_id" bson:"product_id" validate:"required"`
+	Quantity  int                `json:"quantity" bson:"quantity" validate:"required,min=1"`
+	Product   *Product           `json:"product,omitempty" bson:"-"`
+}
+
+var errBundleStock = echo.NewHTTPError(http.StatusBadRequest, "The stock of a bundle is the stock of its components")
+
+func (p Product) isBundle() bool {
+	return p.Type == ProductTypeBundle
+}
+
+func (b Bundle) componentIDs() []primitive.ObjectID {
+	IDs := make([]primitive.ObjectID, len(b.Components))
+	for i, component := range b.Components {
+		IDs[i] = component.ProductID
+	}
+	return IDs
+}
+
+//available is how many bundles the available stock of the components makes up
+func (b Bundle) available(stock map[primitive.ObjectID]int) int {
+	available := -1
+	for _, component := range b.Components {
+		n := stock[component.ProductID] / component.Quantity
+		if available < 0 || n < available {
+			available = n
+		}
+	}
+	if available < 0 {
+		return 0
+	}
+	return available
+}
+
+//derivedPrice sums the components in the currency of the bundle and takes the
+//discount off. Products are priced in whole units so the sum is rounded.
+func derivedPrice(bundle Product, components map[primitive.ObjectID]Product, rates *RateTable) (int, error) {
+	var total int64
+	for _, component := range bundle.Bundle.Components {
+		price, err := components[component.ProductID].PriceIn(bundle.Currency, rates)
+		if err != nil {
+			return 0, err
+		}
+		total += price.Amount * int64(component.Quantity)
+	}
+	price := big.NewRat(total*int64(100-bundle.Bundle.DiscountPercent), 100*pow10(currencies[bundle.Currency]))
+	return int(roundHalfAwayFromZero(price)), nil
+}
+
+//checkBundle makes sure the components of a bundle are other products, which
+//are not bundles themselves, and prices derived bundles
+func (h *ProductHandler) checkBundle(ctx context.Context, product *Product) error {
+	if !product.isBundle() {
+		if product.Bundle != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Only products of type %s have components", ProductTypeBundle))
+		}
+		return nil
+	}
+	if product.Bundle == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "A bundle needs components")
+	}
+	IDs := product.Bundle.componentIDs()
+	found, err := productsByID(ctx, IDs, bson.M{}, h.Col)
+	if err != nil {
+		return err
+	}
+	components := map[primitive.ObjectID]Product{}
+	for _, component := range found {
+		if component.ID == product.ID || component.isBundle() {
+			return echo.NewHTTPError(http.StatusBadRequest, "A bundle cannot contain bundles")
+		}
+		components[component.ID] = component
+	}
+	for _, ID := range IDs {
+		if _, ok := components[ID]; !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Product %s does not exist", ID.Hex()))
+		}
+	}
+	if product.Bundle.Pricing == BundleDerivedPrice {
+		price, err := derivedPrice(*product, components, h.Rates)
+		if err != nil {
+			log.Errorf("Unable to price the bundle : %v", err)
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unable to price the components in %s", product.Currency))
+		}
+		product.Price = price
+		//the product was validated before its price was derived
+		if err := v.StructPartial(*product, "Price"); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("The bundle would cost %d %s, more than a product may", price, product.Currency))
+		}
+	} else if product.Price <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "A bundle with a fixed price needs a price")
+	}
+	return nil
+}
+
+//refreshBundles reprices the derived bundles containing a product whose price
+//changed. They are updated like any product, so their revisions and price
+//history follow.
+func (h *ProductHandler) refreshBundles(ctx context.Context, component Product) {
+	filter := bson.M{"bundle.components.product_id": component.ID, "bundle.pricing": BundleDerivedPrice}
+	bundles, err := findProducts(ctx, filter, h.Col)
+	if err != nil {
+		return
+	}
+	system := actor{userID: "bundles", admin: true}
+	for _, bundle := range bundles {
+		if _, err := modifyProduct(ctx, bundle.ID.Hex(), bytes.NewReader([]byte(`{}`)), h.Col, h.updateHooks(system, 0)); err != nil {
+			log.Errorf("Unable to reprice the bundle %s : %v", bundle.ID.Hex(), err)
+		}
+	}
+}
+
+//availableStock returns the available stock of products by id
+func availableStock(ctx context.Context, IDs []primitive.ObjectID, collection dbiface.CollectionAPI) (map[primitive.ObjectID]int, error) {
+	var stocks []Stock
+	available := map[primitive.ObjectID]int{}
+	if len(IDs) == 0 {
+		return available, nil
+	}
+	cursor, err := collection.Find(ctx, bson.M{"_id": bson.M{"$in": IDs}})
+	if err != nil {
+		log.Errorf("Unable to find the stock : %v", err)
+		return nil, err
+	}
+	if err := cursor.All(ctx, &stocks); err != nil {
+		log.Errorf("Unable to read the cursor : %v", err)
+		return nil, err
+	}
+	for _, stock := range stocks {
+		available[stock.ProductID] = stock.Available
+	}
+	return available, nil
+}
+
+//bundleStock computes the stock of a bundle from the stock of its components
+func bundleStock(ctx context.Context, bundle Product, collection dbiface.CollectionAPI) (Stock, error) {
+	available, err := availableStock(ctx, bundle.Bundle.componentIDs(), collection)
+	if err != nil {
+		return Stock{}, err
+	}
+	n := bundle.Bundle.available(available)
+	return Stock{ProductID: bundle.ID, OnHand: n, Available: n}, nil
+}
+
+//inStockBundleIDs returns the ids of the bundles whose components are in stock
+func (h *ProductHandler) inStockBundleIDs(ctx context.Context) ([]primitive.ObjectID, error) {
+	bundles, err := findProducts(ctx, bson.M{"type": ProductTypeBundle}, h.Col)
+	if err != nil {
+		return nil, err
+	}
+	var IDs []primitive.ObjectID
+	for _, bundle := range bundles {
+		IDs = append(IDs, bundle.Bundle.componentIDs()...)
+	}
+	available, err := availableStock(ctx, IDs, h.InvCol)
+	if err != nil {
+		return nil, err
+	}
+	IDs = nil
+	for _, bundle := range bundles {
+		if bundle.Bundle.available(available) > 0 {
+			IDs = append(IDs, bundle.ID)
+		}
+	}
+	return IDs, nil
+}
+
+//expandBundles embeds the components of the bundles among products, with the
+//number of bundles in stock
+func (h *ProductHandler) expandBundles(ctx context.Context, products []Product, published bool) error {
+	var IDs []primitive.ObjectID
+	for _, p := range products {
+		if p.isBundle() && p.Bundle != nil {
+			IDs = append(IDs, p.Bundle.componentIDs()...)
+		}
+	}
+	if len(IDs) == 0 {
+		return nil
+	}
+	filter := bson.M{}
+	if published {
+		filter["$or"] = publishedFilter
+	}
+	found, err := productsByID(ctx, IDs, filter, h.Col)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the components of the bundles")
+	}
+	components := map[primitive.ObjectID]Product{}
+	for _, component := range found {
+		components[component.ID] = component
+	}
+	var available map[primitive.ObjectID]int
+	if h.InvCol != nil {
+		if available, err = availableStock(ctx, IDs, h.InvCol); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the stock")
+		}
+	}
+	for i := range products {
+		bundle := products[i].Bundle
+		if !products[i].isBundle() || bundle == nil {
+			continue
+		}
+		for j, component := range bundle.Components {
+			if p, ok := components[component.ProductID]; ok {
+				bundle.Components[j].Product = &p
+			}
+		}
+		if available != nil {
+			n := bundle.available(available)
+			bundle.Available = &n
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestBundlePricing(t *testing.T) {
+	phone := Product{ID: primitive.NewObjectID(), Price: 500, Currency: "USD"}
+	charger := Product{ID: primitive.NewObjectID(), Price: 25, Currency: "USD"}
+	components := map[primitive.ObjectID]Product{phone.ID: phone, charger.ID: charger}
+	bundle := Product{Currency: "USD", Type: ProductTypeBundle, Bundle: &Bundle{
+		Components: []BundleComponent{
+			{ProductID: phone.ID, Quantity: 1},
+			{ProductID: charger.ID, Quantity: 2},
+		},
+		Pricing:         BundleDerivedPrice,
+		DiscountPercent: 15,
+	}}
+
+	price, err := derivedPrice(bundle, components, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 468, price, "550 minus 15% is 467.5")
+
+	bundle.Currency = "EUR"
+	_, err = derivedPrice(bundle, components, nil)
+	assert.NotNil(t, err, "no exchange rates")
+}
+
+func TestBundleAvailability(t *testing.T) {
+	phone, charger := primitive.NewObjectID(), primitive.NewObjectID()
+	bundle := Bundle{Components: []BundleComponent{{ProductID: phone, Quantity: 1}, {ProductID: charger, Quantity: 2}}}
+	assert.Equal(t, 3, bundle.available(map[primitive.ObjectID]int{phone: 5, charger: 7}))
+	assert.Equal(t, 0, bundle.available(map[primitive.ObjectID]int{phone: 5}))
+}
+
+func TestBundles(t *testing.T) {
+	ih := InventoryHandler{Col: db.Collection("inventory"), ProdCol: col}
+	h := ProductHandler{Col: col, InvCol: ih.Col}
+
+	create := func(body string) ([]primitive.ObjectID, error) {
+		var IDs []primitive.ObjectID
+		c, res := newRequest(http.MethodPost, "/products", body, adminClaims)
+		if err := h.CreateProducts(c); err != nil {
+			return nil, err
+		}
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &IDs))
+		return IDs, nil
+	}
+
+	IDs, err := create(`[{"product_name":"pixel","price":500,"currency":"USD","vendor":"google"},{"product_name":"charger","price":25,"currency":"USD","vendor":"google"}]`)
+	if !assert.Nil(t, err) || !assert.Len(t, IDs, 2) {
+		return
+	}
+	phone, charger := IDs[0], IDs[1]
+	c, _ := newRequest(http.MethodPost, "/", `{"delta":4,"reason":"restock"}`, adminClaims, "id", phone.Hex())
+	assert.Nil(t, ih.AdjustStock(c))
+	c, _ = newRequest(http.MethodPost, "/", `{"delta":3,"reason":"restock"}`, adminClaims, "id", charger.Hex())
+	assert.Nil(t, ih.AdjustStock(c))
+
+	body := fmt.Sprintf(`[{"product_name":"pixel kit","currency":"USD","vendor":"google","type":"bundle","bundle":{"pricing":"derived","discount_percent":10,"components":[{"product_id":%q,"quantity":1},{"product_id":%q,"quantity":2}]}}]`, phone.Hex(), charger.Hex())
+	IDs, err = create(body)
+	if !assert.Nil(t, err) || !assert.Len(t, IDs, 1) {
+		return
+	}
+	kit := IDs[0].Hex()
+
+	t.Run("derived price and availability", func(t *testing.T) {
+		var product Product
+		c, res := newRequest(http.MethodGet, "/products/"+kit, "", adminClaims, "id", kit)
+		assert.Nil(t, h.GetProduct(c))
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &product))
+		assert.Equal(t, 495, product.Price)
+		assert.Equal(t, 1, *product.Bundle.Available)
+		assert.Equal(t, "charger", product.Bundle.Components[1].Product.Name)
+	})
+
+	t.Run("component price changes reprice the bundle", func(t *testing.T) {
+		c, _ := newRequest(http.MethodPut, "/", `{"price":400}`, adminClaims, "id", phone.Hex())
+		assert.Nil(t, h.UpdateProduct(c))
+		product, err := findProduct(c.Request().Context(), kit, col)
+		assert.Nil(t, err)
+		assert.Equal(t, 405, product.Price)
+	})
+
+	t.Run("derived prices are capped", func(t *testing.T) {
+		_, err := create(fmt.Sprintf(`[{"product_name":"pixel pack","currency":"USD","vendor":"google","type":"bundle","bundle":{"pricing":"derived","components":[{"product_id":%q,"quantity":6}]}}]`, phone.Hex()))
+		assertHTTPError(t, err, http.StatusBadRequest, "6 phones cost more than a product may")
+	})
+
+	t.Run("bundles cannot nest", func(t *testing.T) {
+		_, err := create(fmt.Sprintf(`[{"product_name":"mega kit","price":900,"currency":"USD","vendor":"google","type":"bundle","bundle":{"pricing":"fixed","components":[{"product_id":%q,"quantity":1}]}}]`, kit))
+		assertHTTPError(t, err, http.StatusBadRequest)
+	})
+
+	t.Run("components cannot be deleted", func(t *testing.T) {
+		c, _ := newRequest(http.MethodDelete, "/", "", adminClaims, "id", charger.Hex())
+		err := h.DeleteProduct(c)
+		assertHTTPError(t, err, http.StatusConflict)
+	})
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+//bufferedWriter holds a response back so its ETag can be computed from the body
+type bufferedWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *bufferedWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+//Conditional makes a GET route cacheable. Successful responses get a strong
+//ETag computed from their body and the Cache-Control header; requests whose
+//If-None-Match or If-Modified-Since still hold get 304 Not Modified. The
+//Last-Modified header is up to the handler, see setLastModified. Responses to
+//authenticated requests may differ per user, so they are only cached privately,
+//and they vary with the language asked for.
+func Conditional(cacheControl string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req, res := c.Request(), c.Response()
+			if req.Method != http.MethodGet {
+				return next(c)
+			}
+			original := res.Writer
+			buffered := &bufferedWriter{ResponseWriter: original, status: http.StatusOK}
+			res.Writer = buffered
+			err := next(c)
+			res.Writer = original
+			if !res.Committed {
+				return err
+			}
+			res.Committed, res.Size = false, 0
+			if err != nil || buffered.status != http.StatusOK {
+				res.WriteHeader(buffered.status)
+				if _, werr := res.Write(buffered.body.Bytes()); err == nil {
+					err = werr
+				}
+				return err
+			}
+			sum := sha256.Sum256(buffered.body.Bytes())
+			etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+			res.Header().Add(echo.HeaderVary, "x-auth-token")
+			res.Header().Add(echo.HeaderVary, "Accept-Language")
+			if req.Header.Get("x-auth-token") != "" {
+				res.Header().Set("Cache-Control", privateCache(cacheControl))
+			} else if cacheControl != "" {
+				res.Header().Set("Cache-Control", cacheControl)
+			}
+			res.Header().Set("ETag", etag)
+			if notModified(req, etag, res.Header().Get(echo.HeaderLastModified)) {
+				res.Header().Del(echo.HeaderContentType)
+				return c.NoContent(http.StatusNotModified)
+			}
+			res.WriteHeader(http.StatusOK)
+			_, err = res.Write(buffered.body.Bytes())
+			return err
+		}
+	}
+}
+
+//privateCache keeps a response to an authenticated request out of shared caches
+func privateCache(cacheControl string) string {
+	if cacheControl == "" {
+		return "private"
+	}
+	if strings.Contains(cacheControl, "public") {
+		return strings.Replace(cacheControl, "public", "private", 1)
+	}
+	if strings.Contains(cacheControl, "private") || strings.Contains(cacheControl, "no-store") {
+		return cacheControl
+	}
+	return "private, " + cacheControl
+}
+
+//notModified evaluates the conditions of a GET as RFC 7232 does:
+//If-Modified-Since is only looked at without If-None-Match
+func notModified(req *http.Request, etag, lastModified string) bool {
+	if match := req.Header.Get("If-None-Match"); match != "" {
+		for _, tag := range strings.Split(match, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(req.Header.Get(echo.HeaderIfModifiedSince))
+	if err != nil || lastModified == "" {
+		return false
+	}
+	modified, err := http.ParseTime(lastModified)
+	return err == nil && !modified.After(since)
+}
+
+//setLastModified sets the Last-Modified header of a product response from the
+//time it was last written, or created for products never updated since.
+//Responses showing more than the stored product, such as prices worked out
+//from promotions or rates, change without it being written: they get none
+//and rely on their ETag.
+func setLastModified(c echo.Context, product Product) {
+	if product.Pricing != nil || product.DisplayPrice != nil || product.Expanded != nil || product.Bundle != nil {
+		return
+	}
+	last := product.UpdatedAt
+	if last == nil {
+		last = product.CreatedAt
+	}
+	if last != nil {
+		c.Response().Header().Set(echo.HeaderLastModified, last.UTC().Format(http.TimeFormat))
+	}
+}
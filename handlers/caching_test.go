@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestConditional(t *testing.T) {
+	modified := time.Date(2020, 6, 1, 10, 0, 0, 0, time.UTC)
+	e := echo.New()
+	e.GET("/products/:id", func(c echo.Context) error {
+		if c.Param("id") == "missing" {
+			return echo.NewHTTPError(http.StatusNotFound, "Product does not exist")
+		}
+		setLastModified(c, Product{Name: "phone", CreatedAt: &modified})
+		return c.JSON(http.StatusOK, Product{Name: "phone"})
+	}, Conditional("public, max-age=60"))
+
+	get := func(path string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		res := httptest.NewRecorder()
+		e.ServeHTTP(res, req)
+		return res
+	}
+
+	res := get("/products/1", nil)
+	assert.Equal(t, http.StatusOK, res.Code)
+	etag := res.Header().Get("ETag")
+	assert.Regexp(t, `^"[0-9a-f]{32}"$`, etag)
+	assert.Equal(t, "public, max-age=60", res.Header().Get("Cache-Control"))
+	assert.Equal(t, "Mon, 01 Jun 2020 10:00:00 GMT", res.Header().Get(echo.HeaderLastModified))
+	assert.Equal(t, []string{"x-auth-token", "Accept-Language"}, res.Header()[echo.HeaderVary])
+	assert.Contains(t, res.Body.String(), `"product_name":"phone"`)
+	assert.Equal(t, etag, get("/products/2", nil).Header().Get("ETag"), "the ETag only depends on the body")
+
+	testCases := []struct {
+		name    string
+		headers map[string]string
+		code    int
+	}{
+		{"matching etag", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"one of the etags", map[string]string{"If-None-Match": `"other", W/` + etag}, http.StatusNotModified},
+		{"other etag", map[string]string{"If-None-Match": `"other"`}, http.StatusOK},
+		{"not modified since", map[string]string{echo.HeaderIfModifiedSince: "Mon, 01 Jun 2020 10:00:00 GMT"}, http.StatusNotModified},
+		{"modified since", map[string]string{echo.HeaderIfModifiedSince: "Mon, 01 Jun 2020 09:59:59 GMT"}, http.StatusOK},
+		{"etag wins over date", map[string]string{"If-None-Match": `"other"`, echo.HeaderIfModifiedSince: "Mon, 01 Jun 2020 10:00:00 GMT"}, http.StatusOK},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res := get("/products/1", tc.headers)
+			assert.Equal(t, tc.code, res.Code)
+			assert.Equal(t, etag, res.Header().Get("ETag"))
+			if tc.code == http.StatusNotModified {
+				assert.Empty(t, res.Body.String())
+			}
+		})
+	}
+
+	res = get("/products/1", map[string]string{"x-auth-token": "Bearer token"})
+	assert.Equal(t, "private, max-age=60", res.Header().Get("Cache-Control"))
+
+	res = get("/products/missing", map[string]string{"If-None-Match": "*"})
+	assert.Equal(t, http.StatusNotFound, res.Code)
+	assert.Empty(t, res.Header().Get("ETag"))
+}
+
+func TestSetLastModified(t *testing.T) {
+	modified := time.Date(2020, 6, 1, 10, 0, 0, 0, time.UTC)
+	lastModified := func(product Product) string {
+		res := httptest.NewRecorder()
+		setLastModified(echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), res), product)
+		return res.Header().Get(echo.HeaderLastModified)
+	}
+	stored := Product{Name: "phone", CreatedAt: &modified}
+	assert.Equal(t, "Mon, 01 Jun 2020 10:00:00 GMT", lastModified(stored))
+
+	promoted, converted, bundle := stored, stored, stored
+	promoted.Pricing = &Pricing{}
+	converted.DisplayPrice = &Money{Amount: 100, Currency: "EUR"}
+	bundle.Bundle = &Bundle{}
+	for _, p := range []Product{promoted, converted, bundle} {
+		assert.Empty(t, lastModified(p), "promotions, rates and other products change on their own")
+	}
+}
+
+func TestPrivateCache(t *testing.T) {
+	assert.Equal(t, "private, max-age=60", privateCache("public, max-age=60"))
+	assert.Equal(t, "private, max-age=60", privateCache("max-age=60"))
+	assert.Equal(t, "no-store", privateCache("no-store"))
+	assert.Equal(t, "private", privateCache(""))
+}
+
+func TestTouch(t *testing.T) {
+	update := touch(bson.M{"$pull": bson.M{"media": "a"}})
+	assert.IsType(t, time.Time{}, update["$set"].(bson.M)["updated_at"])
+	update = touch(bson.M{"$set": bson.M{"vendor": "v"}})
+	assert.Equal(t, "v", update["$set"].(bson.M)["vendor"])
+	assert.Contains(t, update["$set"], "updated_at")
+}
@@ -0,0 +1,420 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/inerts73/tronicscorp/dbiface"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//HeaderCartToken carries the token of a guest cart
+const HeaderCartToken = "X-Cart-Token"
+
+const (
+	maxCartItems    = 100
+	maxItemQuantity = 99
+)
+
+//The issues which keep a cart line out of the total
+const (
+	IssueDeleted           = "deleted"
+	IssueUnavailable       = "unavailable"
+	IssueInsufficientStock = "insufficient_stock"
+	//IssueUnpriced products have no price in the currency of the cart
+	IssueUnpriced = "unpriced"
+)
+
+//Cart is the cart of a user, or of a guest holding its token
+type Cart struct {
+	ID        primitive.ObjectID `json:"_id" bson:"_id"`
+	UserID    string             `json:"user_id,omitempty" bson:"user_id,omitempty"`
+	Token     string             `json:"token,omitempty" bson:"token,omitempty"`
+	Items     []CartItem         `json:"items" bson:"items"`
+	UpdatedAt time.Time          `json:"updated_at" bson:"updated_at"`
+}
+
+//CartItem is a product in a cart
+type CartItem struct {
+	ProductID primitive.ObjectID `json:"product_id" bson:"product_id" validate:"required"`
+	Quantity  int                `json:"quantity" bson:"quantity" validate:"required,min=1,max=99"`
+	AddedAt   time.Time          `json:"added_at" bson:"added_at"`
+}
+
+//CartLine is a cart item priced against the current product
+type CartLine struct {
+	CartItem
+	Name      string `json:"product_name,omitempty"`
+	UnitPrice *Money `json:"unit_price,omitempty"`
+	LineTotal *Money `json:"line_total,omitempty"`
+	Issue     string `json:"issue,omitempty"`
+}
+
+//CartView is a cart as the customer sees it. Lines with an issue are not in the total.
+type CartView struct {
+	Token     string     `json:"token,omitempty"`
+	Lines     []CartLine `json:"lines"`
+	Total     Money      `json:"total"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+//CartsHandler a carts handler
+type CartsHandler struct {
+	Col      dbiface.CollectionAPI
+	ProdCol  dbiface.CollectionAPI
+	InvCol   dbiface.CollectionAPI
+	Rates    *RateTable
+	PromoCol dbiface.CollectionAPI
+	Promos   *PromotionEngine
+	//Currency is the currency of carts unless a request asks for another
+	Currency string
+}
+
+func newCartToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+//cartOwner is the filter of the cart of the request: the cart of the
+//authenticated user, or else the guest cart of the X-Cart-Token header
+func cartOwner(c echo.Context) bson.M {
+	if userID := userIDFromContext(c); userID != "" {
+		return bson.M{"user_id": userID}
+	}
+	if token := c.Request().Header.Get(HeaderCartToken); token != "" {
+		return bson.M{"token": token}
+	}
+	return nil
+}
+
+func findCart(ctx context.Context, owner bson.M, collection dbiface.CollectionAPI) (Cart, error) {
+	cart := Cart{Items: []CartItem{}}
+	res := collection.FindOne(ctx, owner)
+	if err := res.Decode(&cart); err != nil && err != mongo.ErrNoDocuments {
+		log.Errorf("Unable to decode the cart : %v", err)
+		return cart, err
+	}
+	return cart, nil
+}
+
+//addItem adds quantity of a product to a cart, creating the cart when needed
+func addItem(ctx context.Context, owner bson.M, item CartItem, collection dbiface.CollectionAPI) error {
+	cart, err := findCart(ctx, owner, collection)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, existing := range cart.Items {
+		if existing.ProductID != item.ProductID {
+			continue
+		}
+		quantity := existing.Quantity + item.Quantity
+		if quantity > maxItemQuantity {
+			quantity = maxItemQuantity
+		}
+		return setQuantity(ctx, owner, item.ProductID, quantity, collection)
+	}
+	if len(cart.Items) >= maxCartItems {
+		return echo.NewHTTPError(http.StatusConflict, "The cart is full")
+	}
+	item.AddedAt = now
+	update := bson.M{
+		"$push":        bson.M{"items": item},
+		"$set":         bson.M{"updated_at": now},
+		"$setOnInsert": bson.M{"_id": primitive.NewObjectID()},
+	}
+	_, err = collection.UpdateOne(ctx, owner, update, options.Update().SetUpsert(true))
+	return err
+}
+
+//setQuantity changes the quantity of a product already in a cart
+func setQuantity(ctx context.Context, owner bson.M, productID primitive.ObjectID, quantity int, collection dbiface.CollectionAPI) error {
+	filter := bson.M{"items.product_id": productID}
+	for k, v := range owner {
+		filter[k] = v
+	}
+	update := bson.M{"$set": bson.M{"items.$.quantity": quantity, "updated_at": time.Now().UTC()}}
+	res, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "Product is not in the cart")
+	}
+	return nil
+}
+
+//priceCart prices the items of a cart against the current products in currency
+func (h *CartsHandler) priceCart(ctx context.Context, cart Cart, currency string) (CartView, error) {
+	currency = strings.ToUpper(currency)
+	view := CartView{Token: cart.Token, Lines: []CartLine{}, Total: Money{Currency: currency}, UpdatedAt: cart.UpdatedAt}
+	IDs := make([]primitive.ObjectID, len(cart.Items))
+	for i, item := range cart.Items {
+		IDs[i] = item.ProductID
+	}
+	products, err := productsByID(ctx, IDs, bson.M{}, h.ProdCol)
+	if err != nil {
+		return view, echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the products")
+	}
+	//a product without a price in currency only flags its own line
+	priced := make([]Product, 0, len(products))
+	for _, p := range products {
+		price, err := p.PriceIn(currency, h.Rates)
+		if err != nil {
+			log.Warnf("Unable to price the product %s in %s : %v", p.ID.Hex(), currency, err)
+			continue
+		}
+		p.DisplayPrice = &price
+		priced = append(priced, p)
+	}
+	if len(priced) > 0 && h.PromoCol != nil && h.Promos != nil {
+		if err := h.Promos.setPricing(ctx, priced, h.PromoCol); err != nil {
+			return view, err
+		}
+	}
+	byID := map[primitive.ObjectID]Product{}
+	for _, p := range products {
+		byID[p.ID] = p
+	}
+	for _, p := range priced {
+		byID[p.ID] = p
+	}
+	stock, err := h.availableStock(ctx, products)
+	if err != nil {
+		return view, echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the stock")
+	}
+	for _, item := range cart.Items {
+		product, ok := byID[item.ProductID]
+		line := cartLine(item, product, ok, stock)
+		if line.Issue == "" {
+			view.Total.Amount += line.LineTotal.Amount
+		}
+		view.Lines = append(view.Lines, line)
+	}
+	return view, nil
+}
+
+//cartLine prices an item against its product, found tells if the product
+//still exists. stock is nil when stock is not tracked.
+func cartLine(item CartItem, product Product, found bool, stock map[primitive.ObjectID]int) CartLine {
+	line := CartLine{CartItem: item}
+	switch {
+	case !found:
+		line.Issue = IssueDeleted
+	case product.status() != StatusPublished:
+		line.Issue = IssueUnavailable
+	case product.DisplayPrice == nil:
+		line.Issue = IssueUnpriced
+	case stock != nil && stock[product.ID] < item.Quantity:
+		line.Issue = IssueInsufficientStock
+	}
+	if !found {
+		return line
+	}
+	line.Name = product.Name
+	if product.DisplayPrice == nil {
+		return line
+	}
+	unitPrice := *product.DisplayPrice
+	if product.Pricing != nil {
+		unitPrice = product.Pricing.FinalPrice
+	}
+	lineTotal := Money{Amount: unitPrice.Amount * int64(item.Quantity), Currency: unitPrice.Currency}
+	line.UnitPrice, line.LineTotal = &unitPrice, &lineTotal
+	return line
+}
+
+//availableStock returns the available stock of products, bundles included,
+//or nil when stock is not tracked
+func (h *CartsHandler) availableStock(ctx context.Context, products []Product) (map[primitive.ObjectID]int, error) {
+	if h.InvCol == nil {
+		return nil, nil
+	}
+	var IDs []primitive.ObjectID
+	for _, p := range products {
+		IDs = append(IDs, p.ID)
+		if p.isBundle() {
+			IDs = append(IDs, p.Bundle.componentIDs()...)
+		}
+	}
+	stock, err := availableStock(ctx, IDs, h.InvCol)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range products {
+		if p.isBundle() {
+			stock[p.ID] = p.Bundle.available(stock)
+		}
+	}
+	return stock, nil
+}
+
+func (h *CartsHandler) currency(c echo.Context) string {
+	if currency := c.QueryParam("currency"); currency != "" {
+		return strings.ToUpper(currency)
+	}
+	return h.Currency
+}
+
+func (h *CartsHandler) respond(c echo.Context, status int, owner bson.M) error {
+	ctx := storageContext(c)
+	cart := Cart{Items: []CartItem{}}
+	if owner != nil {
+		var err error
+		if cart, err = findCart(ctx, owner, h.Col); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the cart")
+		}
+	}
+	view, err := h.priceCart(ctx, cart, h.currency(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(status, view)
+}
+
+func cartProductID(c echo.Context) (primitive.ObjectID, error) {
+	docID, err := primitive.ObjectIDFromHex(c.Param("pid"))
+	if err != nil {
+		return docID, echo.NewHTTPError(http.StatusBadRequest, "Invalid product id")
+	}
+	return docID, nil
+}
+
+//GetCart gets the cart of the user, or the guest cart of the X-Cart-Token header
+func (h *CartsHandler) GetCart(c echo.Context) error {
+	return h.respond(c, http.StatusOK, cartOwner(c))
+}
+
+//AddCartItem adds a product to the cart. Guests without a cart get one, its
+//token is returned in the X-Cart-Token header.
+func (h *CartsHandler) AddCartItem(c echo.Context) error {
+	ctx := storageContext(c)
+	var item CartItem
+	if err := c.Bind(&item); err != nil {
+		log.Errorf("Unable to bind to cart item : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	if err := v.Struct(item); err != nil {
+		log.Errorf("Unable to validate the cart item %+v %v", item, err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload.")
+	}
+	product, err := productByID(ctx, item.ProductID.Hex(), h.ProdCol)
+	if err != nil {
+		return err
+	}
+	if product.status() != StatusPublished {
+		return echo.NewHTTPError(http.StatusNotFound, "Product does not exist")
+	}
+	owner := cartOwner(c)
+	if owner == nil {
+		token, err := newCartToken()
+		if err != nil {
+			log.Errorf("Unable to create a cart token : %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Unable to create the cart")
+		}
+		owner = bson.M{"token": token}
+		c.Response().Header().Set(HeaderCartToken, token)
+	}
+	if err := addItem(ctx, owner, item, h.Col); err != nil {
+		if _, ok := err.(*echo.HTTPError); ok {
+			return err
+		}
+		log.Errorf("Unable to add to the cart : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to add to the cart")
+	}
+	return h.respond(c, http.StatusOK, owner)
+}
+
+//quantityUpdate changes the quantity of a cart item
+type quantityUpdate struct {
+	Quantity int `json:"quantity" validate:"required,min=1,max=99"`
+}
+
+//UpdateCartItem changes the quantity of a product in the cart
+func (h *CartsHandler) UpdateCartItem(c echo.Context) error {
+	var req quantityUpdate
+	productID, err := cartProductID(c)
+	if err != nil {
+		return err
+	}
+	owner := cartOwner(c)
+	if owner == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Product is not in the cart")
+	}
+	if err := c.Bind(&req); err != nil {
+		log.Errorf("Unable to bind to cart item : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	if err := v.Struct(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload.")
+	}
+	if err := setQuantity(storageContext(c), owner, productID, req.Quantity, h.Col); err != nil {
+		if _, ok := err.(*echo.HTTPError); ok {
+			return err
+		}
+		log.Errorf("Unable to update the cart : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to update the cart")
+	}
+	return h.respond(c, http.StatusOK, owner)
+}
+
+//RemoveCartItem removes a product from the cart
+func (h *CartsHandler) RemoveCartItem(c echo.Context) error {
+	productID, err := cartProductID(c)
+	if err != nil {
+		return err
+	}
+	owner := cartOwner(c)
+	if owner == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Product is not in the cart")
+	}
+	update := bson.M{
+		"$pull": bson.M{"items": bson.M{"product_id": productID}},
+		"$set":  bson.M{"updated_at": time.Now().UTC()},
+	}
+	if _, err := h.Col.UpdateOne(storageContext(c), owner, update); err != nil {
+		log.Errorf("Unable to update the cart : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to update the cart")
+	}
+	return h.respond(c, http.StatusOK, owner)
+}
+
+//MergeCart moves the guest cart of the X-Cart-Token header into the cart of
+//the authenticated user, e.g. right after login
+func (h *CartsHandler) MergeCart(c echo.Context) error {
+	ctx := storageContext(c)
+	token := c.Request().Header.Get(HeaderCartToken)
+	if token == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Missing "+HeaderCartToken)
+	}
+	owner := bson.M{"user_id": userIDFromContext(c)}
+	guest, err := findCart(ctx, bson.M{"token": token}, h.Col)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the cart")
+	}
+	for _, item := range guest.Items {
+		if err := addItem(ctx, owner, item, h.Col); err != nil {
+			if _, ok := err.(*echo.HTTPError); ok {
+				return err
+			}
+			log.Errorf("Unable to merge the cart : %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Unable to merge the cart")
+		}
+	}
+	if _, err := h.Col.DeleteOne(ctx, bson.M{"token": token}); err != nil {
+		log.Errorf("Unable to delete the guest cart : %v", err)
+	}
+	return h.respond(c, http.StatusOK, owner)
+}
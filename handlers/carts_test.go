@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCarts(t *testing.T) {
+	ph := ProductHandler{Col: col}
+	h := CartsHandler{Col: db.Collection("carts"), ProdCol: col, Currency: "USD"}
+
+	view := func(res *httptest.ResponseRecorder) CartView {
+		var cart CartView
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &cart))
+		return cart
+	}
+
+	var IDs []primitive.ObjectID
+	c, res := newRequest(http.MethodPost, "/products", `[{"product_name":"pixel","price":500,"currency":"USD","vendor":"google","status":"published"},{"product_name":"case","price":20,"currency":"USD","vendor":"google","status":"published"}]`, adminClaims)
+	assert.Nil(t, ph.CreateProducts(c))
+	if !assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &IDs)) || !assert.Len(t, IDs, 2) {
+		return
+	}
+	phone, cover := IDs[0].Hex(), IDs[1].Hex()
+
+	var token string
+	t.Run("guest cart", func(t *testing.T) {
+		c, res := newRequest(http.MethodPost, "/cart/items", fmt.Sprintf(`{"product_id":%q,"quantity":2}`, cover), nil)
+		assert.Nil(t, h.AddCartItem(c))
+		token = res.Header().Get(HeaderCartToken)
+		assert.NotEmpty(t, token)
+		assert.Equal(t, int64(4000), view(res).Total.Amount)
+	})
+
+	t.Run("user cart", func(t *testing.T) {
+		c, _ := newRequest(http.MethodPost, "/cart/items", fmt.Sprintf(`{"product_id":%q,"quantity":1}`, phone), userClaims("shopper@tronics.com"))
+		assert.Nil(t, h.AddCartItem(c))
+		c, _ = newRequest(http.MethodPost, "/cart/items", fmt.Sprintf(`{"product_id":%q,"quantity":1}`, cover), userClaims("shopper@tronics.com"))
+		assert.Nil(t, h.AddCartItem(c))
+
+		c, res := newRequest(http.MethodPut, "/cart/items/"+cover, `{"quantity":3}`, userClaims("shopper@tronics.com"), "pid", cover)
+		assert.Nil(t, h.UpdateCartItem(c))
+		cart := view(res)
+		assert.Len(t, cart.Lines, 2)
+		assert.Equal(t, int64(56000), cart.Total.Amount)
+	})
+
+	t.Run("merge on login", func(t *testing.T) {
+		c, res := newRequest(http.MethodPost, "/cart/merge", "", userClaims("shopper@tronics.com"))
+		c.Request().Header.Set(HeaderCartToken, token)
+		assert.Nil(t, h.MergeCart(c))
+		cart := view(res)
+		assert.Equal(t, 5, cart.Lines[1].Quantity)
+
+		c, res = newRequest(http.MethodGet, "/cart", "", nil)
+		c.Request().Header.Set(HeaderCartToken, token)
+		assert.Nil(t, h.GetCart(c))
+		assert.Len(t, view(res).Lines, 0)
+	})
+
+	t.Run("deleted products are flagged", func(t *testing.T) {
+		c, _ := newRequest(http.MethodDelete, "/products/"+phone, "", adminClaims, "id", phone)
+		assert.Nil(t, ph.DeleteProduct(c))
+
+		c, res := newRequest(http.MethodGet, "/cart", "", userClaims("shopper@tronics.com"))
+		assert.Nil(t, h.GetCart(c))
+		cart := view(res)
+		assert.Equal(t, IssueDeleted, cart.Lines[0].Issue)
+		assert.Equal(t, int64(10000), cart.Total.Amount)
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		c, res := newRequest(http.MethodDelete, "/cart/items/"+cover, "", userClaims("shopper@tronics.com"), "pid", cover)
+		assert.Nil(t, h.RemoveCartItem(c))
+		assert.Len(t, view(res).Lines, 1)
+	})
+}
+
+func TestCartLine(t *testing.T) {
+	price := Money{Amount: 50000, Currency: "USD"}
+	phone := Product{ID: primitive.NewObjectID(), Name: "pixel", Status: StatusPublished, DisplayPrice: &price}
+	unpriced := Product{ID: primitive.NewObjectID(), Name: "jiophone", Status: StatusPublished}
+	item := func(p Product) CartItem {
+		return CartItem{ProductID: p.ID, Quantity: 2}
+	}
+
+	line := cartLine(item(phone), phone, true, nil)
+	assert.Empty(t, line.Issue)
+	assert.Equal(t, Money{Amount: 100000, Currency: "USD"}, *line.LineTotal)
+
+	line = cartLine(item(unpriced), unpriced, true, nil)
+	assert.Equal(t, IssueUnpriced, line.Issue, "a product without a price in the currency of the cart")
+	assert.Equal(t, "jiophone", line.Name)
+	assert.Nil(t, line.LineTotal)
+
+	assert.Equal(t, IssueDeleted, cartLine(item(phone), Product{}, false, nil).Issue)
+	assert.Equal(t, IssueInsufficientStock, cartLine(item(phone), phone, true, map[primitive.ObjectID]int{phone.ID: 1}).Issue)
+}
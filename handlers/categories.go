@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/inerts73/tronicscorp/dbiface"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//Category is a node of the product taxonomy, e.g. Phones > Smartphones > Android
+type Category struct {
+	ID       primitive.ObjectID  `json:"_id,omitempty" bson:"_id,omitempty"`
+	Name     string              `json:"name" bson:"name" validate:"required,max=50"`
+	ParentID *primitive.ObjectID `json:"parent_id,omitempty" bson:"parent_id,omitempty"`
+	// Ancestors lists the ids from the root down to the parent
+	Ancestors []primitive.ObjectID `json:"ancestors" bson:"ancestors"`
+	// Attributes are the attributes of the products in the category and its subtree
+	Attributes []AttributeDef `json:"attributes,omitempty" bson:"attributes,omitempty" validate:"unique=Key,dive"`
+}
+
+//CategoriesHandler a categories handler
+type CategoriesHandler struct {
+	Col     dbiface.CollectionAPI
+	ProdCol dbiface.CollectionAPI
+}
+
+func findCategory(ctx context.Context, id primitive.ObjectID, collection dbiface.CollectionAPI) (Category, error) {
+	var category Category
+	res := collection.FindOne(ctx, bson.M{"_id": id})
+	if err := res.Decode(&category); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return category, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("Category %s does not exist", id.Hex()))
+		}
+		log.Errorf("Unable to decode the category : %v", err)
+		return category, err
+	}
+	return category, nil
+}
+
+func categoryID(id string) (primitive.ObjectID, error) {
+	docID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return docID, echo.NewHTTPError(http.StatusBadRequest, "Invalid category id")
+	}
+	return docID, nil
+}
+
+//subtreeIDs returns the id of a category and the ids of all of its descendants
+func subtreeIDs(ctx context.Context, id primitive.ObjectID, collection dbiface.CollectionAPI) ([]primitive.ObjectID, error) {
+	var descendants []Category
+	cursor, err := collection.Find(ctx, bson.M{"ancestors": id}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		log.Errorf("Unable to find the descendants : %v", err)
+		return nil, err
+	}
+	if err := cursor.All(ctx, &descendants); err != nil {
+		log.Errorf("Unable to read the cursor : %v", err)
+		return nil, err
+	}
+	IDs := []primitive.ObjectID{id}
+	for _, d := range descendants {
+		IDs = append(IDs, d.ID)
+	}
+	return IDs, nil
+}
+
+//checkCategories makes sure that every category of a product exists
+func checkCategories(ctx context.Context, IDs []primitive.ObjectID, collection dbiface.CollectionAPI) error {
+	for _, ID := range IDs {
+		if _, err := findCategory(ctx, ID, collection); err != nil {
+			if he, ok := err.(*echo.HTTPError); ok {
+				return echo.NewHTTPError(http.StatusBadRequest, he.Message)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+//withParent sets the parent and the ancestors of a category
+func withParent(ctx context.Context, category Category, collection dbiface.CollectionAPI) (Category, error) {
+	category.Ancestors = []primitive.ObjectID{}
+	if category.ParentID == nil {
+		return category, nil
+	}
+	parent, err := findCategory(ctx, *category.ParentID, collection)
+	if err != nil {
+		return category, err
+	}
+	if parent.ID == category.ID {
+		return category, echo.NewHTTPError(http.StatusBadRequest, "A category cannot be its own parent")
+	}
+	for _, ancestor := range parent.Ancestors {
+		if ancestor == category.ID {
+			return category, echo.NewHTTPError(http.StatusBadRequest, "A category cannot be moved below its descendants")
+		}
+	}
+	category.Ancestors = append(parent.Ancestors, parent.ID)
+	return category, nil
+}
+
+//GetCategories lists the categories, the children of a category with parent=<id>
+func (h *CategoriesHandler) GetCategories(c echo.Context) error {
+	var categories []Category
+	filter := bson.M{}
+	if parent := c.QueryParam("parent"); parent != "" {
+		parentID, err := categoryID(parent)
+		if err != nil {
+			return err
+		}
+		filter["parent_id"] = parentID
+	}
+	cursor, err := h.Col.Find(storageContext(c), filter, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		log.Errorf("Unable to find the categories : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the categories")
+	}
+	if err := cursor.All(storageContext(c), &categories); err != nil {
+		log.Errorf("Unable to read the cursor : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the categories")
+	}
+	return c.JSON(http.StatusOK, categories)
+}
+
+//GetCategory gets a single category
+func (h *CategoriesHandler) GetCategory(c echo.Context) error {
+	docID, err := categoryID(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	category, err := findCategory(storageContext(c), docID, h.Col)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, category)
+}
+
+//CreateCategory creates a category
+func (h *CategoriesHandler) CreateCategory(c echo.Context) error {
+	var category Category
+	if err := c.Bind(&category); err != nil {
+		log.Errorf("Unable to bind to category : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	if err := v.Struct(category); err != nil {
+		log.Errorf("Unable to validate the category %+v %v", category, err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload.")
+	}
+	category.ID = primitive.NewObjectID()
+	category, err := withParent(storageContext(c), category, h.Col)
+	if err != nil {
+		return err
+	}
+	if _, err := h.Col.InsertOne(storageContext(c), category); err != nil {
+		log.Errorf("Unable to insert the category : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to create the category")
+	}
+	return c.JSON(http.StatusCreated, category)
+}
+
+//categoryRename renames a category
+type categoryRename struct {
+	Name string `json:"name" validate:"required,max=50"`
+}
+
+//UpdateCategory renames a category
+func (h *CategoriesHandler) UpdateCategory(c echo.Context) error {
+	var req categoryRename
+	docID, err := categoryID(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	category, err := findCategory(storageContext(c), docID, h.Col)
+	if err != nil {
+		return err
+	}
+	if err := c.Bind(&req); err != nil {
+		log.Errorf("Unable to bind to category : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	if err := v.Struct(req); err != nil {
+		log.Errorf("Unable to validate the category %+v %v", req, err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload.")
+	}
+	category.Name = req.Name
+	if _, err := h.Col.UpdateOne(storageContext(c), bson.M{"_id": docID}, bson.M{"$set": bson.M{"name": req.Name}}); err != nil {
+		log.Errorf("Unable to update the category : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to update the category")
+	}
+	return c.JSON(http.StatusOK, category)
+}
+
+//categoryMove moves a category under a parent, or to the root with a null parent_id
+type categoryMove struct {
+	ParentID *primitive.ObjectID `json:"parent_id"`
+}
+
+//MoveCategory moves a category and its subtree below another parent, or to the root
+func (h *CategoriesHandler) MoveCategory(c echo.Context) error {
+	var req categoryMove
+	ctx := storageContext(c)
+	docID, err := categoryID(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	category, err := findCategory(ctx, docID, h.Col)
+	if err != nil {
+		return err
+	}
+	if err := c.Bind(&req); err != nil {
+		log.Errorf("Unable to bind to category move : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	oldPath := append(category.Ancestors, category.ID)
+	category.ParentID = req.ParentID
+	category, err = withParent(ctx, category, h.Col)
+	if err != nil {
+		return err
+	}
+	update := bson.M{"$set": bson.M{"parent_id": category.ParentID, "ancestors": category.Ancestors}}
+	if _, err := h.Col.UpdateOne(ctx, bson.M{"_id": docID}, update); err != nil {
+		log.Errorf("Unable to move the category : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to move the category")
+	}
+
+	// rewrite the path of every descendant, keeping the part below the category
+	var descendants []Category
+	cursor, err := h.Col.Find(ctx, bson.M{"ancestors": docID})
+	if err != nil {
+		log.Errorf("Unable to find the descendants : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to move the descendants")
+	}
+	if err := cursor.All(ctx, &descendants); err != nil {
+		log.Errorf("Unable to read the cursor : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to move the descendants")
+	}
+	newPath := append(category.Ancestors, category.ID)
+	for _, d := range descendants {
+		ancestors := append(append([]primitive.ObjectID{}, newPath...), d.Ancestors[len(oldPath):]...)
+		if _, err := h.Col.UpdateOne(ctx, bson.M{"_id": d.ID}, bson.M{"$set": bson.M{"ancestors": ancestors}}); err != nil {
+			log.Errorf("Unable to move the descendant %s : %v", d.ID.Hex(), err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Unable to move the descendants")
+		}
+	}
+	return c.JSON(http.StatusOK, category)
+}
+
+//DeleteCategory deletes a category. A category with products is only deleted
+//when reassign_to names the category the products move to.
+func (h *CategoriesHandler) DeleteCategory(c echo.Context) error {
+	ctx := storageContext(c)
+	docID, err := categoryID(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	if _, err := findCategory(ctx, docID, h.Col); err != nil {
+		return err
+	}
+	children, err := h.Col.CountDocuments(ctx, bson.M{"parent_id": docID})
+	if err != nil {
+		log.Errorf("Unable to count the children : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to delete the category")
+	}
+	if children > 0 {
+		return echo.NewHTTPError(http.StatusConflict, "Category has subcategories, move or delete them first")
+	}
+	products, err := h.ProdCol.CountDocuments(ctx, bson.M{"categories": docID})
+	if err != nil {
+		log.Errorf("Unable to count the products : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to delete the category")
+	}
+	if products > 0 {
+		reassign := c.QueryParam("reassign_to")
+		if reassign == "" {
+			return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("Category has %d products, reassign them with reassign_to", products))
+		}
+		targetID, err := categoryID(reassign)
+		if err != nil {
+			return err
+		}
+		if targetID == docID {
+			return echo.NewHTTPError(http.StatusBadRequest, "Products cannot be reassigned to the deleted category")
+		}
+		if err := checkCategories(ctx, []primitive.ObjectID{targetID}, h.Col); err != nil {
+			return err
+		}
+		filter := bson.M{"categories": docID}
+		if _, err := h.ProdCol.UpdateMany(ctx, filter, touch(bson.M{"$addToSet": bson.M{"categories": targetID}})); err != nil {
+			log.Errorf("Unable to reassign the products : %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Unable to reassign the products")
+		}
+		if _, err := h.ProdCol.UpdateMany(ctx, filter, touch(bson.M{"$pull": bson.M{"categories": docID}})); err != nil {
+			log.Errorf("Unable to reassign the products : %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Unable to reassign the products")
+		}
+	}
+	res, err := h.Col.DeleteOne(ctx, bson.M{"_id": docID})
+	if err != nil {
+		log.Errorf("Unable to delete the category : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to delete the category")
+	}
+	return c.JSON(http.StatusOK, versioned(c, res.DeletedCount, Deleted{DeletedCount: res.DeletedCount}))
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCategories(t *testing.T) {
+	ctx := context.Background()
+	ch := CategoriesHandler{Col: db.Collection("categories"), ProdCol: col}
+	ph := ProductHandler{Col: col, CatCol: ch.Col}
+	IDs := map[string]primitive.ObjectID{}
+
+	create := func(name, parent string) {
+		body := fmt.Sprintf(`{"name":%q}`, name)
+		if parent != "" {
+			body = fmt.Sprintf(`{"name":%q,"parent_id":%q}`, name, IDs[parent].Hex())
+		}
+		var category Category
+		c, res := newRequest(http.MethodPost, "/categories", body, adminClaims)
+		assert.Nil(t, ch.CreateCategory(c))
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &category))
+		IDs[name] = category.ID
+	}
+
+	t.Run("create a tree", func(t *testing.T) {
+		create("Phones", "")
+		create("Smartphones", "Phones")
+		create("Android", "Smartphones")
+		create("Audio", "")
+		category, err := findCategory(ctx, IDs["Android"], ch.Col)
+		assert.Nil(t, err)
+		assert.Equal(t, []primitive.ObjectID{IDs["Phones"], IDs["Smartphones"]}, category.Ancestors)
+	})
+
+	t.Run("product with unknown category", func(t *testing.T) {
+		body := fmt.Sprintf(`[{"product_name":"pixel","price":500,"currency":"USD","vendor":"google","categories":[%q]}]`, primitive.NewObjectID().Hex())
+		c, _ := newRequest(http.MethodPost, "/products", body, adminClaims)
+		err := ph.CreateProducts(c)
+		assertHTTPError(t, err, http.StatusBadRequest)
+	})
+
+	t.Run("products of a subtree", func(t *testing.T) {
+		body := fmt.Sprintf(`[{"product_name":"pixel","price":500,"currency":"USD","vendor":"google","categories":[%q]}]`, IDs["Android"].Hex())
+		c, _ := newRequest(http.MethodPost, "/products", body, adminClaims)
+		assert.Nil(t, ph.CreateProducts(c))
+
+		var products []Product
+		c, res := newRequest(http.MethodGet, "/products?descendants=true&category="+IDs["Phones"].Hex(), "", adminClaims)
+		assert.Nil(t, ph.GetProducts(c))
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &products))
+		assert.Len(t, products, 1)
+
+		products = nil
+		c, res = newRequest(http.MethodGet, "/products?category="+IDs["Phones"].Hex(), "", adminClaims)
+		assert.Nil(t, ph.GetProducts(c))
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &products))
+		assert.Len(t, products, 0)
+	})
+
+	t.Run("move below a descendant", func(t *testing.T) {
+		body := fmt.Sprintf(`{"parent_id":%q}`, IDs["Android"].Hex())
+		c, _ := newRequest(http.MethodPost, "/", body, adminClaims, "id", IDs["Phones"].Hex())
+		err := ch.MoveCategory(c)
+		assertHTTPError(t, err, http.StatusBadRequest)
+	})
+
+	t.Run("move a subtree", func(t *testing.T) {
+		body := fmt.Sprintf(`{"parent_id":%q}`, IDs["Audio"].Hex())
+		c, _ := newRequest(http.MethodPost, "/", body, adminClaims, "id", IDs["Smartphones"].Hex())
+		assert.Nil(t, ch.MoveCategory(c))
+		category, err := findCategory(ctx, IDs["Android"], ch.Col)
+		if !assert.Nil(t, err) {
+			return
+		}
+		assert.Equal(t, []primitive.ObjectID{IDs["Audio"], IDs["Smartphones"]}, category.Ancestors)
+	})
+
+	t.Run("delete a category with products", func(t *testing.T) {
+		c, _ := newRequest(http.MethodDelete, "/", "", adminClaims, "id", IDs["Android"].Hex())
+		err := ch.DeleteCategory(c)
+		assertHTTPError(t, err, http.StatusConflict)
+
+		c, res := newRequest(http.MethodDelete, "/?reassign_to="+IDs["Phones"].Hex(), "", adminClaims, "id", IDs["Android"].Hex())
+		assert.Nil(t, ch.DeleteCategory(c))
+		assert.Equal(t, http.StatusOK, res.Code)
+		count, err := col.CountDocuments(ctx, map[string]interface{}{"categories": IDs["Phones"]})
+		assert.Nil(t, err)
+		assert.Equal(t, int64(1), count)
+	})
+}
@@ -0,0 +1,419 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/graph-gophers/graphql-go"
+	"github.com/inerts73/tronicscorp/dbiface"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/go-playground/validator.v9"
+)
+
+//GraphQLHandler serves the GraphQL API. It runs behind the optional jwt
+//middleware and applies the checks of the REST routes to each field.
+type GraphQLHandler struct {
+	Products  *ProductHandler
+	ReviewCol dbiface.CollectionAPI
+	UsersCol  dbiface.CollectionAPI
+
+	once   sync.Once
+	schema *graphql.Schema
+}
+
+//GraphQLRequest is the body of a GraphQL request
+type GraphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+type echoContextKey struct{}
+
+//graphqlError is an error shown to GraphQL clients, with the http status the
+//REST routes answer in its extensions
+type graphqlError struct {
+	code    int
+	message string
+}
+
+func (e graphqlError) Error() string {
+	return e.message
+}
+
+//Extensions adds the status code to the error in the response
+func (e graphqlError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": e.code}
+}
+
+//toGraphQLError turns the errors of the storage layer and of the checks into
+//errors for clients
+func toGraphQLError(err error) error {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case graphqlError:
+		return e
+	case *echo.HTTPError:
+		return graphqlError{e.Code, fmt.Sprint(e.Message)}
+	case validator.ValidationErrors:
+		return graphqlError{http.StatusBadRequest, "Unable to validate request payload."}
+	}
+	if err == mongo.ErrNoDocuments {
+		return graphqlError{http.StatusNotFound, "Product does not exist"}
+	}
+	log.Errorf("Unable to resolve the query : %v", err)
+	return graphqlError{http.StatusInternalServerError, "Internal server error"}
+}
+
+func echoContext(ctx context.Context) echo.Context {
+	c, _ := ctx.Value(echoContextKey{}).(echo.Context)
+	return c
+}
+
+func actorFromGraphQL(ctx context.Context) actor {
+	if c := echoContext(ctx); c != nil {
+		return actorFromContext(c)
+	}
+	return actor{}
+}
+
+//requireUser is the jwt middleware of the REST routes
+func requireUser(ctx context.Context) (actor, error) {
+	who := actorFromGraphQL(ctx)
+	if who.userID == "" {
+		return who, graphqlError{http.StatusUnauthorized, "Missing token"}
+	}
+	return who, nil
+}
+
+//requireVendor is the vendor middleware of the REST routes
+func requireVendor(ctx context.Context) (actor, error) {
+	who, err := requireUser(ctx)
+	if err != nil {
+		return who, err
+	}
+	if !who.admin && who.vendorID.IsZero() {
+		return who, graphqlError{http.StatusForbidden, "Only vendor users can change products"}
+	}
+	return who, nil
+}
+
+//requireAdmin is the admin middleware of the REST routes
+func requireAdmin(ctx context.Context) (actor, error) {
+	who, err := requireUser(ctx)
+	if err != nil {
+		return who, err
+	}
+	if !who.admin {
+		return who, graphqlError{http.StatusForbidden, "Not authorized"}
+	}
+	return who, nil
+}
+
+func graphqlObjectID(id graphql.ID) (primitive.ObjectID, error) {
+	docID, err := primitive.ObjectIDFromHex(string(id))
+	if err != nil {
+		return docID, graphqlError{http.StatusBadRequest, fmt.Sprintf("Invalid id %q", id)}
+	}
+	return docID, nil
+}
+
+//Serve executes a GraphQL request
+func (h *GraphQLHandler) Serve(c echo.Context) error {
+	var req GraphQLRequest
+	//resolvers run in parallel, the session of an atomic batch cannot be shared
+	if inAtomicBatch(c.Request().Context()) {
+		return echo.NewHTTPError(http.StatusBadRequest, "GraphQL requests cannot run in an atomic batch")
+	}
+	if err := c.Bind(&req); err != nil {
+		log.Errorf("Unable to bind to the graphql request : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	if req.Query == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "A query is required")
+	}
+	h.once.Do(func() {
+		h.schema = graphql.MustParseSchema(graphqlSchema, &graphqlRoot{h}, graphql.MaxDepth(10), graphql.MaxParallelism(10))
+	})
+	ctx := context.WithValue(c.Request().Context(), echoContextKey{}, c)
+	return c.JSON(http.StatusOK, h.schema.Exec(ctx, req.Query, req.OperationName, req.Variables))
+}
+
+//graphqlRoot resolves the queries and the mutations
+type graphqlRoot struct {
+	h *GraphQLHandler
+}
+
+type productFilterInput struct {
+	Vendor      *string
+	VendorID    *graphql.ID
+	Status      *string
+	Category    *graphql.ID
+	Descendants *bool
+	InStock     *bool
+	Attributes  *[]attributeFilterInput
+}
+
+type attributeFilterInput struct {
+	Key    string
+	Values *[]string
+	Min    *float64
+	Max    *float64
+}
+
+//values writes the filter as the query params of GET /products
+func (f *productFilterInput) values() url.Values {
+	q := url.Values{}
+	if f == nil {
+		return q
+	}
+	set := func(k string, v *string) {
+		if v != nil {
+			q.Set(k, *v)
+		}
+	}
+	setID := func(k string, v *graphql.ID) {
+		if v != nil {
+			q.Set(k, string(*v))
+		}
+	}
+	set("vendor", f.Vendor)
+	setID("vendor_id", f.VendorID)
+	set("status", f.Status)
+	setID("category", f.Category)
+	if f.Descendants != nil {
+		q.Set("descendants", strconv.FormatBool(*f.Descendants))
+	}
+	if f.InStock != nil {
+		q.Set("in_stock", strconv.FormatBool(*f.InStock))
+	}
+	if f.Attributes != nil {
+		for _, a := range *f.Attributes {
+			if a.Values != nil {
+				q.Set(attrFilterPrefix+a.Key, strings.Join(*a.Values, ","))
+			}
+			if a.Min != nil {
+				q.Set(attrFilterPrefix+a.Key+".min", strconv.FormatFloat(*a.Min, 'f', -1, 64))
+			}
+			if a.Max != nil {
+				q.Set(attrFilterPrefix+a.Key+".max", strconv.FormatFloat(*a.Max, 'f', -1, 64))
+			}
+		}
+	}
+	return q
+}
+
+type productInput struct {
+	Name          *string
+	Price         *int32
+	Currency      *string
+	Description   *string
+	Discount      *int32
+	Vendor        *string
+	VendorID      *graphql.ID
+	Status        *string
+	IsEssential   *string
+	Categories    *[]graphql.ID
+	AccessoryIDs  *[]graphql.ID
+	CompatibleIDs *[]graphql.ID
+}
+
+//body writes the fields of the input which are set as the json body of
+//the REST routes, so products are decoded and validated the same way
+func (in productInput) body() ([]byte, error) {
+	fields := map[string]interface{}{}
+	set := func(k string, v interface{}, ok bool) {
+		if ok {
+			fields[k] = v
+		}
+	}
+	set("product_name", in.Name, in.Name != nil)
+	set("price", in.Price, in.Price != nil)
+	set("currency", in.Currency, in.Currency != nil)
+	set("description", in.Description, in.Description != nil)
+	set("discount", in.Discount, in.Discount != nil)
+	set("vendor", in.Vendor, in.Vendor != nil)
+	set("vendor_id", in.VendorID, in.VendorID != nil)
+	set("status", in.Status, in.Status != nil)
+	set("is_essential", in.IsEssential, in.IsEssential != nil)
+	for k, IDs := range map[string]*[]graphql.ID{"categories": in.Categories, "accessory_ids": in.AccessoryIDs, "compatible_ids": in.CompatibleIDs} {
+		if IDs == nil {
+			continue
+		}
+		for _, id := range *IDs {
+			if _, err := graphqlObjectID(id); err != nil {
+				return nil, err
+			}
+		}
+		fields[k] = *IDs
+	}
+	if in.VendorID != nil {
+		if _, err := graphqlObjectID(*in.VendorID); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(fields)
+}
+
+//pageCursor makes the offset of the next page opaque to clients
+func pageCursor(offset int64) string {
+	return base64.StdEncoding.EncodeToString([]byte("offset:" + strconv.FormatInt(offset, 10)))
+}
+
+func pageOffset(cursor *string) (int64, error) {
+	if cursor == nil {
+		return 0, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(*cursor)
+	if err == nil && strings.HasPrefix(string(raw), "offset:") {
+		if offset, err := strconv.ParseInt(strings.TrimPrefix(string(raw), "offset:"), 10, 64); err == nil && offset >= 0 {
+			return offset, nil
+		}
+	}
+	return 0, graphqlError{http.StatusBadRequest, "Invalid cursor"}
+}
+
+//Product gets a product, nil when it does not exist or is not published
+func (r *graphqlRoot) Product(ctx context.Context, args struct{ ID graphql.ID }) (*productResolver, error) {
+	if _, err := graphqlObjectID(args.ID); err != nil {
+		return nil, err
+	}
+	product, err := findProduct(ctx, string(args.ID), r.h.Products.Col)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	admin := actorFromGraphQL(ctx).admin
+	if !admin && product.status() != StatusPublished {
+		return nil, nil
+	}
+	return newProductBatch(r.h, admin, []Product{product}).resolver(0), nil
+}
+
+//Products lists the products like GET /products, a page at a time
+func (r *graphqlRoot) Products(ctx context.Context, args struct {
+	Filter *productFilterInput
+	First  int32
+	After  *string
+	Sort   *string
+}) (*productConnection, error) {
+	admin := actorFromGraphQL(ctx).admin
+	q := args.Filter.values()
+	if args.Sort != nil {
+		q.Set("sort", strings.ToLower(*args.Sort))
+	}
+	filter, opts, err := r.h.Products.listQuery(ctx, q, admin)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	first := args.First
+	if first < 1 || first > 100 {
+		return nil, graphqlError{http.StatusBadRequest, "first must be between 1 and 100"}
+	}
+	offset, err := pageOffset(args.After)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Sort == nil {
+		opts.SetSort(bson.D{{Key: "_id", Value: 1}})
+	}
+	total, err := r.h.Products.Col.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	products, err := findProducts(ctx, filter, r.h.Products.Col, opts.SetSkip(offset).SetLimit(int64(first)))
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	end := offset + int64(len(products))
+	return &productConnection{batch: newProductBatch(r.h, admin, products), total: total, end: end}, nil
+}
+
+//Me gets the authenticated user
+func (r *graphqlRoot) Me(ctx context.Context) (*userResolver, error) {
+	who, err := requireUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var user User
+	if err := r.h.UsersCol.FindOne(ctx, bson.M{"username": who.userID}).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, graphqlError{http.StatusNotFound, "User does not exist"}
+		}
+		return nil, toGraphQLError(err)
+	}
+	return &userResolver{h: r.h, user: user}, nil
+}
+
+//CreateProduct creates a product like POST /products
+func (r *graphqlRoot) CreateProduct(ctx context.Context, args struct{ Input productInput }) (*productResolver, error) {
+	who, err := requireVendor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	body, err := args.Input.body()
+	if err != nil {
+		return nil, err
+	}
+	products := make([]Product, 1)
+	if err := json.Unmarshal(body, &products[0]); err != nil {
+		return nil, graphqlError{http.StatusBadRequest, "Unable to parse the request payload."}
+	}
+	if _, err := r.h.Products.createProducts(ctx, who, products, v.Struct); err != nil {
+		return nil, toGraphQLError(err)
+	}
+	return newProductBatch(r.h, who.admin, products).resolver(0), nil
+}
+
+//UpdateProduct updates a product like PUT /products/:id
+func (r *graphqlRoot) UpdateProduct(ctx context.Context, args struct {
+	ID    graphql.ID
+	Input productInput
+}) (*productResolver, error) {
+	who, err := requireVendor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := graphqlObjectID(args.ID); err != nil {
+		return nil, err
+	}
+	body, err := args.Input.body()
+	if err != nil {
+		return nil, err
+	}
+	product, err := modifyProduct(ctx, string(args.ID), bytes.NewReader(body), r.h.Products.Col, r.h.Products.updateHooks(who, 0))
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	return newProductBatch(r.h, who.admin, []Product{product}).resolver(0), nil
+}
+
+//DeleteProduct deletes a product like DELETE /products/:id
+func (r *graphqlRoot) DeleteProduct(ctx context.Context, args struct{ ID graphql.ID }) (bool, error) {
+	if _, err := requireAdmin(ctx); err != nil {
+		return false, err
+	}
+	if _, err := graphqlObjectID(args.ID); err != nil {
+		return false, err
+	}
+	n, err := r.h.Products.removeProduct(ctx, string(args.ID))
+	if err != nil {
+		return false, toGraphQLError(err)
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,499 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/graph-gophers/graphql-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//productBatch holds products resolved together, e.g. a page of products or
+//the accessories of a page. Each relation is loaded once for the whole batch,
+//the first time a product of the batch asks for it, instead of once per product.
+type productBatch struct {
+	h        *GraphQLHandler
+	admin    bool
+	products []Product
+
+	pricingOnce sync.Once
+	pricingErr  error
+
+	vendorsOnce sync.Once
+	vendors     map[primitive.ObjectID]Vendor
+	vendorsErr  error
+
+	refsOnce sync.Once
+	refs     *productBatch
+	refIndex map[primitive.ObjectID]int
+	refsErr  error
+
+	reviewsOnce sync.Once
+	reviews     map[primitive.ObjectID][]Review
+	reviewsErr  error
+}
+
+func newProductBatch(h *GraphQLHandler, admin bool, products []Product) *productBatch {
+	return &productBatch{h: h, admin: admin, products: products}
+}
+
+func (b *productBatch) resolver(i int) *productResolver {
+	return &productResolver{b: b, i: i}
+}
+
+func (b *productBatch) resolvers() []*productResolver {
+	resolvers := make([]*productResolver, len(b.products))
+	for i := range b.products {
+		resolvers[i] = b.resolver(i)
+	}
+	return resolvers
+}
+
+//loadPricing applies the promotions to the products of the batch
+func (b *productBatch) loadPricing(ctx context.Context) error {
+	b.pricingOnce.Do(func() {
+		b.pricingErr = b.h.Products.setPricing(ctx, b.products)
+	})
+	return b.pricingErr
+}
+
+//loadVendors finds the vendors of the products of the batch
+func (b *productBatch) loadVendors(ctx context.Context) (map[primitive.ObjectID]Vendor, error) {
+	b.vendorsOnce.Do(func() {
+		b.vendors = map[primitive.ObjectID]Vendor{}
+		var IDs []primitive.ObjectID
+		for _, p := range b.products {
+			if !p.VendorID.IsZero() {
+				IDs = append(IDs, p.VendorID)
+			}
+		}
+		if len(IDs) == 0 || b.h.Products.VendorCol == nil {
+			return
+		}
+		var vendors []Vendor
+		cursor, err := b.h.Products.VendorCol.Find(ctx, bson.M{"_id": bson.M{"$in": IDs}})
+		if err == nil {
+			err = cursor.All(ctx, &vendors)
+		}
+		for _, vendor := range vendors {
+			b.vendors[vendor.ID] = vendor
+		}
+		b.vendorsErr = err
+	})
+	return b.vendors, b.vendorsErr
+}
+
+//loadRefs finds the accessories and the compatible products of the products
+//of the batch. They form a batch of their own.
+func (b *productBatch) loadRefs(ctx context.Context) (*productBatch, map[primitive.ObjectID]int, error) {
+	b.refsOnce.Do(func() {
+		var IDs []primitive.ObjectID
+		for _, p := range b.products {
+			IDs = append(append(IDs, p.AccessoryIDs...), p.CompatibleIDs...)
+		}
+		filter := bson.M{}
+		if !b.admin {
+			filter["$or"] = publishedFilter
+		}
+		var products []Product
+		if len(IDs) > 0 {
+			products, b.refsErr = productsByID(ctx, IDs, filter, b.h.Products.Col)
+		}
+		b.refs = newProductBatch(b.h, b.admin, products)
+		b.refIndex = map[primitive.ObjectID]int{}
+		for i, p := range products {
+			b.refIndex[p.ID] = i
+		}
+	})
+	return b.refs, b.refIndex, b.refsErr
+}
+
+//loadReviews finds the reviews of the products of the batch, last first.
+//Hidden reviews are only shown to admins.
+func (b *productBatch) loadReviews(ctx context.Context) (map[primitive.ObjectID][]Review, error) {
+	b.reviewsOnce.Do(func() {
+		b.reviews = map[primitive.ObjectID][]Review{}
+		if b.h.ReviewCol == nil || len(b.products) == 0 {
+			return
+		}
+		IDs := make([]primitive.ObjectID, len(b.products))
+		for i, p := range b.products {
+			IDs[i] = p.ID
+		}
+		filter := bson.M{"product_id": bson.M{"$in": IDs}}
+		if !b.admin {
+			filter["hidden"] = false
+		}
+		var reviews []Review
+		opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+		cursor, err := b.h.ReviewCol.Find(ctx, filter, opts)
+		if err == nil {
+			err = cursor.All(ctx, &reviews)
+		}
+		for _, review := range reviews {
+			b.reviews[review.ProductID] = append(b.reviews[review.ProductID], review)
+		}
+		b.reviewsErr = err
+	})
+	return b.reviews, b.reviewsErr
+}
+
+type productConnection struct {
+	batch *productBatch
+	total int64
+	end   int64
+}
+
+func (c *productConnection) Nodes() []*productResolver {
+	return c.batch.resolvers()
+}
+
+func (c *productConnection) TotalCount() int32 {
+	return int32(c.total)
+}
+
+func (c *productConnection) PageInfo() *pageInfoResolver {
+	return &pageInfoResolver{c}
+}
+
+type pageInfoResolver struct {
+	c *productConnection
+}
+
+func (p *pageInfoResolver) HasNextPage() bool {
+	return p.c.end < p.c.total
+}
+
+func (p *pageInfoResolver) EndCursor() *string {
+	if len(p.c.batch.products) == 0 {
+		return nil
+	}
+	cursor := pageCursor(p.c.end)
+	return &cursor
+}
+
+type productResolver struct {
+	b *productBatch
+	i int
+}
+
+func (r *productResolver) p() *Product {
+	return &r.b.products[r.i]
+}
+
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func (r *productResolver) ID() graphql.ID {
+	return graphql.ID(r.p().ID.Hex())
+}
+
+func (r *productResolver) Name() string {
+	return r.p().Name
+}
+
+func (r *productResolver) Description() *string {
+	return optionalString(r.p().Description)
+}
+
+func (r *productResolver) Localized(args struct{ Lang string }) *localizedResolver {
+	l := r.p().localize(fallbackChain(normalizeLocale(args.Lang)), r.b.h.Products.DefaultLocale)
+	return &localizedResolver{l}
+}
+
+func (r *productResolver) Price() int32 {
+	return int32(r.p().Price)
+}
+
+func (r *productResolver) Currency() string {
+	return r.p().Currency
+}
+
+func (r *productResolver) ListPrice() *moneyResolver {
+	return &moneyResolver{r.p().ListPrice()}
+}
+
+func (r *productResolver) PriceIn(args struct{ Currency string }) (*moneyResolver, error) {
+	currency := strings.ToUpper(args.Currency)
+	price, err := r.p().PriceIn(currency, r.b.h.Products.Rates)
+	if err != nil {
+		return nil, graphqlError{http.StatusBadRequest, fmt.Sprintf("Unable to show prices in %s", currency)}
+	}
+	return &moneyResolver{price}, nil
+}
+
+func (r *productResolver) Pricing(ctx context.Context) (*pricingResolver, error) {
+	if err := r.b.loadPricing(ctx); err != nil {
+		return nil, toGraphQLError(err)
+	}
+	if r.p().Pricing == nil {
+		return nil, nil
+	}
+	return &pricingResolver{*r.p().Pricing}, nil
+}
+
+func (r *productResolver) Discount() int32 {
+	return int32(r.p().Discount)
+}
+
+func (r *productResolver) Status() string {
+	return r.p().status()
+}
+
+func (r *productResolver) Type() *string {
+	return optionalString(r.p().Type)
+}
+
+func (r *productResolver) VendorName() string {
+	return r.p().Vendor
+}
+
+func (r *productResolver) Vendor(ctx context.Context) (*vendorResolver, error) {
+	vendors, err := r.b.loadVendors(ctx)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	vendor, ok := vendors[r.p().VendorID]
+	if !ok {
+		return nil, nil
+	}
+	return &vendorResolver{vendor}, nil
+}
+
+func (r *productResolver) Categories() []graphql.ID {
+	IDs := make([]graphql.ID, len(r.p().Categories))
+	for i, ID := range r.p().Categories {
+		IDs[i] = graphql.ID(ID.Hex())
+	}
+	return IDs
+}
+
+func (r *productResolver) Attributes() []*attributeResolver {
+	attributes := []*attributeResolver{}
+	for k, value := range r.p().Attributes {
+		attributes = append(attributes, &attributeResolver{k, fmt.Sprint(value)})
+	}
+	sort.Slice(attributes, func(i, j int) bool { return attributes[i].key < attributes[j].key })
+	return attributes
+}
+
+func (r *productResolver) Rating() *ratingResolver {
+	if r.p().Rating == nil {
+		return nil
+	}
+	return &ratingResolver{*r.p().Rating}
+}
+
+func (r *productResolver) refs(ctx context.Context, IDs []primitive.ObjectID) ([]*productResolver, error) {
+	refs, index, err := r.b.loadRefs(ctx)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	resolvers := []*productResolver{}
+	for _, ID := range IDs {
+		if i, ok := index[ID]; ok {
+			resolvers = append(resolvers, refs.resolver(i))
+		}
+	}
+	return resolvers, nil
+}
+
+func (r *productResolver) Accessories(ctx context.Context) ([]*productResolver, error) {
+	return r.refs(ctx, r.p().AccessoryIDs)
+}
+
+func (r *productResolver) Compatible(ctx context.Context) ([]*productResolver, error) {
+	return r.refs(ctx, r.p().CompatibleIDs)
+}
+
+func (r *productResolver) Reviews(ctx context.Context, args struct{ First int32 }) ([]*reviewResolver, error) {
+	reviews, err := r.b.loadReviews(ctx)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	resolvers := []*reviewResolver{}
+	for _, review := range reviews[r.p().ID] {
+		if len(resolvers) >= int(args.First) {
+			break
+		}
+		resolvers = append(resolvers, &reviewResolver{review})
+	}
+	return resolvers, nil
+}
+
+type localizedResolver struct {
+	l Localized
+}
+
+func (r *localizedResolver) Locale() string {
+	return r.l.Locale
+}
+
+func (r *localizedResolver) Name() string {
+	return r.l.Name
+}
+
+func (r *localizedResolver) Description() *string {
+	return optionalString(r.l.Description)
+}
+
+type moneyResolver struct {
+	m Money
+}
+
+//Amount is a Float, as minor units of currencies like IDR overflow GraphQL's 32 bit Int
+func (r *moneyResolver) Amount() float64 {
+	return float64(r.m.Amount)
+}
+
+func (r *moneyResolver) Currency() string {
+	return r.m.Currency
+}
+
+func (r *moneyResolver) Formatted() string {
+	return r.m.String()
+}
+
+type pricingResolver struct {
+	p Pricing
+}
+
+func (r *pricingResolver) ListPrice() *moneyResolver {
+	return &moneyResolver{r.p.ListPrice}
+}
+
+func (r *pricingResolver) FinalPrice() *moneyResolver {
+	return &moneyResolver{r.p.FinalPrice}
+}
+
+func (r *pricingResolver) Promotions() []*appliedPromotionResolver {
+	resolvers := make([]*appliedPromotionResolver, len(r.p.Promotions))
+	for i, p := range r.p.Promotions {
+		resolvers[i] = &appliedPromotionResolver{p}
+	}
+	return resolvers
+}
+
+type appliedPromotionResolver struct {
+	p AppliedPromotion
+}
+
+func (r *appliedPromotionResolver) ID() graphql.ID {
+	return graphql.ID(r.p.ID.Hex())
+}
+
+func (r *appliedPromotionResolver) Name() string {
+	return r.p.Name
+}
+
+func (r *appliedPromotionResolver) Discount() *moneyResolver {
+	return &moneyResolver{r.p.Discount}
+}
+
+type attributeResolver struct {
+	key   string
+	value string
+}
+
+func (r *attributeResolver) Key() string {
+	return r.key
+}
+
+func (r *attributeResolver) Value() string {
+	return r.value
+}
+
+type ratingResolver struct {
+	r RatingSummary
+}
+
+func (r *ratingResolver) Average() float64 {
+	return r.r.Average
+}
+
+func (r *ratingResolver) Count() int32 {
+	return int32(r.r.Count)
+}
+
+type vendorResolver struct {
+	v Vendor
+}
+
+func (r *vendorResolver) ID() graphql.ID {
+	return graphql.ID(r.v.ID.Hex())
+}
+
+func (r *vendorResolver) Name() string {
+	return r.v.Name
+}
+
+func (r *vendorResolver) Slug() string {
+	return r.v.Slug
+}
+
+func (r *vendorResolver) Website() *string {
+	return optionalString(r.v.Website)
+}
+
+type reviewResolver struct {
+	r Review
+}
+
+func (r *reviewResolver) ID() graphql.ID {
+	return graphql.ID(r.r.ID.Hex())
+}
+
+func (r *reviewResolver) UserID() string {
+	return r.r.UserID
+}
+
+func (r *reviewResolver) Rating() int32 {
+	return int32(r.r.Rating)
+}
+
+func (r *reviewResolver) Text() string {
+	return r.r.Text
+}
+
+func (r *reviewResolver) Hidden() bool {
+	return r.r.Hidden
+}
+
+func (r *reviewResolver) CreatedAt() string {
+	return r.r.CreatedAt.Format(time.RFC3339)
+}
+
+type userResolver struct {
+	h    *GraphQLHandler
+	user User
+}
+
+func (r *userResolver) Username() string {
+	return r.user.Email
+}
+
+func (r *userResolver) IsAdmin() bool {
+	return r.user.IsAdmin
+}
+
+func (r *userResolver) Vendor(ctx context.Context) (*vendorResolver, error) {
+	if r.user.VendorID == nil || r.h.Products.VendorCol == nil {
+		return nil, nil
+	}
+	vendor, err := findVendor(ctx, bson.M{"_id": *r.user.VendorID}, r.h.Products.VendorCol)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	return &vendorResolver{vendor}, nil
+}
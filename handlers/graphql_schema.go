@@ -0,0 +1,148 @@
+package handlers
+
+//graphqlSchema is the schema served on /graphql. Products are read and
+//written through the same storage layer, validators and checks as the REST routes.
+const graphqlSchema = `
+schema {
+	query: Query
+	mutation: Mutation
+}
+
+type Query {
+	product(id: ID!): Product
+	products(filter: ProductFilter, first: Int = 20, after: String, sort: ProductSort): ProductConnection!
+	me: User!
+}
+
+type Mutation {
+	createProduct(input: ProductInput!): Product!
+	updateProduct(id: ID!, input: ProductInput!): Product!
+	deleteProduct(id: ID!): Boolean!
+}
+
+enum ProductSort {
+	RATING
+}
+
+input ProductFilter {
+	vendor: String
+	vendorId: ID
+	status: String
+	category: ID
+	descendants: Boolean
+	inStock: Boolean
+	attributes: [AttributeFilter!]
+}
+
+input AttributeFilter {
+	key: String!
+	values: [String!]
+	min: Float
+	max: Float
+}
+
+input ProductInput {
+	name: String
+	price: Int
+	currency: String
+	description: String
+	discount: Int
+	vendor: String
+	vendorId: ID
+	status: String
+	isEssential: String
+	categories: [ID!]
+	accessoryIds: [ID!]
+	compatibleIds: [ID!]
+}
+
+type ProductConnection {
+	nodes: [Product!]!
+	totalCount: Int!
+	pageInfo: PageInfo!
+}
+
+type PageInfo {
+	hasNextPage: Boolean!
+	endCursor: String
+}
+
+type Product {
+	id: ID!
+	name: String!
+	description: String
+	localized(lang: String!): Localized!
+	price: Int!
+	currency: String!
+	listPrice: Money!
+	priceIn(currency: String!): Money!
+	pricing: Pricing
+	discount: Int!
+	status: String!
+	type: String
+	vendorName: String!
+	vendor: Vendor
+	categories: [ID!]!
+	attributes: [Attribute!]!
+	rating: Rating
+	accessories: [Product!]!
+	compatible: [Product!]!
+	reviews(first: Int = 10): [Review!]!
+}
+
+type Localized {
+	locale: String!
+	name: String!
+	description: String
+}
+
+type Money {
+	amount: Float!
+	currency: String!
+	formatted: String!
+}
+
+type Pricing {
+	listPrice: Money!
+	finalPrice: Money!
+	promotions: [AppliedPromotion!]!
+}
+
+type AppliedPromotion {
+	id: ID!
+	name: String!
+	discount: Money!
+}
+
+type Attribute {
+	key: String!
+	value: String!
+}
+
+type Rating {
+	average: Float!
+	count: Int!
+}
+
+type Vendor {
+	id: ID!
+	name: String!
+	slug: String!
+	website: String
+}
+
+type Review {
+	id: ID!
+	userId: String!
+	rating: Int!
+	text: String!
+	hidden: Boolean!
+	createdAt: String!
+}
+
+type User {
+	username: String!
+	isAdmin: Boolean!
+	vendor: Vendor
+}
+`
@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/graph-gophers/graphql-go"
+	"github.com/inerts73/tronicscorp/dbiface"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//countingCollection counts the queries made to a collection
+type countingCollection struct {
+	dbiface.CollectionAPI
+	finds int32
+}
+
+func (c *countingCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	atomic.AddInt32(&c.finds, 1)
+	return c.CollectionAPI.Find(ctx, filter, opts...)
+}
+
+type graphqlResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message    string                 `json:"message"`
+		Extensions map[string]interface{} `json:"extensions"`
+	} `json:"errors"`
+}
+
+func graphqlRequest(t *testing.T, h *GraphQLHandler, query string, variables map[string]interface{}, claims jwt.MapClaims) graphqlResponse {
+	body, _ := json.Marshal(GraphQLRequest{Query: query, Variables: variables})
+	req := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(string(body)))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	res := httptest.NewRecorder()
+	c := echo.New().NewContext(req, res)
+	if claims != nil {
+		c.Set("user", jwt.NewWithClaims(jwt.SigningMethodHS256, claims))
+	}
+	assert.Nil(t, h.Serve(c))
+	var out graphqlResponse
+	assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &out))
+	return out
+}
+
+func TestGraphQLSchema(t *testing.T) {
+	assert.NotPanics(t, func() {
+		graphql.MustParseSchema(graphqlSchema, &graphqlRoot{})
+	})
+}
+
+func TestGraphQLAuth(t *testing.T) {
+	h := &GraphQLHandler{Products: &ProductHandler{}}
+	id := primitive.NewObjectID().Hex()
+	tests := []struct {
+		name   string
+		query  string
+		claims jwt.MapClaims
+		code   float64
+	}{
+		{"create needs a token", `mutation { createProduct(input: {name: "pixel"}) { id } }`, nil, http.StatusUnauthorized},
+		{"create needs a vendor", `mutation { createProduct(input: {name: "pixel"}) { id } }`, jwt.MapClaims{"user_id": "shopper@tronics.com"}, http.StatusForbidden},
+		{"update needs a vendor", fmt.Sprintf(`mutation { updateProduct(id: %q, input: {price: 10}) { id } }`, id), jwt.MapClaims{"user_id": "shopper@tronics.com"}, http.StatusForbidden},
+		{"delete needs an admin", fmt.Sprintf(`mutation { deleteProduct(id: %q) }`, id), jwt.MapClaims{"user_id": "seller@tronics.com", "vendor_id": id}, http.StatusForbidden},
+		{"me needs a token", `{ me { username } }`, nil, http.StatusUnauthorized},
+		{"invalid id", `mutation { deleteProduct(id: "42") }`, jwt.MapClaims{"user_id": "admin@tronics.com", "authorized": true}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := graphqlRequest(t, h, tt.query, nil, tt.claims)
+			assert.Len(t, res.Errors, 1)
+			assert.Equal(t, tt.code, res.Errors[0].Extensions["code"])
+		})
+	}
+}
+
+func TestGraphQLFilterValues(t *testing.T) {
+	vendorID, inStock, min := graphql.ID("5f0c0f3e2a7b4c1d9e8f7a6b"), true, 6.1
+	values := []string{"5g", "wifi"}
+	f := &productFilterInput{
+		VendorID:   &vendorID,
+		InStock:    &inStock,
+		Attributes: &[]attributeFilterInput{{Key: "connectivity", Values: &values}, {Key: "screen_size", Min: &min}},
+	}
+	assert.Equal(t, url.Values{
+		"vendor_id":            {"5f0c0f3e2a7b4c1d9e8f7a6b"},
+		"in_stock":             {"true"},
+		"attr.connectivity":    {"5g,wifi"},
+		"attr.screen_size.min": {"6.1"},
+	}, f.values())
+	var none *productFilterInput
+	assert.Empty(t, none.values())
+}
+
+func TestMoneyAmount(t *testing.T) {
+	r := &moneyResolver{Money{Amount: 25000000000, Currency: "IDR"}}
+	assert.Equal(t, float64(25000000000), r.Amount(), "more than an Int holds")
+}
+
+func TestPageCursor(t *testing.T) {
+	cursor := pageCursor(40)
+	offset, err := pageOffset(&cursor)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(40), offset)
+	invalid := "offset:40"
+	_, err = pageOffset(&invalid)
+	assert.NotNil(t, err)
+}
+
+func TestGraphQL(t *testing.T) {
+	products := &countingCollection{CollectionAPI: col}
+	reviews := &countingCollection{CollectionAPI: db.Collection("reviews")}
+	ph := &ProductHandler{Col: products}
+	h := &GraphQLHandler{Products: ph, ReviewCol: reviews, UsersCol: db.Collection("users")}
+	admin := jwt.MapClaims{"user_id": "admin@tronics.com", "authorized": true}
+
+	create := func(input map[string]interface{}) string {
+		res := graphqlRequest(t, h, `mutation($input: ProductInput!) { createProduct(input: $input) { id } }`, map[string]interface{}{"input": input}, admin)
+		assert.Empty(t, res.Errors)
+		var data struct{ CreateProduct struct{ ID string } }
+		assert.Nil(t, json.Unmarshal(res.Data, &data))
+		return data.CreateProduct.ID
+	}
+	charger := create(map[string]interface{}{"name": "charger", "price": 20, "currency": "USD", "vendor": "graphql", "status": "published"})
+	cover := create(map[string]interface{}{"name": "cover", "price": 10, "currency": "USD", "vendor": "graphql", "status": "published"})
+	for _, name := range []string{"pixel", "pixel xl", "pixel 4"} {
+		id := create(map[string]interface{}{"name": name, "price": 500, "currency": "USD", "vendor": "graphql", "status": "published", "accessoryIds": []string{charger, cover}})
+		productID, _ := primitive.ObjectIDFromHex(id)
+		_, err := reviews.CollectionAPI.InsertOne(context.Background(), Review{ID: primitive.NewObjectID(), ProductID: productID, UserID: "shopper@tronics.com", Rating: 5, CreatedAt: time.Now()})
+		assert.Nil(t, err)
+	}
+
+	t.Run("products with relations in one round trip", func(t *testing.T) {
+		atomic.StoreInt32(&products.finds, 0)
+		atomic.StoreInt32(&reviews.finds, 0)
+		query := `{ products(filter: {vendor: "graphql"}, first: 3) {
+			totalCount
+			pageInfo { hasNextPage endCursor }
+			nodes { name accessories { name } reviews { rating } }
+		} }`
+		res := graphqlRequest(t, h, query, nil, nil)
+		assert.Empty(t, res.Errors)
+		var data struct {
+			Products struct {
+				TotalCount int
+				PageInfo   struct{ HasNextPage bool }
+				Nodes      []struct {
+					Name        string
+					Accessories []struct{ Name string }
+					Reviews     []struct{ Rating int }
+				}
+			}
+		}
+		assert.Nil(t, json.Unmarshal(res.Data, &data))
+		assert.Equal(t, 5, data.Products.TotalCount)
+		assert.True(t, data.Products.PageInfo.HasNextPage)
+		// one query for the page and one for the accessories of the whole page
+		assert.Equal(t, int32(2), atomic.LoadInt32(&products.finds))
+		assert.Equal(t, int32(1), atomic.LoadInt32(&reviews.finds))
+	})
+
+	t.Run("update and delete", func(t *testing.T) {
+		res := graphqlRequest(t, h, `mutation($id: ID!) { updateProduct(id: $id, input: {price: 15}) { price } }`, map[string]interface{}{"id": cover}, admin)
+		assert.Empty(t, res.Errors)
+		assert.JSONEq(t, `{"updateProduct":{"price":15}}`, string(res.Data))
+
+		res = graphqlRequest(t, h, `mutation($id: ID!) { updateProduct(id: $id, input: {price: 5000}) { price } }`, map[string]interface{}{"id": cover}, admin)
+		assert.Equal(t, float64(http.StatusBadRequest), res.Errors[0].Extensions["code"])
+
+		res = graphqlRequest(t, h, `mutation($id: ID!) { deleteProduct(id: $id) }`, map[string]interface{}{"id": cover}, admin)
+		assert.JSONEq(t, `{"deleteProduct":true}`, string(res.Data))
+		res = graphqlRequest(t, h, `query($id: ID!) { product(id: $id) { name } }`, map[string]interface{}{"id": cover}, nil)
+		assert.JSONEq(t, `{"product":null}`, string(res.Data))
+	})
+}
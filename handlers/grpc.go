@@ -0,0 +1,349 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/inerts73/tronicscorp/catalogpb"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	//MetadataAuthToken carries the jwt of gRPC calls, like the x-auth-token header
+	MetadataAuthToken = "x-auth-token"
+	//maxBatchGet is the most products a BatchGetProducts call gets
+	maxBatchGet = 100
+	//streamBatchSize is how many products ListProducts prices at a time
+	streamBatchSize = 100
+)
+
+//ProductServer serves products over gRPC for internal services, with the
+//storage and the checks of the REST routes
+type ProductServer struct {
+	catalogpb.UnimplementedProductsServer
+	Products *ProductHandler
+	Secret   []byte
+}
+
+type grpcActorKey struct{}
+
+func actorFromGRPC(ctx context.Context) actor {
+	who, _ := ctx.Value(grpcActorKey{}).(actor)
+	return who
+}
+
+//grpcCodes maps the http statuses of the REST routes to gRPC codes
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:      codes.InvalidArgument,
+	http.StatusUnauthorized:    codes.Unauthenticated,
+	http.StatusForbidden:       codes.PermissionDenied,
+	http.StatusNotFound:        codes.NotFound,
+	http.StatusConflict:        codes.FailedPrecondition,
+	http.StatusPaymentRequired: codes.FailedPrecondition,
+}
+
+//toGRPCError turns the errors of the storage layer into gRPC statuses
+func toGRPCError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	if e, ok := err.(*echo.HTTPError); ok {
+		if code, ok := grpcCodes[e.Code]; ok {
+			return status.Error(code, fmt.Sprint(e.Message))
+		}
+	}
+	switch err {
+	case mongo.ErrNoDocuments:
+		return status.Error(codes.NotFound, "Product does not exist")
+	case primitive.ErrInvalidHex:
+		return status.Error(codes.InvalidArgument, "Invalid id")
+	}
+	log.Errorf("Unable to serve the gRPC call : %v", err)
+	return status.Error(codes.Internal, "Internal server error")
+}
+
+//authenticate checks the jwt in the metadata like the jwt middleware. Calls
+//without a token are anonymous, as on GET /products.
+func (s *ProductServer) authenticate(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(MetadataAuthToken)
+	if len(values) == 0 {
+		return ctx, nil
+	}
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(strings.TrimPrefix(values[0], "Bearer "), claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return s.Secret, nil
+	})
+	if err != nil {
+		return ctx, status.Error(codes.Unauthenticated, "invalid or expired jwt")
+	}
+	return context.WithValue(ctx, grpcActorKey{}, actorFromClaims(claims)), nil
+}
+
+//UnaryInterceptor authenticates unary calls
+func (s *ProductServer) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+//StreamInterceptor authenticates streaming calls
+func (s *ProductServer) StreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, authenticatedStream{ServerStream: ss, ctx: ctx})
+}
+
+//price sets the display prices and the pricing of products like the REST routes
+func (s *ProductServer) price(ctx context.Context, products []Product, currency string) error {
+	if currency != "" {
+		if err := setDisplayPrices(products, currency, s.Products.Rates); err != nil {
+			return err
+		}
+	}
+	return s.Products.setPricing(ctx, products)
+}
+
+//GetProduct gets a single product
+func (s *ProductServer) GetProduct(ctx context.Context, req *catalogpb.GetProductRequest) (*catalogpb.Product, error) {
+	product, err := findProduct(ctx, req.Id, s.Products.Col)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	if !actorFromGRPC(ctx).admin && product.status() != StatusPublished {
+		return nil, status.Error(codes.NotFound, "Product does not exist")
+	}
+	products := []Product{product}
+	if err := s.price(ctx, products, req.Currency); err != nil {
+		return nil, toGRPCError(err)
+	}
+	return productToProto(products[0]), nil
+}
+
+//listValues writes the request as the query params of GET /products
+func listValues(req *catalogpb.ListProductsRequest) url.Values {
+	q := url.Values{}
+	set := func(k, v string) {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	set("vendor", req.Vendor)
+	set("vendor_id", req.VendorId)
+	set("status", req.Status)
+	set("category", req.Category)
+	if req.Descendants {
+		q.Set("descendants", "true")
+	}
+	set("in_stock", req.InStock)
+	set("sort", req.Sort)
+	for k, v := range req.Attributes {
+		q.Set(attrFilterPrefix+k, v)
+	}
+	return q
+}
+
+//ListProducts streams the products matching the request, pricing them a batch at a time
+func (s *ProductServer) ListProducts(req *catalogpb.ListProductsRequest, stream catalogpb.Products_ListProductsServer) error {
+	ctx := stream.Context()
+	filter, opts, err := s.Products.listQuery(ctx, listValues(req), actorFromGRPC(ctx).admin)
+	if err != nil {
+		return toGRPCError(err)
+	}
+	cursor, err := s.Products.Col.Find(ctx, filter, opts.SetBatchSize(streamBatchSize))
+	if err != nil {
+		log.Errorf("Unable to find the products : %v", err)
+		return toGRPCError(err)
+	}
+	defer cursor.Close(ctx)
+	batch := make([]Product, 0, streamBatchSize)
+	send := func() error {
+		if err := s.price(ctx, batch, req.Currency); err != nil {
+			return toGRPCError(err)
+		}
+		for _, product := range batch {
+			if err := stream.Send(productToProto(product)); err != nil {
+				return err
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+	for cursor.Next(ctx) {
+		var product Product
+		if err := cursor.Decode(&product); err != nil {
+			log.Errorf("Unable to read the cursor : %v", err)
+			return toGRPCError(err)
+		}
+		if batch = append(batch, product); len(batch) == streamBatchSize {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		log.Errorf("Unable to read the cursor : %v", err)
+		return toGRPCError(err)
+	}
+	return send()
+}
+
+//BatchGetProducts gets products in the order of their ids and lists the ones not found
+func (s *ProductServer) BatchGetProducts(ctx context.Context, req *catalogpb.BatchGetProductsRequest) (*catalogpb.BatchGetProductsResponse, error) {
+	if len(req.Ids) == 0 || len(req.Ids) > maxBatchGet {
+		return nil, status.Errorf(codes.InvalidArgument, "ids must have between 1 and %d products", maxBatchGet)
+	}
+	IDs := make([]primitive.ObjectID, len(req.Ids))
+	for i, id := range req.Ids {
+		docID, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid product id %q", id)
+		}
+		IDs[i] = docID
+	}
+	filter := bson.M{"_id": bson.M{"$in": IDs}}
+	if !actorFromGRPC(ctx).admin {
+		filter["$or"] = publishedFilter
+	}
+	found, err := findProducts(ctx, filter, s.Products.Col)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	byID := map[primitive.ObjectID]Product{}
+	for _, product := range found {
+		byID[product.ID] = product
+	}
+	res := &catalogpb.BatchGetProductsResponse{}
+	products := make([]Product, 0, len(found))
+	for i, docID := range IDs {
+		product, ok := byID[docID]
+		if !ok {
+			res.NotFound = append(res.NotFound, req.Ids[i])
+			continue
+		}
+		products = append(products, product)
+	}
+	if err := s.price(ctx, products, req.Currency); err != nil {
+		return nil, toGRPCError(err)
+	}
+	for _, product := range products {
+		res.Products = append(res.Products, productToProto(product))
+	}
+	return res, nil
+}
+
+func moneyToProto(m *Money) *catalogpb.Money {
+	if m == nil {
+		return nil
+	}
+	return &catalogpb.Money{Amount: m.Amount, Currency: m.Currency}
+}
+
+func hexIDs(IDs []primitive.ObjectID) []string {
+	hex := make([]string, len(IDs))
+	for i, id := range IDs {
+		hex[i] = id.Hex()
+	}
+	return hex
+}
+
+//attributeString writes an attribute value the way the attr.* filters take it
+func attributeString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case primitive.A:
+		return attributeString([]interface{}(v))
+	case []interface{}:
+		values := make([]string, len(v))
+		for i := range v {
+			values[i] = attributeString(v[i])
+		}
+		return strings.Join(values, ",")
+	}
+	return fmt.Sprint(value)
+}
+
+func productToProto(p Product) *catalogpb.Product {
+	listPrice := p.ListPrice()
+	pb := &catalogpb.Product{
+		Id:            p.ID.Hex(),
+		Name:          p.Name,
+		Price:         int64(p.Price),
+		Currency:      p.Currency,
+		Description:   p.Description,
+		Discount:      int64(p.Discount),
+		Vendor:        p.Vendor,
+		Status:        p.status(),
+		Type:          p.Type,
+		Categories:    hexIDs(p.Categories),
+		AccessoryIds:  hexIDs(p.AccessoryIDs),
+		CompatibleIds: hexIDs(p.CompatibleIDs),
+		ListPrice:     moneyToProto(&listPrice),
+		DisplayPrice:  moneyToProto(p.DisplayPrice),
+	}
+	if !p.VendorID.IsZero() {
+		pb.VendorId = p.VendorID.Hex()
+	}
+	if len(p.Attributes) > 0 {
+		pb.Attributes = map[string]string{}
+		for k, v := range p.Attributes {
+			pb.Attributes[k] = attributeString(v)
+		}
+	}
+	for i := range p.Prices {
+		pb.Prices = append(pb.Prices, moneyToProto(&p.Prices[i]))
+	}
+	if p.Pricing != nil {
+		pb.Pricing = &catalogpb.Pricing{
+			ListPrice:  moneyToProto(&p.Pricing.ListPrice),
+			FinalPrice: moneyToProto(&p.Pricing.FinalPrice),
+		}
+		for _, promo := range p.Pricing.Promotions {
+			discount := promo.Discount
+			pb.Pricing.Promotions = append(pb.Pricing.Promotions, &catalogpb.AppliedPromotion{
+				Id:       promo.ID.Hex(),
+				Name:     promo.Name,
+				Discount: moneyToProto(&discount),
+			})
+		}
+	}
+	if p.Rating != nil {
+		pb.Rating = &catalogpb.Rating{Average: p.Rating.Average, Count: int64(p.Rating.Count)}
+	}
+	return pb
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/inerts73/tronicscorp/catalogpb"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func signedToken(t *testing.T, secret string, claims jwt.MapClaims) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	assert.Nil(t, err)
+	return token
+}
+
+func TestGRPCAuthenticate(t *testing.T) {
+	s := &ProductServer{Secret: []byte("grpc-secret")}
+	vendorID := primitive.NewObjectID()
+	withToken := func(token string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(MetadataAuthToken, "Bearer "+token))
+	}
+
+	ctx, err := s.authenticate(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, actor{}, actorFromGRPC(ctx))
+
+	ctx, err = s.authenticate(withToken(signedToken(t, "grpc-secret", jwt.MapClaims{"user_id": "seller@tronics.com", "vendor_id": vendorID.Hex()})))
+	assert.Nil(t, err)
+	assert.Equal(t, actor{userID: "seller@tronics.com", vendorID: vendorID}, actorFromGRPC(ctx))
+
+	_, err = s.authenticate(withToken(signedToken(t, "other-secret", jwt.MapClaims{"user_id": "admin@tronics.com", "authorized": true})))
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = s.authenticate(withToken("not-a-jwt"))
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestToGRPCError(t *testing.T) {
+	assert.Nil(t, toGRPCError(nil))
+	assert.Equal(t, codes.InvalidArgument, status.Code(toGRPCError(echo.NewHTTPError(http.StatusBadRequest, "Invalid category id"))))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(toGRPCError(echo.NewHTTPError(http.StatusConflict, "conflict"))))
+	assert.Equal(t, codes.NotFound, status.Code(toGRPCError(mongo.ErrNoDocuments)))
+	assert.Equal(t, codes.InvalidArgument, status.Code(toGRPCError(primitive.ErrInvalidHex)))
+	assert.Equal(t, codes.Internal, status.Code(toGRPCError(io.ErrUnexpectedEOF)))
+}
+
+func TestProductToProto(t *testing.T) {
+	vendorID := primitive.NewObjectID()
+	p := productToProto(Product{
+		ID:         primitive.NewObjectID(),
+		Name:       "pixel",
+		Price:      500,
+		Currency:   "USD",
+		VendorID:   vendorID,
+		Attributes: map[string]interface{}{"screen_size": 6.1, "connectivity": primitive.A{"5g", "wifi"}, "nfc": true},
+	})
+	assert.Equal(t, StatusPublished, p.Status)
+	assert.Equal(t, vendorID.Hex(), p.VendorId)
+	assert.Equal(t, &catalogpb.Money{Amount: 50000, Currency: "USD"}, p.ListPrice)
+	assert.Nil(t, p.DisplayPrice)
+	assert.Equal(t, map[string]string{"screen_size": "6.1", "connectivity": "5g,wifi", "nfc": "true"}, p.Attributes)
+}
+
+func TestBatchGetProductsValidation(t *testing.T) {
+	s := &ProductServer{Products: &ProductHandler{}}
+	_, err := s.BatchGetProducts(context.Background(), &catalogpb.BatchGetProductsRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = s.BatchGetProducts(context.Background(), &catalogpb.BatchGetProductsRequest{Ids: make([]string, maxBatchGet+1)})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = s.BatchGetProducts(context.Background(), &catalogpb.BatchGetProductsRequest{Ids: []string{"42"}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestGRPC(t *testing.T) {
+	ps := &ProductServer{Products: &ProductHandler{Col: col}, Secret: []byte("grpc-secret")}
+	lis := bufconn.Listen(1 << 20)
+	s := grpc.NewServer(grpc.UnaryInterceptor(ps.UnaryInterceptor), grpc.StreamInterceptor(ps.StreamInterceptor))
+	catalogpb.RegisterProductsServer(s, ps)
+	go s.Serve(lis)
+	defer s.Stop()
+	conn, err := grpc.DialContext(context.Background(), "bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return lis.Dial()
+	}))
+	assert.Nil(t, err)
+	defer conn.Close()
+	client := catalogpb.NewProductsClient(conn)
+	admin := metadata.AppendToOutgoingContext(context.Background(), MetadataAuthToken,
+		"Bearer "+signedToken(t, "grpc-secret", jwt.MapClaims{"user_id": "admin@tronics.com", "authorized": true}))
+
+	IDs, err := insertProducts(context.Background(), []Product{
+		{ID: primitive.NewObjectID(), Name: "pixel", Price: 500, Currency: "USD", Vendor: "grpc", Status: StatusPublished},
+		{ID: primitive.NewObjectID(), Name: "pixel xl", Price: 700, Currency: "USD", Vendor: "grpc", Status: StatusPublished},
+		{ID: primitive.NewObjectID(), Name: "pixel 5", Price: 900, Currency: "USD", Vendor: "grpc", Status: StatusDraft},
+	}, col)
+	if !assert.Nil(t, err) {
+		return
+	}
+	published, draft := IDs[0].(primitive.ObjectID).Hex(), IDs[2].(primitive.ObjectID).Hex()
+
+	t.Run("get product", func(t *testing.T) {
+		p, err := client.GetProduct(context.Background(), &catalogpb.GetProductRequest{Id: published})
+		assert.Nil(t, err)
+		assert.Equal(t, "pixel", p.Name)
+		_, err = client.GetProduct(context.Background(), &catalogpb.GetProductRequest{Id: draft})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+		p, err = client.GetProduct(admin, &catalogpb.GetProductRequest{Id: draft})
+		assert.Nil(t, err)
+		assert.Equal(t, StatusDraft, p.Status)
+	})
+
+	t.Run("list products", func(t *testing.T) {
+		count := func(ctx context.Context) int {
+			stream, err := client.ListProducts(ctx, &catalogpb.ListProductsRequest{Vendor: "grpc"})
+			assert.Nil(t, err)
+			n := 0
+			for {
+				_, err := stream.Recv()
+				if err == io.EOF {
+					return n
+				}
+				assert.Nil(t, err)
+				n++
+			}
+		}
+		assert.Equal(t, 2, count(context.Background()))
+		assert.Equal(t, 3, count(admin))
+	})
+
+	t.Run("batch get products", func(t *testing.T) {
+		missing := primitive.NewObjectID().Hex()
+		res, err := client.BatchGetProducts(context.Background(), &catalogpb.BatchGetProductsRequest{Ids: []string{draft, missing, published}})
+		assert.Nil(t, err)
+		assert.Len(t, res.Products, 1)
+		assert.Equal(t, published, res.Products[0].Id)
+		assert.Equal(t, []string{draft, missing}, res.NotFound)
+	})
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+//adminClaims are the claims of the admin used across the tests
+var adminClaims = userClaims("admin@tronics.com")
+
+//userClaims returns the claims of a user, only admin@tronics.com is an admin
+func userClaims(user string) jwt.MapClaims {
+	return jwt.MapClaims{"user_id": user, "authorized": user == "admin@tronics.com"}
+}
+
+//newRequest builds the context of a JSON request sent with claims, nil for an
+//anonymous caller. params are path parameter names followed by their values.
+func newRequest(method, target, body string, claims jwt.MapClaims, params ...string) (echo.Context, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	res := httptest.NewRecorder()
+	c := echo.New().NewContext(req, res)
+	if claims != nil {
+		c.Set("user", jwt.NewWithClaims(jwt.SigningMethodHS256, claims))
+	}
+	if len(params) > 0 {
+		c.SetParamNames(params[:len(params)/2]...)
+		c.SetParamValues(params[len(params)/2:]...)
+	}
+	return c, res
+}
+
+//assertHTTPError asserts err is an *echo.HTTPError with the code
+func assertHTTPError(t *testing.T, err error, code int, msgAndArgs ...interface{}) bool {
+	t.Helper()
+	he, ok := err.(*echo.HTTPError)
+	if !assert.True(t, ok, "expected an *echo.HTTPError, got %v", err) {
+		return false
+	}
+	return assert.Equal(t, code, he.Code, msgAndArgs...)
+}
@@ -0,0 +1,258 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/go-playground/validator.v9"
+)
+
+var localePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Z]{2})?$`)
+
+func init() {
+	v.RegisterValidation("locale", func(fl validator.FieldLevel) bool {
+		return localePattern.MatchString(fl.Field().String())
+	})
+}
+
+//Translation is the content of a product in one locale
+type Translation struct {
+	Name        string `json:"name" bson:"name" validate:"required,max=100"`
+	Description string `json:"description,omitempty" bson:"description,omitempty" validate:"max=2000"`
+}
+
+//Localized is the content of a product in the locale chosen for the response
+type Localized struct {
+	Locale      string `json:"locale"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+//MissingTranslation is a product which lacks content in a locale
+type MissingTranslation struct {
+	ProductID string   `json:"product_id"`
+	Name      string   `json:"product_name"`
+	Fields    []string `json:"fields"`
+}
+
+//normalizeLocale writes a locale the way translations are keyed, e.g. en_in as en-IN
+func normalizeLocale(locale string) string {
+	parts := strings.SplitN(strings.Replace(strings.TrimSpace(locale), "_", "-", 1), "-", 2)
+	parts[0] = strings.ToLower(parts[0])
+	if len(parts) == 2 {
+		parts[1] = strings.ToUpper(parts[1])
+	}
+	return strings.Join(parts, "-")
+}
+
+//fallbackChain lists the locales to try for locale, e.g. en-IN, en
+func fallbackChain(locale string) []string {
+	chain := []string{locale}
+	for i := strings.LastIndex(locale, "-"); i > 0; i = strings.LastIndex(locale, "-") {
+		locale = locale[:i]
+		chain = append(chain, locale)
+	}
+	return chain
+}
+
+//preferredLocales lists the locales a request asks for, best first. The lang
+//param wins over the Accept-Language header.
+func preferredLocales(c echo.Context) []string {
+	if lang := c.QueryParam("lang"); lang != "" {
+		return fallbackChain(normalizeLocale(lang))
+	}
+	type weighted struct {
+		locale string
+		q      float64
+	}
+	var prefs []weighted
+	for _, part := range strings.Split(c.Request().Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(part, ";")
+		locale := strings.TrimSpace(fields[0])
+		if locale == "" || locale == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if f, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q > 0 {
+			prefs = append(prefs, weighted{normalizeLocale(locale), q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	var locales []string
+	for _, p := range prefs {
+		locales = append(locales, fallbackChain(p.locale)...)
+	}
+	return locales
+}
+
+//localize picks the content of product for the first of locales it is
+//translated to, or its default content
+func (p Product) localize(locales []string, defaultLocale string) Localized {
+	for _, locale := range locales {
+		if t, ok := p.Translations[locale]; ok {
+			if t.Description == "" {
+				t.Description = p.Description
+			}
+			return Localized{Locale: locale, Name: t.Name, Description: t.Description}
+		}
+	}
+	return Localized{Locale: defaultLocale, Name: p.Name, Description: p.Description}
+}
+
+//setLocalized fills in the localized content of products for the request.
+//Content-Language is only set when all of them are in the same locale.
+func (h *ProductHandler) setLocalized(c echo.Context, products []Product) {
+	locales := preferredLocales(c)
+	if len(locales) == 0 {
+		return
+	}
+	language := ""
+	for i := range products {
+		localized := products[i].localize(locales, h.DefaultLocale)
+		products[i].Localized = &localized
+		if i == 0 {
+			language = localized.Locale
+		} else if language != localized.Locale {
+			language = ""
+		}
+	}
+	if language != "" {
+		c.Response().Header().Set("Content-Language", language)
+	}
+}
+
+//missingTranslations lists, for each locale, the products whose name or
+//description is not served in it. A locale is served by the first translation
+//of its fallback chain, or by the default content when the chain reaches
+//defaultLocale, as localize does.
+func missingTranslations(products []Product, locales []string, defaultLocale string) map[string][]MissingTranslation {
+	report := map[string][]MissingTranslation{}
+	for _, locale := range locales {
+		report[locale] = []MissingTranslation{}
+		for _, p := range products {
+			fields := []string{"name"}
+			if p.Description != "" {
+				fields = append(fields, "description")
+			}
+			for _, l := range fallbackChain(locale) {
+				if t, ok := p.Translations[l]; ok {
+					fields = nil
+					if p.Description != "" && t.Description == "" {
+						fields = []string{"description"}
+					}
+					break
+				}
+				if l == defaultLocale {
+					fields = nil
+					break
+				}
+			}
+			if len(fields) > 0 {
+				report[locale] = append(report[locale], MissingTranslation{ProductID: p.ID.Hex(), Name: p.Name, Fields: fields})
+			}
+		}
+	}
+	return report
+}
+
+func translationLocale(c echo.Context) (string, error) {
+	locale := normalizeLocale(c.Param("locale"))
+	if !localePattern.MatchString(locale) {
+		return locale, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid locale %q", c.Param("locale")))
+	}
+	return locale, nil
+}
+
+//GetTranslations lists the translations of a product
+func (h *ProductHandler) GetTranslations(c echo.Context) error {
+	product, err := findProduct(storageContext(c), c.Param("id"), h.Col)
+	if err == mongo.ErrNoDocuments {
+		return echo.NewHTTPError(http.StatusNotFound, "Product does not exist")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid product id")
+	}
+	if product.Translations == nil {
+		product.Translations = map[string]Translation{}
+	}
+	return c.JSON(http.StatusOK, product.Translations)
+}
+
+//SetTranslation adds or replaces the translation of a product to a locale
+func (h *ProductHandler) SetTranslation(c echo.Context) error {
+	productID, err := productObjectID(storageContext(c), c.Param("id"), h.Col)
+	if err != nil {
+		return err
+	}
+	locale, err := translationLocale(c)
+	if err != nil {
+		return err
+	}
+	var translation Translation
+	if err := c.Bind(&translation); err != nil {
+		log.Errorf("Unable to bind to translation : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	if err := v.Struct(translation); err != nil {
+		log.Errorf("Unable to validate the translation %+v %v", translation, err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload.")
+	}
+	update := touch(bson.M{"$set": bson.M{"translations." + locale: translation}})
+	if _, err := h.Col.UpdateOne(storageContext(c), bson.M{"_id": productID}, update); err != nil {
+		log.Errorf("Unable to update the translation : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to update the translation")
+	}
+	return c.JSON(http.StatusOK, translation)
+}
+
+//DeleteTranslation removes the translation of a product to a locale
+func (h *ProductHandler) DeleteTranslation(c echo.Context) error {
+	productID, err := productObjectID(storageContext(c), c.Param("id"), h.Col)
+	if err != nil {
+		return err
+	}
+	locale, err := translationLocale(c)
+	if err != nil {
+		return err
+	}
+	update := touch(bson.M{"$unset": bson.M{"translations." + locale: ""}})
+	filter := bson.M{"_id": productID, "translations." + locale: bson.M{"$exists": true}}
+	res, err := h.Col.UpdateOne(storageContext(c), filter, update)
+	if err != nil {
+		log.Errorf("Unable to delete the translation : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to delete the translation")
+	}
+	return c.JSON(http.StatusOK, versioned(c, res.ModifiedCount, Deleted{DeletedCount: res.ModifiedCount}))
+}
+
+//GetMissingTranslations reports the products missing translations for each
+//locale we sell in, or only for the locale param
+func (h *ProductHandler) GetMissingTranslations(c echo.Context) error {
+	locales := h.Locales
+	if locale := c.QueryParam("locale"); locale != "" {
+		locales = []string{normalizeLocale(locale)}
+	}
+	opts := options.Find().SetProjection(bson.M{"product_name": 1, "description": 1, "translations": 1})
+	products, err := findProducts(storageContext(c), bson.M{}, h.Col, opts)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the products")
+	}
+	return c.JSON(http.StatusOK, missingTranslations(products, locales, h.DefaultLocale))
+}
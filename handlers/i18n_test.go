@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestLocales(t *testing.T) {
+	assert.Equal(t, "en-IN", normalizeLocale("en_in"))
+	assert.Equal(t, []string{"en-IN", "en"}, fallbackChain("en-IN"))
+
+	request := func(target, acceptLanguage string) echo.Context {
+		c, _ := newRequest(http.MethodGet, target, "", nil)
+		c.Request().Header.Set("Accept-Language", acceptLanguage)
+		return c
+	}
+	assert.Equal(t, []string{"hi-IN", "hi", "en-IN", "en"}, preferredLocales(request("/products", "en-IN;q=0.8, hi-IN, *;q=0.1")))
+	assert.Equal(t, []string{"en-US", "en"}, preferredLocales(request("/products?lang=en-us", "hi-IN")))
+	assert.Empty(t, preferredLocales(request("/products", "")))
+}
+
+func TestLocalize(t *testing.T) {
+	p := Product{
+		ID:          primitive.NewObjectID(),
+		Name:        "pixel",
+		Description: "A phone",
+		Translations: map[string]Translation{
+			"hi": {Name: "पिक्सेल"},
+		},
+	}
+	assert.Equal(t, Localized{Locale: "hi", Name: "पिक्सेल", Description: "A phone"}, p.localize([]string{"hi-IN", "hi"}, "en"))
+	assert.Equal(t, Localized{Locale: "en", Name: "pixel", Description: "A phone"}, p.localize([]string{"fr"}, "en"))
+
+	report := missingTranslations([]Product{p}, []string{"hi", "hi-IN", "en-IN", "fr"}, "en")
+	assert.Equal(t, []string{"description"}, report["hi"][0].Fields)
+	assert.Equal(t, []string{"description"}, report["hi-IN"][0].Fields, "served by the hi translation")
+	assert.Empty(t, report["en-IN"], "served by the default content")
+	assert.Equal(t, []string{"name", "description"}, report["fr"][0].Fields)
+}
+
+func TestValidateTranslations(t *testing.T) {
+	p := Product{Name: "pixel", Price: 500, Currency: "USD", Vendor: "google"}
+	p.Translations = map[string]Translation{"en-IN": {Name: "pixel"}}
+	assert.Nil(t, v.Struct(p))
+	p.Translations = map[string]Translation{"english": {Name: "pixel"}}
+	assert.NotNil(t, v.Struct(p))
+	p.Translations = map[string]Translation{"en": {}}
+	assert.NotNil(t, v.Struct(p))
+}
+
+func TestContentLanguage(t *testing.T) {
+	h := ProductHandler{DefaultLocale: "en"}
+	translated := Product{Name: "pixel", Translations: map[string]Translation{"hi": {Name: "पिक्सेल"}}}
+	untranslated := Product{Name: "nest"}
+	contentLanguage := func(acceptLanguage string, products ...Product) string {
+		req := httptest.NewRequest(http.MethodGet, "/products", nil)
+		req.Header.Set("Accept-Language", acceptLanguage)
+		res := httptest.NewRecorder()
+		h.setLocalized(echo.New().NewContext(req, res), products)
+		return res.Header().Get("Content-Language")
+	}
+	assert.Equal(t, "hi", contentLanguage("hi-IN", translated), "the locale the product resolved to")
+	assert.Equal(t, "en", contentLanguage("hi-IN", untranslated), "the default content")
+	assert.Empty(t, contentLanguage("hi-IN", translated, untranslated), "products in several locales")
+	assert.Empty(t, contentLanguage("", translated))
+}
@@ -0,0 +1,366 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/inerts73/tronicscorp/dbiface"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//Stock describes the quantity of a product held in the warehouse
+type Stock struct {
+	ProductID    primitive.ObjectID `json:"product_id" bson:"_id"`
+	OnHand       int                `json:"on_hand" bson:"on_hand"`
+	Available    int                `json:"available" bson:"available"`
+	Reservations []Reservation      `json:"reservations,omitempty" bson:"reservations,omitempty"`
+}
+
+//Reservation holds back stock for a limited time, e.g. during checkout
+type Reservation struct {
+	ID        primitive.ObjectID `json:"_id" bson:"_id"`
+	UserID    string             `json:"user_id" bson:"user_id"`
+	Quantity  int                `json:"quantity" bson:"quantity" validate:"required,min=1"`
+	ExpiresAt time.Time          `json:"expires_at" bson:"expires_at"`
+}
+
+//StockAdjustment records a manual change of the on hand quantity
+type StockAdjustment struct {
+	ID        primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	ProductID primitive.ObjectID `json:"product_id" bson:"product_id"`
+	Delta     int                `json:"delta" bson:"delta" validate:"required"`
+	Reason    string             `json:"reason" bson:"reason" validate:"required,oneof=restock return damaged lost correction"`
+	Note      string             `json:"note,omitempty" bson:"note,omitempty" validate:"max=300"`
+	UserID    string             `json:"user_id" bson:"user_id"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+}
+
+//InventoryHandler an inventory handler
+type InventoryHandler struct {
+	Col            dbiface.CollectionAPI
+	AdjCol         dbiface.CollectionAPI
+	ProdCol        dbiface.CollectionAPI
+	ReservationTTL time.Duration
+}
+
+var (
+	errInsufficientStock = echo.NewHTTPError(http.StatusConflict, "Insufficient stock")
+)
+
+func findStock(ctx context.Context, productID primitive.ObjectID, collection dbiface.CollectionAPI) (Stock, error) {
+	stock := Stock{ProductID: productID}
+	res := collection.FindOne(ctx, bson.M{"_id": productID})
+	if err := res.Decode(&stock); err != nil && err != mongo.ErrNoDocuments {
+		log.Errorf("Unable to decode the stock : %v", err)
+		return stock, err
+	}
+	return stock, nil
+}
+
+//inStockProductIDs returns the ids of the products that can still be sold
+func inStockProductIDs(ctx context.Context, collection dbiface.CollectionAPI) ([]primitive.ObjectID, error) {
+	var stocks []Stock
+	cursor, err := collection.Find(ctx, bson.M{"available": bson.M{"$gt": 0}})
+	if err != nil {
+		log.Errorf("Unable to find the stock : %v", err)
+		return nil, err
+	}
+	if err := cursor.All(ctx, &stocks); err != nil {
+		log.Errorf("Unable to read the cursor : %v", err)
+		return nil, err
+	}
+	IDs := make([]primitive.ObjectID, 0, len(stocks))
+	for _, stock := range stocks {
+		IDs = append(IDs, stock.ProductID)
+	}
+	return IDs, nil
+}
+
+//decrementStock atomically takes qty items out of the available stock
+func decrementStock(ctx context.Context, productID primitive.ObjectID, qty int, collection dbiface.CollectionAPI) error {
+	filter := bson.M{"_id": productID, "available": bson.M{"$gte": qty}}
+	update := bson.M{"$inc": bson.M{"on_hand": -qty, "available": -qty}}
+	res, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		log.Errorf("Unable to decrement the stock : %v", err)
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errInsufficientStock
+	}
+	return nil
+}
+
+func adjustStock(ctx context.Context, adj StockAdjustment, collection dbiface.CollectionAPI) error {
+	filter := bson.M{"_id": adj.ProductID}
+	if adj.Delta < 0 {
+		filter["available"] = bson.M{"$gte": -adj.Delta}
+	}
+	update := bson.M{"$inc": bson.M{"on_hand": adj.Delta, "available": adj.Delta}}
+	res, err := collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(adj.Delta > 0))
+	if err != nil {
+		log.Errorf("Unable to adjust the stock : %v", err)
+		return err
+	}
+	if res.MatchedCount == 0 && res.UpsertedCount == 0 {
+		return errInsufficientStock
+	}
+	return nil
+}
+
+func reserveStock(ctx context.Context, productID primitive.ObjectID, r Reservation, collection dbiface.CollectionAPI) error {
+	filter := bson.M{"_id": productID, "available": bson.M{"$gte": r.Quantity}}
+	update := bson.M{
+		"$inc":  bson.M{"available": -r.Quantity},
+		"$push": bson.M{"reservations": r},
+	}
+	res, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		log.Errorf("Unable to reserve the stock : %v", err)
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errInsufficientStock
+	}
+	return nil
+}
+
+//settleReservation removes a reservation. When commit is true the reserved
+//items leave the warehouse, otherwise they are put back in the available stock.
+func settleReservation(ctx context.Context, productID, reservationID primitive.ObjectID, commit bool, collection dbiface.CollectionAPI) error {
+	stock, err := findStock(ctx, productID, collection)
+	if err != nil {
+		return err
+	}
+	var reservation *Reservation
+	for i := range stock.Reservations {
+		if stock.Reservations[i].ID == reservationID {
+			reservation = &stock.Reservations[i]
+		}
+	}
+	if reservation == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Reservation does not exist")
+	}
+	filter := bson.M{"_id": productID, "reservations._id": reservationID}
+	inc := bson.M{"available": reservation.Quantity}
+	if commit {
+		inc = bson.M{"on_hand": -reservation.Quantity}
+	}
+	update := bson.M{
+		"$inc":  inc,
+		"$pull": bson.M{"reservations": bson.M{"_id": reservationID}},
+	}
+	res, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		log.Errorf("Unable to settle the reservation : %v", err)
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "Reservation does not exist")
+	}
+	return nil
+}
+
+func releaseExpiredReservations(ctx context.Context, now time.Time, collection dbiface.CollectionAPI) (int, error) {
+	var stocks []Stock
+	cursor, err := collection.Find(ctx, bson.M{"reservations.expires_at": bson.M{"$lte": now}})
+	if err != nil {
+		log.Errorf("Unable to find expired reservations : %v", err)
+		return 0, err
+	}
+	if err := cursor.All(ctx, &stocks); err != nil {
+		log.Errorf("Unable to read the cursor : %v", err)
+		return 0, err
+	}
+	released := 0
+	for _, stock := range stocks {
+		for _, r := range stock.Reservations {
+			if r.ExpiresAt.After(now) {
+				continue
+			}
+			// a reservation may be settled concurrently, which is fine
+			if err := settleReservation(ctx, stock.ProductID, r.ID, false, collection); err != nil {
+				if _, ok := err.(*echo.HTTPError); ok {
+					continue
+				}
+				return released, err
+			}
+			released++
+		}
+	}
+	return released, nil
+}
+
+//ExpireReservations releases expired reservations every interval until ctx is done
+func (h *InventoryHandler) ExpireReservations(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := releaseExpiredReservations(ctx, now, h.Col)
+			if err != nil {
+				log.Errorf("Unable to release expired reservations : %v", err)
+				continue
+			}
+			if n > 0 {
+				log.Infof("Released %d expired reservations", n)
+			}
+		}
+	}
+}
+
+func productByID(ctx context.Context, id string, collection dbiface.CollectionAPI) (Product, error) {
+	product, err := findProduct(ctx, id, collection)
+	if err == mongo.ErrNoDocuments {
+		return product, echo.NewHTTPError(http.StatusNotFound, "Product does not exist")
+	}
+	if err != nil {
+		return product, echo.NewHTTPError(http.StatusBadRequest, "Invalid product id")
+	}
+	return product, nil
+}
+
+func productObjectID(ctx context.Context, id string, collection dbiface.CollectionAPI) (primitive.ObjectID, error) {
+	product, err := productByID(ctx, id, collection)
+	return product.ID, err
+}
+
+//stockedProductID returns the id of a product which has its own stock, unlike bundles
+func stockedProductID(ctx context.Context, id string, collection dbiface.CollectionAPI) (primitive.ObjectID, error) {
+	product, err := productByID(ctx, id, collection)
+	if err == nil && product.isBundle() {
+		return product.ID, errBundleStock
+	}
+	return product.ID, err
+}
+
+//GetStock gets the stock of a product
+func (h *InventoryHandler) GetStock(c echo.Context) error {
+	product, err := productByID(storageContext(c), c.Param("id"), h.ProdCol)
+	if err != nil {
+		return err
+	}
+	if product.isBundle() {
+		stock, err := bundleStock(storageContext(c), product, h.Col)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the stock")
+		}
+		return c.JSON(http.StatusOK, stock)
+	}
+	stock, err := findStock(storageContext(c), product.ID, h.Col)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the stock")
+	}
+	return c.JSON(http.StatusOK, stock)
+}
+
+//AdjustStock changes the on hand quantity of a product
+func (h *InventoryHandler) AdjustStock(c echo.Context) error {
+	var adj StockAdjustment
+	productID, err := stockedProductID(storageContext(c), c.Param("id"), h.ProdCol)
+	if err != nil {
+		return err
+	}
+	if err := c.Bind(&adj); err != nil {
+		log.Errorf("Unable to bind to stock adjustment : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	if err := v.Struct(adj); err != nil {
+		log.Errorf("Unable to validate the stock adjustment %+v %v", adj, err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload.")
+	}
+	adj.ID = primitive.NewObjectID()
+	adj.ProductID = productID
+	adj.UserID = userIDFromContext(c)
+	adj.CreatedAt = time.Now().UTC()
+	if err := adjustStock(storageContext(c), adj, h.Col); err != nil {
+		return err
+	}
+	if _, err := h.AdjCol.InsertOne(storageContext(c), adj); err != nil {
+		log.Errorf("Unable to record the stock adjustment : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to record the stock adjustment")
+	}
+	stock, err := findStock(storageContext(c), productID, h.Col)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the stock")
+	}
+	return c.JSON(http.StatusOK, stock)
+}
+
+//GetStockAdjustments lists the stock adjustments of a product
+func (h *InventoryHandler) GetStockAdjustments(c echo.Context) error {
+	var adjustments []StockAdjustment
+	productID, err := productObjectID(storageContext(c), c.Param("id"), h.ProdCol)
+	if err != nil {
+		return err
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cursor, err := h.AdjCol.Find(storageContext(c), bson.M{"product_id": productID}, opts)
+	if err != nil {
+		log.Errorf("Unable to find the stock adjustments : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the stock adjustments")
+	}
+	if err := cursor.All(storageContext(c), &adjustments); err != nil {
+		log.Errorf("Unable to read the cursor : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the stock adjustments")
+	}
+	return c.JSON(http.StatusOK, adjustments)
+}
+
+//ReserveStock holds stock of a product for the authenticated user
+func (h *InventoryHandler) ReserveStock(c echo.Context) error {
+	var r Reservation
+	productID, err := stockedProductID(storageContext(c), c.Param("id"), h.ProdCol)
+	if err != nil {
+		return err
+	}
+	if err := c.Bind(&r); err != nil {
+		log.Errorf("Unable to bind to reservation : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	if err := v.Struct(r); err != nil {
+		log.Errorf("Unable to validate the reservation %+v %v", r, err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload.")
+	}
+	r.ID = primitive.NewObjectID()
+	r.UserID = userIDFromContext(c)
+	r.ExpiresAt = time.Now().UTC().Add(h.ReservationTTL)
+	if err := reserveStock(storageContext(c), productID, r, h.Col); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, r)
+}
+
+//ReleaseReservation gives reserved stock back before the reservation expires
+func (h *InventoryHandler) ReleaseReservation(c echo.Context) error {
+	productID, err := productObjectID(storageContext(c), c.Param("id"), h.ProdCol)
+	if err != nil {
+		return err
+	}
+	reservationID, err := primitive.ObjectIDFromHex(c.Param("rid"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid reservation id")
+	}
+	stock, err := findStock(storageContext(c), productID, h.Col)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the stock")
+	}
+	for _, r := range stock.Reservations {
+		if r.ID == reservationID && r.UserID != userIDFromContext(c) && !isAdminFromContext(c) {
+			return echo.NewHTTPError(http.StatusForbidden, "Not authorized")
+		}
+	}
+	if err := settleReservation(storageContext(c), productID, reservationID, false, h.Col); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestInventory(t *testing.T) {
+	ctx := context.Background()
+	ih := InventoryHandler{
+		Col:            db.Collection("inventory"),
+		AdjCol:         db.Collection("stock_adjustments"),
+		ProdCol:        col,
+		ReservationTTL: time.Minute,
+	}
+	IDs, err := insertProducts(ctx, []Product{{Name: "pixel", Price: 500, Currency: "USD", Vendor: "google"}}, col)
+	if !assert.Nil(t, err) {
+		return
+	}
+	productID := IDs[0].(primitive.ObjectID)
+	docID := productID.Hex()
+
+	t.Run("adjust stock", func(t *testing.T) {
+		var stock Stock
+		c, res := newRequest(http.MethodPost, "/", `{"delta":3,"reason":"restock"}`, adminClaims, "id", docID)
+		assert.Nil(t, ih.AdjustStock(c))
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &stock))
+		assert.Equal(t, 3, stock.OnHand)
+		assert.Equal(t, 3, stock.Available)
+	})
+
+	t.Run("adjust stock with unknown reason", func(t *testing.T) {
+		c, _ := newRequest(http.MethodPost, "/", `{"delta":3,"reason":"gift"}`, adminClaims, "id", docID)
+		err := ih.AdjustStock(c)
+		assertHTTPError(t, err, http.StatusBadRequest)
+	})
+
+	t.Run("reserve more than available", func(t *testing.T) {
+		c, _ := newRequest(http.MethodPost, "/", `{"quantity":4}`, adminClaims, "id", docID)
+		assert.Equal(t, errInsufficientStock, ih.ReserveStock(c))
+	})
+
+	var reservation Reservation
+	t.Run("reserve stock", func(t *testing.T) {
+		c, res := newRequest(http.MethodPost, "/", `{"quantity":2}`, adminClaims, "id", docID)
+		assert.Nil(t, ih.ReserveStock(c))
+		assert.Equal(t, http.StatusCreated, res.Code)
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &reservation))
+		stock, err := findStock(ctx, productID, ih.Col)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, stock.OnHand)
+		assert.Equal(t, 1, stock.Available)
+	})
+
+	t.Run("in stock filter", func(t *testing.T) {
+		var products []Product
+		req := httptest.NewRequest(http.MethodGet, "/products?in_stock=true", nil)
+		res := httptest.NewRecorder()
+		c := echo.New().NewContext(req, res)
+		ph := ProductHandler{Col: col, InvCol: ih.Col}
+		assert.Nil(t, ph.GetProducts(c))
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &products))
+		assert.Len(t, products, 1)
+		for _, product := range products {
+			assert.Equal(t, productID, product.ID)
+		}
+	})
+
+	t.Run("expired reservations are released", func(t *testing.T) {
+		n, err := releaseExpiredReservations(ctx, time.Now().Add(2*time.Minute), ih.Col)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, n)
+		c, res := newRequest(http.MethodGet, "/", "", adminClaims, "id", docID)
+		assert.Nil(t, ih.GetStock(c))
+		var stock Stock
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &stock))
+		assert.Equal(t, 3, stock.Available)
+		assert.Empty(t, stock.Reservations)
+	})
+
+	t.Run("release settled reservation", func(t *testing.T) {
+		c, _ := newRequest(http.MethodDelete, "/", "", adminClaims, "id", "rid", docID, reservation.ID.Hex())
+		err := ih.ReleaseReservation(c)
+		assertHTTPError(t, err, http.StatusNotFound)
+	})
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	//StatusDraft products are only visible to admins
+	StatusDraft = "draft"
+	//StatusPublished products are listed to everyone
+	StatusPublished = "published"
+	//StatusArchived products are no longer sold
+	StatusArchived = "archived"
+)
+
+//statusTransitions lists the statuses a product can move to from each status
+var statusTransitions = map[string][]string{
+	StatusDraft:     {StatusPublished, StatusArchived},
+	StatusPublished: {StatusDraft, StatusArchived},
+	StatusArchived:  {StatusDraft},
+}
+
+//publishedFilter matches published products. Products stored before the
+//lifecycle existed have no status and stay visible.
+var publishedFilter = bson.A{
+	bson.M{"status": StatusPublished},
+	bson.M{"status": bson.M{"$exists": false}},
+}
+
+//status returns the status of a product, products without one are published
+func (p Product) status() string {
+	if p.Status == "" {
+		return StatusPublished
+	}
+	return p.Status
+}
+
+func canTransition(from, to string) bool {
+	if from == to {
+		return true
+	}
+	for _, s := range statusTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+//checkStatusChange makes sure only admins change the lifecycle of a product
+//and only through the allowed transitions
+func checkStatusChange(who actor, old, updated Product) error {
+	if updated.PublishAt != nil && updated.UnpublishAt != nil && !updated.UnpublishAt.After(*updated.PublishAt) {
+		return echo.NewHTTPError(http.StatusBadRequest, "unpublish_at must be after publish_at")
+	}
+	scheduleChanged := !sameTime(old.PublishAt, updated.PublishAt) || !sameTime(old.UnpublishAt, updated.UnpublishAt)
+	if old.status() == updated.status() && !scheduleChanged {
+		return nil
+	}
+	if !who.admin {
+		return echo.NewHTTPError(http.StatusForbidden, "Only admins can publish products")
+	}
+	if !canTransition(old.status(), updated.status()) {
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("A product cannot go from %s to %s", old.status(), updated.status()))
+	}
+	return nil
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+//applySchedule publishes and unpublishes the products that are due at now.
+//Changes go through the same path as an update made by an admin, which
+//unsets the timestamp that was applied, so a product is only moved once.
+//Unpublished products go back to draft, from where they can be scheduled again.
+func (h *ProductHandler) applySchedule(ctx context.Context, now time.Time) (int, error) {
+	scheduler := actor{userID: "scheduler", admin: true}
+	jobs := []struct {
+		filter bson.M
+		body   string
+	}{
+		{
+			filter: bson.M{"status": StatusDraft, "publish_at": bson.M{"$lte": now}},
+			body:   fmt.Sprintf(`{"status":%q,"publish_at":null}`, StatusPublished),
+		},
+		{
+			filter: bson.M{"$or": publishedFilter, "unpublish_at": bson.M{"$lte": now}},
+			body:   fmt.Sprintf(`{"status":%q,"unpublish_at":null}`, StatusDraft),
+		},
+	}
+	changed := 0
+	for _, job := range jobs {
+		products, err := findProducts(ctx, job.filter, h.Col)
+		if err != nil {
+			return changed, err
+		}
+		for _, p := range products {
+			_, err := modifyProduct(ctx, p.ID.Hex(), bytes.NewReader([]byte(job.body)), h.Col, h.updateHooks(scheduler, 0))
+			if err != nil {
+				log.Errorf("Unable to apply the schedule of %s : %v", p.ID.Hex(), err)
+				continue
+			}
+			changed++
+		}
+	}
+	return changed, nil
+}
+
+//RunScheduler applies the publishing schedule every interval until ctx is done
+func (h *ProductHandler) RunScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := h.applySchedule(ctx, now)
+			if err != nil {
+				log.Errorf("Unable to apply the publishing schedule : %v", err)
+				continue
+			}
+			if n > 0 {
+				log.Infof("Applied the publishing schedule to %d products", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestStatusChange(t *testing.T) {
+	admin, user := actor{userID: "admin@tronics.com", admin: true}, actor{userID: "user@tronics.com"}
+	draft, published, archived := Product{Status: StatusDraft}, Product{Status: StatusPublished}, Product{Status: StatusArchived}
+
+	assert.Nil(t, checkStatusChange(admin, draft, published))
+	assert.Nil(t, checkStatusChange(admin, published, archived))
+	assert.Nil(t, checkStatusChange(admin, archived, draft))
+	assert.Nil(t, checkStatusChange(user, draft, draft))
+	assert.Nil(t, checkStatusChange(admin, Product{}, archived), "products without status are published")
+
+	err := checkStatusChange(admin, archived, published)
+	assertHTTPError(t, err, http.StatusConflict)
+	err = checkStatusChange(user, draft, published)
+	assertHTTPError(t, err, http.StatusForbidden)
+
+	now := time.Now()
+	later := now.Add(time.Hour)
+	err = checkStatusChange(user, draft, Product{Status: StatusDraft, PublishAt: &now})
+	assertHTTPError(t, err, http.StatusForbidden)
+	assert.Nil(t, checkStatusChange(admin, draft, Product{Status: StatusDraft, PublishAt: &now, UnpublishAt: &later}))
+	err = checkStatusChange(admin, draft, Product{Status: StatusDraft, PublishAt: &later, UnpublishAt: &now})
+	assertHTTPError(t, err, http.StatusBadRequest)
+}
+
+func TestSchedule(t *testing.T) {
+	h := ProductHandler{Col: col}
+	ctx := context.Background()
+	now := time.Now().UTC()
+	publishAt, unpublishAt := now.Add(-time.Hour), now.Add(time.Hour)
+	IDs, err := insertProducts(ctx, []Product{{Name: "launch", Price: 100, Currency: "USD", Vendor: "schedule", Status: StatusDraft, PublishAt: &publishAt, UnpublishAt: &unpublishAt}}, col)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	_, err = h.applySchedule(ctx, now)
+	assert.Nil(t, err)
+	var stored bson.M
+	assert.Nil(t, col.FindOne(ctx, bson.M{"_id": IDs[0]}).Decode(&stored))
+	assert.Equal(t, StatusPublished, stored["status"])
+	assert.NotContains(t, stored, "publish_at", "the applied timestamp is cleared")
+	assert.Contains(t, stored, "unpublish_at")
+
+	_, err = h.applySchedule(ctx, now.Add(2*time.Hour))
+	assert.Nil(t, err)
+	stored = bson.M{}
+	assert.Nil(t, col.FindOne(ctx, bson.M{"_id": IDs[0]}).Decode(&stored))
+	assert.Equal(t, StatusDraft, stored["status"], "unpublished products can be published again")
+	assert.NotContains(t, stored, "unpublish_at")
+
+	n, err := h.applySchedule(ctx, now.Add(3*time.Hour))
+	assert.Nil(t, err)
+	assert.Zero(t, n, "products are moved only once")
+}
+
+func TestGetUnpublishedProduct(t *testing.T) {
+	h := ProductHandler{Col: col}
+	IDs, err := insertProducts(context.Background(), []Product{{Name: "secret", Price: 100, Currency: "USD", Vendor: "schedule", Status: StatusDraft}}, col)
+	if !assert.Nil(t, err) {
+		return
+	}
+	get := func(claims jwt.MapClaims) (*httptest.ResponseRecorder, error) {
+		c, res := newRequest(http.MethodGet, "/", "", claims, "id", IDs[0].(primitive.ObjectID).Hex())
+		return res, h.GetProduct(c)
+	}
+
+	_, err = get(nil)
+	assertHTTPError(t, err, http.StatusNotFound)
+	_, err = get(userClaims("user@tronics.com"))
+	assertHTTPError(t, err, http.StatusNotFound)
+	res, err := get(adminClaims)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, res.Code)
+}
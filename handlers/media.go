@@ -0,0 +1,362 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/inerts73/tronicscorp/dbiface"
+	"github.com/inerts73/tronicscorp/storage"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	thumbnailSize = 256
+	//maxImagePixels bounds the images decoded for thumbnails, a small file can
+	//hold an image too large to fit in memory
+	maxImagePixels = 50 * 1000 * 1000
+)
+
+//mediaTypes are the content types accepted for upload
+var mediaTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+}
+
+//Media is an image or an attachment such as a manual or a spec sheet
+type Media struct {
+	ID           primitive.ObjectID `json:"_id" bson:"_id"`
+	Kind         string             `json:"kind" bson:"kind" validate:"required,oneof=image manual spec_sheet attachment"`
+	FileName     string             `json:"file_name" bson:"file_name"`
+	ContentType  string             `json:"content_type" bson:"content_type"`
+	Size         int64              `json:"size" bson:"size"`
+	SHA256       string             `json:"sha256" bson:"sha256"`
+	Key          string             `json:"-" bson:"key"`
+	ThumbnailKey string             `json:"-" bson:"thumbnail_key,omitempty"`
+	HasThumbnail bool               `json:"has_thumbnail" bson:"-"`
+	UploadedAt   time.Time          `json:"uploaded_at" bson:"uploaded_at"`
+}
+
+//MediaHandler a product media handler
+type MediaHandler struct {
+	Col     dbiface.CollectionAPI
+	Store   storage.BlobStore
+	MaxSize int64
+	// MaxAge is how long clients may cache media, in seconds
+	MaxAge int
+}
+
+//thumbnail scales an image down to fit in a size x size square
+func thumbnail(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return src
+	}
+	tw, th := size, h*size/w
+	if h > w {
+		tw, th = w*size/h, size
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	// average the source pixels that fall into each destination pixel
+	for y := 0; y < th; y++ {
+		y0, y1 := b.Min.Y+y*h/th, b.Min.Y+(y+1)*h/th
+		for x := 0; x < tw; x++ {
+			x0, x1 := b.Min.X+x*w/tw, b.Min.X+(x+1)*w/tw
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(pr), g+uint64(pg), bl+uint64(pb), a+uint64(pa), n+1
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(bl / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
+
+//checkImage reads the header of an image and refuses images with more than
+//maxImagePixels pixels, before they are decoded
+func checkImage(data []byte) error {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to read the image")
+	}
+	if int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Images are limited to %d pixels", maxImagePixels))
+	}
+	return nil
+}
+
+//makeThumbnail returns the encoded thumbnail of an image and its content type.
+//The image must have passed checkImage.
+func makeThumbnail(data []byte, contentType string) ([]byte, string, error) {
+	if contentType == "application/pdf" {
+		return nil, "", fmt.Errorf("no thumbnails for %s", contentType)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	var buf bytes.Buffer
+	thumb := thumbnail(img, thumbnailSize)
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+		return buf.Bytes(), "image/jpeg", err
+	}
+	err = png.Encode(&buf, thumb)
+	return buf.Bytes(), "image/png", err
+}
+
+func findMedia(product Product, id string) (Media, error) {
+	for _, m := range product.Media {
+		if m.ID.Hex() == id {
+			return m, nil
+		}
+	}
+	return Media{}, echo.NewHTTPError(http.StatusNotFound, "Media does not exist")
+}
+
+func (h *MediaHandler) product(ctx context.Context, id string) (Product, error) {
+	if _, err := productObjectID(ctx, id, h.Col); err != nil {
+		return Product{}, err
+	}
+	return findProduct(ctx, id, h.Col)
+}
+
+//shownProduct finds the product of a request to read its media, drafts and
+//archived products are only shown to admins
+func (h *MediaHandler) shownProduct(c echo.Context) (Product, error) {
+	product, err := h.product(storageContext(c), c.Param("id"))
+	if err == nil && !isAdminFromContext(c) && product.status() != StatusPublished {
+		return product, echo.NewHTTPError(http.StatusNotFound, "Product does not exist")
+	}
+	return product, err
+}
+
+//UploadMedia stores a multipart file upload and attaches it to a product
+func (h *MediaHandler) UploadMedia(c echo.Context) error {
+	ctx := storageContext(c)
+	//stored files are not part of the transaction of an atomic batch
+	if inAtomicBatch(ctx) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Files cannot be uploaded in an atomic batch")
+	}
+	product, err := h.product(ctx, c.Param("id"))
+	if err != nil {
+		return err
+	}
+	fh, err := c.FormFile("file")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Missing file")
+	}
+	if fh.Size > h.MaxSize {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("Files are limited to %d bytes", h.MaxSize))
+	}
+	f, err := fh.Open()
+	if err != nil {
+		log.Errorf("Unable to open the upload : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to read the file")
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(f, h.MaxSize+1))
+	if err != nil {
+		log.Errorf("Unable to read the upload : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to read the file")
+	}
+	if int64(len(data)) > h.MaxSize {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("Files are limited to %d bytes", h.MaxSize))
+	}
+
+	// trust the bytes, not the content type the client claims
+	contentType := http.DetectContentType(data)
+	if !mediaTypes[contentType] {
+		return echo.NewHTTPError(http.StatusUnsupportedMediaType, fmt.Sprintf("Unsupported file type %s", contentType))
+	}
+	kind := c.FormValue("kind")
+	if kind == "" {
+		kind = "attachment"
+		if contentType != "application/pdf" {
+			kind = "image"
+		}
+	}
+	sum := sha256.Sum256(data)
+	media := Media{
+		ID:          primitive.NewObjectID(),
+		Kind:        kind,
+		FileName:    path.Base(fh.Filename),
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		SHA256:      hex.EncodeToString(sum[:]),
+		UploadedAt:  time.Now().UTC(),
+	}
+	if err := v.Struct(media); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload.")
+	}
+	if contentType != "application/pdf" {
+		if err := checkImage(data); err != nil {
+			return err
+		}
+	}
+	media.Key = fmt.Sprintf("products/%s/%s", product.ID.Hex(), media.SHA256)
+	if err := h.Store.Put(ctx, media.Key, bytes.NewReader(data), media.Size, contentType); err != nil {
+		log.Errorf("Unable to store the media : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to store the file")
+	}
+	if kind == "image" {
+		thumb, thumbType, err := makeThumbnail(data, contentType)
+		if err != nil {
+			log.Warnf("Unable to make a thumbnail of %s : %v", media.Key, err)
+		} else {
+			media.ThumbnailKey = media.Key + ".thumb"
+			if err := h.Store.Put(ctx, media.ThumbnailKey, bytes.NewReader(thumb), int64(len(thumb)), thumbType); err != nil {
+				log.Errorf("Unable to store the thumbnail : %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, "Unable to store the thumbnail")
+			}
+		}
+	}
+	if _, err := h.Col.UpdateOne(ctx, bson.M{"_id": product.ID}, touch(bson.M{"$push": bson.M{"media": media}})); err != nil {
+		log.Errorf("Unable to attach the media : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to attach the file")
+	}
+	media.HasThumbnail = media.ThumbnailKey != ""
+	return c.JSON(http.StatusCreated, media)
+}
+
+//GetMediaList lists the media of a product
+func (h *MediaHandler) GetMediaList(c echo.Context) error {
+	product, err := h.shownProduct(c)
+	if err != nil {
+		return err
+	}
+	media := product.Media
+	if media == nil {
+		media = []Media{}
+	}
+	for i := range media {
+		media[i].HasThumbnail = media[i].ThumbnailKey != ""
+	}
+	return c.JSON(http.StatusOK, media)
+}
+
+//serve streams a stored file, the files of unpublished products are not kept by shared caches
+func (h *MediaHandler) serve(c echo.Context, public bool, key, contentType, etag string) error {
+	res := c.Response()
+	res.Header().Set("ETag", etag)
+	scope := "private"
+	if public {
+		scope = "public"
+	}
+	// keys are derived from the content, so a key never changes what it serves
+	res.Header().Set("Cache-Control", fmt.Sprintf("%s, max-age=%d, immutable", scope, h.MaxAge))
+	if c.Request().Header.Get("If-None-Match") == etag {
+		return c.NoContent(http.StatusNotModified)
+	}
+	blob, err := h.Store.Get(storageContext(c), key)
+	if err == storage.ErrNotFound {
+		return echo.NewHTTPError(http.StatusNotFound, "Media does not exist")
+	}
+	if err != nil {
+		log.Errorf("Unable to read the media : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to read the file")
+	}
+	defer blob.Close()
+	return c.Stream(http.StatusOK, contentType, blob)
+}
+
+//GetMedia serves a media file
+func (h *MediaHandler) GetMedia(c echo.Context) error {
+	product, err := h.shownProduct(c)
+	if err != nil {
+		return err
+	}
+	media, err := findMedia(product, c.Param("mid"))
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("inline; filename=%q", media.FileName))
+	return h.serve(c, product.status() == StatusPublished, media.Key, media.ContentType, `"`+media.SHA256+`"`)
+}
+
+//GetThumbnail serves the thumbnail of an image
+func (h *MediaHandler) GetThumbnail(c echo.Context) error {
+	product, err := h.shownProduct(c)
+	if err != nil {
+		return err
+	}
+	media, err := findMedia(product, c.Param("mid"))
+	if err != nil {
+		return err
+	}
+	if media.ThumbnailKey == "" {
+		return echo.NewHTTPError(http.StatusNotFound, "Media has no thumbnail")
+	}
+	contentType := "image/png"
+	if media.ContentType == "image/jpeg" {
+		contentType = "image/jpeg"
+	}
+	return h.serve(c, product.status() == StatusPublished, media.ThumbnailKey, contentType, `"`+media.SHA256+`-thumb"`)
+}
+
+//DeleteMedia detaches a media file from a product and deletes it
+func (h *MediaHandler) DeleteMedia(c echo.Context) error {
+	ctx := storageContext(c)
+	product, err := h.product(ctx, c.Param("id"))
+	if err != nil {
+		return err
+	}
+	media, err := findMedia(product, c.Param("mid"))
+	if err != nil {
+		return err
+	}
+	if _, err := h.Col.UpdateOne(ctx, bson.M{"_id": product.ID}, touch(bson.M{"$pull": bson.M{"media": bson.M{"_id": media.ID}}})); err != nil {
+		log.Errorf("Unable to detach the media : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to delete the file")
+	}
+	// the same file may have been uploaded again under another id
+	for _, m := range product.Media {
+		if m.ID != media.ID && m.Key == media.Key {
+			return c.NoContent(http.StatusNoContent)
+		}
+	}
+	//the blobs stay until the media is detached for good
+	afterCommit(ctx, func() {
+		for _, key := range []string{media.Key, media.ThumbnailKey} {
+			if key == "" {
+				continue
+			}
+			if err := h.Store.Delete(context.Background(), key); err != nil {
+				log.Errorf("Unable to delete the blob %s : %v", key, err)
+			}
+		}
+	})
+	return c.NoContent(http.StatusNoContent)
+}
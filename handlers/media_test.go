@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/inerts73/tronicscorp/storage"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//webpImage is a 1x1 lossless WebP image
+const webpImage = "UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA=="
+
+func pngImage(t *testing.T, w, h int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		img.Set(x, 0, color.RGBA{R: 255, A: 255})
+	}
+	var buf bytes.Buffer
+	assert.Nil(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+//pngHeader is the start of a PNG claiming the given size, enough for image.DecodeConfig
+func pngHeader(w, h uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], w)
+	binary.BigEndian.PutUint32(ihdr[8:], h)
+	ihdr[12], ihdr[13] = 8, 6 // 8 bits, RGBA
+	data := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0d")
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(ihdr))
+	return append(append(data, ihdr...), crc...)
+}
+
+func TestCheckImage(t *testing.T) {
+	assert.Nil(t, checkImage(pngImage(t, 10, 10)))
+	err := checkImage(pngHeader(100000, 100000))
+	if assertHTTPError(t, err, http.StatusBadRequest) {
+		assert.Contains(t, err.(*echo.HTTPError).Message, "pixels")
+	}
+	err = checkImage([]byte("not an image"))
+	assertHTTPError(t, err, http.StatusBadRequest)
+}
+
+func TestMakeThumbnail(t *testing.T) {
+	thumb, contentType, err := makeThumbnail(pngImage(t, 1000, 500), "image/png")
+	assert.Nil(t, err)
+	assert.Equal(t, "image/png", contentType)
+	config, err := png.DecodeConfig(bytes.NewReader(thumb))
+	assert.Nil(t, err)
+	assert.Equal(t, thumbnailSize, config.Width)
+	assert.Equal(t, thumbnailSize/2, config.Height)
+
+	webp, err := base64.StdEncoding.DecodeString(webpImage)
+	assert.Nil(t, err)
+	assert.Equal(t, "image/webp", http.DetectContentType(webp))
+	assert.Nil(t, checkImage(webp))
+	_, contentType, err = makeThumbnail(webp, "image/webp")
+	assert.Nil(t, err)
+	assert.Equal(t, "image/png", contentType)
+
+	_, _, err = makeThumbnail([]byte("%PDF-1.4"), "application/pdf")
+	assert.NotNil(t, err)
+}
+
+func TestMedia(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "media")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	mh := MediaHandler{Col: col, Store: &storage.LocalStore{Dir: dir}, MaxSize: 1 << 20, MaxAge: 60}
+	IDs, err := insertProducts(ctx, []Product{{Name: "camera", Price: 300, Currency: "USD", Vendor: "canon"}}, col)
+	if !assert.Nil(t, err) {
+		return
+	}
+	docID := IDs[0].(primitive.ObjectID).Hex()
+
+	upload := func(name string, data []byte) (echo.Context, *httptest.ResponseRecorder) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, err := mw.CreateFormFile("file", name)
+		assert.Nil(t, err)
+		fw.Write(data)
+		mw.Close()
+		req := httptest.NewRequest(http.MethodPost, "/", &body)
+		req.Header.Set(echo.HeaderContentType, mw.FormDataContentType())
+		res := httptest.NewRecorder()
+		c := echo.New().NewContext(req, res)
+		c.SetParamNames("id")
+		c.SetParamValues(docID)
+		return c, res
+	}
+
+	var media Media
+	t.Run("upload an image", func(t *testing.T) {
+		c, res := upload("photo.txt", pngImage(t, 600, 300))
+		assert.Nil(t, mh.UploadMedia(c))
+		assert.Equal(t, http.StatusCreated, res.Code)
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &media))
+		assert.Equal(t, "image/png", media.ContentType, "the type is sniffed from the bytes, not the name")
+		assert.Equal(t, "image", media.Kind)
+		assert.True(t, media.HasThumbnail)
+	})
+
+	t.Run("get the image and its thumbnail", func(t *testing.T) {
+		c, res := newRequest(http.MethodGet, "/", "", nil, "id", "mid", docID, media.ID.Hex())
+		assert.Nil(t, mh.GetMedia(c))
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, `"`+media.SHA256+`"`, res.Header().Get("ETag"))
+
+		c, res = newRequest(http.MethodGet, "/", "", nil, "id", "mid", docID, media.ID.Hex())
+		assert.Nil(t, mh.GetThumbnail(c))
+		config, err := png.DecodeConfig(res.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, thumbnailSize, config.Width)
+	})
+
+	t.Run("unsupported type", func(t *testing.T) {
+		c, _ := upload("notes.png", []byte("just some text"))
+		err := mh.UploadMedia(c)
+		assertHTTPError(t, err, http.StatusUnsupportedMediaType)
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		c, _ := upload("big.pdf", append([]byte("%PDF-1.4\n"), make([]byte, mh.MaxSize)...))
+		err := mh.UploadMedia(c)
+		assertHTTPError(t, err, http.StatusRequestEntityTooLarge)
+	})
+
+	t.Run("too many pixels", func(t *testing.T) {
+		c, _ := upload("bomb.png", pngHeader(100000, 100000))
+		err := mh.UploadMedia(c)
+		assertHTTPError(t, err, http.StatusBadRequest)
+	})
+
+	t.Run("media of drafts are hidden", func(t *testing.T) {
+		_, err := col.UpdateOne(ctx, bson.M{"_id": IDs[0]}, bson.M{"$set": bson.M{"status": StatusDraft}})
+		assert.Nil(t, err)
+		defer col.UpdateOne(ctx, bson.M{"_id": IDs[0]}, bson.M{"$unset": bson.M{"status": ""}})
+
+		c, _ := newRequest(http.MethodGet, "/", "", nil, "id", "mid", docID, media.ID.Hex())
+		assertHTTPError(t, mh.GetMedia(c), http.StatusNotFound)
+		c, _ = newRequest(http.MethodGet, "/", "", userClaims("user@tronics.com"), "id", docID)
+		assertHTTPError(t, mh.GetMediaList(c), http.StatusNotFound)
+
+		c, res := newRequest(http.MethodGet, "/", "", adminClaims, "id", "mid", docID, media.ID.Hex())
+		assert.Nil(t, mh.GetThumbnail(c))
+		assert.Contains(t, res.Header().Get("Cache-Control"), "private")
+	})
+
+	t.Run("delete the image", func(t *testing.T) {
+		c, res := newRequest(http.MethodGet, "/", "", nil, "id", "mid", docID, media.ID.Hex())
+		assert.Nil(t, mh.DeleteMedia(c))
+		assert.Equal(t, http.StatusNoContent, res.Code)
+		_, err := os.Stat(dir + "/" + media.Key)
+		assert.True(t, os.IsNotExist(err))
+
+		c, _ = newRequest(http.MethodGet, "/", "", nil, "id", "mid", docID, media.ID.Hex())
+		err = mh.GetMedia(c)
+		assertHTTPError(t, err, http.StatusNotFound)
+	})
+}
@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inerts73/tronicscorp/dbiface"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/go-playground/validator.v9"
+)
+
+//currencies maps the active ISO 4217 codes to the number of digits of their minor unit
+var currencies = map[string]int{
+	"AED": 2, "AFN": 2, "ALL": 2, "AMD": 2, "ANG": 2, "AOA": 2, "ARS": 2, "AUD": 2, "AWG": 2, "AZN": 2,
+	"BAM": 2, "BBD": 2, "BDT": 2, "BGN": 2, "BHD": 3, "BIF": 0, "BMD": 2, "BND": 2, "BOB": 2, "BRL": 2,
+	"BSD": 2, "BTN": 2, "BWP": 2, "BYN": 2, "BZD": 2, "CAD": 2, "CDF": 2, "CHF": 2, "CLP": 0, "CNY": 2,
+	"COP": 2, "CRC": 2, "CUP": 2, "CVE": 2, "CZK": 2, "DJF": 0, "DKK": 2, "DOP": 2, "DZD": 2, "EGP": 2,
+	"ERN": 2, "ETB": 2, "EUR": 2, "FJD": 2, "FKP": 2, "GBP": 2, "GEL": 2, "GHS": 2, "GIP": 2, "GMD": 2,
+	"GNF": 0, "GTQ": 2, "GYD": 2, "HKD": 2, "HNL": 2, "HTG": 2, "HUF": 2, "IDR": 2, "ILS": 2, "INR": 2,
+	"IQD": 3, "IRR": 2, "ISK": 0, "JMD": 2, "JOD": 3, "JPY": 0, "KES": 2, "KGS": 2, "KHR": 2, "KMF": 0,
+	"KPW": 2, "KRW": 0, "KWD": 3, "KYD": 2, "KZT": 2, "LAK": 2, "LBP": 2, "LKR": 2, "LRD": 2, "LSL": 2,
+	"LYD": 3, "MAD": 2, "MDL": 2, "MGA": 2, "MKD": 2, "MMK": 2, "MNT": 2, "MOP": 2, "MRU": 2, "MUR": 2,
+	"MVR": 2, "MWK": 2, "MXN": 2, "MYR": 2, "MZN": 2, "NAD": 2, "NGN": 2, "NIO": 2, "NOK": 2, "NPR": 2,
+	"NZD": 2, "OMR": 3, "PAB": 2, "PEN": 2, "PGK": 2, "PHP": 2, "PKR": 2, "PLN": 2, "PYG": 0, "QAR": 2,
+	"RON": 2, "RSD": 2, "RUB": 2, "RWF": 0, "SAR": 2, "SBD": 2, "SCR": 2, "SDG": 2, "SEK": 2, "SGD": 2,
+	"SHP": 2, "SLE": 2, "SOS": 2, "SRD": 2, "SSP": 2, "STN": 2, "SYP": 2, "SZL": 2, "THB": 2, "TJS": 2,
+	"TMT": 2, "TND": 3, "TOP": 2, "TRY": 2, "TTD": 2, "TWD": 2, "TZS": 2, "UAH": 2, "UGX": 0, "USD": 2,
+	"UYU": 2, "UZS": 2, "VES": 2, "VND": 0, "VUV": 0, "WST": 2, "XAF": 0, "XCD": 2, "XOF": 0, "XPF": 0,
+	"YER": 2, "ZAR": 2, "ZMW": 2, "ZWL": 2,
+}
+
+func init() {
+	v.RegisterValidation("iso4217", func(fl validator.FieldLevel) bool {
+		_, ok := currencies[fl.Field().String()]
+		return ok
+	})
+}
+
+//Money is an amount in the minor unit of a currency, e.g. cents for USD
+type Money struct {
+	Amount   int64  `json:"amount" bson:"amount" validate:"min=0"`
+	Currency string `json:"currency" bson:"currency" validate:"required,iso4217"`
+}
+
+func (m Money) String() string {
+	digits := currencies[m.Currency]
+	if digits == 0 {
+		return fmt.Sprintf("%d %s", m.Amount, m.Currency)
+	}
+	sign, amount := "", m.Amount
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	unit := pow10(digits)
+	return fmt.Sprintf("%s%d.%0*d %s", sign, amount/unit, digits, amount%unit, m.Currency)
+}
+
+func pow10(n int) int64 {
+	p := int64(1)
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
+
+//majorUnits converts an amount in major units, e.g. dollars, to Money
+func majorUnits(amount int, currency string) Money {
+	return Money{Amount: int64(amount) * pow10(currencies[currency]), Currency: currency}
+}
+
+//roundHalfAwayFromZero rounds r to the nearest integer, ties away from zero
+func roundHalfAwayFromZero(r *big.Rat) int64 {
+	num, den := new(big.Int).Set(r.Num()), r.Denom()
+	neg := num.Sign() < 0
+	num.Abs(num)
+	q, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if rem.Lsh(rem, 1).Cmp(den) >= 0 {
+		q.Add(q, big.NewInt(1))
+	}
+	if neg {
+		q.Neg(q)
+	}
+	return q.Int64()
+}
+
+//ExchangeRates holds how many units of each currency one unit of Base buys
+type ExchangeRates struct {
+	Base      string             `json:"base" bson:"base" validate:"required,iso4217"`
+	Rates     map[string]float64 `json:"rates" bson:"rates" validate:"required,dive,keys,iso4217,endkeys,gt=0"`
+	UpdatedAt time.Time          `json:"updated_at" bson:"updated_at"`
+}
+
+//RateTable is the exchange rate table shared by the handlers
+type RateTable struct {
+	mu    sync.RWMutex
+	rates ExchangeRates
+}
+
+//Set replaces the exchange rates
+func (t *RateTable) Set(rates ExchangeRates) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rates = rates
+}
+
+//Get returns the current exchange rates
+func (t *RateTable) Get() ExchangeRates {
+	if t == nil {
+		return ExchangeRates{}
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.rates
+}
+
+func (t *RateTable) rate(currency string) (*big.Rat, bool) {
+	rates := t.Get()
+	if currency == rates.Base {
+		return big.NewRat(1, 1), true
+	}
+	f, ok := rates.Rates[currency]
+	if !ok {
+		return nil, false
+	}
+	// go through the shortest decimal form so 0.1 is exactly one tenth
+	r, ok := new(big.Rat).SetString(strconv.FormatFloat(f, 'g', -1, 64))
+	return r, ok
+}
+
+//Convert converts m into currency. The result is rounded to the minor unit of
+//currency, with ties rounded away from zero, e.g. 0.5 cents becomes 1 cent.
+func (t *RateTable) Convert(m Money, currency string) (Money, error) {
+	if _, ok := currencies[currency]; !ok {
+		return Money{}, fmt.Errorf("unknown currency %q", currency)
+	}
+	if m.Currency == currency {
+		return m, nil
+	}
+	from, ok := t.rate(m.Currency)
+	if !ok {
+		return Money{}, fmt.Errorf("no exchange rate for %s", m.Currency)
+	}
+	to, ok := t.rate(currency)
+	if !ok {
+		return Money{}, fmt.Errorf("no exchange rate for %s", currency)
+	}
+	amount := new(big.Rat).SetInt64(m.Amount)
+	amount.Mul(amount, to)
+	amount.Quo(amount, from)
+	amount.Mul(amount, new(big.Rat).SetFrac64(pow10(currencies[currency]), pow10(currencies[m.Currency])))
+	return Money{Amount: roundHalfAwayFromZero(amount), Currency: currency}, nil
+}
+
+//LoadExchangeRates reads exchange rates from a json file
+func LoadExchangeRates(path string) (ExchangeRates, error) {
+	var rates ExchangeRates
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return rates, err
+	}
+	if err := json.Unmarshal(b, &rates); err != nil {
+		return rates, err
+	}
+	if err := v.Struct(rates); err != nil {
+		return rates, err
+	}
+	return rates, nil
+}
+
+//RatesHandler an exchange rates handler
+type RatesHandler struct {
+	Col   dbiface.CollectionAPI
+	Rates *RateTable
+}
+
+const currentRatesID = "current"
+
+//LoadStoredRates loads the exchange rates last set through the admin endpoint
+func (h *RatesHandler) LoadStoredRates(ctx context.Context) error {
+	var rates ExchangeRates
+	res := h.Col.FindOne(ctx, bson.M{"_id": currentRatesID})
+	if err := res.Decode(&rates); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		return err
+	}
+	h.Rates.Set(rates)
+	return nil
+}
+
+//GetRates gets the exchange rates
+func (h *RatesHandler) GetRates(c echo.Context) error {
+	return c.JSON(http.StatusOK, h.Rates.Get())
+}
+
+//SetRates replaces the exchange rates
+func (h *RatesHandler) SetRates(c echo.Context) error {
+	var rates ExchangeRates
+	if err := c.Bind(&rates); err != nil {
+		log.Errorf("Unable to bind to exchange rates : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	rates.Base = strings.ToUpper(rates.Base)
+	if err := v.Struct(rates); err != nil {
+		log.Errorf("Unable to validate the exchange rates : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload.")
+	}
+	rates.UpdatedAt = time.Now().UTC()
+	_, err := h.Col.UpdateOne(storageContext(c), bson.M{"_id": currentRatesID}, bson.M{"$set": rates}, options.Update().SetUpsert(true))
+	if err != nil {
+		log.Errorf("Unable to store the exchange rates : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to store the exchange rates")
+	}
+	h.Rates.Set(rates)
+	return c.JSON(http.StatusOK, rates)
+}
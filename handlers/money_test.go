@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMoney(t *testing.T) {
+	rates := &RateTable{}
+	rates.Set(ExchangeRates{Base: "USD", Rates: map[string]float64{"EUR": 0.9, "INR": 75, "JPY": 110, "KWD": 0.3}})
+
+	t.Run("format", func(t *testing.T) {
+		assert.Equal(t, "12.05 USD", Money{Amount: 1205, Currency: "USD"}.String())
+		assert.Equal(t, "-0.50 EUR", Money{Amount: -50, Currency: "EUR"}.String())
+		assert.Equal(t, "120 JPY", Money{Amount: 120, Currency: "JPY"}.String())
+	})
+
+	t.Run("validate currency", func(t *testing.T) {
+		assert.Nil(t, v.Struct(Money{Amount: 1, Currency: "INR"}))
+		assert.NotNil(t, v.Struct(Money{Amount: 1, Currency: "XYZ"}))
+		assert.NotNil(t, v.Struct(Money{Amount: -1, Currency: "INR"}))
+		assert.NotNil(t, v.Struct(Product{Name: "phone", Currency: "INR", Vendor: "google", Price: 10, Prices: []Money{{Amount: -100, Currency: "USD"}}}))
+	})
+
+	t.Run("convert", func(t *testing.T) {
+		cases := []struct {
+			from     Money
+			currency string
+			want     Money
+		}{
+			{Money{Amount: 1000, Currency: "USD"}, "EUR", Money{Amount: 900, Currency: "EUR"}},
+			{Money{Amount: 900, Currency: "EUR"}, "USD", Money{Amount: 1000, Currency: "USD"}},
+			{Money{Amount: 7500, Currency: "INR"}, "JPY", Money{Amount: 110, Currency: "JPY"}},
+			{Money{Amount: 1000, Currency: "USD"}, "KWD", Money{Amount: 3000, Currency: "KWD"}},
+			// 1 cent is 0.9 euro cents, rounded up
+			{Money{Amount: 1, Currency: "USD"}, "EUR", Money{Amount: 1, Currency: "EUR"}},
+			// 5 yen is 3.409... INR, i.e. 340.909... paise
+			{Money{Amount: 5, Currency: "JPY"}, "INR", Money{Amount: 341, Currency: "INR"}},
+		}
+		for _, tc := range cases {
+			got, err := rates.Convert(tc.from, tc.currency)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.want, got, "%s to %s", tc.from, tc.currency)
+		}
+	})
+
+	t.Run("ties round away from zero", func(t *testing.T) {
+		half := &RateTable{}
+		half.Set(ExchangeRates{Base: "USD", Rates: map[string]float64{"EUR": 0.5}})
+		got, err := half.Convert(Money{Amount: 5, Currency: "USD"}, "EUR")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(3), got.Amount)
+		got, err = half.Convert(Money{Amount: -5, Currency: "USD"}, "EUR")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(-3), got.Amount)
+	})
+
+	t.Run("missing rate", func(t *testing.T) {
+		_, err := rates.Convert(Money{Amount: 100, Currency: "USD"}, "GBP")
+		assert.NotNil(t, err)
+	})
+
+	t.Run("price list wins over conversion", func(t *testing.T) {
+		p := Product{Price: 10, Currency: "USD", Prices: []Money{{Amount: 999, Currency: "EUR"}}}
+		got, err := p.PriceIn("EUR", rates)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(999), got.Amount)
+		got, err = p.PriceIn("INR", rates)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(75000), got.Amount)
+	})
+}
@@ -0,0 +1,509 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+//Media types the product routes read and write besides JSON
+const (
+	MIMEApplicationMsgpack = "application/msgpack"
+	MIMETextCSV            = "text/csv"
+)
+
+//mediaAliases maps other names of the supported media types to the one used
+var mediaAliases = map[string]string{
+	echo.MIMEApplicationJSON: echo.MIMEApplicationJSON,
+	echo.MIMEApplicationXML:  echo.MIMEApplicationXML,
+	echo.MIMETextXML:         echo.MIMEApplicationXML,
+	MIMEApplicationMsgpack:   MIMEApplicationMsgpack,
+	"application/x-msgpack":  MIMEApplicationMsgpack,
+	MIMETextCSV:              MIMETextCSV,
+}
+
+//negotiate picks the media type of the response from the Accept header, JSON
+//when any type will do. CSV is only offered for lists.
+func negotiate(accept string, list bool) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return echo.MIMEApplicationJSON, true
+	}
+	type mediaRange struct {
+		mediaType string
+		q         float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, mediaRange{mediaType, q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+	for _, r := range ranges {
+		switch r.mediaType {
+		case "*/*", "application/*":
+			return echo.MIMEApplicationJSON, true
+		case "text/*":
+			if list {
+				return MIMETextCSV, true
+			}
+			return echo.MIMEApplicationXML, true
+		}
+		if mediaType, ok := mediaAliases[r.mediaType]; ok && (list || mediaType != MIMETextCSV) {
+			return mediaType, true
+		}
+	}
+	return "", false
+}
+
+//respond writes data in the media type the client accepts, or answers 406
+func respond(c echo.Context, status int, data interface{}) error {
+	list := reflect.Indirect(reflect.ValueOf(data)).Kind() == reflect.Slice
+	mediaType, ok := negotiate(c.Request().Header.Get(echo.HeaderAccept), list)
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotAcceptable, "Responses are available as application/json, application/xml, application/msgpack or, for lists, text/csv")
+	}
+	c.Response().Header().Add(echo.HeaderVary, echo.HeaderAccept)
+	if mediaType == echo.MIMEApplicationJSON {
+		return c.JSON(status, data)
+	}
+	tree, err := jsonTree(data)
+	if err != nil {
+		log.Errorf("Unable to encode the response : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to encode the response")
+	}
+	var buf bytes.Buffer
+	switch mediaType {
+	case echo.MIMEApplicationXML:
+		buf.WriteString(xml.Header)
+		root, item := xmlNames(data)
+		err = writeXML(xml.NewEncoder(&buf), root, item, tree)
+	case MIMEApplicationMsgpack:
+		err = msgpack.NewEncoder(&buf).Encode(msgpackValue(tree))
+	case MIMETextCSV:
+		err = writeCSV(&buf, tree.([]interface{}))
+	}
+	if err != nil {
+		log.Errorf("Unable to encode the response : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to encode the response")
+	}
+	contentType := mediaType
+	if mediaType != MIMEApplicationMsgpack {
+		contentType += "; charset=UTF-8"
+	}
+	return c.Blob(status, contentType, buf.Bytes())
+}
+
+//requestJSON reads the request body in the format of its Content-Type and
+//returns it as JSON for a value of type t, or answers 415
+func requestJSON(c echo.Context, t reflect.Type) (io.Reader, error) {
+	mediaType := echo.MIMEApplicationJSON
+	if header := c.Request().Header.Get(echo.HeaderContentType); header != "" {
+		parsed, _, err := mime.ParseMediaType(header)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusUnsupportedMediaType, "Invalid Content-Type")
+		}
+		if mediaType = mediaAliases[parsed]; mediaType == "" {
+			return nil, echo.NewHTTPError(http.StatusUnsupportedMediaType, "Request bodies are read as application/json, application/xml, application/msgpack or text/csv")
+		}
+	}
+	body := c.Request().Body
+	if mediaType == echo.MIMEApplicationJSON {
+		return body, nil
+	}
+	var tree interface{}
+	var err error
+	switch mediaType {
+	case echo.MIMEApplicationXML:
+		var root xmlNode
+		if err = xml.NewDecoder(body).Decode(&root); err == nil {
+			tree = root.tree(t)
+		}
+	case MIMEApplicationMsgpack:
+		err = msgpack.NewDecoder(body).Decode(&tree)
+	case MIMETextCSV:
+		tree, err = readCSV(body, t)
+	}
+	if err != nil {
+		log.Errorf("Unable to decode the %s request : %v", mediaType, err)
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	data, err := json.Marshal(tree)
+	if err != nil {
+		log.Errorf("Unable to decode the %s request : %v", mediaType, err)
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	return bytes.NewReader(data), nil
+}
+
+//jsonTree turns data into the maps, slices and values of its JSON, so every
+//format has the fields and names of the JSON responses
+func jsonTree(data interface{}) (interface{}, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var tree interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	return tree, dec.Decode(&tree)
+}
+
+func msgpackValue(tree interface{}) interface{} {
+	switch v := tree.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		for i := range v {
+			v[i] = msgpackValue(v[i])
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = msgpackValue(v[k])
+		}
+	}
+	return tree
+}
+
+//xmlNames names the root element of an XML response and the elements of its
+//items after its type, e.g. products and product for a []Product
+func xmlNames(data interface{}) (string, string) {
+	t := reflect.TypeOf(data)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Slice {
+		item := elementName(t.Elem())
+		return item + "s", item
+	}
+	return elementName(t), "item"
+}
+
+func elementName(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Name() == "" || t.Kind() == reflect.Interface {
+		return "item"
+	}
+	return strings.ToLower(t.Name()[:1]) + t.Name()[1:]
+}
+
+//writeXML writes a JSON tree as elements named after the keys. The items of a
+//root list are named itemName, those of nested arrays are item elements.
+func writeXML(enc *xml.Encoder, name, itemName string, tree interface{}) error {
+	if list, ok := tree.([]interface{}); ok {
+		start := xml.StartElement{Name: xml.Name{Local: name}}
+		if err := enc.EncodeToken(start); err != nil {
+			return err
+		}
+		for _, e := range list {
+			if err := writeXMLElement(enc, itemName, e); err != nil {
+				return err
+			}
+		}
+		if err := enc.EncodeToken(start.End()); err != nil {
+			return err
+		}
+	} else if err := writeXMLElement(enc, name, tree); err != nil {
+		return err
+	}
+	return enc.Flush()
+}
+
+func writeXMLElement(enc *xml.Encoder, name string, tree interface{}) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	switch v := tree.(type) {
+	case nil:
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if err := writeXMLElement(enc, k, v[k]); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, e := range v {
+			if err := writeXMLElement(enc, "item", e); err != nil {
+				return err
+			}
+		}
+	default:
+		if err := enc.EncodeToken(xml.CharData(fmt.Sprint(v))); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+//xmlNode is an element of an XML request
+type xmlNode struct {
+	XMLName  xml.Name
+	Children []xmlNode `xml:",any"`
+	Text     string    `xml:",chardata"`
+}
+
+//tree turns the element into the JSON tree of a value of type t, which tells
+//lists from single elements and numbers from text
+func (n xmlNode) tree(t reflect.Type) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	text := strings.TrimSpace(n.Text)
+	if t == timeType || t == objectIDType {
+		return text
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		fields := jsonFields(t)
+		object := map[string]interface{}{}
+		for _, child := range n.Children {
+			if f, ok := fields[child.XMLName.Local]; ok {
+				object[child.XMLName.Local] = child.tree(f)
+			}
+		}
+		return object
+	case reflect.Map:
+		object := map[string]interface{}{}
+		for _, child := range n.Children {
+			object[child.XMLName.Local] = child.tree(t.Elem())
+		}
+		return object
+	case reflect.Slice, reflect.Array:
+		list := []interface{}{}
+		for _, child := range n.Children {
+			list = append(list, child.tree(t.Elem()))
+		}
+		return list
+	case reflect.Interface:
+		if len(n.Children) > 0 {
+			return n.tree(reflect.TypeOf(map[string]interface{}{}))
+		}
+		return scalar(text)
+	case reflect.String:
+		return text
+	case reflect.Bool:
+		return text == "true"
+	}
+	if text == "" {
+		return nil
+	}
+	return json.Number(text)
+}
+
+//scalar reads text of an unknown type as a number or a boolean when it is one
+func scalar(text string) interface{} {
+	if _, err := strconv.ParseFloat(text, 64); err == nil {
+		return json.Number(text)
+	}
+	if b, err := strconv.ParseBool(text); err == nil && (text == "true" || text == "false") {
+		return b
+	}
+	return text
+}
+
+//jsonFields returns the types of the fields of a struct by JSON name,
+//including the fields of embedded structs
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.Anonymous && name == "" {
+			for k, v := range jsonFields(f.Type) {
+				fields[k] = v
+			}
+			continue
+		}
+		if f.PkgPath != "" || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+//csvColumns writes the objects of a JSON tree as dotted columns. Arrays are kept
+//as JSON in their cell.
+func csvColumns(prefix string, tree interface{}, row map[string]string) error {
+	switch v := tree.(type) {
+	case nil:
+	case map[string]interface{}:
+		for k, value := range v {
+			if err := csvColumns(prefix+k+".", value, row); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		cell, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		row[strings.TrimSuffix(prefix, ".")] = string(cell)
+	default:
+		row[strings.TrimSuffix(prefix, ".")] = fmt.Sprint(v)
+	}
+	return nil
+}
+
+//writeCSV writes a list as CSV with a header of the columns of all rows, sorted
+func writeCSV(w io.Writer, list []interface{}) error {
+	rows := make([]map[string]string, len(list))
+	columns := map[string]bool{}
+	for i, item := range list {
+		rows[i] = map[string]string{}
+		prefix := ""
+		if _, ok := item.(map[string]interface{}); !ok {
+			prefix = "value."
+		}
+		if err := csvColumns(prefix, item, rows[i]); err != nil {
+			return err
+		}
+		for k := range rows[i] {
+			columns[k] = true
+		}
+	}
+	header := make([]string, 0, len(columns))
+	for k := range columns {
+		header = append(header, k)
+	}
+	sort.Strings(header)
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		record := make([]string, len(header))
+		for i, k := range header {
+			record[i] = row[k]
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+//readCSV reads CSV with dotted columns into the JSON tree of a value of type
+//t, a list of its rows or, for a single value, its only row
+func readCSV(r io.Reader, t reflect.Type) (interface{}, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("missing the header")
+	}
+	rowType := t
+	if t.Kind() == reflect.Slice {
+		rowType = t.Elem()
+	} else if len(records) != 2 {
+		return nil, fmt.Errorf("expected a single row, got %d", len(records)-1)
+	}
+	list := []interface{}{}
+	for _, record := range records[1:] {
+		row := map[string]interface{}{}
+		for i, column := range records[0] {
+			if i >= len(record) || record[i] == "" {
+				continue
+			}
+			if err := setColumn(row, strings.Split(column, "."), record[i], rowType); err != nil {
+				return nil, fmt.Errorf("column %s: %v", column, err)
+			}
+		}
+		list = append(list, row)
+	}
+	if t.Kind() == reflect.Slice {
+		return list, nil
+	}
+	return list[0], nil
+}
+
+func setColumn(object map[string]interface{}, path []string, cell string, t reflect.Type) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var field reflect.Type
+	switch {
+	case t.Kind() == reflect.Map:
+		field = t.Elem()
+	case t.Kind() == reflect.Struct && t != timeType && t != objectIDType:
+		f, ok := jsonFields(t)[path[0]]
+		if !ok {
+			return nil
+		}
+		field = f
+	default:
+		return fmt.Errorf("%s is not an object", path[0])
+	}
+	if len(path) > 1 {
+		child, ok := object[path[0]].(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{}
+			object[path[0]] = child
+		}
+		return setColumn(child, path[1:], cell, field)
+	}
+	for field.Kind() == reflect.Ptr {
+		field = field.Elem()
+	}
+	switch {
+	case field == timeType || field == objectIDType || field.Kind() == reflect.String:
+		object[path[0]] = cell
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(cell)
+		if err != nil {
+			return err
+		}
+		object[path[0]] = b
+	case field.Kind() == reflect.Interface:
+		object[path[0]] = scalar(cell)
+	case field.Kind() == reflect.Slice, field.Kind() == reflect.Map, field.Kind() == reflect.Struct:
+		var value interface{}
+		if err := json.Unmarshal([]byte(cell), &value); err != nil {
+			return err
+		}
+		object[path[0]] = value
+	default:
+		object[path[0]] = json.Number(cell)
+	}
+	return nil
+}
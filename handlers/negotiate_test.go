@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNegotiate(t *testing.T) {
+	testCases := []struct {
+		accept    string
+		list      bool
+		mediaType string
+		ok        bool
+	}{
+		{"", false, echo.MIMEApplicationJSON, true},
+		{"*/*", true, echo.MIMEApplicationJSON, true},
+		{"application/xml", false, echo.MIMEApplicationXML, true},
+		{"text/xml", false, echo.MIMEApplicationXML, true},
+		{"application/x-msgpack", false, MIMEApplicationMsgpack, true},
+		{"text/csv", true, MIMETextCSV, true},
+		{"text/csv", false, "", false},
+		{"text/csv, application/json;q=0.5", false, echo.MIMEApplicationJSON, true},
+		{"application/json;q=0.2, application/xml;q=0.8", false, echo.MIMEApplicationXML, true},
+		{"application/xml;q=0", false, "", false},
+		{"text/html", false, "", false},
+	}
+	for _, tc := range testCases {
+		mediaType, ok := negotiate(tc.accept, tc.list)
+		assert.Equal(t, tc.ok, ok, tc.accept)
+		assert.Equal(t, tc.mediaType, mediaType, tc.accept)
+	}
+}
+
+func negotiated(accept string, data interface{}) (*httptest.ResponseRecorder, error) {
+	req := httptest.NewRequest(http.MethodGet, "/products", nil)
+	req.Header.Set(echo.HeaderAccept, accept)
+	res := httptest.NewRecorder()
+	return res, respond(echo.New().NewContext(req, res), http.StatusOK, data)
+}
+
+func TestRespond(t *testing.T) {
+	id := primitive.NewObjectID()
+	products := []Product{{
+		ID:          id,
+		Name:        "phone",
+		Price:       120,
+		Currency:    "EUR",
+		Accessories: []string{"a", "b"},
+		Attributes:  map[string]interface{}{"color": "red"},
+	}}
+
+	res, err := negotiated(echo.MIMEApplicationXML, products)
+	assert.Nil(t, err)
+	assert.Equal(t, "application/xml; charset=UTF-8", res.Header().Get(echo.HeaderContentType))
+	assert.Equal(t, echo.HeaderAccept, res.Header().Get(echo.HeaderVary))
+	assert.Contains(t, res.Body.String(), "<products><product>")
+	assert.Contains(t, res.Body.String(), "<_id>"+id.Hex()+"</_id>")
+	assert.Contains(t, res.Body.String(), "<accessories><item>a</item><item>b</item></accessories>")
+	assert.Contains(t, res.Body.String(), "<attributes><color>red</color></attributes>")
+
+	res, err = negotiated(MIMEApplicationMsgpack, products[0])
+	assert.Nil(t, err)
+	assert.Equal(t, MIMEApplicationMsgpack, res.Header().Get(echo.HeaderContentType))
+	var decoded map[string]interface{}
+	assert.Nil(t, msgpack.Unmarshal(res.Body.Bytes(), &decoded))
+	assert.Equal(t, "phone", decoded["product_name"])
+	assert.EqualValues(t, 120, decoded["price"])
+
+	res, err = negotiated(MIMETextCSV, products)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(res.Body.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[0], "attributes.color")
+	assert.Contains(t, lines[1], `"[""a"",""b""]"`)
+
+	_, err = negotiated(MIMETextCSV, products[0])
+	assertHTTPError(t, err, http.StatusNotAcceptable)
+}
+
+func readRequest(contentType string, body []byte, v interface{}) error {
+	req := httptest.NewRequest(http.MethodPost, "/products", bytes.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, contentType)
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+	r, err := requestJSON(c, reflect.TypeOf(v).Elem())
+	if err != nil {
+		return err
+	}
+	return json.NewDecoder(r).Decode(v)
+}
+
+func TestRequestJSON(t *testing.T) {
+	var product Product
+	xmlBody := `<product><product_name>phone</product_name><price>120</price><currency>EUR</currency>
+<accessories><item>a</item><item>b</item></accessories><attributes><weight>180</weight></attributes></product>`
+	assert.Nil(t, readRequest(echo.MIMETextXML, []byte(xmlBody), &product))
+	assert.Equal(t, "phone", product.Name)
+	assert.Equal(t, 120, product.Price)
+	assert.Equal(t, []string{"a", "b"}, product.Accessories)
+	assert.Equal(t, float64(180), product.Attributes["weight"])
+
+	var products []Product
+	csvBody := "product_name,price,currency,accessories,attributes.color\nphone,120,EUR,\"[\"\"a\"\"]\",red\ncase,10,USD,,\n"
+	assert.Nil(t, readRequest(MIMETextCSV, []byte(csvBody), &products))
+	assert.Len(t, products, 2)
+	assert.Equal(t, "red", products[0].Attributes["color"])
+	assert.Equal(t, []string{"a"}, products[0].Accessories)
+	assert.Equal(t, 10, products[1].Price)
+
+	body, err := msgpack.Marshal(map[string]interface{}{"product_name": "phone", "price": 120, "currency": "EUR"})
+	assert.Nil(t, err)
+	product = Product{}
+	assert.Nil(t, readRequest(MIMEApplicationMsgpack, body, &product))
+	assert.Equal(t, "phone", product.Name)
+	assert.Equal(t, 120, product.Price)
+
+	err = readRequest(echo.MIMETextPlain, []byte("phone"), &product)
+	assertHTTPError(t, err, http.StatusUnsupportedMediaType)
+	err = readRequest(echo.MIMEApplicationXML, []byte("<product>"), &product)
+	assertHTTPError(t, err, http.StatusBadRequest)
+
+	req := httptest.NewRequest(http.MethodPost, "/products", strings.NewReader(`{"a":1}`))
+	r, err := requestJSON(echo.New().NewContext(req, httptest.NewRecorder()), reflect.TypeOf(product))
+	assert.Nil(t, err)
+	raw, _ := ioutil.ReadAll(r)
+	assert.Equal(t, `{"a":1}`, string(raw))
+}
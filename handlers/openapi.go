@@ -0,0 +1,427 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//Auth levels of the routes, as set by the middlewares in main.go
+const (
+	//AuthNone routes are open to everyone
+	AuthNone = ""
+	//AuthOptional routes are open to everyone and show more to admins
+	AuthOptional = "optional"
+	//AuthUser routes need a jwt
+	AuthUser = "user"
+	//AuthVendor routes need the jwt of a vendor user or of an admin
+	AuthVendor = "vendor"
+	//AuthAdmin routes need the jwt of an admin
+	AuthAdmin = "admin"
+)
+
+//Param documents a query param or a header of an operation
+type Param struct {
+	Name        string
+	In          string
+	Description string
+}
+
+//Operation documents a route. Body and Response are values of the types the
+//handler binds and answers, their schemas are read from the json and validate tags.
+//Negotiated routes also read and write the media types of negotiate.go, Conditional
+//routes answer conditional requests as the Conditional middleware does.
+//V2Response is the envelope /v2 answers instead of Response, see versions.go.
+type Operation struct {
+	Summary     string
+	Auth        string
+	Params      []Param
+	Body        interface{}
+	ContentType string
+	Response    interface{}
+	Status      int
+	Negotiated  bool
+	Conditional bool
+	V2Response  interface{}
+}
+
+//jsonObject is an object of the OpenAPI document
+type jsonObject = map[string]interface{}
+
+var pathParam = regexp.MustCompile(`:(\w+)`)
+
+//DocsHandler serves the OpenAPI document of the API and a page to browse it
+type DocsHandler struct {
+	Title   string
+	Version string
+	//UIScript is the url of the Redoc bundle the docs page loads
+	UIScript string
+
+	spec []byte
+}
+
+//Build writes the OpenAPI document of the routes and returns the routes left
+//out because they have no documentation
+func (h *DocsHandler) Build(routes []*echo.Route) ([]string, error) {
+	spec, undocumented := openAPI(routes, h.Title, h.Version)
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return undocumented, err
+	}
+	h.spec = data
+	return undocumented, nil
+}
+
+//GetSpec serves the OpenAPI document
+func (h *DocsHandler) GetSpec(c echo.Context) error {
+	return c.JSONBlob(http.StatusOK, h.spec)
+}
+
+//GetUI serves a page rendering the OpenAPI document with Redoc
+func (h *DocsHandler) GetUI(c echo.Context) error {
+	return c.HTML(http.StatusOK, fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<head>
+<title>%s</title>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+</head>
+<body>
+<redoc spec-url="/openapi.json"></redoc>
+<script src="%s"></script>
+</body>
+</html>
+`, h.Title, h.UIScript))
+}
+
+//openAPI builds the OpenAPI 3 document of the routes
+func openAPI(routes []*echo.Route, title, version string) (jsonObject, []string) {
+	schemas := jsonObject{
+		"Error": jsonObject{
+			"type":       "object",
+			"properties": jsonObject{"message": jsonObject{"type": "string"}},
+		},
+	}
+	paths := jsonObject{}
+	var undocumented []string
+	for _, route := range routes {
+		//the versions serve the same routes, and their groups catch the
+		//paths no route matches
+		if versionedPath(route.Path) || !strings.HasPrefix(route.Path, "/") || strings.HasSuffix(route.Path, "*") {
+			continue
+		}
+		key := route.Method + " " + route.Path
+		doc, ok := apiDocs[key]
+		if !ok {
+			undocumented = append(undocumented, key)
+			continue
+		}
+		path := pathParam.ReplaceAllString(route.Path, "{$1}")
+		item, ok := paths[path].(jsonObject)
+		if !ok {
+			item = jsonObject{}
+			paths[path] = item
+		}
+		item[strings.ToLower(route.Method)] = doc.operation(route, schemas)
+	}
+	sort.Strings(undocumented)
+	return jsonObject{
+		"openapi": "3.0.3",
+		"info":    jsonObject{"title": title, "version": version},
+		"servers": []jsonObject{
+			{"url": "/v2", "description": "Current version"},
+			{"url": "/v1", "description": "Former response shapes, deprecated where v2 changed them"},
+			{"url": "/", "description": "Alias of /v1"},
+		},
+		"paths": paths,
+		"components": jsonObject{
+			"schemas": schemas,
+			"securitySchemes": jsonObject{
+				"jwt": jsonObject{
+					"type":        "apiKey",
+					"in":          "header",
+					"name":        "x-auth-token",
+					"description": `The token of POST /auth, as "Bearer <token>"`,
+				},
+			},
+		},
+	}, undocumented
+}
+
+func errorResponse(description string) jsonObject {
+	return jsonObject{
+		"description": description,
+		"content":     jsonObject{echo.MIMEApplicationJSON: jsonObject{"schema": jsonObject{"$ref": "#/components/schemas/Error"}}},
+	}
+}
+
+//operationID is the name of the handler method of a route
+func operationID(route *echo.Route) string {
+	name := route.Name[strings.LastIndex(route.Name, ".")+1:]
+	return strings.TrimSuffix(name, "-fm")
+}
+
+func (doc Operation) operation(route *echo.Route, schemas jsonObject) jsonObject {
+	op := jsonObject{
+		"summary":     doc.Summary,
+		"operationId": operationID(route),
+		"tags":        []string{strings.SplitN(strings.TrimPrefix(route.Path, "/"), "/", 2)[0]},
+	}
+	params := []jsonObject{}
+	for _, m := range pathParam.FindAllStringSubmatch(route.Path, -1) {
+		params = append(params, jsonObject{"name": m[1], "in": "path", "required": true, "schema": jsonObject{"type": "string"}})
+	}
+	docParams := doc.Params
+	if doc.Conditional {
+		docParams = append(docParams[:len(docParams):len(docParams)],
+			Param{Name: "If-None-Match", In: "header", Description: "ETag of a cached response"},
+			Param{Name: "If-Modified-Since", In: "header", Description: "Last-Modified of a cached response, ignored with If-None-Match"},
+		)
+	}
+	for _, p := range docParams {
+		in := p.In
+		if in == "" {
+			in = "query"
+		}
+		params = append(params, jsonObject{"name": p.Name, "in": in, "description": p.Description, "schema": jsonObject{"type": "string"}})
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+	if doc.Body != nil {
+		contentType := doc.ContentType
+		if contentType == "" {
+			contentType = echo.MIMEApplicationJSON
+		}
+		op["requestBody"] = jsonObject{
+			"required": true,
+			"content":  doc.content(contentType, schemaOf(reflect.TypeOf(doc.Body), schemas), reflect.TypeOf(doc.Body)),
+		}
+	}
+	status := doc.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := jsonObject{"description": http.StatusText(status)}
+	switch response := doc.Response.(type) {
+	case nil:
+	case []byte:
+		success["content"] = jsonObject{echo.MIMEOctetStream: jsonObject{"schema": jsonObject{"type": "string", "format": "binary"}}}
+	default:
+		schema := schemaOf(reflect.TypeOf(response), schemas)
+		if doc.V2Response != nil {
+			schema = jsonObject{"oneOf": []jsonObject{schema, schemaOf(reflect.TypeOf(doc.V2Response), schemas)}}
+			success["description"] = "The first shape under /v1 and the unversioned path, deprecated, the second under /v2"
+			success["headers"] = jsonObject{
+				"Deprecation": jsonObject{"description": "true for the deprecated shape", "schema": jsonObject{"type": "string"}},
+				"Sunset":      jsonObject{"description": "When the deprecated shape goes away", "schema": jsonObject{"type": "string"}},
+			}
+		}
+		success["content"] = doc.content(echo.MIMEApplicationJSON, schema, reflect.TypeOf(response))
+	}
+	responses := jsonObject{strconv.Itoa(status): success, "default": errorResponse("Error")}
+	if doc.Conditional {
+		success["headers"] = jsonObject{
+			"ETag":          jsonObject{"schema": jsonObject{"type": "string"}},
+			"Last-Modified": jsonObject{"description": "Only when the body is the stored product alone, without computed prices or other products", "schema": jsonObject{"type": "string"}},
+			"Cache-Control": jsonObject{"schema": jsonObject{"type": "string"}},
+		}
+		responses[strconv.Itoa(http.StatusNotModified)] = jsonObject{"description": "The cached response is still valid"}
+	}
+	switch doc.Auth {
+	case AuthOptional:
+		op["security"] = []jsonObject{{}, {"jwt": []string{}}}
+	case AuthUser:
+		op["security"] = []jsonObject{{"jwt": []string{}}}
+		responses["401"] = errorResponse("Missing or invalid token")
+	case AuthVendor, AuthAdmin:
+		op["security"] = []jsonObject{{"jwt": []string{}}}
+		responses["401"] = errorResponse("Missing or invalid token")
+		responses["403"] = errorResponse(fmt.Sprintf("The user is not a%s", map[string]string{AuthVendor: " vendor user", AuthAdmin: "n admin"}[doc.Auth]))
+	}
+	op["responses"] = responses
+	return op
+}
+
+//content lists the media types of a body of type t. CSV is only offered for lists.
+func (doc Operation) content(contentType string, schema jsonObject, t reflect.Type) jsonObject {
+	content := jsonObject{contentType: jsonObject{"schema": schema}}
+	if !doc.Negotiated {
+		return content
+	}
+	content[echo.MIMEApplicationXML] = jsonObject{"schema": schema}
+	content[MIMEApplicationMsgpack] = jsonObject{"schema": schema}
+	if t.Kind() == reflect.Slice {
+		content[MIMETextCSV] = jsonObject{"schema": schema}
+	}
+	return content
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	objectIDType = reflect.TypeOf(primitive.ObjectID{})
+	rawJSONType  = reflect.TypeOf(json.RawMessage{})
+)
+
+//schemaOf returns the schema of a type. Structs are added to the schemas of
+//the document and referenced.
+func schemaOf(t reflect.Type, schemas jsonObject) jsonObject {
+	switch t {
+	case timeType:
+		return jsonObject{"type": "string", "format": "date-time"}
+	case objectIDType:
+		return jsonObject{"type": "string", "pattern": "^[0-9a-f]{24}$"}
+	case rawJSONType:
+		return jsonObject{}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem(), schemas)
+	case reflect.Bool:
+		return jsonObject{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return jsonObject{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return jsonObject{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return jsonObject{"type": "number"}
+	case reflect.String:
+		return jsonObject{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return jsonObject{"type": "string", "format": "byte"}
+		}
+		return jsonObject{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return jsonObject{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, schemas)
+		}
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := schemas[name]; !ok {
+			// set first, so types referring to themselves end
+			schemas[name] = jsonObject{}
+			schemas[name] = structSchema(t, schemas)
+		}
+		return jsonObject{"$ref": "#/components/schemas/" + name}
+	}
+	return jsonObject{}
+}
+
+func structSchema(t reflect.Type, schemas jsonObject) jsonObject {
+	properties := jsonObject{}
+	required := []string{}
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if f.Anonymous && name == "" {
+				addFields(f.Type)
+				continue
+			}
+			if f.PkgPath != "" || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			schema := schemaOf(f.Type, schemas)
+			if applyValidation(schema, f.Type, f.Tag.Get("validate")) {
+				required = append(required, name)
+			}
+			properties[name] = schema
+		}
+	}
+	addFields(t)
+	schema := jsonObject{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+//applyValidation renders the validate tag of a field as constraints of its
+//schema and reports whether the field is required
+func applyValidation(schema jsonObject, t reflect.Type, tag string) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	required := false
+	rules := strings.Split(tag, ",")
+	for i, rule := range rules {
+		name, param := rule, ""
+		if eq := strings.Index(rule, "="); eq >= 0 {
+			name, param = rule[:eq], rule[eq+1:]
+		}
+		if _, ref := schema["$ref"]; ref && name != "required" {
+			continue
+		}
+		switch name {
+		case "required":
+			required = true
+		case "dive":
+			// the rules after dive are for the elements
+			if items, ok := schema["items"].(jsonObject); ok {
+				applyValidation(items, t.Elem(), strings.Join(rules[i+1:], ","))
+			}
+			return required
+		case "min", "max", "len", "gte", "lte":
+			n, err := strconv.ParseFloat(param, 64)
+			if err != nil {
+				continue
+			}
+			bounds := map[string][]string{
+				"min": {"minimum", "minLength", "minItems"},
+				"gte": {"minimum", "minLength", "minItems"},
+				"max": {"maximum", "maxLength", "maxItems"},
+				"lte": {"maximum", "maxLength", "maxItems"},
+			}[name]
+			if name == "len" {
+				applyValidation(schema, t, fmt.Sprintf("min=%s,max=%s", param, param))
+				continue
+			}
+			switch t.Kind() {
+			case reflect.String:
+				schema[bounds[1]] = int(n)
+			case reflect.Slice, reflect.Array:
+				schema[bounds[2]] = int(n)
+			case reflect.Map:
+				schema[strings.Replace(bounds[2], "Items", "Properties", 1)] = int(n)
+			default:
+				schema[bounds[0]] = n
+			}
+		case "oneof":
+			values := []interface{}{}
+			for _, value := range strings.Fields(param) {
+				if n, err := strconv.Atoi(value); err == nil && t.Kind() != reflect.String {
+					values = append(values, n)
+				} else {
+					values = append(values, value)
+				}
+			}
+			schema["enum"] = values
+		case "unique":
+			if t.Kind() == reflect.Slice {
+				schema["uniqueItems"] = true
+			}
+		case "email":
+			schema["format"] = "email"
+		case "url":
+			schema["format"] = "uri"
+		case "iso4217":
+			schema["pattern"] = "^[A-Z]{3}$"
+		}
+	}
+	return required
+}
@@ -0,0 +1,505 @@
+package handlers
+
+import (
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	currencyParam = Param{Name: "currency", Description: "ISO 4217 code to show the prices in"}
+	langParam     = Param{Name: "lang", Description: "Locale of the content, the Accept-Language header is used without it"}
+	fromParam     = Param{Name: "from", Description: "Start of the window, RFC 3339"}
+	toParam       = Param{Name: "to", Description: "End of the window, RFC 3339"}
+	cartToken     = Param{Name: HeaderCartToken, In: "header", Description: "Token of a guest cart"}
+)
+
+//apiDocs documents the routes registered in main.go, by method and path.
+//Every route must have an entry, the tests check it.
+var apiDocs = map[string]Operation{
+	"GET /products": {
+		Summary: "List products. Fields such as vendor or status filter the list, attr.<key> filters by attribute.",
+		Auth:    AuthOptional,
+		Params: []Param{
+			currencyParam,
+			langParam,
+			{Name: "in_stock", Description: "true or false"},
+			{Name: "sort", Description: "rating"},
+			{Name: "category", Description: "Id of a category"},
+			{Name: "descendants", Description: "true to include the subcategories"},
+		},
+		Response:    []Product{},
+		Negotiated:  true,
+		Conditional: true,
+	},
+	"POST /products": {
+		Summary:    "Create products",
+		Auth:       AuthVendor,
+		Body:       []Product{},
+		Response:   []primitive.ObjectID{},
+		V2Response: Created{},
+		Status:     http.StatusCreated,
+		Negotiated: true,
+	},
+	"GET /products/:id": {
+		Summary:     "Get a product. Drafts and archived products are only shown to admins.",
+		Auth:        AuthOptional,
+		Params:      []Param{currencyParam, langParam, {Name: "expand", Description: "accessories, compatible or both separated by commas"}},
+		Response:    Product{},
+		Negotiated:  true,
+		Conditional: true,
+	},
+	"PUT /products/:id": {
+		Summary:    "Update a product",
+		Auth:       AuthVendor,
+		Body:       Product{},
+		Response:   Product{},
+		Negotiated: true,
+	},
+	"DELETE /products/:id": {
+		Summary:    "Delete a product, returns the number of deleted products",
+		Auth:       AuthAdmin,
+		Response:   int64(0),
+		V2Response: Deleted{},
+	},
+	"GET /products/:id/stock": {
+		Summary:  "Get the stock of a product",
+		Response: Stock{},
+	},
+	"POST /products/:id/stock/adjustments": {
+		Summary:  "Change the on hand quantity of a product",
+		Auth:     AuthAdmin,
+		Body:     StockAdjustment{},
+		Response: Stock{},
+	},
+	"GET /products/:id/stock/adjustments": {
+		Summary:  "List the stock adjustments of a product",
+		Auth:     AuthAdmin,
+		Response: []StockAdjustment{},
+	},
+	"POST /products/:id/stock/reservations": {
+		Summary:  "Reserve stock of a product",
+		Auth:     AuthUser,
+		Body:     Reservation{},
+		Response: Reservation{},
+		Status:   http.StatusCreated,
+	},
+	"DELETE /products/:id/stock/reservations/:rid": {
+		Summary: "Release a reservation",
+		Auth:    AuthUser,
+		Status:  http.StatusNoContent,
+	},
+	"GET /products/:id/revisions": {
+		Summary:  "List the revisions of a product",
+		Auth:     AuthAdmin,
+		Response: []Revision{},
+	},
+	"GET /products/:id/revisions/diff": {
+		Summary:  "Compare two revisions of a product",
+		Auth:     AuthAdmin,
+		Params:   []Param{{Name: "from", Description: "Revision number"}, {Name: "to", Description: "Revision number"}},
+		Response: []FieldChange{},
+	},
+	"GET /products/:id/revisions/:rev": {
+		Summary:  "Get a revision of a product",
+		Auth:     AuthAdmin,
+		Response: Revision{},
+	},
+	"POST /products/:id/revisions/:rev/restore": {
+		Summary:  "Restore a product to a revision",
+		Auth:     AuthAdmin,
+		Response: Product{},
+	},
+	"GET /products/:id/reviews": {
+		Summary:  "List the reviews of a product, hidden ones only for admins",
+		Auth:     AuthOptional,
+		Response: []Review{},
+	},
+	"POST /products/:id/reviews": {
+		Summary:  "Review a product",
+		Auth:     AuthUser,
+		Body:     Review{},
+		Response: Review{},
+		Status:   http.StatusCreated,
+	},
+	"PUT /products/:id/reviews/:rid": {
+		Summary:  "Change a review of the user",
+		Auth:     AuthUser,
+		Body:     reviewUpdate{},
+		Response: Review{},
+	},
+	"PUT /products/:id/reviews/:rid/moderation": {
+		Summary:  "Hide or show a review",
+		Auth:     AuthAdmin,
+		Body:     Moderation{},
+		Response: Review{},
+	},
+	"DELETE /products/:id/reviews/:rid": {
+		Summary:    "Delete a review of the user, returns the number of deleted reviews",
+		Auth:       AuthUser,
+		Response:   int64(0),
+		V2Response: Deleted{},
+	},
+	"GET /products/:id/translations": {
+		Summary:  "List the translations of a product by locale",
+		Auth:     AuthAdmin,
+		Response: map[string]Translation{},
+	},
+	"PUT /products/:id/translations/:locale": {
+		Summary:  "Set the translation of a product for a locale",
+		Auth:     AuthAdmin,
+		Body:     Translation{},
+		Response: Translation{},
+	},
+	"DELETE /products/:id/translations/:locale": {
+		Summary:    "Delete the translation of a product for a locale",
+		Auth:       AuthAdmin,
+		Response:   int64(0),
+		V2Response: Deleted{},
+	},
+	"GET /reports/missing-translations": {
+		Summary:  "List the products missing translations, by locale",
+		Auth:     AuthAdmin,
+		Params:   []Param{{Name: "locale", Description: "Only report this locale"}},
+		Response: map[string][]MissingTranslation{},
+	},
+	"GET /products/:id/price-history": {
+		Summary:  "List the price changes of a product",
+		Auth:     AuthAdmin,
+		Params:   []Param{fromParam, toParam},
+		Response: []PricePoint{},
+	},
+	"GET /analytics/vendor-prices": {
+		Summary:  "Price statistics per vendor and currency",
+		Auth:     AuthAdmin,
+		Params:   []Param{fromParam, toParam},
+		Response: []VendorPriceStats{},
+	},
+	"GET /products/:id/media": {
+		Summary:  "List the media of a product. The media of drafts and archived products are only shown to admins.",
+		Auth:     AuthOptional,
+		Response: []Media{},
+	},
+	"GET /products/:id/media/:mid": {
+		Summary:  "Download a media file",
+		Auth:     AuthOptional,
+		Response: []byte{},
+	},
+	"GET /products/:id/media/:mid/thumbnail": {
+		Summary:  "Download the thumbnail of an image",
+		Auth:     AuthOptional,
+		Response: []byte{},
+	},
+	"POST /products/:id/media": {
+		Summary: "Upload a media file",
+		Auth:    AuthAdmin,
+		Body: struct {
+			File []byte `json:"file" validate:"required"`
+		}{},
+		ContentType: "multipart/form-data",
+		Response:    Media{},
+		Status:      http.StatusCreated,
+	},
+	"DELETE /products/:id/media/:mid": {
+		Summary: "Delete a media file",
+		Auth:    AuthAdmin,
+		Status:  http.StatusNoContent,
+	},
+	"GET /cart": {
+		Summary:  "Get the cart of the user or of the guest token",
+		Auth:     AuthOptional,
+		Params:   []Param{cartToken, currencyParam},
+		Response: CartView{},
+	},
+	"POST /cart/items": {
+		Summary:  "Add a product to the cart, guests get the token of their new cart in " + HeaderCartToken,
+		Auth:     AuthOptional,
+		Params:   []Param{cartToken, currencyParam},
+		Body:     CartItem{},
+		Response: CartView{},
+	},
+	"PUT /cart/items/:pid": {
+		Summary:  "Change the quantity of a product in the cart",
+		Auth:     AuthOptional,
+		Params:   []Param{cartToken, currencyParam},
+		Body:     quantityUpdate{},
+		Response: CartView{},
+	},
+	"DELETE /cart/items/:pid": {
+		Summary:  "Remove a product from the cart",
+		Auth:     AuthOptional,
+		Params:   []Param{cartToken, currencyParam},
+		Response: CartView{},
+	},
+	"POST /cart/merge": {
+		Summary:  "Move a guest cart into the cart of the user",
+		Auth:     AuthUser,
+		Params:   []Param{cartToken, currencyParam},
+		Response: CartView{},
+	},
+	"POST /orders": {
+		Summary:  "Check out the items into a pending order. Orders not paid within PENDING_ORDER_TTL are cancelled.",
+		Auth:     AuthUser,
+		Params:   []Param{{Name: HeaderIdempotencyKey, In: "header", Description: "Retries with the same key get the same order"}},
+		Body:     Checkout{},
+		Response: Order{},
+		Status:   http.StatusCreated,
+	},
+	"GET /orders": {
+		Summary:  "List all orders",
+		Auth:     AuthAdmin,
+		Response: []Order{},
+	},
+	"GET /orders/:id": {
+		Summary:  "Get an order of the user",
+		Auth:     AuthUser,
+		Response: Order{},
+	},
+	"POST /orders/:id/pay": {
+		Summary:  "Pay a pending order",
+		Auth:     AuthUser,
+		Body:     payment{},
+		Response: Order{},
+	},
+	"POST /orders/:id/cancel": {
+		Summary:  "Cancel an order of the user",
+		Auth:     AuthUser,
+		Response: Order{},
+	},
+	"POST /orders/:id/transitions": {
+		Summary:  "Move an order to another status",
+		Auth:     AuthAdmin,
+		Body:     orderTransition{},
+		Response: Order{},
+	},
+	"GET /users/me/orders": {
+		Summary:  "List the orders of the user",
+		Auth:     AuthUser,
+		Response: []Order{},
+	},
+	"GET /users/me/wishlist": {
+		Summary:  "List the wishlist of the user",
+		Auth:     AuthUser,
+		Response: []WishlistItem{},
+	},
+	"POST /users/me/wishlist": {
+		Summary:  "Save a product to the wishlist, 200 when it was already saved",
+		Auth:     AuthUser,
+		Body:     WishlistItem{},
+		Response: WishlistItem{},
+		Status:   http.StatusCreated,
+	},
+	"DELETE /users/me/wishlist/:pid": {
+		Summary: "Remove a product from the wishlist",
+		Auth:    AuthUser,
+		Status:  http.StatusNoContent,
+	},
+	"GET /users/me/alerts": {
+		Summary:  "List the product alerts of the user",
+		Auth:     AuthUser,
+		Response: []Alert{},
+	},
+	"POST /users/me/alerts": {
+		Summary:  "Create a product alert",
+		Auth:     AuthUser,
+		Body:     Alert{},
+		Response: Alert{},
+		Status:   http.StatusCreated,
+	},
+	"DELETE /users/me/alerts/:id": {
+		Summary: "Delete a product alert",
+		Auth:    AuthUser,
+		Status:  http.StatusNoContent,
+	},
+	"POST /graphql": {
+		Summary:  "Run a GraphQL query",
+		Auth:     AuthOptional,
+		Body:     GraphQLRequest{},
+		Response: map[string]interface{}{},
+	},
+	"GET /webhooks": {
+		Summary:  "List the webhooks",
+		Auth:     AuthAdmin,
+		Response: []Webhook{},
+	},
+	"POST /webhooks": {
+		Summary:  "Create a webhook, its secret is only shown in the response",
+		Auth:     AuthAdmin,
+		Body:     Webhook{},
+		Response: Webhook{},
+		Status:   http.StatusCreated,
+	},
+	"GET /webhooks/:id": {
+		Summary:  "Get a webhook",
+		Auth:     AuthAdmin,
+		Response: Webhook{},
+	},
+	"PUT /webhooks/:id": {
+		Summary:  "Update a webhook",
+		Auth:     AuthAdmin,
+		Body:     Webhook{},
+		Response: Webhook{},
+	},
+	"DELETE /webhooks/:id": {
+		Summary:    "Delete a webhook",
+		Auth:       AuthAdmin,
+		Response:   int64(0),
+		V2Response: Deleted{},
+	},
+	"GET /webhooks/:id/deliveries": {
+		Summary:  "List the deliveries of a webhook",
+		Auth:     AuthAdmin,
+		Params:   []Param{{Name: "status", Description: "pending, delivered or dead"}},
+		Response: []Delivery{},
+	},
+	"POST /webhooks/:id/deliveries/:did/redeliver": {
+		Summary:  "Send a delivery again",
+		Auth:     AuthAdmin,
+		Response: Delivery{},
+		Status:   http.StatusAccepted,
+	},
+	"GET /vendors": {
+		Summary:  "List the vendors",
+		Response: []Vendor{},
+	},
+	"GET /vendors/:id": {
+		Summary:  "Get a vendor",
+		Response: Vendor{},
+	},
+	"POST /vendors": {
+		Summary:  "Create a vendor",
+		Auth:     AuthAdmin,
+		Body:     Vendor{},
+		Response: Vendor{},
+		Status:   http.StatusCreated,
+	},
+	"PUT /vendors/:id": {
+		Summary:  "Update a vendor, vendor users can update their own",
+		Auth:     AuthVendor,
+		Body:     Vendor{},
+		Response: Vendor{},
+	},
+	"DELETE /vendors/:id": {
+		Summary:    "Delete a vendor",
+		Auth:       AuthAdmin,
+		Response:   int64(0),
+		V2Response: Deleted{},
+	},
+	"GET /categories": {
+		Summary:  "List the categories",
+		Params:   []Param{{Name: "parent", Description: "Id of the parent, root for the top level"}},
+		Response: []Category{},
+	},
+	"GET /categories/:id": {
+		Summary:  "Get a category",
+		Response: Category{},
+	},
+	"PUT /categories/:id/attributes": {
+		Summary:  "Set the attribute definitions of a category",
+		Auth:     AuthAdmin,
+		Body:     attributesUpdate{},
+		Response: Category{},
+	},
+	"POST /categories": {
+		Summary:  "Create a category",
+		Auth:     AuthAdmin,
+		Body:     Category{},
+		Response: Category{},
+		Status:   http.StatusCreated,
+	},
+	"PUT /categories/:id": {
+		Summary:  "Rename a category",
+		Auth:     AuthAdmin,
+		Body:     categoryRename{},
+		Response: Category{},
+	},
+	"POST /categories/:id/move": {
+		Summary:  "Move a category under another parent",
+		Auth:     AuthAdmin,
+		Body:     categoryMove{},
+		Response: Category{},
+	},
+	"DELETE /categories/:id": {
+		Summary:    "Delete a category",
+		Auth:       AuthAdmin,
+		Params:     []Param{{Name: "reassign_to", Description: "Category the products move to"}},
+		Response:   int64(0),
+		V2Response: Deleted{},
+	},
+	"GET /promotions": {
+		Summary:  "List the promotions",
+		Params:   []Param{{Name: "active", Description: "true for the promotions running now"}},
+		Response: []Promotion{},
+	},
+	"GET /promotions/:id": {
+		Summary:  "Get a promotion",
+		Response: Promotion{},
+	},
+	"POST /promotions": {
+		Summary:  "Create a promotion",
+		Auth:     AuthAdmin,
+		Body:     Promotion{},
+		Response: Promotion{},
+		Status:   http.StatusCreated,
+	},
+	"PUT /promotions/:id": {
+		Summary:  "Update a promotion",
+		Auth:     AuthAdmin,
+		Body:     Promotion{},
+		Response: Promotion{},
+	},
+	"DELETE /promotions/:id": {
+		Summary:    "Delete a promotion",
+		Auth:       AuthAdmin,
+		Response:   int64(0),
+		V2Response: Deleted{},
+	},
+	"GET /exchange-rates": {
+		Summary:  "Get the exchange rates",
+		Response: ExchangeRates{},
+	},
+	"PUT /exchange-rates": {
+		Summary:  "Replace the exchange rates",
+		Auth:     AuthAdmin,
+		Body:     ExchangeRates{},
+		Response: ExchangeRates{},
+	},
+	"POST /users": {
+		Summary:  "Sign up, the token is returned in the x-auth-token header",
+		Body:     User{},
+		Response: "",
+		Status:   http.StatusCreated,
+	},
+	"POST /auth": {
+		Summary:  "Log in, the token is returned in the x-auth-token header",
+		Body:     User{},
+		Response: User{},
+	},
+	"PUT /users/:username/vendor": {
+		Summary:  "Link a user to a vendor",
+		Auth:     AuthAdmin,
+		Body:     vendorLink{},
+		Response: User{},
+	},
+	"GET /openapi.json": {
+		Summary:  "Get this OpenAPI document",
+		Response: map[string]interface{}{},
+	},
+	"GET /docs": {
+		Summary: "Browse this OpenAPI document",
+	},
+	"POST /batch": {
+		Summary: "Run several requests in one round trip. Each sub-request goes through the routes and their checks, " +
+			"with the x-auth-token of the batch unless it sets its own. Atomic batches stop at the first failure " +
+			"and undo the storage operations of the batch, which needs MongoDB as a replica set. " +
+			"Their notifications are only sent once the batch is applied. They cannot upload files, pay or refund orders, " +
+			"or run GraphQL requests.",
+		Body:     batch{},
+		Response: BatchResult{},
+	},
+	"GET /debug/vars": {
+		Summary:  "Get the metrics of the server, e.g. api_version_requests counts the requests by API version",
+		Auth:     AuthAdmin,
+		Response: map[string]interface{}{},
+	},
+}
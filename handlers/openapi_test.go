@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+//registeredRoutes reads the routes registered in main.go, following the
+//prefixes of route groups
+func registeredRoutes(t *testing.T) []string {
+	f, err := parser.ParseFile(token.NewFileSet(), "../main.go", nil, 0)
+	assert.Nil(t, err)
+	prefixes := map[string]string{"e": ""}
+	var routes []string
+	ast.Inspect(f, func(n ast.Node) bool {
+		//routes registered in a loop over the groups of the versions are
+		//documented by their unversioned path
+		if loop, ok := n.(*ast.RangeStmt); ok {
+			value, isValue := loop.Value.(*ast.Ident)
+			groups, isGroups := loop.X.(*ast.CompositeLit)
+			if isValue && isGroups && len(groups.Elts) > 0 {
+				prefixes[value.Name] = ""
+			}
+			return true
+		}
+		if assign, ok := n.(*ast.AssignStmt); ok && len(assign.Lhs) == 1 && len(assign.Rhs) == 1 {
+			call, ok := assign.Rhs[0].(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok || sel.Sel.Name != "Group" || len(call.Args) == 0 {
+				return true
+			}
+			parent, isParent := sel.X.(*ast.Ident)
+			lhs, isLhs := assign.Lhs[0].(*ast.Ident)
+			lit, isLit := call.Args[0].(*ast.BasicLit)
+			if isParent && isLhs && isLit {
+				prefix, _ := strconv.Unquote(lit.Value)
+				prefixes[lhs.Name] = prefixes[parent.Name] + prefix
+			}
+			return true
+		}
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) == 0 {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		switch sel.Sel.Name {
+		case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			return true
+		}
+		receiver, ok := sel.X.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		prefix, ok := prefixes[receiver.Name]
+		lit, isLit := call.Args[0].(*ast.BasicLit)
+		if ok && isLit {
+			path, _ := strconv.Unquote(lit.Value)
+			routes = append(routes, sel.Sel.Name+" "+prefix+path)
+		}
+		return true
+	})
+	return routes
+}
+
+func TestRoutesDocumented(t *testing.T) {
+	routes := registeredRoutes(t)
+	assert.NotEmpty(t, routes)
+	registered := map[string]bool{}
+	for _, route := range routes {
+		registered[route] = true
+		_, ok := apiDocs[route]
+		assert.True(t, ok, "%s is registered in main.go without documentation in apiDocs", route)
+	}
+	for route := range apiDocs {
+		assert.True(t, registered[route], "%s is documented but not registered in main.go", route)
+	}
+}
+
+func TestOpenAPISchema(t *testing.T) {
+	schemas := jsonObject{}
+	assert.Equal(t, jsonObject{"$ref": "#/components/schemas/Product"}, schemaOf(reflect.TypeOf(Product{}), schemas))
+	product := schemas["Product"].(jsonObject)
+	properties := product["properties"].(jsonObject)
+	assert.Equal(t, jsonObject{"type": "string", "maxLength": 100}, properties["product_name"])
+	assert.Equal(t, jsonObject{"type": "string", "minLength": 3, "maxLength": 3, "pattern": "^[A-Z]{3}$"}, properties["currency"])
+	assert.Equal(t, jsonObject{"type": "string", "maxLength": 2000}, properties["description"])
+	assert.Equal(t, jsonObject{"type": "integer", "minimum": float64(0), "maximum": float64(2000)}, properties["price"])
+	assert.Equal(t, jsonObject{"type": "string", "enum": []interface{}{"draft", "published", "archived"}}, properties["status"])
+	assert.Equal(t, true, properties["categories"].(jsonObject)["uniqueItems"])
+	assert.Equal(t, []string{"product_name", "currency"}, product["required"])
+	assert.NotContains(t, properties, "Pricing")
+	assert.Contains(t, schemas, "Pricing")
+
+	schemaOf(reflect.TypeOf(User{}), schemas)
+	user := schemas["User"].(jsonObject)["properties"].(jsonObject)
+	assert.Equal(t, jsonObject{"type": "string", "format": "email"}, user["username"])
+	assert.Equal(t, jsonObject{"type": "string", "minLength": 8, "maxLength": 300}, user["password"])
+
+	schemaOf(reflect.TypeOf(orderTransition{}), schemas)
+	assert.Contains(t, schemas, "OrderTransition")
+}
+
+func TestDocsHandler(t *testing.T) {
+	e := echo.New()
+	h := &DocsHandler{Title: "Tronics API", Version: "1.0.0", UIScript: "/redoc.js"}
+	e.GET("/openapi.json", h.GetSpec)
+	e.GET("/products/:id", func(echo.Context) error { return nil })
+	e.DELETE("/products/:id", func(echo.Context) error { return nil })
+	e.GET("/undocumented", func(echo.Context) error { return nil })
+	undocumented, err := h.Build(e.Routes())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"GET /undocumented"}, undocumented)
+
+	res := httptest.NewRecorder()
+	assert.Nil(t, h.GetSpec(e.NewContext(httptest.NewRequest(http.MethodGet, "/openapi.json", nil), res)))
+	var spec struct {
+		OpenAPI string `json:"openapi"`
+		Paths   map[string]map[string]struct {
+			Parameters []struct{ Name, In string }
+			Security   []map[string][]string
+			Responses  map[string]interface{}
+		}
+	}
+	assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &spec))
+	assert.Equal(t, "3.0.3", spec.OpenAPI)
+	assert.NotContains(t, spec.Paths, "/undocumented")
+	product := spec.Paths["/products/{id}"]
+	assert.Equal(t, "id", product["get"].Parameters[0].Name)
+	assert.Equal(t, "path", product["get"].Parameters[0].In)
+	assert.Equal(t, []map[string][]string{{}, {"jwt": {}}}, product["get"].Security, "drafts are shown to admins")
+	assert.Equal(t, []map[string][]string{{"jwt": {}}}, product["delete"].Security)
+	assert.Contains(t, product["delete"].Responses, "403")
+
+	res = httptest.NewRecorder()
+	assert.Nil(t, h.GetUI(e.NewContext(httptest.NewRequest(http.MethodGet, "/docs", nil), res)))
+	assert.Contains(t, res.Body.String(), `<script src="/redoc.js">`)
+}
@@ -0,0 +1,551 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/inerts73/tronicscorp/dbiface"
+	"github.com/inerts73/tronicscorp/payments"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//HeaderIdempotencyKey makes a repeated checkout or transition request a no-op
+const HeaderIdempotencyKey = "Idempotency-Key"
+
+const (
+	//OrderPending orders hold stock and wait for the payment
+	OrderPending = "pending"
+	//OrderPaid orders are paid and wait to be fulfilled
+	OrderPaid = "paid"
+	//OrderFulfilled orders are packed
+	OrderFulfilled = "fulfilled"
+	//OrderShipped orders left the warehouse
+	OrderShipped = "shipped"
+	//OrderCancelled orders were given up before the payment
+	OrderCancelled = "cancelled"
+	//OrderRefunding orders are being paid back, they stay so if the refund fails
+	OrderRefunding = "refunding"
+	//OrderRefunded orders were paid back
+	OrderRefunded = "refunded"
+)
+
+//orderTransitions lists the statuses an order can move to from each status
+var orderTransitions = map[string][]string{
+	OrderPending:   {OrderPaid, OrderCancelled},
+	OrderPaid:      {OrderFulfilled, OrderRefunded},
+	OrderFulfilled: {OrderShipped, OrderRefunded},
+	OrderShipped:   {OrderRefunded},
+	OrderRefunding: {OrderRefunded},
+}
+
+//Order is a purchase of products at the prices of checkout
+type Order struct {
+	ID          primitive.ObjectID `json:"_id" bson:"_id"`
+	UserID      string             `json:"user_id" bson:"user_id"`
+	Items       []OrderItem        `json:"items" bson:"items"`
+	Total       Money              `json:"total" bson:"total"`
+	Status      string             `json:"status" bson:"status"`
+	ChargeID    string             `json:"charge_id,omitempty" bson:"charge_id,omitempty"`
+	CheckoutKey string             `json:"-" bson:"checkout_key,omitempty"`
+	History     []OrderEvent       `json:"history" bson:"history"`
+	CreatedAt   time.Time          `json:"created_at" bson:"created_at"`
+	UpdatedAt   time.Time          `json:"updated_at" bson:"updated_at"`
+}
+
+//OrderItem is a product of an order, priced at checkout
+type OrderItem struct {
+	ProductID primitive.ObjectID `json:"product_id" bson:"product_id"`
+	Name      string             `json:"product_name" bson:"product_name"`
+	Quantity  int                `json:"quantity" bson:"quantity"`
+	UnitPrice Money              `json:"unit_price" bson:"unit_price"`
+	LineTotal Money              `json:"line_total" bson:"line_total"`
+}
+
+//OrderEvent records a change of status
+type OrderEvent struct {
+	From   string    `json:"from,omitempty" bson:"from,omitempty"`
+	To     string    `json:"to" bson:"to"`
+	UserID string    `json:"user_id" bson:"user_id"`
+	Note   string    `json:"note,omitempty" bson:"note,omitempty"`
+	Key    string    `json:"idempotency_key,omitempty" bson:"key,omitempty"`
+	At     time.Time `json:"at" bson:"at"`
+}
+
+//Checkout is the request to buy products
+type Checkout struct {
+	Items    []CartItem `json:"items" validate:"required,min=1,max=100,unique=ProductID,dive"`
+	Currency string     `json:"currency" validate:"omitempty,iso4217"`
+}
+
+//OrdersHandler an orders handler. Prices come from the carts handler.
+type OrdersHandler struct {
+	Col      dbiface.CollectionAPI
+	Carts    *CartsHandler
+	Payments payments.PaymentProvider
+	//PendingTTL is how long a pending order holds its stock before it is cancelled
+	PendingTTL time.Duration
+}
+
+func canTransitionOrder(from, to string) bool {
+	for _, s := range orderTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+//restocks reports whether moving an order from one status to another gives
+//its stock back. Refunds after shipping come back as returns.
+func restocks(from, to string) bool {
+	return to == OrderCancelled || (to == OrderRefunded && from != OrderShipped)
+}
+
+func findOrder(ctx context.Context, id string, collection dbiface.CollectionAPI) (Order, error) {
+	var order Order
+	docID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return order, echo.NewHTTPError(http.StatusBadRequest, "Invalid order id")
+	}
+	res := collection.FindOne(ctx, bson.M{"_id": docID})
+	if err := res.Decode(&order); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return order, echo.NewHTTPError(http.StatusNotFound, "Order does not exist")
+		}
+		log.Errorf("Unable to decode the order : %v", err)
+		return order, err
+	}
+	return order, nil
+}
+
+//stockDeltas returns how much stock of each product the items take, bundles
+//take the stock of their components
+func stockDeltas(items []OrderItem, products map[primitive.ObjectID]Product) map[primitive.ObjectID]int {
+	deltas := map[primitive.ObjectID]int{}
+	for _, item := range items {
+		p := products[item.ProductID]
+		if !p.isBundle() {
+			deltas[item.ProductID] += item.Quantity
+			continue
+		}
+		for _, component := range p.Bundle.Components {
+			deltas[component.ProductID] += item.Quantity * component.Quantity
+		}
+	}
+	return deltas
+}
+
+func (h *OrdersHandler) orderStock(ctx context.Context, items []OrderItem) (map[primitive.ObjectID]int, error) {
+	IDs := make([]primitive.ObjectID, len(items))
+	for i, item := range items {
+		IDs[i] = item.ProductID
+	}
+	found, err := productsByID(ctx, IDs, bson.M{}, h.Carts.ProdCol)
+	if err != nil {
+		return nil, err
+	}
+	products := map[primitive.ObjectID]Product{}
+	for _, p := range found {
+		products[p.ID] = p
+	}
+	return stockDeltas(items, products), nil
+}
+
+//takeStock takes the stock of the items, all of it or none
+func (h *OrdersHandler) takeStock(ctx context.Context, items []OrderItem) error {
+	if h.Carts.InvCol == nil {
+		return nil
+	}
+	deltas, err := h.orderStock(ctx, items)
+	if err != nil {
+		return err
+	}
+	taken := map[primitive.ObjectID]int{}
+	for productID, qty := range deltas {
+		if err := decrementStock(ctx, productID, qty, h.Carts.InvCol); err != nil {
+			h.giveStock(ctx, taken)
+			return err
+		}
+		taken[productID] = qty
+	}
+	return nil
+}
+
+//giveStock puts stock taken by an order back
+func (h *OrdersHandler) giveStock(ctx context.Context, deltas map[primitive.ObjectID]int) {
+	for productID, qty := range deltas {
+		update := bson.M{"$inc": bson.M{"on_hand": qty, "available": qty}}
+		if _, err := h.Carts.InvCol.UpdateOne(ctx, bson.M{"_id": productID}, update); err != nil {
+			log.Errorf("Unable to give the stock of %s back : %v", productID.Hex(), err)
+		}
+	}
+}
+
+//transition moves an order to the status to. A request repeating the
+//idempotency key of a past transition, or asking for the current status,
+//changes nothing. set holds other fields to store along with the status.
+func (h *OrdersHandler) transition(ctx context.Context, order Order, to string, event OrderEvent, set bson.M) (Order, error) {
+	for _, past := range order.History {
+		if event.Key != "" && past.Key == event.Key {
+			return order, nil
+		}
+	}
+	if order.Status == to {
+		return order, nil
+	}
+	from := order.Status
+	if !canTransitionOrder(from, to) {
+		return order, echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("An order cannot go from %s to %s", from, to))
+	}
+	restockFrom := from
+	if to == OrderRefunded && order.ChargeID != "" {
+		//a refund is not part of the transaction of an atomic batch
+		if inAtomicBatch(ctx) {
+			return order, echo.NewHTTPError(http.StatusBadRequest, "Orders cannot be refunded in an atomic batch")
+		}
+		restockFrom = refundedFrom(order)
+		if err := h.refund(ctx, order, event.UserID); err != nil {
+			return order, err
+		}
+		from = OrderRefunding
+	}
+	now := time.Now().UTC()
+	event.From, event.To, event.At = from, to, now
+	if set == nil {
+		set = bson.M{}
+	}
+	set["status"], set["updated_at"] = to, now
+	res, err := h.Col.UpdateOne(ctx, bson.M{"_id": order.ID, "status": from}, bson.M{"$set": set, "$push": bson.M{"history": event}})
+	if err != nil {
+		log.Errorf("Unable to update the order : %v", err)
+		return order, echo.NewHTTPError(http.StatusInternalServerError, "Unable to update the order")
+	}
+	if res.MatchedCount == 0 {
+		return order, echo.NewHTTPError(http.StatusConflict, "The order changed, try again")
+	}
+	if restocks(restockFrom, to) {
+		if deltas, err := h.orderStock(ctx, order.Items); err == nil && h.Carts.InvCol != nil {
+			h.giveStock(ctx, deltas)
+		}
+	}
+	return findOrder(ctx, order.ID.Hex(), h.Col)
+}
+
+//refund claims the refund of an order by moving it to refunding, so that
+//concurrent requests cannot both get past the check of its status, then gives
+//its payment back. An order left refunding by a failed refund is refunded by
+//the next request.
+func (h *OrdersHandler) refund(ctx context.Context, order Order, userID string) error {
+	if order.Status != OrderRefunding {
+		now := time.Now().UTC()
+		claim := OrderEvent{From: order.Status, To: OrderRefunding, UserID: userID, At: now}
+		update := bson.M{"$set": bson.M{"status": OrderRefunding, "updated_at": now}, "$push": bson.M{"history": claim}}
+		res, err := h.Col.UpdateOne(ctx, bson.M{"_id": order.ID, "status": order.Status}, update)
+		if err != nil {
+			log.Errorf("Unable to update the order : %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Unable to update the order")
+		}
+		if res.MatchedCount == 0 {
+			return echo.NewHTTPError(http.StatusConflict, "The order changed, try again")
+		}
+	}
+	// the order id makes retried refunds a single refund
+	if _, err := h.Payments.Refund(ctx, payments.RefundRequest{IdempotencyKey: refundKey(order.ID), ChargeID: order.ChargeID}); err != nil {
+		log.Errorf("Unable to refund the order %s : %v", order.ID.Hex(), err)
+		return echo.NewHTTPError(http.StatusBadGateway, "Unable to refund the payment")
+	}
+	return nil
+}
+
+//chargeKey and refundKey are the idempotency keys of the payment of an order
+//and of its refund, distinct as providers share keys across operations
+func chargeKey(orderID primitive.ObjectID) string {
+	return "charge:" + orderID.Hex()
+}
+
+func refundKey(orderID primitive.ObjectID) string {
+	return "refund:" + orderID.Hex()
+}
+
+//cancelStaleOrders cancels the orders still pending PendingTTL after checkout,
+//which gives their stock back
+func (h *OrdersHandler) cancelStaleOrders(ctx context.Context, now time.Time) (int, error) {
+	var orders []Order
+	filter := bson.M{"status": OrderPending, "created_at": bson.M{"$lte": now.Add(-h.PendingTTL)}}
+	cursor, err := h.Col.Find(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	if err := cursor.All(ctx, &orders); err != nil {
+		return 0, err
+	}
+	cancelled := 0
+	for _, order := range orders {
+		event := OrderEvent{UserID: "scheduler", Note: "Not paid in time"}
+		// a payment may come in concurrently, then the order is left alone
+		if _, err := h.transition(ctx, order, OrderCancelled, event, nil); err != nil {
+			log.Errorf("Unable to cancel the order %s : %v", order.ID.Hex(), err)
+			continue
+		}
+		cancelled++
+	}
+	return cancelled, nil
+}
+
+//CancelStaleOrders cancels stale pending orders every interval until ctx is done
+func (h *OrdersHandler) CancelStaleOrders(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := h.cancelStaleOrders(ctx, now)
+			if err != nil {
+				log.Errorf("Unable to cancel the stale orders : %v", err)
+				continue
+			}
+			if n > 0 {
+				log.Infof("Cancelled %d stale orders", n)
+			}
+		}
+	}
+}
+
+//refundedFrom is the status an order had before its refund was claimed
+func refundedFrom(order Order) string {
+	if order.Status != OrderRefunding {
+		return order.Status
+	}
+	for i := len(order.History) - 1; i >= 0; i-- {
+		if order.History[i].To == OrderRefunding {
+			return order.History[i].From
+		}
+	}
+	return order.Status
+}
+
+func (h *OrdersHandler) ownOrder(c echo.Context) (Order, error) {
+	order, err := findOrder(storageContext(c), c.Param("id"), h.Col)
+	if err != nil {
+		return order, err
+	}
+	if order.UserID != userIDFromContext(c) && !isAdminFromContext(c) {
+		return order, echo.NewHTTPError(http.StatusNotFound, "Order does not exist")
+	}
+	return order, nil
+}
+
+func (h *OrdersHandler) findOrders(c echo.Context, filter bson.M) error {
+	var orders []Order
+	cursor, err := h.Col.Find(storageContext(c), filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		log.Errorf("Unable to find the orders : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the orders")
+	}
+	if err := cursor.All(storageContext(c), &orders); err != nil {
+		log.Errorf("Unable to read the cursor : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the orders")
+	}
+	return c.JSON(http.StatusOK, orders)
+}
+
+//Checkout creates a pending order for the items at their current prices and
+//takes their stock
+func (h *OrdersHandler) Checkout(c echo.Context) error {
+	ctx := storageContext(c)
+	userID := userIDFromContext(c)
+	key := c.Request().Header.Get(HeaderIdempotencyKey)
+	if key != "" {
+		var order Order
+		err := h.Col.FindOne(ctx, bson.M{"user_id": userID, "checkout_key": key}).Decode(&order)
+		if err == nil {
+			return c.JSON(http.StatusOK, order)
+		}
+	}
+	var req Checkout
+	if err := c.Bind(&req); err != nil {
+		log.Errorf("Unable to bind to checkout : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	if err := v.Struct(req); err != nil {
+		log.Errorf("Unable to validate the checkout %+v %v", req, err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload.")
+	}
+	currency := req.Currency
+	if currency == "" {
+		currency = h.Carts.Currency
+	}
+	view, err := h.Carts.priceCart(ctx, Cart{Items: req.Items}, currency)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	order := Order{
+		ID:          primitive.NewObjectID(),
+		UserID:      userID,
+		Total:       view.Total,
+		Status:      OrderPending,
+		CheckoutKey: key,
+		History:     []OrderEvent{{To: OrderPending, UserID: userID, Key: key, At: now}},
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	for _, line := range view.Lines {
+		if line.Issue != "" {
+			return echo.NewHTTPError(http.StatusConflict, map[string]interface{}{"message": "Some products cannot be ordered", "lines": view.Lines})
+		}
+		order.Items = append(order.Items, OrderItem{
+			ProductID: line.ProductID,
+			Name:      line.Name,
+			Quantity:  line.Quantity,
+			UnitPrice: *line.UnitPrice,
+			LineTotal: *line.LineTotal,
+		})
+	}
+	if err := h.takeStock(ctx, order.Items); err != nil {
+		return err
+	}
+	if _, err := h.Col.InsertOne(ctx, order); err != nil {
+		if deltas, err := h.orderStock(ctx, order.Items); err == nil && h.Carts.InvCol != nil {
+			h.giveStock(ctx, deltas)
+		}
+		if isDuplicateKey(err) {
+			return echo.NewHTTPError(http.StatusConflict, "The checkout is in progress, try again")
+		}
+		log.Errorf("Unable to insert the order : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to create the order")
+	}
+	return c.JSON(http.StatusCreated, order)
+}
+
+//GetMyOrders lists the orders of the authenticated user
+func (h *OrdersHandler) GetMyOrders(c echo.Context) error {
+	return h.findOrders(c, bson.M{"user_id": userIDFromContext(c)})
+}
+
+//GetOrders lists the orders, by status=<status> and user_id=<user>
+func (h *OrdersHandler) GetOrders(c echo.Context) error {
+	filter := bson.M{}
+	for _, k := range []string{"status", "user_id"} {
+		if value := c.QueryParam(k); value != "" {
+			filter[k] = value
+		}
+	}
+	return h.findOrders(c, filter)
+}
+
+//GetOrder gets an order of the user, admins get any order
+func (h *OrdersHandler) GetOrder(c echo.Context) error {
+	order, err := h.ownOrder(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, order)
+}
+
+//payment pays an order with a payment source of the provider
+type payment struct {
+	Source string `json:"source" validate:"required"`
+}
+
+//PayOrder charges the payment source for a pending order of the user
+func (h *OrdersHandler) PayOrder(c echo.Context) error {
+	var req payment
+	ctx := storageContext(c)
+	//a charge is not part of the transaction of an atomic batch
+	if inAtomicBatch(ctx) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Orders cannot be paid in an atomic batch")
+	}
+	order, err := h.ownOrder(c)
+	if err != nil {
+		return err
+	}
+	if order.Status == OrderPaid {
+		return c.JSON(http.StatusOK, order)
+	}
+	if order.Status != OrderPending {
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("A %s order cannot be paid", order.Status))
+	}
+	if err := c.Bind(&req); err != nil {
+		log.Errorf("Unable to bind to payment : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	if err := v.Struct(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload.")
+	}
+	// the order id makes retried payments a single charge
+	charge, err := h.Payments.Charge(ctx, payments.ChargeRequest{
+		IdempotencyKey: chargeKey(order.ID),
+		Amount:         order.Total.Amount,
+		Currency:       order.Total.Currency,
+		Source:         req.Source,
+		Description:    "tronicscorp order " + order.ID.Hex(),
+	})
+	if err == payments.ErrDeclined {
+		return echo.NewHTTPError(http.StatusPaymentRequired, "The payment was declined")
+	}
+	if err != nil {
+		log.Errorf("Unable to charge the order %s : %v", order.ID.Hex(), err)
+		return echo.NewHTTPError(http.StatusBadGateway, "Unable to charge the payment")
+	}
+	event := OrderEvent{UserID: userIDFromContext(c), Key: c.Request().Header.Get(HeaderIdempotencyKey)}
+	paid, err := h.transition(ctx, order, OrderPaid, event, bson.M{"charge_id": charge.ID})
+	if err != nil {
+		if _, err := h.Payments.Refund(ctx, payments.RefundRequest{IdempotencyKey: refundKey(order.ID), ChargeID: charge.ID}); err != nil {
+			log.Errorf("Unable to refund the charge %s : %v", charge.ID, err)
+		}
+		return err
+	}
+	return c.JSON(http.StatusOK, paid)
+}
+
+//CancelOrder cancels a pending order of the user and gives its stock back
+func (h *OrdersHandler) CancelOrder(c echo.Context) error {
+	order, err := h.ownOrder(c)
+	if err != nil {
+		return err
+	}
+	event := OrderEvent{UserID: userIDFromContext(c), Key: c.Request().Header.Get(HeaderIdempotencyKey)}
+	order, err = h.transition(storageContext(c), order, OrderCancelled, event, nil)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, order)
+}
+
+//orderTransition moves an order to another status
+type orderTransition struct {
+	To   string `json:"to" validate:"required,oneof=pending paid fulfilled shipped cancelled refunded"`
+	Note string `json:"note" validate:"max=500"`
+}
+
+//TransitionOrder moves an order to another status, for admins
+func (h *OrdersHandler) TransitionOrder(c echo.Context) error {
+	var req orderTransition
+	order, err := findOrder(storageContext(c), c.Param("id"), h.Col)
+	if err != nil {
+		return err
+	}
+	if err := c.Bind(&req); err != nil {
+		log.Errorf("Unable to bind to order transition : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	if err := v.Struct(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload.")
+	}
+	event := OrderEvent{UserID: userIDFromContext(c), Note: req.Note, Key: c.Request().Header.Get(HeaderIdempotencyKey)}
+	order, err = h.transition(storageContext(c), order, req.To, event, nil)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, order)
+}
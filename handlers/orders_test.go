@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/inerts73/tronicscorp/payments"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestOrderTransitions(t *testing.T) {
+	assert.True(t, canTransitionOrder(OrderPending, OrderPaid))
+	assert.True(t, canTransitionOrder(OrderShipped, OrderRefunded))
+	assert.False(t, canTransitionOrder(OrderPending, OrderShipped))
+	assert.False(t, canTransitionOrder(OrderPaid, OrderCancelled))
+	assert.False(t, canTransitionOrder(OrderRefunded, OrderPaid))
+	assert.False(t, canTransitionOrder(OrderCancelled, OrderPending))
+
+	assert.True(t, restocks(OrderPending, OrderCancelled))
+	assert.True(t, restocks(OrderFulfilled, OrderRefunded))
+	assert.False(t, restocks(OrderShipped, OrderRefunded))
+	assert.False(t, restocks(OrderPaid, OrderFulfilled))
+
+	assert.True(t, canTransitionOrder(OrderRefunding, OrderRefunded))
+	claimed := Order{Status: OrderRefunding, History: []OrderEvent{{To: OrderPaid}, {From: OrderPaid, To: OrderShipped}, {From: OrderShipped, To: OrderRefunding}}}
+	assert.Equal(t, OrderShipped, refundedFrom(claimed))
+	assert.Equal(t, OrderPaid, refundedFrom(Order{Status: OrderPaid}))
+}
+
+//failingRefunds is a provider whose refunds fail while fail is set
+type failingRefunds struct {
+	payments.FakeProvider
+	fail bool
+}
+
+func (p *failingRefunds) Refund(ctx context.Context, req payments.RefundRequest) (payments.Charge, error) {
+	if p.fail {
+		return payments.Charge{}, errors.New("provider unavailable")
+	}
+	return p.FakeProvider.Refund(ctx, req)
+}
+
+func TestRefund(t *testing.T) {
+	ctx := context.Background()
+	provider := &failingRefunds{fail: true}
+	h := OrdersHandler{Col: db.Collection("orders"), Carts: &CartsHandler{ProdCol: col}, Payments: provider}
+	charge, err := provider.Charge(ctx, payments.ChargeRequest{IdempotencyKey: "refund", Amount: 50000, Currency: "USD", Source: "tok_visa"})
+	assert.Nil(t, err)
+	//not an order of the shopper of TestOrders, which counts theirs
+	order := Order{ID: primitive.NewObjectID(), UserID: "refunded@tronics.com", Status: OrderShipped, ChargeID: charge.ID, History: []OrderEvent{{To: OrderShipped}}}
+	_, err = h.Col.InsertOne(ctx, order)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer h.Col.DeleteOne(ctx, bson.M{"_id": order.ID})
+	admin := OrderEvent{UserID: "admin@tronics.com"}
+
+	_, err = h.transition(ctx, order, OrderRefunded, admin, nil)
+	assertHTTPError(t, err, http.StatusBadGateway)
+	claimed, err := findOrder(ctx, order.ID.Hex(), h.Col)
+	assert.Nil(t, err)
+	assert.Equal(t, OrderRefunding, claimed.Status, "the refund is claimed before the provider is called")
+
+	provider.fail = false
+	_, err = h.transition(ctx, order, OrderRefunded, admin, nil)
+	assertHTTPError(t, err, http.StatusConflict, "a request that saw the order shipped cannot claim it again")
+
+	refunded, err := h.transition(ctx, claimed, OrderRefunded, admin, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, OrderRefunded, refunded.Status)
+	if assert.Len(t, refunded.History, 3) {
+		assert.Equal(t, OrderRefunding, refunded.History[2].From)
+	}
+}
+
+func TestStockDeltas(t *testing.T) {
+	phone, cover, bundle := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	products := map[primitive.ObjectID]Product{
+		phone: {ID: phone},
+		bundle: {ID: bundle, Type: ProductTypeBundle, Bundle: &Bundle{Components: []BundleComponent{
+			{ProductID: phone, Quantity: 1},
+			{ProductID: cover, Quantity: 2},
+		}}},
+	}
+	items := []OrderItem{{ProductID: phone, Quantity: 1}, {ProductID: bundle, Quantity: 3}}
+	assert.Equal(t, map[primitive.ObjectID]int{phone: 4, cover: 6}, stockDeltas(items, products))
+}
+
+func TestOrders(t *testing.T) {
+	ph := ProductHandler{Col: col}
+	ih := InventoryHandler{Col: db.Collection("inventory"), AdjCol: db.Collection("stock_adjustments"), ProdCol: col}
+	carts := &CartsHandler{Col: db.Collection("carts"), ProdCol: col, InvCol: ih.Col, Currency: "USD"}
+	h := OrdersHandler{Col: db.Collection("orders"), Carts: carts, Payments: &payments.FakeProvider{}}
+
+	decode := func(res *httptest.ResponseRecorder) Order {
+		var order Order
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &order))
+		return order
+	}
+	stock := func(id string) int {
+		c, res := newRequest(http.MethodGet, "/products/"+id+"/stock", "", nil, "id", id)
+		assert.Nil(t, ih.GetStock(c))
+		var s Stock
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &s))
+		return s.Available
+	}
+
+	var IDs []primitive.ObjectID
+	c, res := newRequest(http.MethodPost, "/products", `[{"product_name":"pixel","price":500,"currency":"USD","vendor":"google","status":"published"}]`, adminClaims)
+	assert.Nil(t, ph.CreateProducts(c))
+	if !assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &IDs)) || !assert.Len(t, IDs, 1) {
+		return
+	}
+	phone := IDs[0].Hex()
+	c, _ = newRequest(http.MethodPost, "/products/"+phone+"/stock/adjustments", `{"delta":5,"reason":"restock"}`, adminClaims, "id", phone)
+	assert.Nil(t, ih.AdjustStock(c))
+	checkout := fmt.Sprintf(`{"items":[{"product_id":%q,"quantity":2}]}`, phone)
+
+	var order Order
+	t.Run("checkout", func(t *testing.T) {
+		c, res := newRequest(http.MethodPost, "/orders", checkout, userClaims("shopper@tronics.com"))
+		c.Request().Header.Set(HeaderIdempotencyKey, "checkout-1")
+		assert.Nil(t, h.Checkout(c))
+		assert.Equal(t, http.StatusCreated, res.Code)
+		order = decode(res)
+		assert.Equal(t, OrderPending, order.Status)
+		assert.Equal(t, int64(100000), order.Total.Amount)
+		assert.Equal(t, 3, stock(phone))
+
+		c, res = newRequest(http.MethodPost, "/orders", checkout, userClaims("shopper@tronics.com"))
+		c.Request().Header.Set(HeaderIdempotencyKey, "checkout-1")
+		assert.Nil(t, h.Checkout(c))
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, order.ID, decode(res).ID)
+		assert.Equal(t, 3, stock(phone))
+	})
+
+	t.Run("insufficient stock", func(t *testing.T) {
+		c, _ := newRequest(http.MethodPost, "/orders", fmt.Sprintf(`{"items":[{"product_id":%q,"quantity":9}]}`, phone), userClaims("shopper@tronics.com"))
+		err := h.Checkout(c)
+		assert.NotNil(t, err)
+		assertHTTPError(t, err, http.StatusConflict)
+	})
+
+	t.Run("pay", func(t *testing.T) {
+		c, _ := newRequest(http.MethodPost, "/orders/"+order.ID.Hex()+"/pay", `{"source":"tok_declined"}`, userClaims("shopper@tronics.com"), "id", order.ID.Hex())
+		err := h.PayOrder(c)
+		assertHTTPError(t, err, http.StatusPaymentRequired)
+
+		c, res := newRequest(http.MethodPost, "/orders/"+order.ID.Hex()+"/pay", `{"source":"tok_visa"}`, userClaims("shopper@tronics.com"), "id", order.ID.Hex())
+		assert.Nil(t, h.PayOrder(c))
+		paid := decode(res)
+		assert.Equal(t, OrderPaid, paid.Status)
+		assert.NotEmpty(t, paid.ChargeID)
+	})
+
+	t.Run("guarded transitions", func(t *testing.T) {
+		c, _ := newRequest(http.MethodPost, "/orders/"+order.ID.Hex()+"/cancel", "", userClaims("shopper@tronics.com"), "id", order.ID.Hex())
+		err := h.CancelOrder(c)
+		assertHTTPError(t, err, http.StatusConflict)
+
+		c, _ = newRequest(http.MethodPost, "/orders/"+order.ID.Hex()+"/transitions", `{"to":"shipped"}`, adminClaims, "id", order.ID.Hex())
+		err = h.TransitionOrder(c)
+		assertHTTPError(t, err, http.StatusConflict)
+	})
+
+	t.Run("idempotent transitions", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			c, res := newRequest(http.MethodPost, "/orders/"+order.ID.Hex()+"/transitions", `{"to":"fulfilled","note":"packed"}`, adminClaims, "id", order.ID.Hex())
+			c.Request().Header.Set(HeaderIdempotencyKey, "fulfil-1")
+			assert.Nil(t, h.TransitionOrder(c))
+			fulfilled := decode(res)
+			assert.Equal(t, OrderFulfilled, fulfilled.Status)
+			assert.Len(t, fulfilled.History, 3)
+		}
+	})
+
+	t.Run("refund restocks", func(t *testing.T) {
+		c, res := newRequest(http.MethodPost, "/orders/"+order.ID.Hex()+"/transitions", `{"to":"refunded"}`, adminClaims, "id", order.ID.Hex())
+		assert.Nil(t, h.TransitionOrder(c))
+		assert.Equal(t, OrderRefunded, decode(res).Status)
+		assert.Equal(t, 5, stock(phone))
+		charge, err := h.Payments.Refund(c.Request().Context(), payments.RefundRequest{ChargeID: decode(res).ChargeID})
+		assert.Nil(t, err)
+		assert.True(t, charge.Refunded)
+	})
+
+	t.Run("stale orders are cancelled", func(t *testing.T) {
+		c, res := newRequest(http.MethodPost, "/orders", checkout, userClaims("late@tronics.com"))
+		assert.Nil(t, h.Checkout(c))
+		late := decode(res)
+		assert.Equal(t, 3, stock(phone))
+
+		h.PendingTTL = 30 * time.Minute
+		_, err := h.cancelStaleOrders(context.Background(), time.Now().Add(time.Minute))
+		assert.Nil(t, err)
+		stored, err := findOrder(context.Background(), late.ID.Hex(), h.Col)
+		assert.Nil(t, err)
+		assert.Equal(t, OrderPending, stored.Status, "a fresh order keeps its stock")
+
+		n, err := h.cancelStaleOrders(context.Background(), time.Now().Add(time.Hour))
+		assert.Nil(t, err)
+		assert.True(t, n > 0)
+		stored, err = findOrder(context.Background(), late.ID.Hex(), h.Col)
+		assert.Nil(t, err)
+		assert.Equal(t, OrderCancelled, stored.Status)
+		assert.Equal(t, 5, stock(phone))
+	})
+
+	t.Run("my orders", func(t *testing.T) {
+		c, res := newRequest(http.MethodGet, "/users/me/orders", "", userClaims("shopper@tronics.com"))
+		assert.Nil(t, h.GetMyOrders(c))
+		var orders []Order
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &orders))
+		assert.Len(t, orders, 1)
+
+		c, _ = newRequest(http.MethodGet, "/orders/"+order.ID.Hex(), "", userClaims("someone@tronics.com"), "id", order.ID.Hex())
+		err := h.GetOrder(c)
+		assertHTTPError(t, err, http.StatusNotFound)
+	})
+}
@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/inerts73/tronicscorp/dbiface"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//PricePoint is the price of a product from ChangedAt until the next point
+type PricePoint struct {
+	ID        primitive.ObjectID `json:"_id" bson:"_id"`
+	ProductID primitive.ObjectID `json:"product_id" bson:"product_id"`
+	Vendor    string             `json:"vendor" bson:"vendor"`
+	VendorID  primitive.ObjectID `json:"vendor_id,omitempty" bson:"vendor_id,omitempty"`
+	Price     int                `json:"price" bson:"price"`
+	Currency  string             `json:"currency" bson:"currency"`
+	Discount  int                `json:"discount" bson:"discount"`
+	Prices    []Money            `json:"prices,omitempty" bson:"prices,omitempty"`
+	UserID    string             `json:"user_id,omitempty" bson:"user_id,omitempty"`
+	ChangedAt time.Time          `json:"changed_at" bson:"changed_at"`
+}
+
+//VendorPriceStats sums up the prices of the products of a vendor in one
+//currency. Average weighs each price by the time it was in effect, Count is
+//the number of prices in effect within the window.
+type VendorPriceStats struct {
+	VendorID primitive.ObjectID `json:"vendor_id,omitempty" bson:"vendor_id,omitempty"`
+	Vendor   string             `json:"vendor" bson:"vendor"`
+	Currency string             `json:"currency" bson:"currency"`
+	Min      int                `json:"min" bson:"min"`
+	Max      int                `json:"max" bson:"max"`
+	Average  float64            `json:"average" bson:"average"`
+	Count    int                `json:"count" bson:"count"`
+}
+
+func priceChanged(old, updated Product) bool {
+	return old.Price != updated.Price || old.Currency != updated.Currency || old.Discount != updated.Discount ||
+		!samePrices(old.Prices, updated.Prices)
+}
+
+//samePrices tells if two lists of prices per currency are the same
+func samePrices(a, b []Money) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//recordPrice adds a point to the price history of product
+func recordPrice(ctx context.Context, product Product, userID string, collection dbiface.CollectionAPI) error {
+	point := PricePoint{
+		ID:        primitive.NewObjectID(),
+		ProductID: product.ID,
+		Vendor:    product.Vendor,
+		VendorID:  product.VendorID,
+		Price:     product.Price,
+		Currency:  product.Currency,
+		Discount:  product.Discount,
+		Prices:    product.Prices,
+		UserID:    userID,
+		ChangedAt: time.Now().UTC(),
+	}
+	_, err := collection.InsertOne(ctx, point)
+	return err
+}
+
+//recordPriceChange records the price of an updated product when it changed.
+//Products priced before the history was kept get their old price recorded first.
+func (h *ProductHandler) recordPriceChange(ctx context.Context, old, updated Product, userID string) {
+	if h.HistCol == nil || !priceChanged(old, updated) {
+		return
+	}
+	n, err := h.HistCol.CountDocuments(ctx, bson.M{"product_id": old.ID})
+	if err != nil {
+		log.Errorf("Unable to find the price history of %s : %v", old.ID.Hex(), err)
+		return
+	}
+	if n == 0 {
+		if err := recordPrice(ctx, old, "", h.HistCol); err != nil {
+			log.Errorf("Unable to record the price of %s : %v", old.ID.Hex(), err)
+		}
+	}
+	if err := recordPrice(ctx, updated, userID, h.HistCol); err != nil {
+		log.Errorf("Unable to record the price of %s : %v", updated.ID.Hex(), err)
+	}
+}
+
+//timeRange reads the from and to query params, both RFC 3339 and optional
+func timeRange(c echo.Context) (bson.M, error) {
+	window := bson.M{}
+	for param, op := range map[string]string{"from": "$gte", "to": "$lt"} {
+		value := c.QueryParam(param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid "+param+", expected an RFC 3339 time")
+		}
+		window[op] = t
+	}
+	return window, nil
+}
+
+//GetPriceHistory lists the price points of a product, oldest first
+func (h *ProductHandler) GetPriceHistory(c echo.Context) error {
+	var points []PricePoint
+	productID, err := productObjectID(storageContext(c), c.Param("id"), h.Col)
+	if err != nil {
+		return err
+	}
+	window, err := timeRange(c)
+	if err != nil {
+		return err
+	}
+	filter := bson.M{"product_id": productID}
+	if len(window) > 0 {
+		filter["changed_at"] = window
+	}
+	cursor, err := h.HistCol.Find(storageContext(c), filter, options.Find().SetSort(bson.D{{Key: "changed_at", Value: 1}}))
+	if err != nil {
+		log.Errorf("Unable to find the price history : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the price history")
+	}
+	if err := cursor.All(storageContext(c), &points); err != nil {
+		log.Errorf("Unable to read the cursor : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the price history")
+	}
+	return c.JSON(http.StatusOK, points)
+}
+
+//GetVendorPriceStats returns the min, max and average price of the products
+//of each vendor within the from and to window, per currency
+func (h *ProductHandler) GetVendorPriceStats(c echo.Context) error {
+	window, err := timeRange(c)
+	if err != nil {
+		return err
+	}
+	from, _ := window["$gte"].(time.Time)
+	to, ok := window["$lt"].(time.Time)
+	if !ok {
+		to = time.Now().UTC()
+	}
+	points, err := pricePointsIn(storageContext(c), from, to, h.HistCol)
+	if err != nil {
+		log.Errorf("Unable to find the price history : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to compute the price statistics")
+	}
+	return c.JSON(http.StatusOK, vendorPriceStats(points, from, to))
+}
+
+//pricePointsIn finds the points recorded between from and to, and the point of
+//each product in effect at from, sorted by product then time
+func pricePointsIn(ctx context.Context, from, to time.Time, collection dbiface.CollectionAPI) ([]PricePoint, error) {
+	var points []PricePoint
+	if !from.IsZero() {
+		pipeline := mongo.Pipeline{
+			{{Key: "$match", Value: bson.M{"changed_at": bson.M{"$lt": from}}}},
+			{{Key: "$sort", Value: bson.D{{Key: "product_id", Value: 1}, {Key: "changed_at", Value: 1}}}},
+			{{Key: "$group", Value: bson.M{"_id": "$product_id", "point": bson.M{"$last": "$$ROOT"}}}},
+			{{Key: "$replaceRoot", Value: bson.M{"newRoot": "$point"}}},
+		}
+		cursor, err := collection.Aggregate(ctx, pipeline)
+		if err != nil {
+			return nil, err
+		}
+		if err := cursor.All(ctx, &points); err != nil {
+			return nil, err
+		}
+	}
+	var recorded []PricePoint
+	cursor, err := collection.Find(ctx, bson.M{"changed_at": bson.M{"$gte": from, "$lt": to}})
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &recorded); err != nil {
+		return nil, err
+	}
+	points = append(points, recorded...)
+	sort.SliceStable(points, func(i, j int) bool {
+		if points[i].ProductID != points[j].ProductID {
+			return points[i].ProductID.Hex() < points[j].ProductID.Hex()
+		}
+		return points[i].ChangedAt.Before(points[j].ChangedAt)
+	})
+	return points, nil
+}
+
+//vendorPriceStats sums up points, sorted by product then time, between from
+//and to. A price counts for as long as it was in effect: until the next point
+//of its product, or to. Vendors are told apart by id, points recorded before
+//vendors had one by name.
+func vendorPriceStats(points []PricePoint, from, to time.Time) []VendorPriceStats {
+	type key struct {
+		vendor   string
+		currency string
+	}
+	type sum struct {
+		stats    VendorPriceStats
+		named    time.Time
+		weighted float64
+		seconds  float64
+		total    int
+	}
+	sums := map[key]*sum{}
+	var keys []key
+	for i, p := range points {
+		start, end := p.ChangedAt, to
+		if next := i + 1; next < len(points) && points[next].ProductID == p.ProductID {
+			end = points[next].ChangedAt
+		}
+		if start.Before(from) {
+			start = from
+		}
+		if end.Before(start) || (end.Equal(start) && p.ChangedAt.Before(from)) {
+			continue
+		}
+		k := key{vendor: "name:" + p.Vendor, currency: p.Currency}
+		if !p.VendorID.IsZero() {
+			k.vendor = p.VendorID.Hex()
+		}
+		s, ok := sums[k]
+		if !ok {
+			s = &sum{stats: VendorPriceStats{VendorID: p.VendorID, Currency: p.Currency, Min: p.Price, Max: p.Price}}
+			sums[k] = s
+			keys = append(keys, k)
+		}
+		if !p.ChangedAt.Before(s.named) {
+			s.stats.Vendor, s.named = p.Vendor, p.ChangedAt
+		}
+		if p.Price < s.stats.Min {
+			s.stats.Min = p.Price
+		}
+		if p.Price > s.stats.Max {
+			s.stats.Max = p.Price
+		}
+		s.stats.Count++
+		s.total += p.Price
+		s.seconds += end.Sub(start).Seconds()
+		s.weighted += float64(p.Price) * end.Sub(start).Seconds()
+	}
+	stats := make([]VendorPriceStats, 0, len(keys))
+	for _, k := range keys {
+		s := sums[k]
+		if s.seconds > 0 {
+			s.stats.Average = s.weighted / s.seconds
+		} else {
+			s.stats.Average = float64(s.total) / float64(s.stats.Count)
+		}
+		stats = append(stats, s.stats)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Vendor != stats[j].Vendor {
+			return stats[i].Vendor < stats[j].Vendor
+		}
+		return stats[i].Currency < stats[j].Currency
+	})
+	return stats
+}
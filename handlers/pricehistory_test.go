@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestPriceChanged(t *testing.T) {
+	p := Product{Name: "pixel", Price: 500, Currency: "USD", Vendor: "google"}
+	renamed, cheaper := p, p
+	renamed.Name = "pixel 4"
+	cheaper.Discount = 10
+	assert.False(t, priceChanged(p, renamed))
+	assert.True(t, priceChanged(p, cheaper))
+	inEuros := p
+	inEuros.Prices = []Money{{Amount: 45000, Currency: "EUR"}}
+	assert.True(t, priceChanged(p, inEuros), "a price in another currency")
+	assert.False(t, priceChanged(inEuros, inEuros))
+}
+
+func TestVendorPriceStats(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	phone, tablet, watch := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	google := primitive.NewObjectID()
+	points := []PricePoint{
+		{ProductID: phone, VendorID: google, Vendor: "google", Price: 500, Currency: "USD", ChangedAt: start},
+		{ProductID: phone, VendorID: google, Vendor: "google", Price: 200, Currency: "USD", ChangedAt: start.Add(30 * time.Hour)},
+		{ProductID: tablet, VendorID: google, Vendor: "alphabet", Price: 1000, Currency: "USD", ChangedAt: start.Add(36 * time.Hour)},
+		{ProductID: watch, Vendor: "google", Price: 100, Currency: "USD", ChangedAt: start.Add(12 * time.Hour)},
+	}
+	stats := vendorPriceStats(points, start.Add(24*time.Hour), start.Add(48*time.Hour))
+	assert.Equal(t, []VendorPriceStats{
+		// 500 for 6 hours, 200 for 18 and 1000 for 12
+		{VendorID: google, Vendor: "alphabet", Currency: "USD", Min: 200, Max: 1000, Average: float64(500*6+200*18+1000*12) / 36, Count: 3},
+		{Vendor: "google", Currency: "USD", Min: 100, Max: 100, Average: 100, Count: 1},
+	}, stats, "vendors are grouped by id, named after their latest point")
+
+	assert.Empty(t, vendorPriceStats(points, start.Add(49*time.Hour), start.Add(48*time.Hour)))
+}
+
+func TestPriceHistory(t *testing.T) {
+	h := ProductHandler{Col: col, HistCol: db.Collection("price_history")}
+
+	var IDs []primitive.ObjectID
+	c, res := newRequest(http.MethodPost, "/products", `[{"product_name":"pixel","price":500,"currency":"USD","vendor":"pricing"}]`, adminClaims)
+	assert.Nil(t, h.CreateProducts(c))
+	if !assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &IDs)) || !assert.Len(t, IDs, 1) {
+		return
+	}
+	id := IDs[0].Hex()
+
+	c, _ = newRequest(http.MethodPut, "/products/"+id, `{"product_name":"pixel 4"}`, adminClaims, "id", id)
+	assert.Nil(t, h.UpdateProduct(c))
+	c, _ = newRequest(http.MethodPut, "/products/"+id, `{"price":300}`, adminClaims, "id", id)
+	assert.Nil(t, h.UpdateProduct(c))
+
+	t.Run("history", func(t *testing.T) {
+		var points []PricePoint
+		c, res := newRequest(http.MethodGet, "/products/"+id+"/price-history", "", adminClaims, "id", id)
+		assert.Nil(t, h.GetPriceHistory(c))
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &points))
+		assert.Len(t, points, 2)
+		assert.Equal(t, 300, points[1].Price)
+	})
+
+	t.Run("invalid range", func(t *testing.T) {
+		c, _ := newRequest(http.MethodGet, "/products/"+id+"/price-history?from=yesterday", "", adminClaims, "id", id)
+		err := h.GetPriceHistory(c)
+		assertHTTPError(t, err, http.StatusBadRequest)
+	})
+
+	t.Run("points of a window", func(t *testing.T) {
+		points, err := pricePointsIn(context.Background(), time.Now().Add(time.Hour), time.Now().Add(2*time.Hour), h.HistCol)
+		assert.Nil(t, err)
+		var mine []PricePoint
+		for _, p := range points {
+			if p.ProductID == IDs[0] {
+				mine = append(mine, p)
+			}
+		}
+		if assert.Len(t, mine, 1, "only the point in effect at from") {
+			assert.Equal(t, 300, mine[0].Price)
+		}
+	})
+
+	t.Run("vendor stats", func(t *testing.T) {
+		var stats []VendorPriceStats
+		c, res := newRequest(http.MethodGet, "/analytics/vendor-prices", "", adminClaims)
+		assert.Nil(t, h.GetVendorPriceStats(c))
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &stats))
+		for _, s := range stats {
+			if s.Vendor == "pricing" {
+				assert.Equal(t, 300, s.Min)
+				assert.Equal(t, 500, s.Max)
+				assert.Equal(t, 2, s.Count)
+				assert.InDelta(t, 300, s.Average, 1, "500 was only in effect until the update")
+			}
+		}
+	})
+}
@@ -3,15 +3,20 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"reflect"
+	"strings"
+	"time"
 
 	"github.com/inerts73/tronicscorp/dbiface"
 	"github.com/labstack/echo"
 	"github.com/labstack/gommon/log"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"gopkg.in/go-playground/validator.v9"
 )
 
@@ -19,21 +24,170 @@ var (
 	v = validator.New()
 )
 
-//Product describes an electronic product e.g. phone
+//Product describes an electronic product e.g. phone.
+//Price stays in whole units of Currency for existing clients, ListPrice and Prices are in minor units.
+//Discount is kept for existing clients, discounts are applied through promotions.
+//Accessories are free-form labels, AccessoryIDs and CompatibleIDs refer to other products.
+//Name and Description are the default content, Translations hold it per locale.
+//Rating is kept by the reviews, CreatedAt and UpdatedAt by every write. DisplayPrice,
+//Pricing, Expanded and Localized are computed for the response and never stored.
 type Product struct {
-	ID          primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
-	Name        string             `json:"product_name" bson:"product_name" validate:"required,max=10"`
-	Price       int                `json:"price" bson:"price" validate:"required,max=2000"`
-	Currency    string             `json:"currency" bson:"currency" validate:"required,len=3"`
-	Discount    int                `json:"discount" bson:"discount"`
-	Vendor      string             `json:"vendor" bson:"vendor" validate:"required"`
-	Accessories []string           `json:"accessories,omitempty" bson:"accessories,omitempty"`
-	IsEssential string             `json:"is_essential" bson:"is_essential"`
+	ID            primitive.ObjectID     `json:"_id,omitempty" bson:"_id,omitempty"`
+	Name          string                 `json:"product_name" bson:"product_name" validate:"required,max=100"`
+	Price         int                    `json:"price" bson:"price" validate:"required_without=Bundle,min=0,max=2000"`
+	Currency      string                 `json:"currency" bson:"currency" validate:"required,len=3,iso4217"`
+	Description   string                 `json:"description,omitempty" bson:"description,omitempty" validate:"max=2000"`
+	Translations  map[string]Translation `json:"translations,omitempty" bson:"translations,omitempty" validate:"dive,keys,locale,endkeys,required"`
+	Discount      int                    `json:"discount" bson:"discount"`
+	Vendor        string                 `json:"vendor" bson:"vendor" validate:"required_without=VendorID"`
+	VendorID      primitive.ObjectID     `json:"vendor_id,omitempty" bson:"vendor_id,omitempty"`
+	Type          string                 `json:"type,omitempty" bson:"type,omitempty" validate:"omitempty,oneof=bundle"`
+	Bundle        *Bundle                `json:"bundle,omitempty" bson:"bundle,omitempty"`
+	Accessories   []string               `json:"accessories,omitempty" bson:"accessories,omitempty"`
+	AccessoryIDs  []primitive.ObjectID   `json:"accessory_ids,omitempty" bson:"accessory_ids,omitempty" validate:"unique"`
+	CompatibleIDs []primitive.ObjectID   `json:"compatible_ids,omitempty" bson:"compatible_ids,omitempty" validate:"unique"`
+	IsEssential   string                 `json:"is_essential" bson:"is_essential"`
+	Prices        []Money                `json:"prices,omitempty" bson:"prices,omitempty" validate:"unique=Currency,dive"`
+	Categories    []primitive.ObjectID   `json:"categories,omitempty" bson:"categories,omitempty" validate:"unique"`
+	Attributes    map[string]interface{} `json:"attributes,omitempty" bson:"attributes,omitempty"`
+	Media         []Media                `json:"media,omitempty" bson:"media,omitempty"`
+	Rating        *RatingSummary         `json:"rating,omitempty" bson:"rating,omitempty"`
+	Status        string                 `json:"status" bson:"status,omitempty" validate:"omitempty,oneof=draft published archived"`
+	PublishAt     *time.Time             `json:"publish_at,omitempty" bson:"publish_at,omitempty"`
+	UnpublishAt   *time.Time             `json:"unpublish_at,omitempty" bson:"unpublish_at,omitempty"`
+	CreatedAt     *time.Time             `json:"created_at,omitempty" bson:"created_at,omitempty"`
+	UpdatedAt     *time.Time             `json:"updated_at,omitempty" bson:"updated_at,omitempty"`
+	DisplayPrice  *Money                 `json:"display_price,omitempty" bson:"-"`
+	Pricing       *Pricing               `json:"pricing,omitempty" bson:"-"`
+	Expanded      *Expansion             `json:"expanded,omitempty" bson:"-"`
+	Localized     *Localized             `json:"localized,omitempty" bson:"-"`
+}
+
+//ListPrice is the price of the product in its own currency
+func (p Product) ListPrice() Money {
+	return majorUnits(p.Price, p.Currency)
+}
+
+//PriceIn returns the price list entry for currency, or converts the list price
+func (p Product) PriceIn(currency string, rates *RateTable) (Money, error) {
+	for _, price := range p.Prices {
+		if price.Currency == currency {
+			return price, nil
+		}
+	}
+	return rates.Convert(p.ListPrice(), currency)
+}
+
+func setDisplayPrices(products []Product, currency string, rates *RateTable) error {
+	currency = strings.ToUpper(currency)
+	for i := range products {
+		price, err := products[i].PriceIn(currency, rates)
+		if err != nil {
+			log.Errorf("Unable to price the product in %s : %v", currency, err)
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unable to show prices in %s", currency))
+		}
+		products[i].DisplayPrice = &price
+	}
+	return nil
 }
 
 //ProductHandler a product handler
 type ProductHandler struct {
-	Col dbiface.CollectionAPI
+	Col       dbiface.CollectionAPI
+	InvCol    dbiface.CollectionAPI
+	Rates     *RateTable
+	PromoCol  dbiface.CollectionAPI
+	Promos    *PromotionEngine
+	CatCol    dbiface.CollectionAPI
+	RevCol    dbiface.CollectionAPI
+	VendorCol dbiface.CollectionAPI
+	HistCol   dbiface.CollectionAPI
+	Alerts    *AlertChecker
+	Webhooks  *WebhookDispatcher
+	//Locales are the locales we sell in, DefaultLocale the one of the default content
+	Locales       []string
+	DefaultLocale string
+}
+
+//updateHooks are the hooks of an update made by who
+func (h *ProductHandler) updateHooks(who actor, restoredFrom int) productHooks {
+	return productHooks{
+		check: func(ctx context.Context, old Product, updated *Product) error {
+			if err := checkStatusChange(who, old, *updated); err != nil {
+				return err
+			}
+			if err := h.checkReferences(ctx, &old, updated); err != nil {
+				return err
+			}
+			return checkVendorScope(who, old, *updated)
+		},
+		updated: func(ctx context.Context, old, updated Product) {
+			h.recordUpdate(ctx, old, updated, who.userID, restoredFrom)
+			h.recordPriceChange(ctx, old, updated, who.userID)
+			if priceChanged(old, updated) && !updated.isBundle() {
+				h.refreshBundles(ctx, updated)
+			}
+			if h.Alerts != nil {
+				h.Alerts.check(ctx, old, updated)
+			}
+			if changes, err := diffProducts(old, updated); h.Webhooks != nil && err == nil && len(changes) > 0 && shownToPartners(old, updated) {
+				h.Webhooks.publish(ctx, EventProductUpdated, updated)
+			}
+		},
+	}
+}
+
+//created runs once a product made by who is stored
+func (h *ProductHandler) created(ctx context.Context, who actor, product Product) {
+	if h.RevCol != nil {
+		if _, err := recordRevision(ctx, product, who.userID, 0, h.RevCol); err != nil {
+			log.Errorf("Unable to record the revision of %s : %v", product.ID.Hex(), err)
+		}
+	}
+	if h.HistCol != nil {
+		if err := recordPrice(ctx, product, who.userID, h.HistCol); err != nil {
+			log.Errorf("Unable to record the price of %s : %v", product.ID.Hex(), err)
+		}
+	}
+	if h.Webhooks != nil && product.status() == StatusPublished {
+		h.Webhooks.publish(ctx, EventProductCreated, product)
+	}
+}
+
+//checkReferences makes sure that the documents a product refers to exist. old
+//is the stored product of an update, nil for a new product. An unchanged vendor
+//is not resolved again, so that products made before vendors were documents
+//can still be updated.
+func (h *ProductHandler) checkReferences(ctx context.Context, old *Product, product *Product) error {
+	if h.VendorCol != nil && (old == nil || vendorChanged(*old, *product)) {
+		if err := resolveVendor(ctx, product, h.VendorCol); err != nil {
+			return err
+		}
+	}
+	if h.CatCol != nil {
+		if err := checkCategories(ctx, product.Categories, h.CatCol); err != nil {
+			return err
+		}
+		schema, err := attributeSchema(ctx, product.Categories, h.CatCol)
+		if err != nil {
+			log.Errorf("Unable to find the attribute schema : %v", err)
+			return err
+		}
+		if err := checkAttributes(product.Attributes, schema); err != nil {
+			return err
+		}
+	}
+	if err := h.checkBundle(ctx, product); err != nil {
+		return err
+	}
+	return checkProductRefs(ctx, *product, h.Col)
+}
+
+func (h *ProductHandler) setPricing(ctx context.Context, products []Product) error {
+	if h.PromoCol == nil || h.Promos == nil {
+		return nil
+	}
+	return h.Promos.setPricing(ctx, products, h.PromoCol)
 }
 
 //ProductValidator a product validator
@@ -46,29 +200,123 @@ func (p *ProductValidator) Validate(i interface{}) error {
 	return p.validator.Struct(i)
 }
 
+//listQuery turns the query params of a product listing into a filter and
+//find options. Only admins see the products which are not published.
+func (h *ProductHandler) listQuery(ctx context.Context, q url.Values, admin bool) (bson.M, *options.FindOptions, error) {
+	filter, err := productFilter(q)
+	if err != nil {
+		return nil, nil, err
+	}
+	if inStock := q.Get("in_stock"); inStock != "" && h.InvCol != nil {
+		IDs, err := inStockProductIDs(ctx, h.InvCol)
+		if err != nil {
+			return nil, nil, err
+		}
+		bundleIDs, err := h.inStockBundleIDs(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		IDs = append(IDs, bundleIDs...)
+		if inStock == "true" {
+			filter["_id"] = bson.M{"$in": IDs}
+		} else {
+			filter["_id"] = bson.M{"$nin": IDs}
+		}
+	}
+	if category := q.Get("category"); category != "" && h.CatCol != nil {
+		docID, err := categoryID(category)
+		if err != nil {
+			return nil, nil, err
+		}
+		IDs := []primitive.ObjectID{docID}
+		if q.Get("descendants") == "true" {
+			if IDs, err = subtreeIDs(ctx, docID, h.CatCol); err != nil {
+				return nil, nil, err
+			}
+		}
+		filter["categories"] = bson.M{"$in": IDs}
+	}
+	if !admin {
+		filter["$or"] = publishedFilter
+	}
+	opts := options.Find()
+	switch q.Get("sort") {
+	case "":
+	case "rating":
+		opts.SetSort(bson.D{{Key: "rating.average", Value: -1}, {Key: "rating.count", Value: -1}})
+	default:
+		return nil, nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unable to sort by %q", q.Get("sort")))
+	}
+	return filter, opts, nil
+}
+
 //GetProducts get a list of products
 func (h *ProductHandler) GetProducts(c echo.Context) error {
-	products, err := findProducts(context.Background(), c.QueryParams(), h.Col)
+	q := c.QueryParams()
+	filter, opts, err := h.listQuery(storageContext(c), q, isAdminFromContext(c))
+	if err != nil {
+		return err
+	}
+	products, err := findProducts(storageContext(c), filter, h.Col, opts)
 	if err != nil {
 		return err
 	}
-	return c.JSON(http.StatusOK, products)
+	if currency := q.Get("currency"); currency != "" {
+		if err := setDisplayPrices(products, currency, h.Rates); err != nil {
+			return err
+		}
+	}
+	if err := h.setPricing(storageContext(c), products); err != nil {
+		return err
+	}
+	h.setLocalized(c, products)
+	if err := h.expandBundles(storageContext(c), products, !isAdminFromContext(c)); err != nil {
+		return err
+	}
+	return respond(c, http.StatusOK, products)
 }
 
-func findProducts(ctx context.Context, q url.Values, collection dbiface.CollectionAPI)([]Product, error){
-	var products []Product
-	filter := make(map[string] interface{})
+//listParams are query params which control the listing instead of matching a field
+var listParams = map[string]bool{
+	"in_stock": true,
+	"sort":     true,
+	"currency": true,
+	"category":    true,
+	"descendants": true,
+	"lang":        true,
+}
+
+func productFilter(q url.Values) (bson.M, error) {
+	filter := bson.M{}
 	for k,v := range q{
+		if listParams[k] || strings.HasPrefix(k, attrFilterPrefix) {
+			continue
+		}
 		filter[k]=v[0]	
 	}
-	if filter["_id"] != nil {
-		docID, err := primitive.ObjectIDFromHex(filter["_id"].(string))	
+	for _, k := range []string{"_id", "vendor_id"} {
+		if filter[k] == nil {
+			continue
+		}
+		docID, err := primitive.ObjectIDFromHex(filter[k].(string))
 		if err != nil {
-			return products, err
+			return filter, err
 		}
-		filter["_id"] = docID
+		filter[k] = docID
 	}
-	cursor, err := collection.Find(ctx, bson.M(filter))
+	attributes, err := attributeFilter(q)
+	if err != nil {
+		return filter, err
+	}
+	for k, v := range attributes {
+		filter[k] = v
+	}
+	return filter, nil
+}
+
+func findProducts(ctx context.Context, filter bson.M, collection dbiface.CollectionAPI, opts ...*options.FindOptions)([]Product, error){
+	var products []Product
+	cursor, err := collection.Find(ctx, filter, opts...)
 	if err != nil {
 		log.Errorf("Unable to find the products : %v", err)	
 		return products, err
@@ -83,11 +331,34 @@ func findProducts(ctx context.Context, q url.Values, collection dbiface.Collecti
 
 //GetProduct gets a single product
 func (h *ProductHandler) GetProduct(c echo.Context) error {
-	product, err := findProduct(context.Background(), c.Param("id"), h.Col)
+	product, err := findProduct(storageContext(c), c.Param("id"), h.Col)
 	if err != nil {
 		return err
 	}
-	return c.JSON(http.StatusOK, product)
+	//drafts and archived products are only shown to admins
+	if !isAdminFromContext(c) && product.status() != StatusPublished {
+		return echo.NewHTTPError(http.StatusNotFound, "Product does not exist")
+	}
+	products := []Product{product}
+	if currency := c.QueryParam("currency"); currency != "" {
+		if err := setDisplayPrices(products, currency, h.Rates); err != nil {
+			return err
+		}
+	}
+	if err := h.setPricing(storageContext(c), products); err != nil {
+		return err
+	}
+	h.setLocalized(c, products)
+	if err := h.expandBundles(storageContext(c), products, !isAdminFromContext(c)); err != nil {
+		return err
+	}
+	if expand := c.QueryParam("expand"); expand != "" {
+		if err := expandRefs(storageContext(c), &products[0], expand, !isAdminFromContext(c), h.Col); err != nil {
+			return err
+		}
+	}
+	setLastModified(c, products[0])
+	return respond(c, http.StatusOK, products[0])
 }
 
 func deleteProduct(ctx context.Context, id string, collection dbiface.CollectionAPI) (int64, error) {
@@ -104,13 +375,58 @@ func deleteProduct(ctx context.Context, id string, collection dbiface.Collection
 	return res.DeletedCount, nil
 }
 
-//DeleteProduct gets a single product
+//DeleteProduct deletes a single product and the references other products have to it
 func (h *ProductHandler) DeleteProduct(c echo.Context) error {
-	delCount, err := deleteProduct(context.Background(), c.Param("id"), h.Col)
+	delCount, err := h.removeProduct(storageContext(c), c.Param("id"))
 	if err != nil {
 		return err
 	}
-	return c.JSON(http.StatusOK, delCount)
+	return c.JSON(http.StatusOK, versioned(c, delCount, Deleted{DeletedCount: delCount}))
+}
+
+//removeProduct deletes a product which is not part of a bundle and the
+//references other products have to it
+func (h *ProductHandler) removeProduct(ctx context.Context, id string) (int64, error) {
+	if docID, err := primitive.ObjectIDFromHex(id); err == nil {
+		bundles, err := h.Col.CountDocuments(ctx, bson.M{"bundle.components.product_id": docID})
+		if err != nil {
+			log.Errorf("Unable to count the bundles : %v", err)
+			return 0, echo.NewHTTPError(http.StatusInternalServerError, "Unable to delete the product")
+		}
+		if bundles > 0 {
+			return 0, echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("Product is part of %d bundles", bundles))
+		}
+	}
+	delCount, err := deleteProduct(ctx, id, h.Col)
+	if err != nil {
+		return 0, err
+	}
+	if delCount > 0 {
+		docID, _ := primitive.ObjectIDFromHex(id)
+		n, err := removeDanglingRefs(ctx, docID, h.Col)
+		if err != nil {
+			return 0, echo.NewHTTPError(http.StatusInternalServerError, "Unable to remove the references to the product")
+		}
+		if n > 0 {
+			log.Infof("Removed the references of %d products to %s", n, docID.Hex())
+		}
+		if h.Webhooks != nil {
+			h.Webhooks.publish(ctx, EventProductDeleted, bson.M{"_id": docID})
+		}
+	}
+	return delCount, nil
+}
+
+//touch adds the setting of updated_at to an update of products made outside
+//modifyProduct, so their Last-Modified follows the change
+func touch(update bson.M) bson.M {
+	set, ok := update["$set"].(bson.M)
+	if !ok {
+		set = bson.M{}
+		update["$set"] = set
+	}
+	set["updated_at"] = time.Now().UTC()
+	return update
 }
 
 func findProduct(ctx context.Context, id string, collection dbiface.CollectionAPI) (Product, error) {
@@ -127,7 +443,15 @@ func findProduct(ctx context.Context, id string, collection dbiface.CollectionAP
 	return product, nil
 }
 
-func modifyProduct(ctx context.Context, id string, reqBody io.ReadCloser, collection dbiface.CollectionAPI) (Product, error) {
+//productHooks let a handler take part in a product update
+type productHooks struct {
+	//check can refuse the update, or normalise it, before it is stored
+	check func(ctx context.Context, old Product, updated *Product) error
+	//updated runs once the update is stored
+	updated func(ctx context.Context, old, updated Product)
+}
+
+func modifyProduct(ctx context.Context, id string, reqBody io.Reader, collection dbiface.CollectionAPI, hooks productHooks) (Product, error) {
 	var product Product
 	//find if he product exists, if err return 404
 	docID, err := primitive.ObjectIDFromHex(id)
@@ -142,42 +466,115 @@ func modifyProduct(ctx context.Context, id string, reqBody io.ReadCloser, collec
 		return product, err
 	}
 
+	var old Product
+	if err := res.Decode(&old); err != nil {
+		log.Errorf("unable to decode to product :%v", err)
+		return product, err
+	}
+
+	//media is managed through its own endpoints and ratings by the reviews
+	media, rating, createdAt := product.Media, product.Rating, product.CreatedAt
+
 	//decode the req payload, if err return 500
 	if err := json.NewDecoder(reqBody).Decode(&product); err != nil {
 		log.Errorf("unable to decode using reqBody : %v", err)
 		return product, err
 	}
+	product.Media, product.Rating = media, nil
+	now := time.Now().UTC()
+	product.CreatedAt, product.UpdatedAt = createdAt, &now
 
 	//validate the request, if err return 400
 	if err := v.Struct(product); err != nil {
 		log.Errorf("unable to validate the struct : %v", err)		
 		return product, err
 	}
+	if hooks.check != nil {
+		if err := hooks.check(ctx, old, &product); err != nil {
+			log.Errorf("unable to check the update : %v", err)
+			return product, err
+		}
+	}
 
 	//update the product, if err return 500
-	_, err = collection.UpdateOne(ctx, filter, bson.M{"$set":product})
+	update := bson.M{"$set": product}
+	unset, err := omittedFields(product)
+	if err != nil {
+		log.Errorf("unable to encode the product : %v", err)
+		return product, err
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	_, err = collection.UpdateOne(ctx, filter, update)
 	if err != nil {
 		log.Errorf("unable to validate the struct : %v", err)	
 		return product, err
 	}
+	product.Rating = rating
+	if hooks.updated != nil {
+		hooks.updated(ctx, old, product)
+	}
 	return product, nil
 }
 
+//omittedFields lists the stored fields of product that its encoding leaves
+//out, so that an update can clear them instead of keeping their old values.
+//Media and ratings are left alone, they are managed by their own endpoints.
+func omittedFields(product Product) (bson.M, error) {
+	return omittedBSONFields(product, "media", "rating")
+}
+
+//omittedBSONFields lists the fields of the struct doc that its bson encoding
+//leaves out, but for _id and the kept fields
+func omittedBSONFields(doc interface{}, kept ...string) (bson.M, error) {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	unset := bson.M{}
+	t := reflect.TypeOf(doc)
+fields:
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("bson"), ",")[0]
+		switch name {
+		case "", "-", "_id":
+			continue
+		}
+		for _, k := range kept {
+			if name == k {
+				continue fields
+			}
+		}
+		if _, err := bson.Raw(raw).LookupErr(name); err != nil {
+			unset[name] = ""
+		}
+	}
+	return unset, nil
+}
+
 //UpdateProduct updates a product
 func (h *ProductHandler) UpdateProduct(c echo.Context) error {
-	product, err := modifyProduct(context.Background(), c.Param("id"), c.Request().Body, h.Col)
+	body, err := requestJSON(c, reflect.TypeOf(Product{}))
+	if err != nil {
+		return err
+	}
+	product, err := modifyProduct(storageContext(c), c.Param("id"), body, h.Col, h.updateHooks(actorFromContext(c), 0))
 	if err != nil {
 		log.Errorf("unable to update the product : %v", err)	
 		return err
 	}
-	return c.JSON(http.StatusOK, product)
+	return respond(c, http.StatusOK, product)
 }
 
 func insertProducts(ctx context.Context, products []Product, collection dbiface.CollectionAPI) ([]interface{}, error) {
 	var insertedIds []interface{}
-	for _, product := range products {
-		product.ID = primitive.NewObjectID()
-		insertID, err := collection.InsertOne(ctx, product)
+	now := time.Now().UTC()
+	for i := range products {
+		products[i].ID = primitive.NewObjectID()
+		products[i].Media, products[i].Rating = nil, nil
+		products[i].CreatedAt, products[i].UpdatedAt = &now, &now
+		insertID, err := collection.InsertOne(ctx, products[i])
 		if err != nil {
 			log.Errorf("Unable to insert %v", err)
 			return nil, err
@@ -191,19 +588,51 @@ func insertProducts(ctx context.Context, products []Product, collection dbiface.
 func (h *ProductHandler) CreateProducts(c echo.Context) error {
 	var products []Product
 	c.Echo().Validator = &ProductValidator{validator: v}
-	if err := c.Bind(&products); err != nil {
-		log.Errorf("Unable to find : %v", err)
+	body, err := requestJSON(c, reflect.TypeOf(products))
+	if err != nil {
 		return err
 	}
-	for _, product := range products {
-		if err := c.Validate(product); err != nil {
-			log.Errorf("Unable to validate the product %+v %v", product, err)
-			return err
-		}
+	if err := json.NewDecoder(body).Decode(&products); err != nil {
+		log.Errorf("Unable to decode the products : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
 	}
-	IDs, err := insertProducts(context.Background(), products, h.Col)
+	IDs, err := h.createProducts(storageContext(c), actorFromContext(c), products, c.Validate)
 	if err != nil {
 		return err
 	}
-	return c.JSON(http.StatusCreated, IDs)
+	return respond(c, http.StatusCreated, versioned(c, IDs, Created{IDs: IDs}))
+}
+
+//createProducts checks and stores products made by who, all of them or none
+func (h *ProductHandler) createProducts(ctx context.Context, who actor, products []Product, validate func(i interface{}) error) ([]interface{}, error) {
+	for i := range products {
+		product := &products[i]
+		if product.VendorID.IsZero() && product.Vendor == "" {
+			product.VendorID = who.vendorID
+		}
+		if product.Status == "" {
+			product.Status = StatusDraft
+		}
+		if err := validate(*product); err != nil {
+			log.Errorf("Unable to validate the product %+v %v", *product, err)
+			return nil, err
+		}
+		if err := checkStatusChange(who, Product{Status: StatusDraft}, *product); err != nil {
+			return nil, err
+		}
+		if err := h.checkReferences(ctx, nil, product); err != nil {
+			return nil, err
+		}
+		if err := checkVendorScope(who, Product{VendorID: who.vendorID}, *product); err != nil {
+			return nil, err
+		}
+	}
+	IDs, err := insertProducts(ctx, products, h.Col)
+	if err != nil {
+		return nil, err
+	}
+	for _, product := range products {
+		h.created(ctx, who, product)
+	}
+	return IDs, nil
 }
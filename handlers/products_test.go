@@ -11,8 +11,8 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/ilyakaznacheev/cleanenv"
-	"github.com/inerts73/tronicscorp/config"
 	"github.com/labstack/echo"
 	"github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -23,7 +23,6 @@ var (
 	c   *mongo.Client
 	db  *mongo.Database
 	col *mongo.Collection
-	cfg config.Properties
 	h   ProductHandler
 )
 
@@ -37,7 +36,7 @@ func init() {
 		log.Fatal("Unable tp connect to database: %w", err)
 	}
 	db = c.Database(cfg.DBName)
-	col = db.Collection(cfg.CollectionName)
+	col = db.Collection(cfg.ProductCollection)
 }
 
 func TestMain(m *testing.M) {
@@ -132,6 +131,8 @@ func TestProduct(t *testing.T) {
 		c := e.NewContext(req, res)
 		c.SetParamNames("id") 					  // this is a hack
 		c.SetParamValues(fmt.Sprintf("%s", docID)) //this is a hack
+		//new products are drafts, which only admins see
+		c.Set("user", jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"user_id": "admin@tronics.com", "authorized": true}))
 		h.Col = col
 		err := h.GetProduct(c)
 		assert.Nil(t, err)		
@@ -0,0 +1,338 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/inerts73/tronicscorp/dbiface"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/go-playground/validator.v9"
+)
+
+const (
+	//PercentageDiscount takes Percent percent off the price
+	PercentageDiscount = "percentage"
+	//FixedDiscount takes Amount off the price
+	FixedDiscount = "fixed"
+)
+
+//Promotion is a time limited discount on a set of products
+type Promotion struct {
+	ID          primitive.ObjectID   `json:"_id,omitempty" bson:"_id,omitempty"`
+	Name        string               `json:"name" bson:"name" validate:"required,max=100"`
+	Kind        string               `json:"kind" bson:"kind" validate:"required,oneof=percentage fixed"`
+	Percent     int                  `json:"percent,omitempty" bson:"percent,omitempty" validate:"min=0,max=100"`
+	Amount      *Money               `json:"amount,omitempty" bson:"amount,omitempty"`
+	StartsAt    time.Time            `json:"starts_at" bson:"starts_at" validate:"required"`
+	EndsAt      time.Time            `json:"ends_at" bson:"ends_at" validate:"required,gtfield=StartsAt"`
+	Priority    int                  `json:"priority" bson:"priority"`
+	Exclusive   bool                 `json:"exclusive" bson:"exclusive"`
+	Products    []primitive.ObjectID `json:"products,omitempty" bson:"products,omitempty"`
+	Vendors     []primitive.ObjectID `json:"vendors,omitempty" bson:"vendor_ids,omitempty"`
+	Accessories []string             `json:"accessories,omitempty" bson:"accessories,omitempty"`
+}
+
+func init() {
+	v.RegisterStructValidation(func(sl validator.StructLevel) {
+		p := sl.Current().Interface().(Promotion)
+		if p.Kind == PercentageDiscount && p.Percent == 0 {
+			sl.ReportError(p.Percent, "Percent", "percent", "required", "")
+		}
+		if p.Kind == FixedDiscount && (p.Amount == nil || p.Amount.Amount <= 0) {
+			sl.ReportError(p.Amount, "Amount", "amount", "required", "")
+		}
+		if len(p.Products)+len(p.Vendors)+len(p.Accessories) == 0 {
+			sl.ReportError(p.Products, "Products", "products", "required", "")
+		}
+	}, Promotion{})
+}
+
+//Active reports whether the promotion runs at t
+func (p Promotion) Active(t time.Time) bool {
+	return !t.Before(p.StartsAt) && t.Before(p.EndsAt)
+}
+
+//Targets reports whether the promotion covers the product
+func (p Promotion) Targets(product Product) bool {
+	for _, ID := range p.Products {
+		if ID == product.ID {
+			return true
+		}
+	}
+	for _, vendorID := range p.Vendors {
+		if !product.VendorID.IsZero() && vendorID == product.VendorID {
+			return true
+		}
+	}
+	for _, accessory := range p.Accessories {
+		for _, a := range product.Accessories {
+			if accessory == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//AppliedPromotion is a promotion and what it took off the price
+type AppliedPromotion struct {
+	ID       primitive.ObjectID `json:"_id"`
+	Name     string             `json:"name"`
+	Discount Money              `json:"discount"`
+}
+
+//Pricing breaks a price down into the list price and its promotions
+type Pricing struct {
+	ListPrice  Money              `json:"list_price"`
+	Promotions []AppliedPromotion `json:"promotions"`
+	FinalPrice Money              `json:"final_price"`
+}
+
+//Clock tells the time, so tests can stop it
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+//PromotionEngine works out the final price of products
+type PromotionEngine struct {
+	Clock Clock
+	Rates *RateTable
+}
+
+func (e *PromotionEngine) now() time.Time {
+	if e.Clock == nil {
+		return systemClock{}.Now()
+	}
+	return e.Clock.Now()
+}
+
+//Price applies promotions to the list price of a product.
+//
+//Promotions that run now and target the product are applied from the highest
+//priority to the lowest, ties broken by the oldest id. Each discount is taken
+//from the price left by the previous one. An exclusive promotion is applied
+//only when it comes first and then no other promotion is applied; later
+//exclusive promotions are skipped. The final price never drops below zero.
+func (e *PromotionEngine) Price(product Product, listPrice Money, promotions []Promotion) Pricing {
+	now := e.now()
+	var applicable []Promotion
+	for _, p := range promotions {
+		if p.Active(now) && p.Targets(product) {
+			applicable = append(applicable, p)
+		}
+	}
+	sort.SliceStable(applicable, func(i, j int) bool {
+		if applicable[i].Priority != applicable[j].Priority {
+			return applicable[i].Priority > applicable[j].Priority
+		}
+		return applicable[i].ID.Hex() < applicable[j].ID.Hex()
+	})
+
+	pricing := Pricing{ListPrice: listPrice, Promotions: []AppliedPromotion{}, FinalPrice: listPrice}
+	for i, p := range applicable {
+		if p.Exclusive && i > 0 {
+			continue
+		}
+		discount, ok := e.discount(p, pricing.FinalPrice)
+		if !ok {
+			continue
+		}
+		pricing.FinalPrice.Amount -= discount.Amount
+		pricing.Promotions = append(pricing.Promotions, AppliedPromotion{ID: p.ID, Name: p.Name, Discount: discount})
+		if p.Exclusive {
+			break
+		}
+	}
+	return pricing
+}
+
+func (e *PromotionEngine) discount(p Promotion, price Money) (Money, bool) {
+	discount := Money{Currency: price.Currency}
+	switch p.Kind {
+	case PercentageDiscount:
+		discount.Amount = (price.Amount*int64(p.Percent)*2 + 100) / 200
+	case FixedDiscount:
+		if p.Amount == nil {
+			return discount, false
+		}
+		amount, err := e.Rates.Convert(*p.Amount, price.Currency)
+		if err != nil {
+			log.Errorf("Unable to apply promotion %s : %v", p.ID.Hex(), err)
+			return discount, false
+		}
+		discount.Amount = amount.Amount
+	default:
+		return discount, false
+	}
+	if discount.Amount > price.Amount {
+		discount.Amount = price.Amount
+	}
+	return discount, true
+}
+
+func activePromotions(ctx context.Context, now time.Time, collection dbiface.CollectionAPI) ([]Promotion, error) {
+	var promotions []Promotion
+	filter := bson.M{"starts_at": bson.M{"$lte": now}, "ends_at": bson.M{"$gt": now}}
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		log.Errorf("Unable to find the promotions : %v", err)
+		return nil, err
+	}
+	if err := cursor.All(ctx, &promotions); err != nil {
+		log.Errorf("Unable to read the cursor : %v", err)
+		return nil, err
+	}
+	return promotions, nil
+}
+
+//setPricing works out the pricing of products, in their display price when set
+func (e *PromotionEngine) setPricing(ctx context.Context, products []Product, collection dbiface.CollectionAPI) error {
+	promotions, err := activePromotions(ctx, e.now(), collection)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the promotions")
+	}
+	for i := range products {
+		listPrice := products[i].ListPrice()
+		if products[i].DisplayPrice != nil {
+			listPrice = *products[i].DisplayPrice
+		}
+		pricing := e.Price(products[i], listPrice, promotions)
+		products[i].Pricing = &pricing
+	}
+	return nil
+}
+
+//PromotionsHandler a promotions handler
+type PromotionsHandler struct {
+	Col dbiface.CollectionAPI
+}
+
+func findPromotion(ctx context.Context, id string, collection dbiface.CollectionAPI) (Promotion, error) {
+	var promotion Promotion
+	docID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return promotion, echo.NewHTTPError(http.StatusBadRequest, "Invalid promotion id")
+	}
+	res := collection.FindOne(ctx, bson.M{"_id": docID})
+	if err := res.Decode(&promotion); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return promotion, echo.NewHTTPError(http.StatusNotFound, "Promotion does not exist")
+		}
+		log.Errorf("Unable to decode the promotion : %v", err)
+		return promotion, err
+	}
+	return promotion, nil
+}
+
+//GetPromotions lists the promotions, the ones running now with active=true
+func (h *PromotionsHandler) GetPromotions(c echo.Context) error {
+	var promotions []Promotion
+	filter := bson.M{}
+	if c.QueryParam("active") == "true" {
+		now := time.Now()
+		filter = bson.M{"starts_at": bson.M{"$lte": now}, "ends_at": bson.M{"$gt": now}}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "priority", Value: -1}, {Key: "_id", Value: 1}})
+	cursor, err := h.Col.Find(storageContext(c), filter, opts)
+	if err != nil {
+		log.Errorf("Unable to find the promotions : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the promotions")
+	}
+	if err := cursor.All(storageContext(c), &promotions); err != nil {
+		log.Errorf("Unable to read the cursor : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the promotions")
+	}
+	return c.JSON(http.StatusOK, promotions)
+}
+
+//GetPromotion gets a single promotion
+func (h *PromotionsHandler) GetPromotion(c echo.Context) error {
+	promotion, err := findPromotion(storageContext(c), c.Param("id"), h.Col)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, promotion)
+}
+
+//CreatePromotion creates a promotion
+func (h *PromotionsHandler) CreatePromotion(c echo.Context) error {
+	var promotion Promotion
+	if err := c.Bind(&promotion); err != nil {
+		log.Errorf("Unable to bind to promotion : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	if err := v.Struct(promotion); err != nil {
+		log.Errorf("Unable to validate the promotion %+v %v", promotion, err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload.")
+	}
+	promotion.ID = primitive.NewObjectID()
+	if _, err := h.Col.InsertOne(storageContext(c), promotion); err != nil {
+		log.Errorf("Unable to insert the promotion : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to create the promotion")
+	}
+	return c.JSON(http.StatusCreated, promotion)
+}
+
+//UpdatePromotion updates a promotion
+func (h *PromotionsHandler) UpdatePromotion(c echo.Context) error {
+	promotion, err := findPromotion(storageContext(c), c.Param("id"), h.Col)
+	if err != nil {
+		return err
+	}
+	ID := promotion.ID
+	if err := c.Bind(&promotion); err != nil {
+		log.Errorf("Unable to bind to promotion : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	promotion.ID = ID
+	//only the discount of the kind is kept, so a promotion can switch kinds
+	if promotion.Kind == PercentageDiscount {
+		promotion.Amount = nil
+	} else {
+		promotion.Percent = 0
+	}
+	if err := v.Struct(promotion); err != nil {
+		log.Errorf("Unable to validate the promotion %+v %v", promotion, err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload.")
+	}
+	update := bson.M{"$set": promotion}
+	//emptied targets are left out of the encoding, they are cleared
+	unset, err := omittedBSONFields(promotion)
+	if err != nil {
+		log.Errorf("Unable to encode the promotion : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to update the promotion")
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	if _, err := h.Col.UpdateOne(storageContext(c), bson.M{"_id": ID}, update); err != nil {
+		log.Errorf("Unable to update the promotion : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to update the promotion")
+	}
+	return c.JSON(http.StatusOK, promotion)
+}
+
+//DeletePromotion deletes a promotion
+func (h *PromotionsHandler) DeletePromotion(c echo.Context) error {
+	promotion, err := findPromotion(storageContext(c), c.Param("id"), h.Col)
+	if err != nil {
+		return err
+	}
+	res, err := h.Col.DeleteOne(storageContext(c), bson.M{"_id": promotion.ID})
+	if err != nil {
+		log.Errorf("Unable to delete the promotion : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to delete the promotion")
+	}
+	return c.JSON(http.StatusOK, versioned(c, res.DeletedCount, Deleted{DeletedCount: res.DeletedCount}))
+}
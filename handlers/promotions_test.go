@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func TestPromotionEngine(t *testing.T) {
+	start := time.Date(2020, time.November, 27, 0, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start.Add(time.Hour)}
+	rates := &RateTable{}
+	rates.Set(ExchangeRates{Base: "USD", Rates: map[string]float64{"INR": 75}})
+	engine := &PromotionEngine{Clock: clock, Rates: rates}
+
+	google := primitive.NewObjectID()
+	phone := Product{ID: primitive.NewObjectID(), Name: "pixel", Price: 500, Currency: "USD", Vendor: "google", VendorID: google, Accessories: []string{"charger"}}
+	promo := func(priority int, exclusive bool, kind string) Promotion {
+		p := Promotion{
+			ID:        primitive.NewObjectID(),
+			Name:      "black friday",
+			Kind:      kind,
+			StartsAt:  start,
+			EndsAt:    start.Add(24 * time.Hour),
+			Priority:  priority,
+			Exclusive: exclusive,
+			Vendors:   []primitive.ObjectID{google},
+		}
+		if kind == PercentageDiscount {
+			p.Percent = 10
+		} else {
+			p.Amount = &Money{Amount: 2000, Currency: "USD"}
+		}
+		return p
+	}
+
+	t.Run("no promotions", func(t *testing.T) {
+		pricing := engine.Price(phone, phone.ListPrice(), nil)
+		assert.Equal(t, Money{Amount: 50000, Currency: "USD"}, pricing.FinalPrice)
+		assert.Empty(t, pricing.Promotions)
+	})
+
+	t.Run("stacked in priority order", func(t *testing.T) {
+		percent, fixed := promo(1, false, PercentageDiscount), promo(2, false, FixedDiscount)
+		pricing := engine.Price(phone, phone.ListPrice(), []Promotion{percent, fixed})
+		// 500 - 20 = 480, then 10% off
+		assert.Equal(t, int64(43200), pricing.FinalPrice.Amount)
+		assert.Equal(t, fixed.ID, pricing.Promotions[0].ID)
+		assert.Equal(t, percent.ID, pricing.Promotions[1].ID)
+	})
+
+	t.Run("exclusive promotion first", func(t *testing.T) {
+		exclusive := promo(5, true, PercentageDiscount)
+		pricing := engine.Price(phone, phone.ListPrice(), []Promotion{promo(1, false, FixedDiscount), exclusive})
+		assert.Len(t, pricing.Promotions, 1)
+		assert.Equal(t, int64(45000), pricing.FinalPrice.Amount)
+	})
+
+	t.Run("exclusive promotion later is skipped", func(t *testing.T) {
+		pricing := engine.Price(phone, phone.ListPrice(), []Promotion{promo(1, true, FixedDiscount), promo(5, false, PercentageDiscount)})
+		assert.Len(t, pricing.Promotions, 1)
+		assert.Equal(t, int64(45000), pricing.FinalPrice.Amount)
+	})
+
+	t.Run("fixed discount in another currency", func(t *testing.T) {
+		p := promo(1, false, FixedDiscount)
+		pricing := engine.Price(phone, Money{Amount: 3750000, Currency: "INR"}, []Promotion{p})
+		assert.Equal(t, Money{Amount: 3600000, Currency: "INR"}, pricing.FinalPrice)
+	})
+
+	t.Run("never below zero", func(t *testing.T) {
+		p := promo(1, false, FixedDiscount)
+		p.Amount.Amount = 100000
+		pricing := engine.Price(phone, phone.ListPrice(), []Promotion{p})
+		assert.Equal(t, int64(0), pricing.FinalPrice.Amount)
+	})
+
+	t.Run("outside the promotion window", func(t *testing.T) {
+		p := promo(1, false, PercentageDiscount)
+		clock.now = start.Add(-time.Minute)
+		assert.Empty(t, engine.Price(phone, phone.ListPrice(), []Promotion{p}).Promotions)
+		clock.now = start.Add(24 * time.Hour)
+		assert.Empty(t, engine.Price(phone, phone.ListPrice(), []Promotion{p}).Promotions)
+		clock.now = start
+		assert.Len(t, engine.Price(phone, phone.ListPrice(), []Promotion{p}).Promotions, 1)
+	})
+
+	t.Run("targeting", func(t *testing.T) {
+		p := Promotion{Accessories: []string{"charger"}}
+		assert.True(t, p.Targets(phone))
+		p = Promotion{Products: []primitive.ObjectID{primitive.NewObjectID()}, Vendors: []primitive.ObjectID{primitive.NewObjectID()}}
+		assert.False(t, p.Targets(phone))
+		p.Products = append(p.Products, phone.ID)
+		assert.True(t, p.Targets(phone))
+
+		p = Promotion{Vendors: []primitive.ObjectID{google}}
+		assert.True(t, p.Targets(phone), "the vendor id is matched")
+		sameName := phone
+		sameName.VendorID = primitive.NewObjectID()
+		assert.False(t, p.Targets(sameName), "not the name of the vendor")
+	})
+
+	t.Run("emptied fields are unset", func(t *testing.T) {
+		p := promo(1, false, FixedDiscount)
+		p.Vendors, p.Products = []primitive.ObjectID{}, []primitive.ObjectID{primitive.NewObjectID()}
+		unset, err := omittedBSONFields(p)
+		assert.Nil(t, err)
+		assert.Contains(t, unset, "vendor_ids")
+		assert.Contains(t, unset, "percent")
+		assert.NotContains(t, unset, "products")
+		assert.NotContains(t, unset, "amount")
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		p := promo(1, false, PercentageDiscount)
+		assert.Nil(t, v.Struct(p))
+		p.Percent = 0
+		assert.NotNil(t, v.Struct(p))
+		p = promo(1, false, FixedDiscount)
+		p.EndsAt = p.StartsAt
+		assert.NotNil(t, v.Struct(p))
+	})
+}
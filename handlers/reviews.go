@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/inerts73/tronicscorp/dbiface"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//Review is the opinion of a customer on a product, one per customer and product
+type Review struct {
+	ID             primitive.ObjectID `json:"_id" bson:"_id"`
+	ProductID      primitive.ObjectID `json:"product_id" bson:"product_id"`
+	UserID         string             `json:"user_id" bson:"user_id"`
+	Rating         int                `json:"rating" bson:"rating" validate:"required,min=1,max=5"`
+	Text           string             `json:"text" bson:"text" validate:"max=2000"`
+	Hidden         bool               `json:"hidden" bson:"hidden"`
+	ModerationNote string             `json:"moderation_note,omitempty" bson:"moderation_note,omitempty"`
+	CreatedAt      time.Time          `json:"created_at" bson:"created_at"`
+	UpdatedAt      time.Time          `json:"updated_at" bson:"updated_at"`
+}
+
+//RatingSummary is the average rating of the visible reviews of a product
+type RatingSummary struct {
+	Average float64 `json:"average" bson:"average"`
+	Count   int     `json:"count" bson:"count"`
+}
+
+//Moderation hides or shows a review
+type Moderation struct {
+	Hidden bool   `json:"hidden"`
+	Note   string `json:"note" validate:"max=500"`
+}
+
+//ReviewsHandler a reviews handler
+type ReviewsHandler struct {
+	Col     dbiface.CollectionAPI
+	ProdCol dbiface.CollectionAPI
+}
+
+func findReview(ctx context.Context, productID primitive.ObjectID, id string, collection dbiface.CollectionAPI) (Review, error) {
+	var review Review
+	docID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return review, echo.NewHTTPError(http.StatusBadRequest, "Invalid review id")
+	}
+	res := collection.FindOne(ctx, bson.M{"_id": docID, "product_id": productID})
+	if err := res.Decode(&review); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return review, echo.NewHTTPError(http.StatusNotFound, "Review does not exist")
+		}
+		log.Errorf("Unable to decode the review : %v", err)
+		return review, err
+	}
+	return review, nil
+}
+
+//refreshRating recomputes the rating of a product from its visible reviews.
+//The summary is always computed from scratch so it heals after a failed write.
+func refreshRating(ctx context.Context, productID primitive.ObjectID, reviews, products dbiface.CollectionAPI) error {
+	var summaries []RatingSummary
+	pipeline := bson.A{
+		bson.M{"$match": bson.M{"product_id": productID, "hidden": false}},
+		bson.M{"$group": bson.M{
+			"_id":     nil,
+			"average": bson.M{"$avg": "$rating"},
+			"count":   bson.M{"$sum": 1},
+		}},
+	}
+	cursor, err := reviews.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, &summaries); err != nil {
+		return err
+	}
+	update := bson.M{"$unset": bson.M{"rating": ""}}
+	if len(summaries) > 0 {
+		summary := summaries[0]
+		summary.Average = math.Round(summary.Average*100) / 100
+		update = bson.M{"$set": bson.M{"rating": summary}}
+	}
+	_, err = products.UpdateOne(ctx, bson.M{"_id": productID}, touch(update))
+	return err
+}
+
+func (h *ReviewsHandler) refreshRating(ctx context.Context, productID primitive.ObjectID) {
+	if err := refreshRating(ctx, productID, h.Col, h.ProdCol); err != nil {
+		log.Errorf("Unable to refresh the rating of %s : %v", productID.Hex(), err)
+	}
+}
+
+//GetReviews lists the reviews of a product, newest first. Hidden reviews are
+//only listed to admins.
+func (h *ReviewsHandler) GetReviews(c echo.Context) error {
+	var reviews []Review
+	productID, err := productObjectID(storageContext(c), c.Param("id"), h.ProdCol)
+	if err != nil {
+		return err
+	}
+	filter := bson.M{"product_id": productID}
+	if !isAdminFromContext(c) {
+		filter["hidden"] = false
+	}
+	cursor, err := h.Col.Find(storageContext(c), filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		log.Errorf("Unable to find the reviews : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the reviews")
+	}
+	if err := cursor.All(storageContext(c), &reviews); err != nil {
+		log.Errorf("Unable to read the cursor : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the reviews")
+	}
+	return c.JSON(http.StatusOK, reviews)
+}
+
+//CreateReview reviews a product as the authenticated user
+func (h *ReviewsHandler) CreateReview(c echo.Context) error {
+	ctx := storageContext(c)
+	productID, err := productObjectID(ctx, c.Param("id"), h.ProdCol)
+	if err != nil {
+		return err
+	}
+	var review Review
+	if err := c.Bind(&review); err != nil {
+		log.Errorf("Unable to bind to review : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	if err := v.Struct(review); err != nil {
+		log.Errorf("Unable to validate the review %+v %v", review, err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload.")
+	}
+	now := time.Now().UTC()
+	review.ID = primitive.NewObjectID()
+	review.ProductID = productID
+	review.UserID = userIDFromContext(c)
+	review.Hidden, review.ModerationNote = false, ""
+	review.CreatedAt, review.UpdatedAt = now, now
+	if _, err := h.Col.InsertOne(ctx, review); err != nil {
+		if isDuplicateKey(err) {
+			return echo.NewHTTPError(http.StatusConflict, "You already reviewed this product")
+		}
+		log.Errorf("Unable to insert the review : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to create the review")
+	}
+	h.refreshRating(ctx, productID)
+	return c.JSON(http.StatusCreated, review)
+}
+
+//reviewUpdate changes the rating and text of a review
+type reviewUpdate struct {
+	Rating int    `json:"rating" validate:"required,min=1,max=5"`
+	Text   string `json:"text" validate:"max=2000"`
+}
+
+//UpdateReview lets a user change the rating and text of their review
+func (h *ReviewsHandler) UpdateReview(c echo.Context) error {
+	ctx := storageContext(c)
+	productID, err := productObjectID(ctx, c.Param("id"), h.ProdCol)
+	if err != nil {
+		return err
+	}
+	review, err := findReview(ctx, productID, c.Param("rid"), h.Col)
+	if err != nil {
+		return err
+	}
+	if review.UserID != userIDFromContext(c) {
+		return echo.NewHTTPError(http.StatusForbidden, "Not authorized")
+	}
+	var body reviewUpdate
+	if err := c.Bind(&body); err != nil {
+		log.Errorf("Unable to bind to review : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	if err := v.Struct(body); err != nil {
+		log.Errorf("Unable to validate the review %+v %v", body, err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload.")
+	}
+	review.Rating, review.Text, review.UpdatedAt = body.Rating, body.Text, time.Now().UTC()
+	update := bson.M{"$set": bson.M{"rating": review.Rating, "text": review.Text, "updated_at": review.UpdatedAt}}
+	if _, err := h.Col.UpdateOne(ctx, bson.M{"_id": review.ID}, update); err != nil {
+		log.Errorf("Unable to update the review : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to update the review")
+	}
+	h.refreshRating(ctx, productID)
+	return c.JSON(http.StatusOK, review)
+}
+
+//ModerateReview lets an admin hide a review, or show it again
+func (h *ReviewsHandler) ModerateReview(c echo.Context) error {
+	ctx := storageContext(c)
+	productID, err := productObjectID(ctx, c.Param("id"), h.ProdCol)
+	if err != nil {
+		return err
+	}
+	review, err := findReview(ctx, productID, c.Param("rid"), h.Col)
+	if err != nil {
+		return err
+	}
+	var moderation Moderation
+	if err := c.Bind(&moderation); err != nil {
+		log.Errorf("Unable to bind to moderation : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	if err := v.Struct(moderation); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload.")
+	}
+	review.Hidden, review.ModerationNote = moderation.Hidden, moderation.Note
+	update := bson.M{"$set": bson.M{"hidden": review.Hidden, "moderation_note": review.ModerationNote}}
+	if _, err := h.Col.UpdateOne(ctx, bson.M{"_id": review.ID}, update); err != nil {
+		log.Errorf("Unable to moderate the review : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to moderate the review")
+	}
+	h.refreshRating(ctx, productID)
+	return c.JSON(http.StatusOK, review)
+}
+
+//DeleteReview deletes a review, users may delete their own and admins any
+func (h *ReviewsHandler) DeleteReview(c echo.Context) error {
+	ctx := storageContext(c)
+	productID, err := productObjectID(ctx, c.Param("id"), h.ProdCol)
+	if err != nil {
+		return err
+	}
+	review, err := findReview(ctx, productID, c.Param("rid"), h.Col)
+	if err != nil {
+		return err
+	}
+	if review.UserID != userIDFromContext(c) && !isAdminFromContext(c) {
+		return echo.NewHTTPError(http.StatusForbidden, "Not authorized")
+	}
+	res, err := h.Col.DeleteOne(ctx, bson.M{"_id": review.ID})
+	if err != nil {
+		log.Errorf("Unable to delete the review : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to delete the review")
+	}
+	h.refreshRating(ctx, productID)
+	return c.JSON(http.StatusOK, versioned(c, res.DeletedCount, Deleted{DeletedCount: res.DeletedCount}))
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestReviews(t *testing.T) {
+	ctx := context.Background()
+	ph := ProductHandler{Col: col}
+	rh := ReviewsHandler{Col: db.Collection("reviews"), ProdCol: col}
+
+	review := func(user string, rating int, id string) (Review, error) {
+		var r Review
+		c, res := newRequest(http.MethodPost, "/products/"+id+"/reviews", fmt.Sprintf(`{"rating":%d,"text":"nice"}`, rating), userClaims(user), "id", id)
+		if err := rh.CreateReview(c); err != nil {
+			return r, err
+		}
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &r))
+		return r, nil
+	}
+	rating := func(id string) *RatingSummary {
+		product, err := findProduct(ctx, id, col)
+		assert.Nil(t, err)
+		return product.Rating
+	}
+
+	var IDs []primitive.ObjectID
+	c, res := newRequest(http.MethodPost, "/products", `[{"product_name":"pixel","price":500,"currency":"USD","vendor":"google"},{"product_name":"iphone","price":900,"currency":"USD","vendor":"apple"}]`, adminClaims)
+	assert.Nil(t, ph.CreateProducts(c))
+	if !assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &IDs)) || !assert.Len(t, IDs, 2) {
+		return
+	}
+	pixel, iphone := IDs[0].Hex(), IDs[1].Hex()
+
+	first, err := review("a@tronics.com", 5, pixel)
+	assert.Nil(t, err)
+	_, err = review("b@tronics.com", 2, pixel)
+	assert.Nil(t, err)
+	_, err = review("a@tronics.com", 3, iphone)
+	assert.Nil(t, err)
+
+	t.Run("rating is denormalized", func(t *testing.T) {
+		assert.Equal(t, &RatingSummary{Average: 3.5, Count: 2}, rating(pixel))
+	})
+
+	t.Run("one review per user", func(t *testing.T) {
+		_, err := review("a@tronics.com", 1, pixel)
+		assertHTTPError(t, err, http.StatusConflict)
+	})
+
+	t.Run("invalid rating", func(t *testing.T) {
+		_, err := review("c@tronics.com", 6, pixel)
+		assertHTTPError(t, err, http.StatusBadRequest)
+	})
+
+	t.Run("only the author edits", func(t *testing.T) {
+		c, _ := newRequest(http.MethodPut, "/", `{"rating":1}`, userClaims("b@tronics.com"), "id", "rid", pixel, first.ID.Hex())
+		err := rh.UpdateReview(c)
+		assertHTTPError(t, err, http.StatusForbidden)
+
+		c, _ = newRequest(http.MethodPut, "/", `{"rating":4}`, userClaims("a@tronics.com"), "id", "rid", pixel, first.ID.Hex())
+		assert.Nil(t, rh.UpdateReview(c))
+		assert.Equal(t, &RatingSummary{Average: 3, Count: 2}, rating(pixel))
+	})
+
+	t.Run("moderation hides a review", func(t *testing.T) {
+		c, _ := newRequest(http.MethodPut, "/", `{"hidden":true,"note":"spam"}`, adminClaims, "id", "rid", pixel, first.ID.Hex())
+		assert.Nil(t, rh.ModerateReview(c))
+		assert.Equal(t, &RatingSummary{Average: 2, Count: 1}, rating(pixel))
+
+		var reviews []Review
+		c, res := newRequest(http.MethodGet, "/", "", userClaims("b@tronics.com"), "id", pixel)
+		assert.Nil(t, rh.GetReviews(c))
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &reviews))
+		assert.Len(t, reviews, 1)
+	})
+
+	t.Run("product updates keep the rating", func(t *testing.T) {
+		c, _ := newRequest(http.MethodPut, "/", `{"price":450,"rating":{"average":5,"count":100}}`, adminClaims, "id", pixel)
+		assert.Nil(t, ph.UpdateProduct(c))
+		assert.Equal(t, &RatingSummary{Average: 2, Count: 1}, rating(pixel))
+	})
+
+	t.Run("sort by rating", func(t *testing.T) {
+		var products []Product
+		c, res := newRequest(http.MethodGet, "/products?sort=rating", "", adminClaims)
+		assert.Nil(t, ph.GetProducts(c))
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &products))
+		assert.Equal(t, iphone, products[0].ID.Hex())
+	})
+
+	t.Run("delete the last review", func(t *testing.T) {
+		var reviews []Review
+		c, res := newRequest(http.MethodGet, "/", "", adminClaims, "id", iphone)
+		assert.Nil(t, rh.GetReviews(c))
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &reviews))
+		c, _ = newRequest(http.MethodDelete, "/", "", userClaims("a@tronics.com"), "id", "rid", iphone, reviews[0].ID.Hex())
+		assert.Nil(t, rh.DeleteReview(c))
+		assert.Nil(t, rating(iphone))
+	})
+}
@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inerts73/tronicscorp/dbiface"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//Revision is a full snapshot of a product after a change
+type Revision struct {
+	ID           primitive.ObjectID `json:"_id" bson:"_id"`
+	ProductID    primitive.ObjectID `json:"product_id" bson:"product_id"`
+	Rev          int                `json:"rev" bson:"rev"`
+	Snapshot     *Product           `json:"snapshot,omitempty" bson:"snapshot,omitempty"`
+	UserID       string             `json:"user_id,omitempty" bson:"user_id,omitempty"`
+	RestoredFrom int                `json:"restored_from,omitempty" bson:"restored_from,omitempty"`
+	CreatedAt    time.Time          `json:"created_at" bson:"created_at"`
+}
+
+//FieldChange is a field that differs between two revisions
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+func isDuplicateKey(err error) bool {
+	if we, ok := err.(mongo.WriteException); ok {
+		for _, e := range we.WriteErrors {
+			if e.Code == 11000 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func lastRevision(ctx context.Context, productID primitive.ObjectID, collection dbiface.CollectionAPI) (int, error) {
+	var revisions []Revision
+	opts := options.Find().SetSort(bson.D{{Key: "rev", Value: -1}}).SetLimit(1).SetProjection(bson.M{"snapshot": 0})
+	cursor, err := collection.Find(ctx, bson.M{"product_id": productID}, opts)
+	if err != nil {
+		return 0, err
+	}
+	if err := cursor.All(ctx, &revisions); err != nil {
+		return 0, err
+	}
+	if len(revisions) == 0 {
+		return 0, nil
+	}
+	return revisions[0].Rev, nil
+}
+
+//recordRevision stores a snapshot of product as its next revision
+func recordRevision(ctx context.Context, product Product, userID string, restoredFrom int, collection dbiface.CollectionAPI) (Revision, error) {
+	product.DisplayPrice, product.Pricing = nil, nil
+	revision := Revision{
+		ProductID:    product.ID,
+		Snapshot:     &product,
+		UserID:       userID,
+		RestoredFrom: restoredFrom,
+		CreatedAt:    time.Now().UTC(),
+	}
+	// the unique index on product_id and rev settles concurrent updates
+	for attempt := 0; attempt < 3; attempt++ {
+		last, err := lastRevision(ctx, product.ID, collection)
+		if err != nil {
+			return revision, err
+		}
+		revision.ID = primitive.NewObjectID()
+		revision.Rev = last + 1
+		_, err = collection.InsertOne(ctx, revision)
+		if err == nil || !isDuplicateKey(err) {
+			return revision, err
+		}
+	}
+	return revision, fmt.Errorf("unable to number the revision of %s", product.ID.Hex())
+}
+
+//recordUpdate snapshots an updated product. Products created before revisions
+//were kept also get their previous state recorded, so it can be restored.
+func (h *ProductHandler) recordUpdate(ctx context.Context, old, updated Product, userID string, restoredFrom int) {
+	if h.RevCol == nil {
+		return
+	}
+	last, err := lastRevision(ctx, old.ID, h.RevCol)
+	if err != nil {
+		log.Errorf("Unable to find the revisions of %s : %v", old.ID.Hex(), err)
+		return
+	}
+	if last == 0 {
+		if _, err := recordRevision(ctx, old, "", 0, h.RevCol); err != nil {
+			log.Errorf("Unable to record the revision of %s : %v", old.ID.Hex(), err)
+		}
+	}
+	if _, err := recordRevision(ctx, updated, userID, restoredFrom, h.RevCol); err != nil {
+		log.Errorf("Unable to record the revision of %s : %v", updated.ID.Hex(), err)
+	}
+}
+
+func findRevision(ctx context.Context, productID primitive.ObjectID, rev string, collection dbiface.CollectionAPI) (Revision, error) {
+	var revision Revision
+	n, err := strconv.Atoi(rev)
+	if err != nil {
+		return revision, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid revision %q", rev))
+	}
+	res := collection.FindOne(ctx, bson.M{"product_id": productID, "rev": n})
+	if err := res.Decode(&revision); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return revision, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("Revision %d does not exist", n))
+		}
+		log.Errorf("Unable to decode the revision : %v", err)
+		return revision, err
+	}
+	return revision, nil
+}
+
+//flatten turns a json document into a map of dotted field names to values
+func flatten(prefix string, value interface{}, fields map[string]interface{}) {
+	doc, ok := value.(map[string]interface{})
+	if !ok || len(doc) == 0 {
+		fields[prefix] = value
+		return
+	}
+	for k, v := range doc {
+		if prefix != "" {
+			k = prefix + "." + k
+		}
+		flatten(k, v, fields)
+	}
+}
+
+//diffProducts lists the fields that changed from a to b, as clients see them
+func diffProducts(a, b Product) ([]FieldChange, error) {
+	fields := make([]map[string]interface{}, 2)
+	for i, p := range []Product{a, b} {
+		var doc interface{}
+		raw, err := json.Marshal(p)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, &doc); err != nil {
+			return nil, err
+		}
+		fields[i] = map[string]interface{}{}
+		flatten("", doc, fields[i])
+	}
+	changes := []FieldChange{}
+	for k, from := range fields[0] {
+		if to, ok := fields[1][k]; !ok || !reflect.DeepEqual(from, to) {
+			changes = append(changes, FieldChange{Field: k, From: from, To: fields[1][k]})
+		}
+	}
+	for k, to := range fields[1] {
+		if _, ok := fields[0][k]; !ok {
+			changes = append(changes, FieldChange{Field: k, To: to})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes, nil
+}
+
+//snapshotBody encodes a snapshot as an update body that also clears the
+//fields the snapshot omits, as decoding only touches the fields it is given
+func snapshotBody(snapshot Product) ([]byte, error) {
+	var doc map[string]interface{}
+	raw, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	t := reflect.TypeOf(snapshot)
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if _, ok := doc[name]; !ok && name != "" && name != "-" {
+			doc[name] = reflect.Zero(t.Field(i).Type).Interface()
+		}
+	}
+	return json.Marshal(doc)
+}
+
+//GetRevisions lists the revisions of a product, without their snapshots
+func (h *ProductHandler) GetRevisions(c echo.Context) error {
+	var revisions []Revision
+	productID, err := productObjectID(storageContext(c), c.Param("id"), h.Col)
+	if err != nil {
+		return err
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "rev", Value: -1}}).SetProjection(bson.M{"snapshot": 0})
+	cursor, err := h.RevCol.Find(storageContext(c), bson.M{"product_id": productID}, opts)
+	if err != nil {
+		log.Errorf("Unable to find the revisions : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the revisions")
+	}
+	if err := cursor.All(storageContext(c), &revisions); err != nil {
+		log.Errorf("Unable to read the cursor : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the revisions")
+	}
+	return c.JSON(http.StatusOK, revisions)
+}
+
+//GetRevision gets a single revision with its snapshot
+func (h *ProductHandler) GetRevision(c echo.Context) error {
+	productID, err := productObjectID(storageContext(c), c.Param("id"), h.Col)
+	if err != nil {
+		return err
+	}
+	revision, err := findRevision(storageContext(c), productID, c.Param("rev"), h.RevCol)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, revision)
+}
+
+//DiffRevisions lists the fields changed between the revisions from and to
+func (h *ProductHandler) DiffRevisions(c echo.Context) error {
+	productID, err := productObjectID(storageContext(c), c.Param("id"), h.Col)
+	if err != nil {
+		return err
+	}
+	from, err := findRevision(storageContext(c), productID, c.QueryParam("from"), h.RevCol)
+	if err != nil {
+		return err
+	}
+	to, err := findRevision(storageContext(c), productID, c.QueryParam("to"), h.RevCol)
+	if err != nil {
+		return err
+	}
+	changes, err := diffProducts(*from.Snapshot, *to.Snapshot)
+	if err != nil {
+		log.Errorf("Unable to diff the revisions : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to diff the revisions")
+	}
+	return c.JSON(http.StatusOK, changes)
+}
+
+//RestoreRevision updates a product with an old snapshot. The snapshot goes
+//through the same validation as a PUT and is recorded as a new revision.
+func (h *ProductHandler) RestoreRevision(c echo.Context) error {
+	productID, err := productObjectID(storageContext(c), c.Param("id"), h.Col)
+	if err != nil {
+		return err
+	}
+	revision, err := findRevision(storageContext(c), productID, c.Param("rev"), h.RevCol)
+	if err != nil {
+		return err
+	}
+	body, err := snapshotBody(*revision.Snapshot)
+	if err != nil {
+		log.Errorf("Unable to encode the snapshot : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to restore the revision")
+	}
+	product, err := modifyProduct(storageContext(c), c.Param("id"), bytes.NewReader(body), h.Col, h.updateHooks(actorFromContext(c), revision.Rev))
+	if err != nil {
+		log.Errorf("Unable to restore the revision : %v", err)
+		if _, ok := err.(*echo.HTTPError); ok {
+			return err
+		}
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, fmt.Sprintf("Revision %d is not valid anymore : %v", revision.Rev, err))
+	}
+	return c.JSON(http.StatusOK, product)
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRevisions(t *testing.T) {
+	t.Run("diff", func(t *testing.T) {
+		a := Product{Name: "pixel", Price: 500, Currency: "USD", Vendor: "google", Accessories: []string{"charger"}}
+		b := a
+		b.Price, b.Accessories = 450, nil
+		b.Prices = []Money{{Amount: 40000, Currency: "EUR"}}
+		changes, err := diffProducts(a, b)
+		assert.Nil(t, err)
+		assert.Equal(t, []FieldChange{
+			{Field: "accessories", From: []interface{}{"charger"}},
+			{Field: "price", From: float64(500), To: float64(450)},
+			{Field: "prices", To: []interface{}{map[string]interface{}{"amount": float64(40000), "currency": "EUR"}}},
+		}, changes)
+	})
+
+	t.Run("snapshot clears omitted fields", func(t *testing.T) {
+		current := Product{Name: "pixel", Price: 500, Currency: "USD", Vendor: "google", Accessories: []string{"charger"}}
+		body, err := snapshotBody(Product{Name: "pixel", Price: 400, Currency: "USD", Vendor: "google"})
+		assert.Nil(t, err)
+		assert.Nil(t, json.Unmarshal(body, &current))
+		assert.Equal(t, 400, current.Price)
+		assert.Nil(t, current.Accessories)
+	})
+
+	t.Run("omitted fields are unset", func(t *testing.T) {
+		unset, err := omittedFields(Product{Name: "pixel", Price: 400, Currency: "USD", Vendor: "google", Prices: []Money{}})
+		assert.Nil(t, err)
+		assert.Contains(t, unset, "prices")
+		assert.Contains(t, unset, "accessory_ids")
+		assert.Contains(t, unset, "publish_at")
+		assert.NotContains(t, unset, "price")
+		assert.NotContains(t, unset, "media", "media has its own endpoints")
+		assert.NotContains(t, unset, "rating", "ratings come from the reviews")
+	})
+}
+
+func TestRestoreRevision(t *testing.T) {
+	h := ProductHandler{Col: col, RevCol: db.Collection("revisions")}
+
+	var IDs []primitive.ObjectID
+	c, res := newRequest(http.MethodPost, "/", `[{"product_name":"pixel","price":500,"currency":"USD","vendor":"google"}]`, adminClaims)
+	assert.Nil(t, h.CreateProducts(c))
+	if !assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &IDs)) || !assert.Len(t, IDs, 1) {
+		return
+	}
+	id := IDs[0].Hex()
+
+	c, _ = newRequest(http.MethodPut, "/", `{"accessories":["charger"],"prices":[{"amount":450,"currency":"EUR"}],"translations":{"fr":{"name":"pixel fr"}},"publish_at":"2030-01-01T00:00:00Z"}`, adminClaims, "id", id)
+	assert.Nil(t, h.UpdateProduct(c))
+
+	c, res = newRequest(http.MethodPost, "/", "", adminClaims, "id", "rev", id, "1")
+	assert.Nil(t, h.RestoreRevision(c))
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	var stored bson.M
+	assert.Nil(t, col.FindOne(context.Background(), bson.M{"_id": IDs[0]}).Decode(&stored))
+	assert.Equal(t, "pixel", stored["product_name"])
+	for _, field := range []string{"accessories", "prices", "translations", "publish_at"} {
+		assert.NotContains(t, stored, field, "the restored revision has no "+field)
+	}
+}
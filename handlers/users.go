@@ -9,6 +9,7 @@ import (
 	"github.com/ilyakaznacheev/cleanenv"
 	"github.com/labstack/gommon/log"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/go-playground/validator.v9"
@@ -23,11 +24,13 @@ type User struct {
 	Email		string `json:"username" bson:"username" validate:"required,email"`
 	Password	string `json:"password,omitempty" bson:"password" validate:"required,min=8,max=300"`
 	IsAdmin		bool   `json:"isadmin,omitempty" bson:"isadmin"`
+	VendorID	*primitive.ObjectID `json:"vendor_id,omitempty" bson:"vendor_id,omitempty"`
 }
 
 //UsersHandler users handler
 type UsersHandler struct {
-	Col dbiface.CollectionAPI
+	Col       dbiface.CollectionAPI
+	VendorCol dbiface.CollectionAPI
 }
 
 type userValidator struct {
@@ -52,6 +55,9 @@ func (u User) createToken() (string, error) {
 	claims := jwt.MapClaims{}
 	claims["authorized"] = u.IsAdmin
 	claims["user_id"] = u.Email
+	if u.VendorID != nil {
+		claims["vendor_id"] = u.VendorID.Hex()
+	}
 	claims["exp"] = time.Now().Add(time.Minute * 15).Unix()
 	at := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	token, err := at.SignedString([]byte(cfg.JwtTokenSecret))
@@ -104,7 +110,9 @@ func (h *UsersHandler) CreateUser(c echo.Context) error {
 		log.Errorf("Unable to validate the requested body.")
 		return echo.NewHTTPError(400, "Unable to validate request payload.")
 	}
-	insertedUserID, err := insertUser(context.Background(), user, h.Col)
+	//admins and vendor users are only made by an admin, see LinkVendor
+	user.IsAdmin, user.VendorID = false, nil
+	insertedUserID, err := insertUser(storageContext(c), user, h.Col)
 	if err != nil {
 		log.Errorf("Unable to insert to database.")
 		return err
@@ -135,7 +143,7 @@ func authenticateUser(ctx context.Context, reqUser User, collection dbiface.Coll
 	if !isCredValid(reqUser.Password, storedUser.Password) {
 		return storedUser, echo.NewHTTPError(http.StatusUnauthorized, "Credentials invalid")
 	}
-	return User{Email: storedUser.Email}, nil
+	return User{Email: storedUser.Email, IsAdmin: storedUser.IsAdmin, VendorID: storedUser.VendorID}, nil
 }
 
 //AuthnUser authenticates a user
@@ -150,7 +158,7 @@ func (h *UsersHandler) AuthnUser(c echo.Context) error {
 		log.Errorf("Unable to validate the requested body.")
 		return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload.")
 	}
-	user, err := authenticateUser(context.Background(), user, h.Col)
+	user, err := authenticateUser(storageContext(c), user, h.Col)
 	if err != nil {
 		log.Errorf("Unable to authenticate to database.")
 		return err
@@ -162,4 +170,94 @@ func (h *UsersHandler) AuthnUser(c echo.Context) error {
 	}
 	c.Response().Header().Set("x-auth-token", "Bearer " + token)
 	return c.JSON(http.StatusOK, User{Email: user.Email})	
-}
\ No newline at end of file
+}
+
+//claimsFromContext returns the claims of the jwt set by the jwt middleware
+func claimsFromContext(c echo.Context) jwt.MapClaims {
+	token, ok := c.Get("user").(*jwt.Token)
+	if !ok {
+		return jwt.MapClaims{}
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return jwt.MapClaims{}
+	}
+	return claims
+}
+
+//userIDFromContext returns the user_id claim set by the jwt middleware
+func userIDFromContext(c echo.Context) string {
+	userID, _ := claimsFromContext(c)["user_id"].(string)
+	return userID
+}
+
+//isAdminFromContext reports whether the jwt carries the admin claim
+func isAdminFromContext(c echo.Context) bool {
+	isAdmin, _ := claimsFromContext(c)["authorized"].(bool)
+	return isAdmin
+}
+
+//vendorIDFromContext returns the vendor the user works for, if any
+func vendorIDFromContext(c echo.Context) primitive.ObjectID {
+	hex, _ := claimsFromContext(c)["vendor_id"].(string)
+	vendorID, err := primitive.ObjectIDFromHex(hex)
+	if err != nil {
+		return primitive.NilObjectID
+	}
+	return vendorID
+}
+
+//actor is who makes a change, a user or a background job
+type actor struct {
+	userID   string
+	admin    bool
+	vendorID primitive.ObjectID
+}
+
+func actorFromContext(c echo.Context) actor {
+	return actorFromClaims(claimsFromContext(c))
+}
+
+//actorFromClaims reads the user_id, authorized and vendor_id claims of a jwt
+func actorFromClaims(claims jwt.MapClaims) actor {
+	who := actor{}
+	who.userID, _ = claims["user_id"].(string)
+	who.admin, _ = claims["authorized"].(bool)
+	if hex, _ := claims["vendor_id"].(string); hex != "" {
+		who.vendorID, _ = primitive.ObjectIDFromHex(hex)
+	}
+	return who
+}
+
+//vendorLink links a user to a vendor, or unlinks them with a null vendor_id
+type vendorLink struct {
+	VendorID *primitive.ObjectID `json:"vendor_id"`
+}
+
+//LinkVendor links a user to the vendor they work for, or unlinks them with a null vendor_id
+func (h *UsersHandler) LinkVendor(c echo.Context) error {
+	var req vendorLink
+	ctx := storageContext(c)
+	if err := c.Bind(&req); err != nil {
+		log.Errorf("Unable to bind to the vendor link.")
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	if req.VendorID != nil {
+		if _, err := findVendor(ctx, bson.M{"_id": *req.VendorID}, h.VendorCol); err != nil {
+			return err
+		}
+	}
+	update := bson.M{"$set": bson.M{"vendor_id": req.VendorID}}
+	if req.VendorID == nil {
+		update = bson.M{"$unset": bson.M{"vendor_id": ""}}
+	}
+	res, err := h.Col.UpdateOne(ctx, bson.M{"username": c.Param("username")}, update)
+	if err != nil {
+		log.Errorf("Unable to link the vendor : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to link the vendor")
+	}
+	if res.MatchedCount == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "User does not exist")
+	}
+	return c.JSON(http.StatusOK, User{Email: c.Param("username"), VendorID: req.VendorID})
+}
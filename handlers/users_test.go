@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCreateUser(t *testing.T) {
+	uh := UsersHandler{Col: db.Collection("users")}
+	body := `{"username":"seller@tronics.com","password":"password1","isadmin":true,"vendor_id":"` + primitive.NewObjectID().Hex() + `"}`
+	req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	res := httptest.NewRecorder()
+	assert.Nil(t, uh.CreateUser(echo.New().NewContext(req, res)))
+	assert.Equal(t, http.StatusCreated, res.Code)
+
+	t.Run("self-registered vendor and admin are ignored", func(t *testing.T) {
+		claims := jwt.MapClaims{}
+		_, _, err := new(jwt.Parser).ParseUnverified(strings.TrimPrefix(res.Header().Get("x-auth-token"), "Bearer "), claims)
+		assert.Nil(t, err)
+		assert.Equal(t, "seller@tronics.com", claims["user_id"])
+		assert.Equal(t, false, claims["authorized"])
+		assert.NotContains(t, claims, "vendor_id")
+
+		var stored bson.M
+		assert.Nil(t, uh.Col.FindOne(context.Background(), bson.M{"username": "seller@tronics.com"}).Decode(&stored))
+		assert.Equal(t, false, stored["isadmin"])
+		assert.NotContains(t, stored, "vendor_id")
+	})
+}
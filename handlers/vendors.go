@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/inerts73/tronicscorp/dbiface"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//Vendor is a company whose products we sell, e.g. Google
+type Vendor struct {
+	ID          primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	Name        string             `json:"name" bson:"name" validate:"required,max=50"`
+	Slug        string             `json:"slug" bson:"slug"`
+	Website     string             `json:"website,omitempty" bson:"website,omitempty" validate:"omitempty,url"`
+	Email       string             `json:"email,omitempty" bson:"email,omitempty" validate:"omitempty,email"`
+	Description string             `json:"description,omitempty" bson:"description,omitempty" validate:"max=1000"`
+	CreatedAt   time.Time          `json:"created_at" bson:"created_at"`
+}
+
+//VendorsHandler a vendors handler
+type VendorsHandler struct {
+	Col     dbiface.CollectionAPI
+	ProdCol dbiface.CollectionAPI
+}
+
+//vendorSlug is the key vendors are unique by, so "Google" and "google" are one vendor
+func vendorSlug(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(name)), "-")
+}
+
+func findVendor(ctx context.Context, filter bson.M, collection dbiface.CollectionAPI) (Vendor, error) {
+	var vendor Vendor
+	res := collection.FindOne(ctx, filter)
+	if err := res.Decode(&vendor); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return vendor, echo.NewHTTPError(http.StatusNotFound, "Vendor does not exist")
+		}
+		log.Errorf("Unable to decode the vendor : %v", err)
+		return vendor, err
+	}
+	return vendor, nil
+}
+
+//resolveVendor points a product at its vendor, by id or else by name, and
+//copies the canonical vendor name onto the product
+func resolveVendor(ctx context.Context, product *Product, collection dbiface.CollectionAPI) error {
+	filter := bson.M{"_id": product.VendorID}
+	if product.VendorID.IsZero() {
+		filter = bson.M{"slug": vendorSlug(product.Vendor)}
+	}
+	vendor, err := findVendor(ctx, filter, collection)
+	if err != nil {
+		if he, ok := err.(*echo.HTTPError); ok {
+			return echo.NewHTTPError(http.StatusBadRequest, he.Message)
+		}
+		return err
+	}
+	product.VendorID = vendor.ID
+	product.Vendor = vendor.Name
+	return nil
+}
+
+//vendorChanged tells if an update points a product at another vendor
+func vendorChanged(old, updated Product) bool {
+	return old.VendorID != updated.VendorID || old.Vendor != updated.Vendor
+}
+
+//checkVendorScope makes sure that vendor users only touch their own products.
+//Which users may change products at all is decided by the routes.
+func checkVendorScope(who actor, old, updated Product) error {
+	if who.admin || who.vendorID.IsZero() {
+		return nil
+	}
+	if old.VendorID != who.vendorID || updated.VendorID != who.vendorID {
+		return echo.NewHTTPError(http.StatusForbidden, "Products of other vendors cannot be changed")
+	}
+	return nil
+}
+
+func vendorID(id string) (primitive.ObjectID, error) {
+	docID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return docID, echo.NewHTTPError(http.StatusBadRequest, "Invalid vendor id")
+	}
+	return docID, nil
+}
+
+//GetVendors lists the vendors
+func (h *VendorsHandler) GetVendors(c echo.Context) error {
+	var vendors []Vendor
+	cursor, err := h.Col.Find(storageContext(c), bson.M{}, options.Find().SetSort(bson.D{{Key: "slug", Value: 1}}))
+	if err != nil {
+		log.Errorf("Unable to find the vendors : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the vendors")
+	}
+	if err := cursor.All(storageContext(c), &vendors); err != nil {
+		log.Errorf("Unable to read the cursor : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the vendors")
+	}
+	return c.JSON(http.StatusOK, vendors)
+}
+
+//GetVendor gets a single vendor
+func (h *VendorsHandler) GetVendor(c echo.Context) error {
+	docID, err := vendorID(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	vendor, err := findVendor(storageContext(c), bson.M{"_id": docID}, h.Col)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, vendor)
+}
+
+//CreateVendor creates a vendor
+func (h *VendorsHandler) CreateVendor(c echo.Context) error {
+	var vendor Vendor
+	if err := c.Bind(&vendor); err != nil {
+		log.Errorf("Unable to bind to vendor : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	if err := v.Struct(vendor); err != nil {
+		log.Errorf("Unable to validate the vendor %+v %v", vendor, err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload.")
+	}
+	vendor.ID = primitive.NewObjectID()
+	vendor.Slug = vendorSlug(vendor.Name)
+	vendor.CreatedAt = time.Now().UTC()
+	if _, err := h.Col.InsertOne(storageContext(c), vendor); err != nil {
+		if isDuplicateKey(err) {
+			return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("Vendor %s already exists", vendor.Name))
+		}
+		log.Errorf("Unable to insert the vendor : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to create the vendor")
+	}
+	return c.JSON(http.StatusCreated, vendor)
+}
+
+//UpdateVendor updates the profile of a vendor, admins may update any vendor
+//and vendor users their own
+func (h *VendorsHandler) UpdateVendor(c echo.Context) error {
+	ctx := storageContext(c)
+	docID, err := vendorID(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	who := actorFromContext(c)
+	if !who.admin && who.vendorID != docID {
+		return echo.NewHTTPError(http.StatusForbidden, "Not authorized")
+	}
+	stored, err := findVendor(ctx, bson.M{"_id": docID}, h.Col)
+	if err != nil {
+		return err
+	}
+	vendor := stored
+	if err := c.Bind(&vendor); err != nil {
+		log.Errorf("Unable to bind to vendor : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	vendor.ID, vendor.CreatedAt = stored.ID, stored.CreatedAt
+	vendor.Slug = vendorSlug(vendor.Name)
+	if err := v.Struct(vendor); err != nil {
+		log.Errorf("Unable to validate the vendor %+v %v", vendor, err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload.")
+	}
+	update := bson.M{"$set": bson.M{
+		"name":        vendor.Name,
+		"slug":        vendor.Slug,
+		"website":     vendor.Website,
+		"email":       vendor.Email,
+		"description": vendor.Description,
+	}}
+	if _, err := h.Col.UpdateOne(ctx, bson.M{"_id": docID}, update); err != nil {
+		if isDuplicateKey(err) {
+			return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("Vendor %s already exists", vendor.Name))
+		}
+		log.Errorf("Unable to update the vendor : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to update the vendor")
+	}
+	if vendor.Name != stored.Name {
+		if _, err := h.ProdCol.UpdateMany(ctx, bson.M{"vendor_id": docID}, touch(bson.M{"$set": bson.M{"vendor": vendor.Name}})); err != nil {
+			log.Errorf("Unable to rename the vendor of its products : %v", err)
+		}
+	}
+	return c.JSON(http.StatusOK, vendor)
+}
+
+//DeleteVendor deletes a vendor without products
+func (h *VendorsHandler) DeleteVendor(c echo.Context) error {
+	ctx := storageContext(c)
+	docID, err := vendorID(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	products, err := h.ProdCol.CountDocuments(ctx, bson.M{"vendor_id": docID})
+	if err != nil {
+		log.Errorf("Unable to count the products : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to delete the vendor")
+	}
+	if products > 0 {
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("Vendor has %d products", products))
+	}
+	res, err := h.Col.DeleteOne(ctx, bson.M{"_id": docID})
+	if err != nil {
+		log.Errorf("Unable to delete the vendor : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to delete the vendor")
+	}
+	return c.JSON(http.StatusOK, versioned(c, res.DeletedCount, Deleted{DeletedCount: res.DeletedCount}))
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestVendorSlug(t *testing.T) {
+	assert.Equal(t, "google", vendorSlug("Google"))
+	assert.Equal(t, "western-digital", vendorSlug("  Western   Digital "))
+}
+
+func TestVendorScope(t *testing.T) {
+	google, apple := primitive.NewObjectID(), primitive.NewObjectID()
+	admin := actor{userID: "admin@tronics.com", admin: true}
+	user := actor{userID: "user@tronics.com"}
+	googler := actor{userID: "dev@google.com", vendorID: google}
+
+	assert.Nil(t, checkVendorScope(admin, Product{VendorID: google}, Product{VendorID: apple}))
+	assert.Nil(t, checkVendorScope(user, Product{VendorID: google}, Product{VendorID: apple}))
+	assert.Nil(t, checkVendorScope(googler, Product{VendorID: google}, Product{VendorID: google}))
+
+	err := checkVendorScope(googler, Product{VendorID: apple}, Product{VendorID: apple})
+	assertHTTPError(t, err, http.StatusForbidden)
+	err = checkVendorScope(googler, Product{VendorID: google}, Product{VendorID: apple})
+	assertHTTPError(t, err, http.StatusForbidden)
+}
+
+func TestVendorChanged(t *testing.T) {
+	legacy := Product{Name: "pixel", Vendor: "acme"}
+	renamed := legacy
+	renamed.Name = "pixel 4"
+	assert.False(t, vendorChanged(legacy, renamed), "a product without a vendor document can still be updated")
+	moved := legacy
+	moved.Vendor = "google"
+	assert.True(t, vendorChanged(legacy, moved))
+	moved = legacy
+	moved.VendorID = primitive.NewObjectID()
+	assert.True(t, vendorChanged(legacy, moved))
+}
+
+func TestUpdateVendor(t *testing.T) {
+	h := VendorsHandler{Col: db.Collection("vendors"), ProdCol: col}
+	createdAt := time.Now().UTC().Add(-time.Hour).Truncate(time.Millisecond)
+	vendor := Vendor{ID: primitive.NewObjectID(), Name: "Nothing", Slug: "nothing", Website: "https://nothing.tech", CreatedAt: createdAt}
+	_, err := h.Col.InsertOne(context.Background(), vendor)
+	assert.Nil(t, err)
+	defer h.Col.DeleteOne(context.Background(), bson.M{"_id": vendor.ID})
+
+	claims := jwt.MapClaims{"user_id": "dev@nothing.tech", "vendor_id": vendor.ID.Hex()}
+	c, _ := newRequest(http.MethodPut, "/", `{"name":"Nothing","website":"","created_at":"2000-01-01T00:00:00Z"}`, claims, "id", vendor.ID.Hex())
+	assert.Nil(t, h.UpdateVendor(c))
+
+	stored, err := findVendor(context.Background(), bson.M{"_id": vendor.ID}, h.Col)
+	assert.Nil(t, err)
+	assert.True(t, createdAt.Equal(stored.CreatedAt), "the creation date is not editable")
+	assert.Empty(t, stored.Website, "an emptied field is cleared")
+}
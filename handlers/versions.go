@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"expvar"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+//Versions of the API, served by the /v1 and /v2 route groups. Paths without a
+//prefix are an alias of v1.
+const (
+	APIv1 = 1
+	APIv2 = 2
+)
+
+const apiVersionKey = "api_version"
+
+var (
+	//versionRequests counts the requests by version: v1, v2 or unversioned
+	versionRequests = expvar.NewMap("api_version_requests")
+	//deprecatedRequests counts the requests to the deprecated versions, by
+	//version and route
+	deprecatedRequests = expvar.NewMap("api_deprecated_requests")
+)
+
+//APIVersions makes the middlewares of the route groups of each version
+type APIVersions struct {
+	//Sunset is when v1 and the unversioned paths go away, none is announced when zero
+	Sunset time.Time
+}
+
+//apiVersion is the version of the API a request was made to
+type apiVersion struct {
+	number int
+	name   string
+	prefix string
+}
+
+var (
+	unversionedAPI = apiVersion{number: APIv1, name: "unversioned"}
+	v1API          = apiVersion{number: APIv1, name: "v1", prefix: "/v1"}
+	v2API          = apiVersion{number: APIv2, name: "v2", prefix: "/v2"}
+)
+
+//Unversioned is the middleware of the routes without a prefix, deprecated as v1 is
+func (v *APIVersions) Unversioned(next echo.HandlerFunc) echo.HandlerFunc {
+	return v.serve(unversionedAPI, next)
+}
+
+//V1 is the middleware of the /v1 group, every response of which is deprecated
+func (v *APIVersions) V1(next echo.HandlerFunc) echo.HandlerFunc {
+	return v.serve(v1API, next)
+}
+
+//V2 is the middleware of the /v2 group
+func (v *APIVersions) V2(next echo.HandlerFunc) echo.HandlerFunc {
+	return v.serve(v2API, next)
+}
+
+//serve keeps the version in the context and counts the request. Requests to
+//deprecated versions are flagged and pointed to the same path under /v2.
+func (v *APIVersions) serve(version apiVersion, next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		versionRequests.Add(version.name, 1)
+		c.Set(apiVersionKey, version)
+		if version.number < APIv2 {
+			header := c.Response().Header()
+			header.Set("Deprecation", "true")
+			if !v.Sunset.IsZero() {
+				header.Set("Sunset", v.Sunset.UTC().Format(http.TimeFormat))
+			}
+			header.Set("Link", `</v2`+strings.TrimPrefix(c.Request().URL.Path, version.prefix)+`>; rel="successor-version"`)
+			deprecatedRequests.Add(version.name+" "+c.Request().Method+" "+strings.TrimPrefix(c.Path(), version.prefix), 1)
+		}
+		return next(c)
+	}
+}
+
+func versionFromContext(c echo.Context) apiVersion {
+	if version, ok := c.Get(apiVersionKey).(apiVersion); ok {
+		return version
+	}
+	return unversionedAPI
+}
+
+//versioned picks the response of the version of the request: v2 gets the
+//envelope, older versions the former shape
+func versioned(c echo.Context, v1, v2 interface{}) interface{} {
+	if versionFromContext(c).number >= APIv2 {
+		return v2
+	}
+	return v1
+}
+
+//versionedPath tells if a route path is under a version prefix, so the docs
+//list each route once, by its unversioned path
+func versionedPath(p string) bool {
+	for _, version := range []apiVersion{v1API, v2API} {
+		if p == version.prefix || strings.HasPrefix(p, version.prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+//Deleted is the v2 response of the routes deleting documents
+type Deleted struct {
+	DeletedCount int64 `json:"deleted_count"`
+}
+
+//Created is the v2 response of the routes creating documents
+type Created struct {
+	IDs []interface{} `json:"ids"`
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIVersions(t *testing.T) {
+	sunset := time.Date(2027, 6, 30, 0, 0, 0, 0, time.UTC)
+	versions := &APIVersions{Sunset: sunset}
+	e := echo.New()
+	for _, api := range []*echo.Group{e.Group("", versions.Unversioned), e.Group("/v1", versions.V1), e.Group("/v2", versions.V2)} {
+		api.DELETE("/products/:id", func(c echo.Context) error {
+			return c.JSON(http.StatusOK, versioned(c, int64(1), Deleted{DeletedCount: 1}))
+		})
+		api.GET("/products/:id/stock", func(c echo.Context) error {
+			return c.String(http.StatusOK, "stock")
+		})
+	}
+
+	testCases := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		deprecated bool
+		code       int
+	}{
+		{"unversioned", http.MethodDelete, "/products/1", "1", true, http.StatusOK},
+		{"v1", http.MethodDelete, "/v1/products/1", "1", true, http.StatusOK},
+		{"v2", http.MethodDelete, "/v2/products/1", `{"deleted_count":1}`, false, http.StatusOK},
+		{"v1 route of the same shape", http.MethodGet, "/v1/products/1/stock", "stock", true, http.StatusOK},
+		{"v2 route of the same shape", http.MethodGet, "/v2/products/1/stock", "stock", false, http.StatusOK},
+		{"unknown version", http.MethodDelete, "/v3/products/1", "", false, http.StatusNotFound},
+		{"prefix of a path", http.MethodDelete, "/v2products/1", "", false, http.StatusNotFound},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			before := versionRequests.String()
+			res := httptest.NewRecorder()
+			e.ServeHTTP(res, httptest.NewRequest(tc.method, tc.path, nil))
+			assert.Equal(t, tc.code, res.Code)
+			assert.NotEqual(t, before, versionRequests.String())
+			if tc.code != http.StatusOK {
+				return
+			}
+			assert.Equal(t, tc.body, strings.TrimSpace(res.Body.String()))
+			if tc.deprecated {
+				assert.Equal(t, "true", res.Header().Get("Deprecation"))
+				assert.Equal(t, "Wed, 30 Jun 2027 00:00:00 GMT", res.Header().Get("Sunset"))
+				assert.Equal(t, `</v2`+strings.TrimPrefix(tc.path, "/v1")+`>; rel="successor-version"`, res.Header().Get("Link"))
+			} else {
+				assert.Empty(t, res.Header().Get("Deprecation"))
+			}
+		})
+	}
+
+	var counts map[string]int
+	assert.Nil(t, json.Unmarshal([]byte(deprecatedRequests.String()), &counts))
+	assert.True(t, counts["v1 DELETE /products/:id"] > 0)
+	assert.True(t, counts["v1 GET /products/:id/stock"] > 0)
+	assert.True(t, counts["unversioned DELETE /products/:id"] > 0)
+	assert.Zero(t, counts["v2 DELETE /products/:id"])
+}
+
+func TestVersionedPath(t *testing.T) {
+	assert.True(t, versionedPath("/v1/products"))
+	assert.True(t, versionedPath("/v2"))
+	assert.False(t, versionedPath("/v2products"))
+	assert.False(t, versionedPath("/products"))
+}
@@ -0,0 +1,472 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/inerts73/tronicscorp/dbiface"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/go-playground/validator.v9"
+)
+
+const (
+	//EventProductCreated is sent when a published product is created
+	EventProductCreated = "product.created"
+	//EventProductUpdated is sent when a published product changes, or is
+	//published or unpublished
+	EventProductUpdated = "product.updated"
+	//EventProductDeleted is sent when a product is deleted
+	EventProductDeleted = "product.deleted"
+)
+
+//shownToPartners tells if an update of a product is sent to the webhooks.
+//Drafts and archived products are not, but moving into or out of published is.
+func shownToPartners(old, updated Product) bool {
+	return old.status() == StatusPublished || updated.status() == StatusPublished
+}
+
+const (
+	//DeliveryPending deliveries wait for their next attempt
+	DeliveryPending = "pending"
+	//DeliveryDelivered deliveries were accepted by the receiver
+	DeliveryDelivered = "delivered"
+	//DeliveryDead deliveries failed every attempt, they form the dead-letter queue
+	DeliveryDead = "dead"
+)
+
+const (
+	//HeaderWebhookEvent names the event of a delivery
+	HeaderWebhookEvent = "X-Tronics-Event"
+	//HeaderWebhookDelivery is the id of a delivery, the same across its attempts
+	HeaderWebhookDelivery = "X-Tronics-Delivery"
+	//HeaderWebhookTimestamp is the unix time of the attempt, part of the signature
+	HeaderWebhookTimestamp = "X-Tronics-Timestamp"
+	//HeaderWebhookSignature is sha256=<hex HMAC-SHA256 of timestamp.body keyed by the secret>
+	HeaderWebhookSignature = "X-Tronics-Signature"
+)
+
+func init() {
+	v.RegisterStructValidation(func(sl validator.StructLevel) {
+		w := sl.Current().Interface().(Webhook)
+		if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			sl.ReportError(w.URL, "URL", "url", "url", "")
+		}
+	}, Webhook{})
+}
+
+//Webhook is the subscription of a partner to catalog events. The secret is
+//only shown when the webhook is created.
+type Webhook struct {
+	ID        primitive.ObjectID `json:"_id" bson:"_id"`
+	URL       string             `json:"url" bson:"url" validate:"required,max=2000"`
+	Events    []string           `json:"events" bson:"events" validate:"required,min=1,unique,dive,oneof=product.created product.updated product.deleted"`
+	Secret    string             `json:"secret,omitempty" bson:"secret" validate:"omitempty,min=16,max=200"`
+	Active    bool               `json:"active" bson:"active"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+}
+
+//WebhookEvent is the body of a delivery
+type WebhookEvent struct {
+	ID        primitive.ObjectID `json:"id"`
+	Type      string             `json:"type"`
+	CreatedAt time.Time          `json:"created_at"`
+	Data      interface{}        `json:"data"`
+}
+
+//Delivery is an event sent to a webhook, with the outcome of its last attempt
+type Delivery struct {
+	ID            primitive.ObjectID  `json:"_id" bson:"_id"`
+	WebhookID     primitive.ObjectID  `json:"webhook_id" bson:"webhook_id"`
+	Event         string              `json:"event" bson:"event"`
+	Payload       string              `json:"payload" bson:"payload"`
+	Status        string              `json:"status" bson:"status"`
+	Attempts      int                 `json:"attempts" bson:"attempts"`
+	NextAttemptAt time.Time           `json:"next_attempt_at" bson:"next_attempt_at"`
+	ResponseCode  int                 `json:"response_code,omitempty" bson:"response_code,omitempty"`
+	LastError     string              `json:"last_error,omitempty" bson:"last_error,omitempty"`
+	RedeliveryOf  *primitive.ObjectID `json:"redelivery_of,omitempty" bson:"redelivery_of,omitempty"`
+	CreatedAt     time.Time           `json:"created_at" bson:"created_at"`
+	DeliveredAt   *time.Time          `json:"delivered_at,omitempty" bson:"delivered_at,omitempty"`
+}
+
+//WebhooksHandler a webhooks handler
+type WebhooksHandler struct {
+	Col        dbiface.CollectionAPI
+	Dispatcher *WebhookDispatcher
+}
+
+//WebhookDispatcher queues the events for the webhooks and delivers them.
+//Failed attempts are retried after Backoff, doubled at each attempt, until
+//MaxAttempts is reached and the delivery is dead.
+type WebhookDispatcher struct {
+	Col         dbiface.CollectionAPI
+	DelCol      dbiface.CollectionAPI
+	Client      *http.Client
+	MaxAttempts int
+	Backoff     time.Duration
+}
+
+//SignPayload signs the body of a delivery made at timestamp. Receivers compute
+//it again to check that a delivery comes from us.
+func SignPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+//backoff is how long to wait after a delivery failed attempts times
+func (d *WebhookDispatcher) backoff(attempts int) time.Duration {
+	wait := d.Backoff
+	for i := 1; i < attempts; i++ {
+		wait *= 2
+	}
+	return wait
+}
+
+//publish queues the event for the active webhooks subscribed to it
+func (d *WebhookDispatcher) publish(ctx context.Context, event string, data interface{}) {
+	var webhooks []Webhook
+	cursor, err := d.Col.Find(ctx, bson.M{"active": true, "events": event})
+	if err != nil {
+		log.Errorf("Unable to find the webhooks : %v", err)
+		return
+	}
+	if err := cursor.All(ctx, &webhooks); err != nil {
+		log.Errorf("Unable to read the cursor : %v", err)
+		return
+	}
+	if len(webhooks) == 0 {
+		return
+	}
+	now := time.Now().UTC()
+	payload, err := json.Marshal(WebhookEvent{ID: primitive.NewObjectID(), Type: event, CreatedAt: now, Data: data})
+	if err != nil {
+		log.Errorf("Unable to encode the %s event : %v", event, err)
+		return
+	}
+	for _, w := range webhooks {
+		delivery := Delivery{
+			ID:            primitive.NewObjectID(),
+			WebhookID:     w.ID,
+			Event:         event,
+			Payload:       string(payload),
+			Status:        DeliveryPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		}
+		if _, err := d.DelCol.InsertOne(ctx, delivery); err != nil {
+			log.Errorf("Unable to queue the %s delivery to %s : %v", event, w.ID.Hex(), err)
+		}
+	}
+}
+
+//send makes one attempt of the delivery and returns the status code of the receiver
+func (d *WebhookDispatcher) send(ctx context.Context, w Webhook, delivery Delivery, now time.Time) (int, error) {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(HeaderWebhookEvent, delivery.Event)
+	req.Header.Set(HeaderWebhookDelivery, delivery.ID.Hex())
+	req.Header.Set(HeaderWebhookTimestamp, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(HeaderWebhookSignature, SignPayload(w.Secret, now.Unix(), body))
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<16))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("receiver answered %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+//attempt claims the delivery, so that a single dispatcher attempts it, sends
+//it and records the outcome
+func (d *WebhookDispatcher) attempt(ctx context.Context, delivery Delivery, now time.Time) error {
+	claim := bson.M{"_id": delivery.ID, "status": DeliveryPending, "attempts": delivery.Attempts}
+	res, err := d.DelCol.UpdateOne(ctx, claim, bson.M{"$inc": bson.M{"attempts": 1}})
+	if err != nil || res.MatchedCount == 0 {
+		return err
+	}
+	delivery.Attempts++
+	var w Webhook
+	set := bson.M{}
+	err = d.Col.FindOne(ctx, bson.M{"_id": delivery.WebhookID}).Decode(&w)
+	if err == nil {
+		var code int
+		if code, err = d.send(ctx, w, delivery, now); code != 0 {
+			set["response_code"] = code
+		}
+	}
+	switch {
+	case err == nil:
+		set["status"], set["delivered_at"] = DeliveryDelivered, now
+	case delivery.Attempts >= d.MaxAttempts || err == mongo.ErrNoDocuments:
+		set["status"], set["last_error"] = DeliveryDead, err.Error()
+	default:
+		set["next_attempt_at"], set["last_error"] = now.Add(d.backoff(delivery.Attempts)), err.Error()
+	}
+	_, err = d.DelCol.UpdateOne(ctx, bson.M{"_id": delivery.ID}, bson.M{"$set": set})
+	return err
+}
+
+//deliverDue attempts the deliveries due at now and returns how many it attempted
+func (d *WebhookDispatcher) deliverDue(ctx context.Context, now time.Time) (int, error) {
+	var deliveries []Delivery
+	filter := bson.M{"status": DeliveryPending, "next_attempt_at": bson.M{"$lte": now}}
+	cursor, err := d.DelCol.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "next_attempt_at", Value: 1}}).SetLimit(100))
+	if err != nil {
+		return 0, err
+	}
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		return 0, err
+	}
+	for _, delivery := range deliveries {
+		if err := d.attempt(ctx, delivery, now); err != nil {
+			log.Errorf("Unable to record the delivery %s : %v", delivery.ID.Hex(), err)
+		}
+	}
+	return len(deliveries), nil
+}
+
+//Run delivers the due deliveries every interval until ctx is done
+func (d *WebhookDispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if _, err := d.deliverDue(ctx, now.UTC()); err != nil {
+				log.Errorf("Unable to deliver the webhooks : %v", err)
+			}
+		}
+	}
+}
+
+func webhookID(c echo.Context) (primitive.ObjectID, error) {
+	docID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return docID, echo.NewHTTPError(http.StatusBadRequest, "Invalid webhook id")
+	}
+	return docID, nil
+}
+
+func findWebhook(ctx context.Context, docID primitive.ObjectID, collection dbiface.CollectionAPI) (Webhook, error) {
+	var w Webhook
+	if err := collection.FindOne(ctx, bson.M{"_id": docID}).Decode(&w); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return w, echo.NewHTTPError(http.StatusNotFound, "Webhook does not exist")
+		}
+		log.Errorf("Unable to decode the webhook : %v", err)
+		return w, echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the webhook")
+	}
+	w.Secret = ""
+	return w, nil
+}
+
+//GetWebhooks lists the webhooks
+func (h *WebhooksHandler) GetWebhooks(c echo.Context) error {
+	ctx := storageContext(c)
+	webhooks := []Webhook{}
+	cursor, err := h.Col.Find(ctx, bson.M{}, options.Find().SetProjection(bson.M{"secret": 0}))
+	if err != nil {
+		log.Errorf("Unable to find the webhooks : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the webhooks")
+	}
+	if err := cursor.All(ctx, &webhooks); err != nil {
+		log.Errorf("Unable to read the cursor : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the webhooks")
+	}
+	return c.JSON(http.StatusOK, webhooks)
+}
+
+//GetWebhook gets a webhook
+func (h *WebhooksHandler) GetWebhook(c echo.Context) error {
+	docID, err := webhookID(c)
+	if err != nil {
+		return err
+	}
+	w, err := findWebhook(storageContext(c), docID, h.Col)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, w)
+}
+
+//CreateWebhook subscribes a url to events. A secret is generated unless one is given.
+func (h *WebhooksHandler) CreateWebhook(c echo.Context) error {
+	w := Webhook{Active: true}
+	if err := c.Bind(&w); err != nil {
+		log.Errorf("Unable to bind to webhook : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	if err := v.Struct(w); err != nil {
+		log.Errorf("Unable to validate the webhook %+v %v", w, err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload.")
+	}
+	if w.Secret == "" {
+		secret, err := newWebhookSecret()
+		if err != nil {
+			log.Errorf("Unable to generate a secret : %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Unable to create the webhook")
+		}
+		w.Secret = secret
+	}
+	w.ID = primitive.NewObjectID()
+	w.CreatedAt = time.Now().UTC()
+	if _, err := h.Col.InsertOne(storageContext(c), w); err != nil {
+		log.Errorf("Unable to insert the webhook : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to create the webhook")
+	}
+	return c.JSON(http.StatusCreated, w)
+}
+
+//UpdateWebhook changes the url, the events or the secret of a webhook, or
+//pauses it with active set to false
+func (h *WebhooksHandler) UpdateWebhook(c echo.Context) error {
+	ctx := storageContext(c)
+	docID, err := webhookID(c)
+	if err != nil {
+		return err
+	}
+	var stored Webhook
+	if err := h.Col.FindOne(ctx, bson.M{"_id": docID}).Decode(&stored); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return echo.NewHTTPError(http.StatusNotFound, "Webhook does not exist")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the webhook")
+	}
+	w := stored
+	if err := c.Bind(&w); err != nil {
+		log.Errorf("Unable to bind to webhook : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	w.ID, w.CreatedAt = stored.ID, stored.CreatedAt
+	if err := v.Struct(w); err != nil {
+		log.Errorf("Unable to validate the webhook %+v %v", w, err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload.")
+	}
+	update := bson.M{"$set": bson.M{"url": w.URL, "events": w.Events, "secret": w.Secret, "active": w.Active}}
+	if _, err := h.Col.UpdateOne(ctx, bson.M{"_id": docID}, update); err != nil {
+		log.Errorf("Unable to update the webhook : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to update the webhook")
+	}
+	w.Secret = ""
+	return c.JSON(http.StatusOK, w)
+}
+
+//DeleteWebhook deletes a webhook, its pending deliveries are not attempted anymore
+func (h *WebhooksHandler) DeleteWebhook(c echo.Context) error {
+	docID, err := webhookID(c)
+	if err != nil {
+		return err
+	}
+	res, err := h.Col.DeleteOne(storageContext(c), bson.M{"_id": docID})
+	if err != nil {
+		log.Errorf("Unable to delete the webhook : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to delete the webhook")
+	}
+	return c.JSON(http.StatusOK, versioned(c, res.DeletedCount, Deleted{DeletedCount: res.DeletedCount}))
+}
+
+//GetDeliveries lists the deliveries of a webhook, last first, by status=<status>.
+//status=dead lists its dead-letter queue.
+func (h *WebhooksHandler) GetDeliveries(c echo.Context) error {
+	ctx := storageContext(c)
+	docID, err := webhookID(c)
+	if err != nil {
+		return err
+	}
+	filter := bson.M{"webhook_id": docID}
+	if status := c.QueryParam("status"); status != "" {
+		filter["status"] = status
+	}
+	deliveries := []Delivery{}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(200)
+	cursor, err := h.Dispatcher.DelCol.Find(ctx, filter, opts)
+	if err != nil {
+		log.Errorf("Unable to find the deliveries : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the deliveries")
+	}
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		log.Errorf("Unable to read the cursor : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the deliveries")
+	}
+	return c.JSON(http.StatusOK, deliveries)
+}
+
+//Redeliver queues a delivery again, as a new delivery of the same event
+func (h *WebhooksHandler) Redeliver(c echo.Context) error {
+	ctx := storageContext(c)
+	docID, err := webhookID(c)
+	if err != nil {
+		return err
+	}
+	deliveryID, err := primitive.ObjectIDFromHex(c.Param("did"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid delivery id")
+	}
+	if _, err := findWebhook(ctx, docID, h.Col); err != nil {
+		return err
+	}
+	var original Delivery
+	if err := h.Dispatcher.DelCol.FindOne(ctx, bson.M{"_id": deliveryID, "webhook_id": docID}).Decode(&original); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return echo.NewHTTPError(http.StatusNotFound, "Delivery does not exist")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the delivery")
+	}
+	now := time.Now().UTC()
+	delivery := Delivery{
+		ID:            primitive.NewObjectID(),
+		WebhookID:     docID,
+		Event:         original.Event,
+		Payload:       original.Payload,
+		Status:        DeliveryPending,
+		NextAttemptAt: now,
+		RedeliveryOf:  &original.ID,
+		CreatedAt:     now,
+	}
+	if _, err := h.Dispatcher.DelCol.InsertOne(ctx, delivery); err != nil {
+		log.Errorf("Unable to queue the delivery : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to redeliver")
+	}
+	return c.JSON(http.StatusAccepted, delivery)
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSignPayload(t *testing.T) {
+	body := []byte(`{"type":"product.created"}`)
+	sig := SignPayload("whsec_test", 1593600000, body)
+	assert.True(t, strings.HasPrefix(sig, "sha256="))
+	assert.Len(t, sig, len("sha256=")+64)
+	assert.Equal(t, sig, SignPayload("whsec_test", 1593600000, body))
+	assert.NotEqual(t, sig, SignPayload("whsec_other", 1593600000, body))
+	assert.NotEqual(t, sig, SignPayload("whsec_test", 1593600001, body))
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	d := WebhookDispatcher{Backoff: 30 * time.Second}
+	assert.Equal(t, 30*time.Second, d.backoff(1))
+	assert.Equal(t, 60*time.Second, d.backoff(2))
+	assert.Equal(t, 4*time.Minute, d.backoff(4))
+}
+
+func TestShownToPartners(t *testing.T) {
+	draft, published, archived := Product{Status: StatusDraft}, Product{Status: StatusPublished}, Product{Status: StatusArchived}
+	assert.False(t, shownToPartners(draft, draft))
+	assert.False(t, shownToPartners(draft, archived))
+	assert.True(t, shownToPartners(draft, published))
+	assert.True(t, shownToPartners(published, published))
+	assert.True(t, shownToPartners(published, archived), "partners learn that the product is gone")
+	assert.True(t, shownToPartners(Product{}, Product{}), "products stored before the lifecycle are published")
+}
+
+func TestWebhookValidation(t *testing.T) {
+	assert.Nil(t, v.Struct(Webhook{URL: "https://partner.example.com/hooks", Events: []string{EventProductCreated}}))
+	assert.NotNil(t, v.Struct(Webhook{URL: "ftp://partner.example.com", Events: []string{EventProductCreated}}))
+	assert.NotNil(t, v.Struct(Webhook{URL: "https://partner.example.com", Events: []string{"order.created"}}))
+	assert.NotNil(t, v.Struct(Webhook{URL: "https://partner.example.com"}))
+}
+
+func TestWebhooks(t *testing.T) {
+	var mu sync.Mutex
+	var received []*http.Request
+	var failing bool
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		ts, _ := strconv.ParseInt(r.Header.Get(HeaderWebhookTimestamp), 10, 64)
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, r)
+		if failing || r.Header.Get(HeaderWebhookSignature) != SignPayload("whsec_0123456789abcdef", ts, body) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	d := &WebhookDispatcher{Col: db.Collection("webhooks"), DelCol: db.Collection("webhook_deliveries"), Client: receiver.Client(), MaxAttempts: 2, Backoff: time.Minute}
+	ph := ProductHandler{Col: col, Webhooks: d}
+	h := WebhooksHandler{Col: d.Col, Dispatcher: d}
+
+	deliveries := func(webhookID, status string) []Delivery {
+		var list []Delivery
+		c, res := newRequest(http.MethodGet, "/webhooks/"+webhookID+"/deliveries?status="+status, "", adminClaims, "id", webhookID)
+		assert.Nil(t, h.GetDeliveries(c))
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &list))
+		return list
+	}
+
+	var webhook Webhook
+	c, res := newRequest(http.MethodPost, "/webhooks", fmt.Sprintf(`{"url":%q,"events":["product.created"],"secret":"whsec_0123456789abcdef"}`, receiver.URL), adminClaims)
+	assert.Nil(t, h.CreateWebhook(c))
+	assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &webhook))
+	id := webhook.ID.Hex()
+
+	t.Run("secret is not shown", func(t *testing.T) {
+		var w Webhook
+		c, res := newRequest(http.MethodGet, "/webhooks/"+id, "", adminClaims, "id", id)
+		assert.Nil(t, h.GetWebhook(c))
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &w))
+		assert.Empty(t, w.Secret)
+	})
+
+	t.Run("signed delivery", func(t *testing.T) {
+		c, _ := newRequest(http.MethodPost, "/products", `[{"product_name":"pixel 9","price":900,"currency":"USD","vendor":"google"}]`, adminClaims)
+		assert.Nil(t, ph.CreateProducts(c))
+		_, err := d.deliverDue(context.Background(), time.Now().UTC())
+		assert.Nil(t, err)
+		assert.Empty(t, received, "drafts are not sent to partners")
+
+		var IDs []primitive.ObjectID
+		c, res := newRequest(http.MethodPost, "/products", `[{"product_name":"pixel","price":500,"currency":"USD","vendor":"google","status":"published"}]`, adminClaims)
+		assert.Nil(t, ph.CreateProducts(c))
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &IDs))
+
+		_, err = d.deliverDue(context.Background(), time.Now().UTC())
+		assert.Nil(t, err)
+		if assert.Len(t, received, 1) {
+			assert.Equal(t, EventProductCreated, received[0].Header.Get(HeaderWebhookEvent))
+		}
+		assert.Len(t, deliveries(id, DeliveryDelivered), 1)
+	})
+
+	t.Run("retries then dead letter", func(t *testing.T) {
+		failing = true
+		c, _ := newRequest(http.MethodPost, "/products", `[{"product_name":"nokia","price":100,"currency":"USD","vendor":"nokia","status":"published"}]`, adminClaims)
+		assert.Nil(t, ph.CreateProducts(c))
+
+		now := time.Now().UTC()
+		_, err := d.deliverDue(context.Background(), now)
+		assert.Nil(t, err)
+		pending := deliveries(id, DeliveryPending)
+		if assert.Len(t, pending, 1) {
+			assert.Equal(t, 1, pending[0].Attempts)
+			assert.Equal(t, http.StatusInternalServerError, pending[0].ResponseCode)
+		}
+
+		n, _ := d.deliverDue(context.Background(), now.Add(30*time.Second))
+		assert.Equal(t, 0, n)
+		_, err = d.deliverDue(context.Background(), now.Add(2*time.Minute))
+		assert.Nil(t, err)
+		dead := deliveries(id, DeliveryDead)
+		if !assert.Len(t, dead, 1) {
+			return
+		}
+
+		failing = false
+		c, res := newRequest(http.MethodPost, "/", "", adminClaims, "id", "did", id, dead[0].ID.Hex())
+		assert.Nil(t, h.Redeliver(c))
+		assert.Equal(t, http.StatusAccepted, res.Code)
+		_, err = d.deliverDue(context.Background(), time.Now().UTC())
+		assert.Nil(t, err)
+		assert.Len(t, deliveries(id, DeliveryDelivered), 2)
+	})
+}
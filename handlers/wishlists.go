@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/inerts73/tronicscorp/dbiface"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//WishlistItem is a product a user saved. Product is embedded in responses
+//while it is published.
+type WishlistItem struct {
+	ID        primitive.ObjectID `json:"_id" bson:"_id"`
+	UserID    string             `json:"user_id" bson:"user_id"`
+	ProductID primitive.ObjectID `json:"product_id" bson:"product_id" validate:"required"`
+	AddedAt   time.Time          `json:"added_at" bson:"added_at"`
+	Product   *Product           `json:"product,omitempty" bson:"-"`
+}
+
+//WishlistsHandler a wishlists handler
+type WishlistsHandler struct {
+	Col     dbiface.CollectionAPI
+	ProdCol dbiface.CollectionAPI
+}
+
+//publishedProduct finds a product customers can see
+func publishedProduct(ctx context.Context, id string, collection dbiface.CollectionAPI) (Product, error) {
+	product, err := productByID(ctx, id, collection)
+	if err == nil && product.status() != StatusPublished {
+		return product, echo.NewHTTPError(http.StatusNotFound, "Product does not exist")
+	}
+	return product, err
+}
+
+//GetWishlist lists the products the user saved, last saved first
+func (h *WishlistsHandler) GetWishlist(c echo.Context) error {
+	ctx := storageContext(c)
+	items := []WishlistItem{}
+	opts := options.Find().SetSort(bson.D{{Key: "added_at", Value: -1}})
+	cursor, err := h.Col.Find(ctx, bson.M{"user_id": userIDFromContext(c)}, opts)
+	if err != nil {
+		log.Errorf("Unable to find the wishlist : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the wishlist")
+	}
+	if err := cursor.All(ctx, &items); err != nil {
+		log.Errorf("Unable to read the cursor : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the wishlist")
+	}
+	IDs := make([]primitive.ObjectID, len(items))
+	for i, item := range items {
+		IDs[i] = item.ProductID
+	}
+	products, err := productsByID(ctx, IDs, bson.M{"$or": publishedFilter}, h.ProdCol)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to retrieve the products")
+	}
+	byID := map[primitive.ObjectID]Product{}
+	for _, p := range products {
+		byID[p.ID] = p
+	}
+	for i := range items {
+		if p, ok := byID[items[i].ProductID]; ok {
+			items[i].Product = &p
+		}
+	}
+	return c.JSON(http.StatusOK, items)
+}
+
+//AddToWishlist saves a product to the wishlist of the user. Saving it again
+//changes nothing.
+func (h *WishlistsHandler) AddToWishlist(c echo.Context) error {
+	ctx := storageContext(c)
+	var item WishlistItem
+	if err := c.Bind(&item); err != nil {
+		log.Errorf("Unable to bind to wishlist item : %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the request payload.")
+	}
+	if err := v.Struct(item); err != nil {
+		log.Errorf("Unable to validate the wishlist item %+v %v", item, err)
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload.")
+	}
+	if _, err := publishedProduct(ctx, item.ProductID.Hex(), h.ProdCol); err != nil {
+		return err
+	}
+	item.UserID = userIDFromContext(c)
+	filter := bson.M{"user_id": item.UserID, "product_id": item.ProductID}
+	update := bson.M{"$setOnInsert": bson.M{"_id": primitive.NewObjectID(), "added_at": time.Now().UTC()}}
+	res, err := h.Col.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		log.Errorf("Unable to add to the wishlist : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to add to the wishlist")
+	}
+	status := http.StatusOK
+	if res.UpsertedCount > 0 {
+		status = http.StatusCreated
+	}
+	if err := h.Col.FindOne(ctx, filter).Decode(&item); err != nil {
+		log.Errorf("Unable to decode the wishlist item : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to add to the wishlist")
+	}
+	return c.JSON(status, item)
+}
+
+//RemoveFromWishlist removes a product from the wishlist of the user
+func (h *WishlistsHandler) RemoveFromWishlist(c echo.Context) error {
+	productID, err := primitive.ObjectIDFromHex(c.Param("pid"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid product id")
+	}
+	res, err := h.Col.DeleteOne(storageContext(c), bson.M{"user_id": userIDFromContext(c), "product_id": productID})
+	if err != nil {
+		log.Errorf("Unable to remove from the wishlist : %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to remove from the wishlist")
+	}
+	if res.DeletedCount == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "Product is not in the wishlist")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -4,22 +4,31 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/ilyakaznacheev/cleanenv"
+	"github.com/inerts73/tronicscorp/catalogpb"
 	"github.com/inerts73/tronicscorp/config"
 	"github.com/inerts73/tronicscorp/handlers"
+	"github.com/inerts73/tronicscorp/notify"
+	"github.com/inerts73/tronicscorp/payments"
+	"github.com/inerts73/tronicscorp/storage"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 	"github.com/labstack/gommon/log"
 	"github.com/labstack/gommon/random"
 	"go.mongodb.org/mongo-driver/mongo"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
 )
 
 const (
@@ -28,11 +37,26 @@ const (
 )
 
 var (
-	c   *mongo.Client
-	db  *mongo.Database
-	prodCol *mongo.Collection
-	usersCol *mongo.Collection
-	cfg config.Properties
+	c             *mongo.Client
+	db            *mongo.Database
+	prodCol       *mongo.Collection
+	usersCol      *mongo.Collection
+	invCol        *mongo.Collection
+	stockAdjCol   *mongo.Collection
+	ratesCol      *mongo.Collection
+	promoCol      *mongo.Collection
+	catCol        *mongo.Collection
+	revCol        *mongo.Collection
+	vendorsCol    *mongo.Collection
+	priceHistCol  *mongo.Collection
+	reviewsCol    *mongo.Collection
+	cartsCol      *mongo.Collection
+	ordersCol     *mongo.Collection
+	wishlistsCol  *mongo.Collection
+	alertsCol     *mongo.Collection
+	webhooksCol   *mongo.Collection
+	deliveriesCol *mongo.Collection
+	cfg           config.Properties
 )
 
 func init() {
@@ -47,10 +71,25 @@ func init() {
 	db = c.Database(cfg.DBName)
 	prodCol = db.Collection(cfg.ProductCollection)
 	usersCol = db.Collection(cfg.UsersCollection)
+	invCol = db.Collection(cfg.InventoryCollection)
+	stockAdjCol = db.Collection(cfg.StockAdjCollection)
+	ratesCol = db.Collection(cfg.RatesCollection)
+	promoCol = db.Collection(cfg.PromotionsCollection)
+	catCol = db.Collection(cfg.CategoriesCollection)
+	revCol = db.Collection(cfg.RevisionsCollection)
+	vendorsCol = db.Collection(cfg.VendorsCollection)
+	priceHistCol = db.Collection(cfg.PriceHistoryCollection)
+	reviewsCol = db.Collection(cfg.ReviewsCollection)
+	cartsCol = db.Collection(cfg.CartsCollection)
+	ordersCol = db.Collection(cfg.OrdersCollection)
+	wishlistsCol = db.Collection(cfg.WishlistsCollection)
+	alertsCol = db.Collection(cfg.AlertsCollection)
+	webhooksCol = db.Collection(cfg.WebhooksCollection)
+	deliveriesCol = db.Collection(cfg.DeliveriesCollection)
 
 	isUserIndexUnique := true
 	indexModel := mongo.IndexModel{
-		Keys: bson.D{{"username", 1}},
+		Keys: bson.D{{Key: "username", Value: 1}},
 		Options: &options.IndexOptions{
 			Unique: &isUserIndexUnique,
 		},
@@ -59,10 +98,100 @@ func init() {
 	if err != nil {
 		log.Fatalf("Unable to create an index : %+v", err)
 	}
+	_, err = catCol.Indexes().CreateOne(context.Background(), mongo.IndexModel{Keys: bson.D{{Key: "ancestors", Value: 1}}})
+	if err != nil {
+		log.Fatalf("Unable to create an index : %+v", err)
+	}
+	_, err = vendorsCol.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "slug", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Fatalf("Unable to create an index : %+v", err)
+	}
+	_, err = cartsCol.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}},
+			Options: options.Index().SetUnique(true).SetSparse(true),
+		},
+		{
+			Keys:    bson.D{{Key: "token", Value: 1}},
+			Options: options.Index().SetUnique(true).SetSparse(true),
+		},
+		{
+			// guest carts expire, the carts of users are kept
+			Keys: bson.D{{Key: "updated_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(cfg.GuestCartTTL.Seconds())).
+				SetPartialFilterExpression(bson.M{"token": bson.M{"$exists": true}}),
+		},
+	})
+	if err != nil {
+		log.Fatalf("Unable to create an index : %+v", err)
+	}
+	_, err = deliveriesCol.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt_at", Value: 1}}},
+		{Keys: bson.D{{Key: "webhook_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+	if err != nil {
+		log.Fatalf("Unable to create an index : %+v", err)
+	}
+	_, err = wishlistsCol.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "product_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Fatalf("Unable to create an index : %+v", err)
+	}
+	_, err = alertsCol.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "product_id", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+	if err != nil {
+		log.Fatalf("Unable to create an index : %+v", err)
+	}
+	_, err = ordersCol.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: -1}}},
+		{
+			Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "checkout_key", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"checkout_key": bson.M{"$exists": true}}),
+		},
+	})
+	if err != nil {
+		log.Fatalf("Unable to create an index : %+v", err)
+	}
+	_, err = reviewsCol.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "product_id", Value: 1}, {Key: "user_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Fatalf("Unable to create an index : %+v", err)
+	}
+	_, err = prodCol.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "rating.average", Value: -1}, {Key: "rating.count", Value: -1}},
+	})
+	if err != nil {
+		log.Fatalf("Unable to create an index : %+v", err)
+	}
+	_, err = priceHistCol.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "product_id", Value: 1}, {Key: "changed_at", Value: 1}}},
+		{Keys: bson.D{{Key: "changed_at", Value: 1}}},
+	})
+	if err != nil {
+		log.Fatalf("Unable to create an index : %+v", err)
+	}
+	_, err = revCol.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "product_id", Value: 1}, {Key: "rev", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Fatalf("Unable to create an index : %+v", err)
+	}
 }
 
 func addCorrelationID(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context)error{
+	return func(c echo.Context) error {
 		// generate correlation id
 		id := c.Request().Header.Get(CorrelationID)
 		var newID string
@@ -75,7 +204,7 @@ func addCorrelationID(next echo.HandlerFunc) echo.HandlerFunc {
 
 		c.Request().Header.Set(CorrelationID, newID)
 		c.Response().Header().Set(CorrelationID, newID)
-		return next(c)	
+		return next(c)
 	}
 }
 
@@ -94,7 +223,56 @@ func adminMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 			return echo.NewHTTPError(http.StatusForbidden, "Not authorized")
 		}
 		return next(c)
-	}	
+	}
+}
+
+//vendorMiddleware lets admins and users working for a vendor through
+func vendorMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, ok := c.Get("user").(*jwt.Token)
+		if !ok {
+			return echo.NewHTTPError(http.StatusUnauthorized, "Missing token")
+		}
+		claims, _ := token.Claims.(jwt.MapClaims)
+		if isAdmin, _ := claims["authorized"].(bool); isAdmin {
+			return next(c)
+		}
+		if vendorID, _ := claims["vendor_id"].(string); vendorID == "" {
+			return echo.NewHTTPError(http.StatusForbidden, "Only vendor users can change products")
+		}
+		return next(c)
+	}
+}
+
+//optionalJWT authenticates the request when it carries a token, so handlers
+//open to everyone can still recognise admins
+func optionalJWT(jwtMiddleware echo.MiddlewareFunc) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		withJWT := jwtMiddleware(next)
+		return func(c echo.Context) error {
+			if c.Request().Header.Get("x-auth-token") == "" {
+				return next(c)
+			}
+			return withJWT(c)
+		}
+	}
+}
+
+//serveGRPC serves the products to internal services on their own port
+func serveGRPC(ps *handlers.ProductServer) {
+	lis, err := net.Listen("tcp", fmt.Sprintf("%s:%s", cfg.Host, cfg.GRPCPort))
+	if err != nil {
+		log.Fatalf("Unable to listen for gRPC : %v", err)
+	}
+	s := grpc.NewServer(grpc.UnaryInterceptor(ps.UnaryInterceptor), grpc.StreamInterceptor(ps.StreamInterceptor))
+	catalogpb.RegisterProductsServer(s, ps)
+	if cfg.GRPCReflection {
+		reflection.Register(s)
+	}
+	log.Infof("gRPC listening on %s:%s", cfg.Host, cfg.GRPCPort)
+	if err := s.Serve(lis); err != nil {
+		log.Fatalf("Unable to serve gRPC : %v", err)
+	}
 }
 
 func main() {
@@ -104,23 +282,182 @@ func main() {
 	middleware.RequestID()
 	e.Pre(addCorrelationID)
 	jwtMiddleware := middleware.JWTWithConfig(middleware.JWTConfig{
-		SigningKey: []byte(cfg.JwtTokenSecret),
+		SigningKey:  []byte(cfg.JwtTokenSecret),
 		TokenLookup: "header:x-auth-token",
 	})
 	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
 		Format: `${time_rfc3339_nano} ${remote_ip} ${header:X-Correlation-ID} ${host} ${method} ${uri} ${user_agent} ` +
-			`${status} ${error} ${latency_human}` + "\n",	
+			`${status} ${error} ${latency_human}` + "\n",
 	}))
-	h := &handlers.ProductHandler{Col: prodCol}
-	uh := &handlers.UsersHandler{Col: usersCol}
-	e.GET("/products/:id", h.GetProduct)
-	e.DELETE("/products/:id", h.DeleteProduct, jwtMiddleware, adminMiddleware)
-	e.PUT("/products/:id", h.UpdateProduct, middleware.BodyLimit("1M"), jwtMiddleware)
-	e.POST("/products", h.CreateProducts, middleware.BodyLimit("1M"), jwtMiddleware)
-	e.GET("/products", h.GetProducts)
-
-	e.POST("/users", uh.CreateUser)
-	e.POST("/auth", uh.AuthnUser)
+	rates := &handlers.RateTable{}
+	if cfg.ExchangeRatesFile != "" {
+		r, err := handlers.LoadExchangeRates(cfg.ExchangeRatesFile)
+		if err != nil {
+			log.Fatalf("Unable to load the exchange rates : %v", err)
+		}
+		rates.Set(r)
+	}
+	rh := &handlers.RatesHandler{Col: ratesCol, Rates: rates}
+	if err := rh.LoadStoredRates(context.Background()); err != nil {
+		log.Fatalf("Unable to load the stored exchange rates : %v", err)
+	}
+	promos := &handlers.PromotionEngine{Rates: rates}
+	var notifier notify.Notifier = notify.LogNotifier{}
+	if cfg.Notifier == "file" {
+		notifier = &notify.FileNotifier{Path: cfg.NotificationsFile}
+	}
+	dispatcher := &handlers.WebhookDispatcher{
+		Col:         webhooksCol,
+		DelCol:      deliveriesCol,
+		Client:      &http.Client{Timeout: cfg.WebhookTimeout},
+		MaxAttempts: cfg.WebhookMaxAttempts,
+		Backoff:     cfg.WebhookBackoff,
+	}
+	go dispatcher.Run(context.Background(), cfg.WebhookInterval)
+	alerts := &handlers.AlertChecker{Col: alertsCol, Rates: rates, Notifier: notifier, Promos: promos, PromoCol: promoCol}
+	h := &handlers.ProductHandler{Col: prodCol, InvCol: invCol, Rates: rates, PromoCol: promoCol, Promos: promos, CatCol: catCol, RevCol: revCol, VendorCol: vendorsCol, HistCol: priceHistCol, Alerts: alerts, Webhooks: dispatcher, Locales: cfg.Locales, DefaultLocale: cfg.DefaultLocale}
+	go h.RunScheduler(context.Background(), cfg.SchedulerInterval)
+	ch := &handlers.CategoriesHandler{Col: catCol, ProdCol: prodCol}
+	var blobs storage.BlobStore = &storage.LocalStore{Dir: cfg.BlobDir}
+	if cfg.BlobStore == "s3" {
+		blobs = &storage.S3Store{
+			Endpoint:  cfg.S3Endpoint,
+			Region:    cfg.S3Region,
+			Bucket:    cfg.S3Bucket,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+		}
+	}
+	mh := &handlers.MediaHandler{Col: prodCol, Store: blobs, MaxSize: cfg.MediaMaxSize, MaxAge: cfg.MediaMaxAge}
+	ph := &handlers.PromotionsHandler{Col: promoCol}
+	uh := &handlers.UsersHandler{Col: usersCol, VendorCol: vendorsCol}
+	vh := &handlers.VendorsHandler{Col: vendorsCol, ProdCol: prodCol}
+	revh := &handlers.ReviewsHandler{Col: reviewsCol, ProdCol: prodCol}
+	cartsh := &handlers.CartsHandler{Col: cartsCol, ProdCol: prodCol, InvCol: invCol, Rates: rates, PromoCol: promoCol, Promos: promos, Currency: cfg.CartCurrency}
+	var provider payments.PaymentProvider
+	switch cfg.PaymentProvider {
+	case "fake":
+		provider = &payments.FakeProvider{}
+	default:
+		log.Fatalf("Unknown payment provider %s", cfg.PaymentProvider)
+	}
+	gh := &handlers.GraphQLHandler{Products: h, ReviewCol: reviewsCol, UsersCol: usersCol}
+	webh := &handlers.WebhooksHandler{Col: webhooksCol, Dispatcher: dispatcher}
+	wh := &handlers.WishlistsHandler{Col: wishlistsCol, ProdCol: prodCol}
+	ah := &handlers.AlertsHandler{Col: alertsCol, ProdCol: prodCol}
+	oh := &handlers.OrdersHandler{Col: ordersCol, Carts: cartsh, Payments: provider, PendingTTL: cfg.PendingOrderTTL}
+	go oh.CancelStaleOrders(context.Background(), cfg.PendingOrderSweep)
+	ih := &handlers.InventoryHandler{Col: invCol, AdjCol: stockAdjCol, ProdCol: prodCol, ReservationTTL: cfg.ReservationTTL}
+	go ih.ExpireReservations(context.Background(), cfg.ReservationSweep)
+	docs := &handlers.DocsHandler{Title: "Tronics API", Version: "1.0.0", UIScript: cfg.DocsUIScript}
+	e.GET("/openapi.json", docs.GetSpec)
+	e.GET("/docs", docs.GetUI)
+	e.GET("/debug/vars", echo.WrapHandler(expvar.Handler()), jwtMiddleware, adminMiddleware)
+	bh := &handlers.BatchHandler{Echo: e, Client: db.Client(), MaxRequests: cfg.BatchMaxRequests}
+	if !cfg.APIv1Sunset.After(time.Now()) {
+		log.Warnf("The sunset of v1, %s, has passed", cfg.APIv1Sunset.Format("2006-01-02"))
+	}
+	versions := &handlers.APIVersions{Sunset: cfg.APIv1Sunset}
+	//paths without a version prefix are an alias of v1
+	for _, api := range []*echo.Group{e.Group("", versions.Unversioned), e.Group("/v1", versions.V1), e.Group("/v2", versions.V2)} {
+		api.POST("/batch", bh.Serve, middleware.BodyLimit("4M"))
+		api.GET("/products/:id", h.GetProduct, optionalJWT(jwtMiddleware), handlers.Conditional(cfg.ProductCacheControl))
+		api.DELETE("/products/:id", h.DeleteProduct, jwtMiddleware, adminMiddleware)
+		api.PUT("/products/:id", h.UpdateProduct, middleware.BodyLimit("1M"), jwtMiddleware, vendorMiddleware)
+		api.POST("/products", h.CreateProducts, middleware.BodyLimit("1M"), jwtMiddleware, vendorMiddleware)
+		api.GET("/products", h.GetProducts, optionalJWT(jwtMiddleware), handlers.Conditional(cfg.ProductsCacheControl))
+		api.GET("/products/:id/stock", ih.GetStock)
+		api.POST("/products/:id/stock/adjustments", ih.AdjustStock, jwtMiddleware, adminMiddleware)
+		api.GET("/products/:id/stock/adjustments", ih.GetStockAdjustments, jwtMiddleware, adminMiddleware)
+		api.POST("/products/:id/stock/reservations", ih.ReserveStock, jwtMiddleware)
+		api.DELETE("/products/:id/stock/reservations/:rid", ih.ReleaseReservation, jwtMiddleware)
+
+		api.GET("/products/:id/revisions", h.GetRevisions, jwtMiddleware, adminMiddleware)
+		api.GET("/products/:id/revisions/diff", h.DiffRevisions, jwtMiddleware, adminMiddleware)
+		api.GET("/products/:id/revisions/:rev", h.GetRevision, jwtMiddleware, adminMiddleware)
+		api.POST("/products/:id/revisions/:rev/restore", h.RestoreRevision, jwtMiddleware, adminMiddleware)
+		api.GET("/products/:id/reviews", revh.GetReviews, optionalJWT(jwtMiddleware))
+		api.POST("/products/:id/reviews", revh.CreateReview, middleware.BodyLimit("1M"), jwtMiddleware)
+		api.PUT("/products/:id/reviews/:rid", revh.UpdateReview, middleware.BodyLimit("1M"), jwtMiddleware)
+		api.PUT("/products/:id/reviews/:rid/moderation", revh.ModerateReview, middleware.BodyLimit("1M"), jwtMiddleware, adminMiddleware)
+		api.DELETE("/products/:id/reviews/:rid", revh.DeleteReview, jwtMiddleware)
+		api.GET("/products/:id/translations", h.GetTranslations, jwtMiddleware, adminMiddleware)
+		api.PUT("/products/:id/translations/:locale", h.SetTranslation, middleware.BodyLimit("1M"), jwtMiddleware, adminMiddleware)
+		api.DELETE("/products/:id/translations/:locale", h.DeleteTranslation, jwtMiddleware, adminMiddleware)
+		api.GET("/reports/missing-translations", h.GetMissingTranslations, jwtMiddleware, adminMiddleware)
+		api.GET("/products/:id/price-history", h.GetPriceHistory, jwtMiddleware, adminMiddleware)
+		api.GET("/analytics/vendor-prices", h.GetVendorPriceStats, jwtMiddleware, adminMiddleware)
+		api.GET("/products/:id/media", mh.GetMediaList, optionalJWT(jwtMiddleware))
+		api.GET("/products/:id/media/:mid", mh.GetMedia, optionalJWT(jwtMiddleware))
+		api.GET("/products/:id/media/:mid/thumbnail", mh.GetThumbnail, optionalJWT(jwtMiddleware))
+		api.POST("/products/:id/media", mh.UploadMedia, middleware.BodyLimit(fmt.Sprintf("%dB", cfg.MediaMaxSize+1<<20)), jwtMiddleware, adminMiddleware)
+		api.DELETE("/products/:id/media/:mid", mh.DeleteMedia, jwtMiddleware, adminMiddleware)
+
+		api.GET("/cart", cartsh.GetCart, optionalJWT(jwtMiddleware))
+		api.POST("/cart/items", cartsh.AddCartItem, middleware.BodyLimit("1M"), optionalJWT(jwtMiddleware))
+		api.PUT("/cart/items/:pid", cartsh.UpdateCartItem, middleware.BodyLimit("1M"), optionalJWT(jwtMiddleware))
+		api.DELETE("/cart/items/:pid", cartsh.RemoveCartItem, optionalJWT(jwtMiddleware))
+		api.POST("/cart/merge", cartsh.MergeCart, jwtMiddleware)
+
+		api.POST("/orders", oh.Checkout, middleware.BodyLimit("1M"), jwtMiddleware)
+		api.GET("/orders", oh.GetOrders, jwtMiddleware, adminMiddleware)
+		api.GET("/orders/:id", oh.GetOrder, jwtMiddleware)
+		api.POST("/orders/:id/pay", oh.PayOrder, middleware.BodyLimit("1M"), jwtMiddleware)
+		api.POST("/orders/:id/cancel", oh.CancelOrder, jwtMiddleware)
+		api.POST("/orders/:id/transitions", oh.TransitionOrder, middleware.BodyLimit("1M"), jwtMiddleware, adminMiddleware)
+		api.GET("/users/me/orders", oh.GetMyOrders, jwtMiddleware)
+		api.GET("/users/me/wishlist", wh.GetWishlist, jwtMiddleware)
+		api.POST("/users/me/wishlist", wh.AddToWishlist, middleware.BodyLimit("1M"), jwtMiddleware)
+		api.DELETE("/users/me/wishlist/:pid", wh.RemoveFromWishlist, jwtMiddleware)
+		api.GET("/users/me/alerts", ah.GetAlerts, jwtMiddleware)
+		api.POST("/users/me/alerts", ah.CreateAlert, middleware.BodyLimit("1M"), jwtMiddleware)
+		api.DELETE("/users/me/alerts/:id", ah.DeleteAlert, jwtMiddleware)
+
+		api.POST("/graphql", gh.Serve, middleware.BodyLimit("1M"), optionalJWT(jwtMiddleware))
+
+		api.GET("/webhooks", webh.GetWebhooks, jwtMiddleware, adminMiddleware)
+		api.POST("/webhooks", webh.CreateWebhook, middleware.BodyLimit("1M"), jwtMiddleware, adminMiddleware)
+		api.GET("/webhooks/:id", webh.GetWebhook, jwtMiddleware, adminMiddleware)
+		api.PUT("/webhooks/:id", webh.UpdateWebhook, middleware.BodyLimit("1M"), jwtMiddleware, adminMiddleware)
+		api.DELETE("/webhooks/:id", webh.DeleteWebhook, jwtMiddleware, adminMiddleware)
+		api.GET("/webhooks/:id/deliveries", webh.GetDeliveries, jwtMiddleware, adminMiddleware)
+		api.POST("/webhooks/:id/deliveries/:did/redeliver", webh.Redeliver, jwtMiddleware, adminMiddleware)
+
+		api.GET("/vendors", vh.GetVendors)
+		api.GET("/vendors/:id", vh.GetVendor)
+		api.POST("/vendors", vh.CreateVendor, middleware.BodyLimit("1M"), jwtMiddleware, adminMiddleware)
+		api.PUT("/vendors/:id", vh.UpdateVendor, middleware.BodyLimit("1M"), jwtMiddleware, vendorMiddleware)
+		api.DELETE("/vendors/:id", vh.DeleteVendor, jwtMiddleware, adminMiddleware)
+
+		api.GET("/categories", ch.GetCategories)
+		api.GET("/categories/:id", ch.GetCategory)
+		api.PUT("/categories/:id/attributes", ch.SetAttributes, middleware.BodyLimit("1M"), jwtMiddleware, adminMiddleware)
+		api.POST("/categories", ch.CreateCategory, middleware.BodyLimit("1M"), jwtMiddleware, adminMiddleware)
+		api.PUT("/categories/:id", ch.UpdateCategory, middleware.BodyLimit("1M"), jwtMiddleware, adminMiddleware)
+		api.POST("/categories/:id/move", ch.MoveCategory, middleware.BodyLimit("1M"), jwtMiddleware, adminMiddleware)
+		api.DELETE("/categories/:id", ch.DeleteCategory, jwtMiddleware, adminMiddleware)
+
+		api.GET("/promotions", ph.GetPromotions)
+		api.GET("/promotions/:id", ph.GetPromotion)
+		api.POST("/promotions", ph.CreatePromotion, middleware.BodyLimit("1M"), jwtMiddleware, adminMiddleware)
+		api.PUT("/promotions/:id", ph.UpdatePromotion, middleware.BodyLimit("1M"), jwtMiddleware, adminMiddleware)
+		api.DELETE("/promotions/:id", ph.DeletePromotion, jwtMiddleware, adminMiddleware)
+
+		api.GET("/exchange-rates", rh.GetRates)
+		api.PUT("/exchange-rates", rh.SetRates, middleware.BodyLimit("1M"), jwtMiddleware, adminMiddleware)
+
+		api.POST("/users", uh.CreateUser)
+		api.POST("/auth", uh.AuthnUser)
+		api.PUT("/users/:username/vendor", uh.LinkVendor, jwtMiddleware, adminMiddleware)
+	}
+	undocumented, err := docs.Build(e.Routes())
+	if err != nil {
+		log.Fatalf("Unable to build the OpenAPI document : %v", err)
+	}
+	for _, route := range undocumented {
+		log.Warnf("Route %s is not documented", route)
+	}
+	go serveGRPC(&handlers.ProductServer{Products: h, Secret: []byte(cfg.JwtTokenSecret)})
 	e.Logger.Infof("Listening on %s:%s", cfg.Host, cfg.Port)
 	e.Logger.Fatal(e.Start(fmt.Sprintf("%s:%s", cfg.Host, cfg.Port)))
 }
@@ -0,0 +1,39 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileNotifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notify")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	f := &FileNotifier{Path: filepath.Join(dir, "alerts", "notifications.log")}
+
+	at := time.Date(2020, 7, 1, 10, 0, 0, 0, time.UTC)
+	assert.Nil(t, f.Notify(context.Background(), Notification{UserID: "shopper@tronics.com", Kind: "price_drop", Message: "pixel is now USD 450", At: at}))
+	assert.Nil(t, f.Notify(context.Background(), Notification{UserID: "other@tronics.com", Kind: "discount", Message: "pixel is 10% off", At: at}))
+
+	file, err := os.Open(f.Path)
+	assert.Nil(t, err)
+	defer file.Close()
+	var got []Notification
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var n Notification
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &n))
+		got = append(got, n)
+	}
+	assert.Len(t, got, 2)
+	assert.Equal(t, "shopper@tronics.com", got[0].UserID)
+	assert.Equal(t, "discount", got[1].Kind)
+}
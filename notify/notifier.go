@@ -0,0 +1,33 @@
+package notify
+
+import (
+	"context"
+	"time"
+
+	"github.com/labstack/gommon/log"
+)
+
+//Notification is a message for a user, e.g. a price drop of a product they follow
+type Notification struct {
+	UserID    string    `json:"user_id"`
+	Kind      string    `json:"kind"`
+	ProductID string    `json:"product_id,omitempty"`
+	Message   string    `json:"message"`
+	At        time.Time `json:"at"`
+}
+
+type (
+	//Notifier delivers notifications to users, e.g. by email
+	Notifier interface {
+		Notify(ctx context.Context, n Notification) error
+	}
+)
+
+//LogNotifier writes notifications to the log
+type LogNotifier struct{}
+
+//Notify logs the notification
+func (LogNotifier) Notify(ctx context.Context, n Notification) error {
+	log.Infof("Notification for %s : [%s] %s", n.UserID, n.Kind, n.Message)
+	return nil
+}
@@ -0,0 +1,73 @@
+package payments
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+//DeclinedSource is a source the fake provider always declines
+const DeclinedSource = "tok_declined"
+
+//FakeProvider keeps charges in memory, for tests and local development
+type FakeProvider struct {
+	mu      sync.Mutex
+	charges map[string]*Charge
+	//keys are shared by charges and refunds, as they are by real providers
+	keys map[string]keyUse
+}
+
+//keyUse is the request an idempotency key was first used for
+type keyUse struct {
+	refund   bool
+	chargeID string
+}
+
+func (p *FakeProvider) init() {
+	if p.charges == nil {
+		p.charges, p.keys = map[string]*Charge{}, map[string]keyUse{}
+	}
+}
+
+//Charge records a charge, unless the source is DeclinedSource
+func (p *FakeProvider) Charge(ctx context.Context, req ChargeRequest) (Charge, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.init()
+	if use, ok := p.keys[req.IdempotencyKey]; ok && req.IdempotencyKey != "" {
+		if use.refund {
+			return Charge{}, ErrKeyReused
+		}
+		return *p.charges[use.chargeID], nil
+	}
+	if req.Source == DeclinedSource {
+		return Charge{}, ErrDeclined
+	}
+	charge := &Charge{ID: fmt.Sprintf("ch_fake_%d", len(p.charges)+1), Amount: req.Amount, Currency: req.Currency}
+	p.charges[charge.ID] = charge
+	if req.IdempotencyKey != "" {
+		p.keys[req.IdempotencyKey] = keyUse{chargeID: charge.ID}
+	}
+	return *charge, nil
+}
+
+//Refund marks the charge refunded
+func (p *FakeProvider) Refund(ctx context.Context, req RefundRequest) (Charge, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.init()
+	if use, ok := p.keys[req.IdempotencyKey]; ok && req.IdempotencyKey != "" {
+		if !use.refund || use.chargeID != req.ChargeID {
+			return Charge{}, ErrKeyReused
+		}
+	}
+	charge, ok := p.charges[req.ChargeID]
+	if !ok {
+		return Charge{}, ErrNotFound
+	}
+	charge.Refunded = true
+	if req.IdempotencyKey != "" {
+		p.keys[req.IdempotencyKey] = keyUse{refund: true, chargeID: charge.ID}
+	}
+	return *charge, nil
+}
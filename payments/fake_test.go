@@ -0,0 +1,32 @@
+package payments
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeProvider(t *testing.T) {
+	ctx := context.Background()
+	p := &FakeProvider{}
+
+	charge, err := p.Charge(ctx, ChargeRequest{IdempotencyKey: "order-1", Amount: 50000, Currency: "USD", Source: "tok_visa"})
+	assert.Nil(t, err)
+	again, err := p.Charge(ctx, ChargeRequest{IdempotencyKey: "order-1", Amount: 50000, Currency: "USD", Source: "tok_visa"})
+	assert.Nil(t, err)
+	assert.Equal(t, charge.ID, again.ID)
+
+	_, err = p.Charge(ctx, ChargeRequest{IdempotencyKey: "order-2", Amount: 100, Currency: "USD", Source: DeclinedSource})
+	assert.Equal(t, ErrDeclined, err)
+
+	_, err = p.Refund(ctx, RefundRequest{IdempotencyKey: "order-1", ChargeID: charge.ID})
+	assert.Equal(t, ErrKeyReused, err, "keys are shared by charges and refunds")
+	refund, err := p.Refund(ctx, RefundRequest{IdempotencyKey: "refund-1", ChargeID: charge.ID})
+	assert.Nil(t, err)
+	assert.True(t, refund.Refunded)
+	_, err = p.Refund(ctx, RefundRequest{IdempotencyKey: "refund-1", ChargeID: charge.ID})
+	assert.Nil(t, err, "a retried refund")
+	_, err = p.Refund(ctx, RefundRequest{ChargeID: "ch_missing"})
+	assert.Equal(t, ErrNotFound, err)
+}
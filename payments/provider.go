@@ -0,0 +1,49 @@
+package payments
+
+import (
+	"context"
+	"errors"
+)
+
+//ErrDeclined is returned when the payment method is refused
+var ErrDeclined = errors.New("payment declined")
+
+//ErrNotFound is returned when a charge does not exist
+var ErrNotFound = errors.New("charge not found")
+
+//ErrKeyReused is returned when an idempotency key was used for another request
+var ErrKeyReused = errors.New("idempotency key used by another request")
+
+//ChargeRequest asks to take Amount, in the minor unit of Currency, from Source.
+//Requests with the same IdempotencyKey make a single charge.
+type ChargeRequest struct {
+	IdempotencyKey string
+	Amount         int64
+	Currency       string
+	Source         string
+	Description    string
+}
+
+//RefundRequest asks to give a charge back. Requests with the same
+//IdempotencyKey make a single refund.
+type RefundRequest struct {
+	IdempotencyKey string
+	ChargeID       string
+}
+
+//Charge is money taken from a customer
+type Charge struct {
+	ID       string
+	Amount   int64
+	Currency string
+	Refunded bool
+}
+
+type (
+	//PaymentProvider takes and gives back payments, e.g. a card processor
+	PaymentProvider interface {
+		Charge(ctx context.Context, req ChargeRequest) (Charge, error)
+		//Refund gives the whole charge back, refunding twice is not an error
+		Refund(ctx context.Context, req RefundRequest) (Charge, error)
+	}
+)
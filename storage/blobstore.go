@@ -0,0 +1,19 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+//ErrNotFound is returned when a blob does not exist
+var ErrNotFound = errors.New("blob not found")
+
+type (
+	//BlobStore stores opaque blobs by key, e.g. product images
+	BlobStore interface {
+		Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+		Get(ctx context.Context, key string) (io.ReadCloser, error)
+		Delete(ctx context.Context, key string) error
+	}
+)
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalStore(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "blobs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := &LocalStore{Dir: dir}
+
+	t.Run("put and get", func(t *testing.T) {
+		assert.Nil(t, s.Put(ctx, "products/1/abc", strings.NewReader("hello"), 5, "text/plain"))
+		r, err := s.Get(ctx, "products/1/abc")
+		assert.Nil(t, err)
+		defer r.Close()
+		b, err := ioutil.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello", string(b))
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		assert.Nil(t, s.Delete(ctx, "products/1/abc"))
+		_, err := s.Get(ctx, "products/1/abc")
+		assert.Equal(t, ErrNotFound, err)
+		assert.Nil(t, s.Delete(ctx, "products/1/abc"))
+	})
+
+	t.Run("keys stay below the directory", func(t *testing.T) {
+		assert.NotNil(t, s.Put(ctx, "../escape", strings.NewReader("x"), 1, "text/plain"))
+	})
+}
+
+func TestS3Store(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("signing key", func(t *testing.T) {
+		// example from the AWS signature version 4 documentation
+		key := signingKey("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20120215", "us-east-1", "iam")
+		assert.Equal(t, "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d", hex.EncodeToString(key))
+	})
+
+	t.Run("requests", func(t *testing.T) {
+		blobs := map[string]string{}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.True(t, strings.HasPrefix(r.Header.Get("Authorization"),
+				"AWS4-HMAC-SHA256 Credential=minio/20200101/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature="))
+			assert.Equal(t, "20200101T120000Z", r.Header.Get("x-amz-date"))
+			switch r.Method {
+			case http.MethodPut:
+				b, _ := ioutil.ReadAll(r.Body)
+				blobs[r.URL.Path] = string(b)
+			case http.MethodGet:
+				b, ok := blobs[r.URL.Path]
+				if !ok {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.Write([]byte(b))
+			case http.MethodDelete:
+				delete(blobs, r.URL.Path)
+				w.WriteHeader(http.StatusNoContent)
+			}
+		}))
+		defer srv.Close()
+		s := &S3Store{
+			Endpoint:  srv.URL,
+			Region:    "us-east-1",
+			Bucket:    "tronics",
+			AccessKey: "minio",
+			SecretKey: "minio123",
+			now:       func() time.Time { return time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC) },
+		}
+
+		assert.Nil(t, s.Put(ctx, "products/1/a b", strings.NewReader("hello"), 5, "text/plain"))
+		assert.Equal(t, "hello", blobs["/tronics/products/1/a b"])
+		r, err := s.Get(ctx, "products/1/a b")
+		assert.Nil(t, err)
+		b, _ := ioutil.ReadAll(r)
+		r.Close()
+		assert.Equal(t, "hello", string(b))
+		assert.Nil(t, s.Delete(ctx, "products/1/a b"))
+		_, err = s.Get(ctx, "products/1/a b")
+		assert.Equal(t, ErrNotFound, err)
+	})
+}